@@ -4,7 +4,7 @@ set -ex
 
 
 BUILD_DIR=out
-GOFMT_FILES=$(ls src/certd/*.go)
+GOFMT_FILES=$(find src/certd -name '*.go')
 
 function _cleanup() {
     r=$?
@@ -45,5 +45,7 @@ if [ -z ${SKIP_TESTS} ]; then
 fi
 
 mkdir -p ${BUILD_DIR}
-go build -i -o ${BUILD_DIR}/certd-cli src/certd/cmds/cert-cli/main.go
-go build -i -o ${BUILD_DIR}/certd src/certd/cmds/certd/main.go
+# BUILD_TAGS=pkcs11 builds in support for CA keys in PKCS#11 tokens, it
+# needs cgo
+go build -tags "${BUILD_TAGS}" -o ${BUILD_DIR}/certd-cli certd/cmds/cert-cli
+go build -tags "${BUILD_TAGS}" -o ${BUILD_DIR}/certd certd/cmds/certd
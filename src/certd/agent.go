@@ -0,0 +1,511 @@
+package certd
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRenewAt is the fraction of a cert's lifetime after which the
+	// agent renews it
+	DefaultRenewAt = 2.0 / 3
+	// AgentJitter is the fraction of a cert's lifetime the renewal is
+	// randomly brought forward by, so agents started together spread out
+	AgentJitter = 0.05
+
+	agentMinBackoff  = 30 * time.Second
+	agentMaxBackoff  = time.Hour
+	agentMaxSleep    = time.Hour
+	agentHookTimeout = time.Minute
+)
+
+// Issuer issues a cert for csr, returning the PEM encoded cert
+type Issuer interface {
+	Issue(csr *CSR, profile string) (string, error)
+}
+
+// CAIssuer is an Issuer that signs with a local CA
+type CAIssuer struct {
+	CA *CA
+	// Profiles that can be requested, DefaultProfiles if nil
+	Profiles map[string]*Profile
+}
+
+// Issue implements Issuer
+func (i *CAIssuer) Issue(csr *CSR, profile string) (string, error) {
+	profiles := i.Profiles
+	if profiles == nil {
+		profiles = DefaultProfiles()
+	}
+	if profile == "" {
+		profile = DefaultProfile
+	}
+	p, ok := profiles[profile]
+	if !ok {
+		return "", fmt.Errorf("%w \"%v\"", ErrUnknownProfile, profile)
+	}
+	if err := p.Apply(csr); err != nil {
+		return "", err
+	}
+	cert, err := i.CA.CertFromCSR(csr)
+	if err != nil {
+		return "", err
+	}
+	return string(cert.CertBytes), nil
+}
+
+// AgentConfig is the list of certs the agent keeps renewed
+type AgentConfig struct {
+	// RenewAt is the default for AgentCert.RenewAt
+	RenewAt float64      `json:"renew_at,omitempty"`
+	Certs   []*AgentCert `json:"certs"`
+}
+
+// AgentCert is a cert and key on disk that the agent keeps renewed
+type AgentCert struct {
+	Name    string   `json:"name"`
+	Hosts   []string `json:"hosts"`
+	Profile string   `json:"profile,omitempty"`
+	KeyType string   `json:"key_type,omitempty"`
+	Cert    string   `json:"cert"`
+	Key     string   `json:"key"`
+	// Owner of the files as "user" or "user:group", unchanged if empty
+	Owner string `json:"owner,omitempty"`
+	// CertMode and KeyMode are octal, 0644 and 0600 by default
+	CertMode string `json:"cert_mode,omitempty"`
+	KeyMode  string `json:"key_mode,omitempty"`
+	// RenewAt is the fraction of the cert's lifetime after which it is
+	// renewed
+	RenewAt float64 `json:"renew_at,omitempty"`
+	// Hooks are run in order after the cert is renewed
+	Hooks []*AgentHook `json:"hooks,omitempty"`
+
+	certMode, keyMode os.FileMode
+	uid, gid          int
+
+	// scheduling state
+	next     time.Time
+	failures int
+	serial   string
+	jitter   float64
+}
+
+// AgentHook is run after a cert is renewed, either a command or a signal
+// sent to the process in a pid file
+type AgentHook struct {
+	Command []string `json:"command,omitempty"`
+	Signal  string   `json:"signal,omitempty"`
+	PIDFile string   `json:"pid_file,omitempty"`
+}
+
+// LoadAgentConfig loads and validates an agent config
+func LoadAgentConfig(path string) (*AgentConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c AgentConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return &c, nil
+}
+
+// Validate checks the config and fills in defaults
+func (c *AgentConfig) Validate() error {
+	if c.RenewAt == 0 {
+		c.RenewAt = DefaultRenewAt
+	}
+	if c.RenewAt <= 0 || c.RenewAt >= 1 {
+		return fmt.Errorf("renew_at must be between 0 and 1")
+	}
+	if len(c.Certs) == 0 {
+		return fmt.Errorf("no certs configured")
+	}
+
+	names := make(map[string]bool)
+	for i, cert := range c.Certs {
+		if cert.Name == "" {
+			cert.Name = strconv.Itoa(i)
+		}
+		if names[cert.Name] {
+			return fmt.Errorf("duplicate cert \"%v\"", cert.Name)
+		}
+		names[cert.Name] = true
+		if err := cert.validate(c.RenewAt); err != nil {
+			return fmt.Errorf("cert \"%v\": %v", cert.Name, err)
+		}
+	}
+	return nil
+}
+
+func (c *AgentCert) validate(renewAt float64) error {
+	if len(c.Hosts) == 0 {
+		return fmt.Errorf("no hosts")
+	}
+	if c.Cert == "" || c.Key == "" {
+		return fmt.Errorf("cert and key paths are required")
+	}
+	if c.Cert == c.Key {
+		return fmt.Errorf("cert and key must be different files")
+	}
+	switch c.KeyType {
+	case "", KeyRSA, KeyECDSAP256, KeyECDSAP384, KeyEd25519:
+	default:
+		return fmt.Errorf("unknown key type \"%v\"", c.KeyType)
+	}
+
+	if c.RenewAt == 0 {
+		c.RenewAt = renewAt
+	}
+	if c.RenewAt <= 0 || c.RenewAt >= 1 {
+		return fmt.Errorf("renew_at must be between 0 and 1")
+	}
+
+	var err error
+	if c.certMode, err = parseFileMode(c.CertMode, 0644); err != nil {
+		return fmt.Errorf("cert_mode: %v", err)
+	}
+	if c.keyMode, err = parseFileMode(c.KeyMode, 0600); err != nil {
+		return fmt.Errorf("key_mode: %v", err)
+	}
+	if c.uid, c.gid, err = lookupOwner(c.Owner); err != nil {
+		return fmt.Errorf("owner: %v", err)
+	}
+
+	for _, h := range c.Hooks {
+		switch {
+		case len(h.Command) > 0 && h.Signal == "" && h.PIDFile == "":
+		case len(h.Command) == 0 && h.Signal != "" && h.PIDFile != "":
+			if _, err := signalByName(h.Signal); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("a hook must have either a command or a signal and pid_file")
+		}
+	}
+	return nil
+}
+
+func parseFileMode(s string, def os.FileMode) (os.FileMode, error) {
+	if s == "" {
+		return def, nil
+	}
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid mode \"%v\"", s)
+	}
+	return os.FileMode(m), nil
+}
+
+// lookupOwner returns the uid and gid for "user" or "user:group", -1 means
+// unchanged
+func lookupOwner(owner string) (int, int, error) {
+	if owner == "" {
+		return -1, -1, nil
+	}
+	name, group := owner, ""
+	if i := strings.Index(owner, ":"); i >= 0 {
+		name, group = owner[:i], owner[i+1:]
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("user \"%v\" has no numeric uid", name)
+	}
+	gid := -1
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return 0, 0, err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, fmt.Errorf("group \"%v\" has no numeric gid", group)
+		}
+	}
+	return uid, gid, nil
+}
+
+// Agent keeps the certs in its config renewed
+type Agent struct {
+	Config *AgentConfig
+	Issuer Issuer
+}
+
+// NewAgent creates an Agent
+func NewAgent(config *AgentConfig, issuer Issuer) *Agent {
+	return &Agent{Config: config, Issuer: issuer}
+}
+
+// Run checks the certs, renewing those that are due, until ctx is cancelled.
+// Failed renewals are retried with exponential backoff.
+func (a *Agent) Run(ctx context.Context) {
+	for {
+		now := time.Now()
+		next := now.Add(agentMaxSleep)
+		for _, c := range a.Config.Certs {
+			if !now.Before(c.next) {
+				a.process(c, now)
+			}
+			if c.next.Before(next) {
+				next = c.next
+			}
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// RunOnce renews the certs that are due and returns the first error
+func (a *Agent) RunOnce() error {
+	var first error
+	now := time.Now()
+	for _, c := range a.Config.Certs {
+		if err := a.process(c, now); err != nil && first == nil {
+			first = fmt.Errorf("cert \"%v\": %v", c.Name, err)
+		}
+	}
+	return first
+}
+
+// process renews c if it is due and schedules its next check
+func (a *Agent) process(c *AgentCert, now time.Time) error {
+	crt, err := a.renewIfDue(c, now)
+	if err != nil {
+		c.failures++
+		c.next = now.Add(agentBackoff(c.failures))
+		logger.Error("failed to renew cert", "name", c.Name, "error", err, "failures", c.failures, "retry_at", c.next)
+		return err
+	}
+	c.failures = 0
+	c.next = c.renewTime(crt)
+	logger.Debug("next renewal scheduled", "name", c.Name, "at", c.next)
+	return nil
+}
+
+// agentBackoff returns the delay before retrying after failures consecutive
+// failures, doubling each time with jitter
+func agentBackoff(failures int) time.Duration {
+	d := agentMaxBackoff
+	if failures < 20 {
+		if b := agentMinBackoff << uint(failures-1); b < d {
+			d = b
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// renewTime returns when crt should be renewed. The jitter is picked once
+// per cert so the time does not move each time it is checked.
+func (c *AgentCert) renewTime(crt *x509.Certificate) time.Time {
+	serial := crt.SerialNumber.String()
+	if c.serial != serial {
+		c.serial = serial
+		c.jitter = rand.Float64()
+	}
+	lifetime := crt.NotAfter.Sub(crt.NotBefore)
+	return crt.NotBefore.Add(time.Duration(float64(lifetime) * (c.RenewAt - AgentJitter*c.jitter)))
+}
+
+// renewIfDue renews c if the cert on disk is missing, does not match the
+// config or its key, or is due for renewal. It returns the current cert.
+func (a *Agent) renewIfDue(c *AgentCert, now time.Time) (*x509.Certificate, error) {
+	crt, err := c.load()
+	switch {
+	case err != nil:
+		logger.Info("renewing cert", "name", c.Name, "reason", err)
+	case now.Before(c.renewTime(crt)):
+		return crt, nil
+	default:
+		logger.Info("renewing cert", "name", c.Name, "reason", "due", "not_after", crt.NotAfter)
+	}
+	return a.renew(c)
+}
+
+// load reads the cert and key from disk and checks they match the config
+func (c *AgentCert) load() (*x509.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(c.Cert)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(c.Key)
+	if err != nil {
+		return nil, err
+	}
+	crt, err := parseCertPEM(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", c.Cert, err)
+	}
+	if err := CheckKeyPair(crt, keyPEM); err != nil {
+		return nil, err
+	}
+	if !sameHosts(certHosts(crt), c.Hosts) {
+		return nil, fmt.Errorf("hosts changed")
+	}
+	return crt, nil
+}
+
+// renew issues a new cert for c, writes it and its key to disk and runs
+// the hooks
+func (a *Agent) renew(c *AgentCert) (*x509.Certificate, error) {
+	csr, err := NewCSR(strings.Join(c.Hosts, ","), c.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := a.Issuer.Issue(csr, c.Profile)
+	if err != nil {
+		return nil, err
+	}
+	crt, err := parseCertPEM([]byte(certPEM))
+	if err != nil {
+		return nil, fmt.Errorf("issued cert: %v", err)
+	}
+	if err := CheckKeyPair(crt, csr.PrivateKey); err != nil {
+		return nil, fmt.Errorf("issued cert: %v", err)
+	}
+
+	// the key is written first, a reader that sees the new cert always
+	// finds its key
+	if err := writeFileOwned(c.Key, csr.PrivateKey, c.keyMode, c.uid, c.gid); err != nil {
+		return nil, err
+	}
+	if err := writeFileOwned(c.Cert, []byte(certPEM), c.certMode, c.uid, c.gid); err != nil {
+		return nil, err
+	}
+	logger.Info("renewed cert", "name", c.Name, "serial", fmt.Sprintf("%x", crt.SerialNumber), "not_after", crt.NotAfter)
+
+	// the cert is in place so a failing hook is not retried as a failed
+	// renewal
+	for _, h := range c.Hooks {
+		if err := h.run(c); err != nil {
+			logger.Error("post renew hook failed", "name", c.Name, "error", err)
+		}
+	}
+	return crt, nil
+}
+
+// run runs the hook for c
+func (h *AgentHook) run(c *AgentCert) error {
+	if h.Signal != "" {
+		b, err := ioutil.ReadFile(h.PIDFile)
+		if err != nil {
+			return err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil {
+			return fmt.Errorf("%v: invalid pid", h.PIDFile)
+		}
+		sig, err := signalByName(h.Signal)
+		if err != nil {
+			return err
+		}
+		p, err := os.FindProcess(pid)
+		if err != nil {
+			return err
+		}
+		return p.Signal(sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), agentHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Env = append(os.Environ(), "CERTD_NAME="+c.Name, "CERTD_CERT="+c.Cert, "CERTD_KEY="+c.Key)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %v: %s", h.Command[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func parseCertPEM(b []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// certHosts returns the SANs of crt
+func certHosts(crt *x509.Certificate) []string {
+	hosts := append([]string{}, crt.DNSNames...)
+	for _, ip := range crt.IPAddresses {
+		hosts = append(hosts, ip.String())
+	}
+	return hosts
+}
+
+// sameHosts reports whether a and b contain the same hosts in any order
+func sameHosts(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	norm := func(l []string) []string {
+		n := make([]string, len(l))
+		for i, h := range l {
+			n[i] = strings.ToLower(h)
+		}
+		sort.Strings(n)
+		return n
+	}
+	return reflect.DeepEqual(norm(a), norm(b))
+}
+
+// writeFileOwned writes b to path atomically with perm and, unless they are
+// -1, the uid and gid. The mode is set explicitly so the umask can not
+// narrow or widen it.
+func writeFileOwned(path string, b []byte, perm os.FileMode, uid, gid int) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if uid != -1 || gid != -1 {
+		if err := f.Chown(uid, gid); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package certd
+
+import (
+	"fmt"
+	"os"
+)
+
+// signalByName always fails, hooks can only send signals on unix
+func signalByName(name string) (os.Signal, error) {
+	return nil, fmt.Errorf("signal hooks are not supported on this platform")
+}
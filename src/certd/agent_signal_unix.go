@@ -0,0 +1,28 @@
+//go:build !windows && !plan9
+
+package certd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// signalByName returns the signal called name, with or without the SIG
+// prefix
+func signalByName(name string) (os.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "HUP":
+		return syscall.SIGHUP, nil
+	case "INT":
+		return syscall.SIGINT, nil
+	case "TERM":
+		return syscall.SIGTERM, nil
+	case "USR1":
+		return syscall.SIGUSR1, nil
+	case "USR2":
+		return syscall.SIGUSR2, nil
+	}
+	return nil, fmt.Errorf("unsupported signal \"%v\"", name)
+}
@@ -0,0 +1,196 @@
+package certd
+
+import (
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAgentCert(dir, name string) *AgentCert {
+	return &AgentCert{
+		Name:  name,
+		Hosts: []string{name + ".example.com", "10.0.0.1"},
+		Cert:  filepath.Join(dir, name+".crt"),
+		Key:   filepath.Join(dir, name+".key"),
+	}
+}
+
+func Test_AgentConfig_Validate(t *testing.T) {
+	for name, c := range map[string]*AgentConfig{
+		"no certs":     {},
+		"renew_at":     {RenewAt: 1.5, Certs: []*AgentCert{testAgentCert("", "a")}},
+		"no hosts":     {Certs: []*AgentCert{{Cert: "a.crt", Key: "a.key"}}},
+		"no key":       {Certs: []*AgentCert{{Hosts: []string{"a"}, Cert: "a.crt"}}},
+		"same file":    {Certs: []*AgentCert{{Hosts: []string{"a"}, Cert: "a", Key: "a"}}},
+		"key type":     {Certs: []*AgentCert{{Hosts: []string{"a"}, Cert: "a.crt", Key: "a.key", KeyType: "dsa"}}},
+		"mode":         {Certs: []*AgentCert{{Hosts: []string{"a"}, Cert: "a.crt", Key: "a.key", KeyMode: "0999"}}},
+		"owner":        {Certs: []*AgentCert{{Hosts: []string{"a"}, Cert: "a.crt", Key: "a.key", Owner: "no-such-user-certd"}}},
+		"duplicate":    {Certs: []*AgentCert{testAgentCert("", "a"), testAgentCert("", "a")}},
+		"empty hook":   {Certs: []*AgentCert{{Hosts: []string{"a"}, Cert: "a.crt", Key: "a.key", Hooks: []*AgentHook{{}}}}},
+		"no pid file":  {Certs: []*AgentCert{{Hosts: []string{"a"}, Cert: "a.crt", Key: "a.key", Hooks: []*AgentHook{{Signal: "HUP"}}}}},
+		"both hooks":   {Certs: []*AgentCert{{Hosts: []string{"a"}, Cert: "a.crt", Key: "a.key", Hooks: []*AgentHook{{Command: []string{"true"}, Signal: "HUP", PIDFile: "x"}}}}},
+		"cert renewat": {Certs: []*AgentCert{{Hosts: []string{"a"}, Cert: "a.crt", Key: "a.key", RenewAt: -1}}},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+	}
+
+	c := &AgentConfig{RenewAt: 0.5, Certs: []*AgentCert{testAgentCert("", "a"), {Hosts: []string{"b"}, Cert: "b.crt", Key: "b.key", RenewAt: 0.8, KeyMode: "0640"}}}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Certs[0].RenewAt != 0.5 || c.Certs[1].RenewAt != 0.8 {
+		t.Errorf("unexpected renew_at %v %v", c.Certs[0].RenewAt, c.Certs[1].RenewAt)
+	}
+	if c.Certs[1].Name != "1" || c.Certs[1].keyMode != 0640 || c.Certs[1].certMode != 0644 || c.Certs[1].uid != -1 {
+		t.Errorf("unexpected defaults %+v", c.Certs[1])
+	}
+}
+
+func Test_Agent(t *testing.T) {
+	s := newTestServer(t)
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var certs []*AgentCert
+	for _, kt := range []string{KeyRSA, KeyECDSAP256, KeyECDSAP384, KeyEd25519} {
+		c := testAgentCert(dir, kt)
+		c.KeyType = kt
+		c.Profile = "server"
+		c.KeyMode = "0640"
+		certs = append(certs, c)
+	}
+	hooked := filepath.Join(dir, "hooked")
+	certs[0].Hooks = []*AgentHook{{Command: []string{"sh", "-c", "echo $CERTD_NAME >> " + hooked}}}
+	config := &AgentConfig{Certs: certs}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	agent := NewAgent(config, &CAIssuer{CA: s.CA})
+	if err := agent.RunOnce(); err != nil {
+		t.Fatal(err)
+	}
+	serials := map[string]string{}
+	for _, c := range certs {
+		st, err := os.Stat(c.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Mode().Perm() != 0640 {
+			t.Errorf("%v: expected key mode 0640 got %v", c.Name, st.Mode())
+		}
+		crt, err := c.load()
+		if err != nil {
+			t.Fatalf("%v: %v", c.Name, err)
+		}
+		if len(crt.ExtKeyUsage) != 1 || crt.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+			t.Errorf("%v: profile not applied", c.Name)
+		}
+		serials[c.Name] = c.serial
+	}
+	if b, _ := ioutil.ReadFile(hooked); string(b) != "rsa\n" {
+		t.Errorf("unexpected hook output %q", b)
+	}
+
+	// nothing is due
+	if err := agent.RunOnce(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range certs {
+		if c.serial != serials[c.Name] {
+			t.Errorf("%v: renewed when not due", c.Name)
+		}
+	}
+
+	// changing the hosts or replacing the key forces a renewal
+	certs[0].Hosts = append(certs[0].Hosts, "new.example.com")
+	other, _ := ioutil.ReadFile(certs[2].Key)
+	ioutil.WriteFile(certs[1].Key, other, 0600)
+	if err := agent.RunOnce(); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range certs {
+		if renewed := c.serial != serials[c.Name]; renewed != (i < 2) {
+			t.Errorf("%v: renewed %v", c.Name, renewed)
+		}
+	}
+	if b, _ := ioutil.ReadFile(hooked); string(b) != "rsa\nrsa\n" {
+		t.Errorf("unexpected hook output %q", b)
+	}
+}
+
+type failingIssuer struct{}
+
+func (failingIssuer) Issue(*CSR, string) (string, error) {
+	return "", errors.New("unavailable")
+}
+
+func Test_Agent_backoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := testAgentCert(dir, "a")
+	config := &AgentConfig{Certs: []*AgentCert{c}}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	agent := NewAgent(config, failingIssuer{})
+
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		if err := agent.process(c, now); err == nil || !strings.Contains(err.Error(), "unavailable") {
+			t.Fatalf("expected the issuer's error, got %v", err)
+		}
+		if c.failures != i {
+			t.Errorf("expected %v failures got %v", i, c.failures)
+		}
+		max := agentMinBackoff << uint(i-1)
+		if d := c.next.Sub(now); d < max/2 || d > max {
+			t.Errorf("attempt %v: unexpected backoff %v", i, d)
+		}
+	}
+	for i := 1; i < 100; i++ {
+		if d := agentBackoff(i); d > agentMaxBackoff || d < agentMinBackoff/2 {
+			t.Errorf("backoff %v out of range after %v failures", d, i)
+		}
+	}
+}
+
+func Test_AgentCert_renewTime(t *testing.T) {
+	c := &AgentCert{RenewAt: 0.5}
+	start := time.Now()
+	crt := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: start, NotAfter: start.Add(100 * time.Hour)}
+
+	at := c.renewTime(crt)
+	if at.Before(start.Add(45*time.Hour)) || at.After(start.Add(50*time.Hour)) {
+		t.Errorf("unexpected renewal time %v after issue", at.Sub(start))
+	}
+	for i := 0; i < 10; i++ {
+		if again := c.renewTime(crt); !again.Equal(at) {
+			t.Fatalf("renewal time moved from %v to %v", at, again)
+		}
+	}
+}
+
+func Test_sameHosts(t *testing.T) {
+	if !sameHosts([]string{"A.example.com", "10.0.0.1"}, []string{"10.0.0.1", "a.example.com"}) {
+		t.Errorf("expected hosts to match")
+	}
+	if sameHosts([]string{"a", "b"}, []string{"a", "a"}) || sameHosts([]string{"a"}, []string{"a", "b"}) {
+		t.Errorf("expected hosts not to match")
+	}
+}
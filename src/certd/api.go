@@ -0,0 +1,367 @@
+package certd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const APIPrefix = "/api/v1/"
+
+// API error codes
+const (
+	ErrCodeInvalidRequest    = "invalid_request"
+	ErrCodeUnauthorized      = "unauthorized"
+	ErrCodeForbidden         = "forbidden"
+	ErrCodeNotFound          = "not_found"
+	ErrCodeMethodNotAllowed  = "method_not_allowed"
+	ErrCodePolicyViolation   = "policy_violation"
+	ErrCodeUnknownProfile    = "unknown_profile"
+	ErrCodeAlreadyRevoked    = "already_revoked"
+	ErrCodeSealed            = "sealed"
+	ErrCodeLifetimeExceedsCA = "lifetime_exceeds_ca"
+	ErrCodeInternal          = "internal_error"
+)
+
+// APIError is the error returned by the JSON API
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Code, e.Message)
+}
+
+// IssueRequest is the body of a request for a new cert. If CSR is empty a
+// private key is generated and returned along with the cert.
+type IssueRequest struct {
+	Hosts   []string `json:"hosts,omitempty"`
+	CSR     string   `json:"csr,omitempty"`
+	Profile string   `json:"profile,omitempty"`
+	// KeyFormat and Passphrase set how a generated key is returned, see
+	// FormatKey
+	KeyFormat  string `json:"key_format,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+// RevokeRequest is the body of a request to revoke a cert
+type RevokeRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// IssuedCert is returned by the API when a cert is issued
+type IssuedCert struct {
+	*CertRecord
+	PrivateKey string `json:"private_key,omitempty"`
+}
+
+// CAInfo describes the CA
+type CAInfo struct {
+	Subject     string    `json:"subject"`
+	Serial      string    `json:"serial"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	Fingerprint string    `json:"fingerprint"`
+	Cert        string    `json:"cert"`
+	// Bundle holds the certs to trust, during a rotation both roots and
+	// the cross certs between them
+	Bundle   string        `json:"bundle,omitempty"`
+	Rotation *RotationInfo `json:"rotation,omitempty"`
+}
+
+// RotationInfo describes a root rotation in progress
+type RotationInfo struct {
+	NextFingerprint string    `json:"next_fingerprint"`
+	SwitchAt        time.Time `json:"switch_at"`
+	RetireAt        time.Time `json:"retire_at"`
+	Switched        bool      `json:"switched"`
+}
+
+// serveAPI routes requests for the JSON API
+func (s *Server) serveAPI(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, APIPrefix), "/"), "/")
+
+	var h http.HandlerFunc
+	var allowed string
+	switch {
+	case len(parts) == 1 && parts[0] == "certificates":
+		allowed = "GET, POST"
+		switch req.Method {
+		case "GET":
+			h = s.apiList
+		case "POST":
+			h = s.apiIssue
+		}
+	case len(parts) == 2 && parts[0] == "certificates":
+		allowed = "GET"
+		if req.Method == "GET" {
+			h = s.apiGet
+		}
+	case len(parts) == 3 && parts[0] == "certificates" && parts[2] == "revoke":
+		allowed = "POST"
+		if req.Method == "POST" {
+			h = s.apiAdmin(s.apiRevoke)
+		}
+	case len(parts) == 1 && parts[0] == "subordinates":
+		allowed = "POST"
+		if req.Method == "POST" {
+			h = s.apiAdmin(s.apiIssueSubordinate)
+		}
+	case len(parts) == 1 && parts[0] == "cas":
+		allowed = "GET"
+		if req.Method == "GET" {
+			h = s.apiAdmin(s.apiListCAs)
+		}
+	case len(parts) == 1 && parts[0] == "ca":
+		allowed = "GET"
+		if req.Method == "GET" {
+			h = s.apiCA
+		}
+	default:
+		writeAPIError(w, req, &APIError{http.StatusNotFound, ErrCodeNotFound, "no such endpoint"})
+		return
+	}
+
+	if h == nil {
+		w.Header().Set("Allow", allowed)
+		writeAPIError(w, req, &APIError{http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, req.Method + " is not allowed"})
+		return
+	}
+	s.apiAuth(h)(w, req)
+}
+
+// apiSerial returns the serial from a /certificates/{serial} path
+func apiSerial(req *http.Request) string {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, APIPrefix+"certificates/"), "/")
+	return parts[0]
+}
+
+// apiAuth wraps h so it is only called for authenticated requests
+func (s *Server) apiAuth(h http.HandlerFunc) http.HandlerFunc {
+	return s.apiRole(h, "")
+}
+
+// apiAdmin wraps h so it is only called for requests from an admin
+func (s *Server) apiAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return s.apiRole(h, RoleAdmin)
+}
+
+// apiRole wraps h so it is only called for authenticated requests from a
+// user with role, or any role if it is empty
+func (s *Server) apiRole(h http.HandlerFunc, role string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		userRole, ok := s.authenticateRole(req)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Basic realm=\"certd\"")
+			writeAPIError(w, req, &APIError{http.StatusUnauthorized, ErrCodeUnauthorized, "invalid or missing credentials"})
+			return
+		}
+		if role != "" && userRole != role {
+			loggerFrom(req.Context()).Warn("request needs a role the user does not have", "role", role)
+			writeAPIError(w, req, &APIError{http.StatusForbidden, ErrCodeForbidden, "the " + role + " role is required"})
+			return
+		}
+		h(w, req)
+	}
+}
+
+func (s *Server) apiIssue(w http.ResponseWriter, req *http.Request) {
+	var ir IssueRequest
+	if err := decodeJSON(w, req, &ir); err != nil {
+		writeAPIError(w, req, err)
+		return
+	}
+
+	cert, record, err := s.issueRequest(req.Context(), &ir)
+	if err != nil {
+		writeAPIError(w, req, err)
+		return
+	}
+	writeJSON(w, req, http.StatusCreated, &IssuedCert{record, string(cert.KeyBytes)})
+}
+
+func (s *Server) apiList(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	f := CertFilter{
+		Host:   q.Get("host"),
+		Status: q.Get("status"),
+	}
+
+	switch f.Status {
+	case "", "valid", "revoked", "expired":
+	default:
+		writeAPIError(w, req, &APIError{http.StatusBadRequest, ErrCodeInvalidRequest, "status must be one of valid, revoked or expired"})
+		return
+	}
+
+	if v := q.Get("expires_before"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeAPIError(w, req, &APIError{http.StatusBadRequest, ErrCodeInvalidRequest, "expires_before must be an RFC3339 time"})
+			return
+		}
+		f.ExpiresBefore = t
+	}
+	if v := q.Get("expires_within"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			writeAPIError(w, req, &APIError{http.StatusBadRequest, ErrCodeInvalidRequest, "expires_within must be a duration such as 720h"})
+			return
+		}
+		f.ExpiresBefore = time.Now().Add(d)
+	}
+
+	writeJSON(w, req, http.StatusOK, s.Inventory.List(f))
+}
+
+func (s *Server) apiGet(w http.ResponseWriter, req *http.Request) {
+	record, err := s.Inventory.Get(apiSerial(req))
+	if err != nil {
+		writeAPIError(w, req, err)
+		return
+	}
+	writeJSON(w, req, http.StatusOK, record)
+}
+
+func (s *Server) apiRevoke(w http.ResponseWriter, req *http.Request) {
+	var rr RevokeRequest
+	if req.ContentLength != 0 {
+		if err := decodeJSON(w, req, &rr); err != nil {
+			writeAPIError(w, req, err)
+			return
+		}
+	}
+
+	// the store and the ledger are updated together so concurrent
+	// revocations of a cert record it once and a failure records neither,
+	// the ledger entry is removed again if the store fails to commit
+	ca := s.settings().CA
+	var record *CertRecord
+	var pending *pendingEntry
+	err := s.Inventory.Update(func(tx StoreTx) error {
+		r, err := revokeRecord(tx, apiSerial(req), rr.Reason)
+		if err != nil {
+			return err
+		}
+		// the CRL can not be signed while sealed so revocations wait too
+		if ca.Sealed() {
+			return ErrSealed
+		}
+		record = r
+		pending, err = ca.prepareRevocation(r.Serial, rr.Reason)
+		return err
+	})
+	pending.finish(err)
+	if err != nil {
+		writeAPIError(w, req, err)
+		return
+	}
+	s.Metrics.Revoked()
+	loggerFrom(req.Context()).Info("revoked cert", "serial", record.Serial, "reason", rr.Reason)
+	if s.IsLeader() {
+		if err := s.generateCRL(); err != nil {
+			loggerFrom(req.Context()).Error("failed to regenerate CRL", "error", err)
+		}
+	}
+	s.Audit.Log(req.Context(), AuditCertRevoked, "serial", record.Serial, "hosts", record.Hosts, "reason", rr.Reason)
+	writeJSON(w, req, http.StatusOK, record)
+}
+
+func (s *Server) apiCA(w http.ResponseWriter, req *http.Request) {
+	info, err := caInfo(s.settings().CA)
+	if err != nil {
+		writeAPIError(w, req, err)
+		return
+	}
+	writeJSON(w, req, http.StatusOK, info)
+}
+
+// caInfo describes ca for the API
+func caInfo(ca *CA) (*CAInfo, error) {
+	crt, err := ca.Cert()
+	if err != nil {
+		return nil, err
+	}
+	info := &CAInfo{
+		Subject:     crt.Subject.String(),
+		Serial:      fmt.Sprintf("%x", crt.SerialNumber),
+		NotBefore:   crt.NotBefore,
+		NotAfter:    crt.NotAfter,
+		Fingerprint: Fingerprint(crt),
+		Cert:        string(ca.CertBytes),
+		Bundle:      string(ca.TrustBundle()),
+	}
+	if r := ca.Rotation; r != nil {
+		next, err := r.Next.Cert()
+		if err != nil {
+			return nil, err
+		}
+		info.Rotation = &RotationInfo{
+			NextFingerprint: Fingerprint(next),
+			SwitchAt:        r.SwitchAt,
+			RetireAt:        r.RetireAt,
+			Switched:        r.Switched(time.Now()),
+		}
+	}
+	return info, nil
+}
+
+// decodeJSON decodes the body of req into v
+func decodeJSON(w http.ResponseWriter, req *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return &APIError{http.StatusBadRequest, ErrCodeInvalidRequest, "invalid JSON body: " + err.Error()}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, req *http.Request, status int, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		writeAPIError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+	w.Write([]byte("\n"))
+}
+
+// writeAPIError writes err as a JSON error, errors that are not known to the
+// API are logged and reported as internal errors
+func writeAPIError(w http.ResponseWriter, req *http.Request, err error) {
+	var apiErr *APIError
+	var policyErr *PolicyError
+	switch {
+	case errors.As(err, &apiErr):
+	case errors.As(err, &policyErr):
+		apiErr = &APIError{http.StatusForbidden, ErrCodePolicyViolation, policyErr.Reason}
+	case errors.Is(err, ErrUnknownProfile):
+		apiErr = &APIError{http.StatusBadRequest, ErrCodeUnknownProfile, err.Error()}
+	case errors.Is(err, ErrCertNotFound):
+		apiErr = &APIError{http.StatusNotFound, ErrCodeNotFound, err.Error()}
+	case errors.Is(err, ErrAlreadyRevoked):
+		apiErr = &APIError{http.StatusConflict, ErrCodeAlreadyRevoked, err.Error()}
+	case errors.Is(err, ErrSealed):
+		apiErr = &APIError{http.StatusServiceUnavailable, ErrCodeSealed, err.Error()}
+	case errors.Is(err, ErrLifetimeExceedsCA):
+		apiErr = &APIError{http.StatusBadRequest, ErrCodeLifetimeExceedsCA, err.Error()}
+	default:
+		loggerFrom(req.Context()).Error("request failed", "error", err)
+		apiErr = &APIError{http.StatusInternalServerError, ErrCodeInternal, http.StatusText(http.StatusInternalServerError)}
+	}
+
+	b, _ := json.Marshal(struct {
+		Error *APIError `json:"error"`
+	}{apiErr})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	w.Write(b)
+	w.Write([]byte("\n"))
+}
@@ -0,0 +1,218 @@
+package certd
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestServer(t *testing.T) *Server {
+	tmpfile, err := ioutil.TempFile("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpfile.Close()
+	t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+
+	c, err := SetupCA(tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(c, "127.0.0.1", "4443", "")
+}
+
+func apiRequest(t *testing.T, s *Server, method, endpoint string, body io.Reader, v interface{}) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(DefaultUser, DefaultPassword)
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	if v != nil {
+		if err := json.Unmarshal(rr.Body.Bytes(), v); err != nil {
+			t.Fatalf("failed to decode response %q: %v", rr.Body.String(), err)
+		}
+	}
+	return rr
+}
+
+type apiErrorBody struct {
+	Error APIError `json:"error"`
+}
+
+func Test_API_issue(t *testing.T) {
+	s := newTestServer(t)
+
+	var issued IssuedCert
+	rr := apiRequest(t, s, "POST", "/api/v1/certificates", strings.NewReader(`{"hosts":["localhost","127.0.0.1"],"profile":"server"}`), &issued)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected %v got %v: %v", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	if issued.Serial == "" || issued.PrivateKey == "" || issued.Cert == "" {
+		t.Errorf("incomplete response: %v", rr.Body.String())
+	}
+	if issued.Profile != "server" {
+		t.Errorf("expected profile server got %v", issued.Profile)
+	}
+
+	var record CertRecord
+	rr = apiRequest(t, s, "GET", "/api/v1/certificates/"+issued.Serial, nil, &record)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %v got %v", http.StatusOK, rr.Code)
+	}
+	if len(record.Hosts) != 2 {
+		t.Errorf("expected 2 hosts got %v", record.Hosts)
+	}
+}
+
+func Test_API_issue_csr(t *testing.T) {
+	s := newTestServer(t)
+	caCRT, err := s.CA.Cert()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keyType := range []string{KeyRSA, KeyECDSAP256, KeyECDSAP384, KeyEd25519} {
+		csr, err := NewCSR("client.local", keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := json.Marshal(&IssueRequest{CSR: string(csr.PEM())})
+
+		var issued IssuedCert
+		rr := apiRequest(t, s, "POST", "/api/v1/certificates", strings.NewReader(string(body)), &issued)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("%v: expected %v got %v: %v", keyType, http.StatusCreated, rr.Code, rr.Body.String())
+		}
+		if issued.PrivateKey != "" {
+			t.Errorf("%v: private key returned for submitted CSR", keyType)
+		}
+		if len(issued.Hosts) != 1 || issued.Hosts[0] != "client.local" {
+			t.Errorf("%v: unexpected hosts %v", keyType, issued.Hosts)
+		}
+
+		block, _ := pem.Decode([]byte(issued.Cert))
+		if block == nil {
+			t.Fatalf("%v: no certificate in %q", keyType, issued.Cert)
+		}
+		crt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := crt.CheckSignatureFrom(caCRT); err != nil {
+			t.Errorf("%v: cert not signed by the CA: %v", keyType, err)
+		}
+	}
+}
+
+func Test_API_errors(t *testing.T) {
+	s := newTestServer(t)
+	s.Policy = &Policy{AllowedDomains: []string{"example.com"}}
+
+	tests := []struct {
+		method, endpoint, body string
+		status                 int
+		code                   string
+	}{
+		{"POST", "/api/v1/certificates", `{"hosts":["other.org"]}`, http.StatusForbidden, ErrCodePolicyViolation},
+		{"POST", "/api/v1/certificates", `{"hosts":["a.example.com"],"profile":"nope"}`, http.StatusBadRequest, ErrCodeUnknownProfile},
+		{"POST", "/api/v1/certificates", `{"hosts":`, http.StatusBadRequest, ErrCodeInvalidRequest},
+		{"POST", "/api/v1/certificates", `{"csr":"junk"}`, http.StatusBadRequest, ErrCodeInvalidRequest},
+		{"GET", "/api/v1/certificates/abc", "", http.StatusNotFound, ErrCodeNotFound},
+		{"GET", "/api/v1/certificates?status=bogus", "", http.StatusBadRequest, ErrCodeInvalidRequest},
+		{"POST", "/api/v1/certificates/abc/revoke", "", http.StatusNotFound, ErrCodeNotFound},
+		{"GET", "/api/v1/nothing", "", http.StatusNotFound, ErrCodeNotFound},
+		{"DELETE", "/api/v1/ca", "", http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		var e apiErrorBody
+		rr := apiRequest(t, s, tt.method, tt.endpoint, strings.NewReader(tt.body), &e)
+		if rr.Code != tt.status || e.Error.Code != tt.code {
+			t.Errorf("%v %v: expected %v/%v got %v/%v", tt.method, tt.endpoint, tt.status, tt.code, rr.Code, e.Error.Code)
+		}
+	}
+}
+
+func Test_API_unauthorized(t *testing.T) {
+	s := newTestServer(t)
+
+	req, _ := http.NewRequest("GET", "/api/v1/ca", nil)
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+
+	var e apiErrorBody
+	json.Unmarshal(rr.Body.Bytes(), &e)
+	if rr.Code != http.StatusUnauthorized || e.Error.Code != ErrCodeUnauthorized {
+		t.Errorf("expected %v/%v got %v/%v", http.StatusUnauthorized, ErrCodeUnauthorized, rr.Code, e.Error.Code)
+	}
+}
+
+func Test_API_revoke_and_list(t *testing.T) {
+	s := newTestServer(t)
+
+	var a, b IssuedCert
+	apiRequest(t, s, "POST", "/api/v1/certificates", strings.NewReader(`{"hosts":["a.local"]}`), &a)
+	apiRequest(t, s, "POST", "/api/v1/certificates", strings.NewReader(`{"hosts":["b.local"]}`), &b)
+
+	var revoked CertRecord
+	rr := apiRequest(t, s, "POST", "/api/v1/certificates/"+a.Serial+"/revoke", strings.NewReader(`{"reason":"testing"}`), &revoked)
+	if rr.Code != http.StatusOK || !revoked.Revoked || revoked.RevocationReason != "testing" {
+		t.Fatalf("revoke failed: %v", rr.Body.String())
+	}
+
+	var e apiErrorBody
+	rr = apiRequest(t, s, "POST", "/api/v1/certificates/"+a.Serial+"/revoke", nil, &e)
+	if rr.Code != http.StatusConflict || e.Error.Code != ErrCodeAlreadyRevoked {
+		t.Errorf("expected %v got %v", http.StatusConflict, rr.Code)
+	}
+
+	var records []CertRecord
+	apiRequest(t, s, "GET", "/api/v1/certificates?status=valid", nil, &records)
+	if len(records) != 1 || records[0].Serial != b.Serial {
+		t.Errorf("unexpected valid certs %v", records)
+	}
+
+	apiRequest(t, s, "GET", "/api/v1/certificates?host=a.local", nil, &records)
+	if len(records) != 1 || records[0].Serial != a.Serial {
+		t.Errorf("unexpected certs for host %v", records)
+	}
+
+	apiRequest(t, s, "GET", "/api/v1/certificates?expires_within=1h", nil, &records)
+	if len(records) != 0 {
+		t.Errorf("unexpected expiring certs %v", records)
+	}
+}
+
+func Test_API_ca(t *testing.T) {
+	s := newTestServer(t)
+
+	var info CAInfo
+	rr := apiRequest(t, s, "GET", "/api/v1/ca", nil, &info)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %v got %v", http.StatusOK, rr.Code)
+	}
+	if info.Cert != string(s.CA.CertBytes) || !strings.Contains(info.Subject, "CERTD") {
+		t.Errorf("unexpected CA info %+v", info)
+	}
+}
+
+func Test_API_issue_lifetime_exceeds_ca(t *testing.T) {
+	s := newTestServer(t)
+	s.Profiles["long"] = &Profile{Lifetime: Duration(2 * OneYear)}
+
+	var apiErr apiErrorBody
+	rr := apiRequest(t, s, "POST", "/api/v1/certificates", strings.NewReader(`{"hosts":["localhost"],"profile":"long"}`), &apiErr)
+	if rr.Code != http.StatusBadRequest || apiErr.Error.Code != ErrCodeLifetimeExceedsCA {
+		t.Errorf("expected a lifetime beyond the CA to be refused got %v %v", rr.Code, rr.Body.String())
+	}
+}
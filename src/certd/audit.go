@@ -0,0 +1,82 @@
+package certd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// audit events
+const (
+	AuditCertIssued        = "cert_issued"
+	AuditCertRevoked       = "cert_revoked"
+	AuditAuthFailure       = "auth_failure"
+	AuditConfigChanged     = "config_changed"
+	AuditConfigRejected    = "config_rejected"
+	AuditCASealed          = "ca_sealed"
+	AuditCAUnsealed        = "ca_unsealed"
+	AuditUnsealFailed      = "unseal_failed"
+	AuditSubordinateIssued = "subordinate_issued"
+)
+
+// AuditLog is an append-only record of security events, separate from the
+// operational log. A nil *AuditLog discards events.
+type AuditLog struct {
+	logger *slog.Logger
+	closer io.Closer
+}
+
+// NewAuditLog creates an AuditLog writing JSON lines to w
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{logger: slog.New(slog.NewJSONHandler(w, nil))}
+}
+
+// OpenAuditLog opens the audit log at dest, which is either the path of a
+// file to append to or "syslog", optionally followed by a tag such as
+// "syslog:certd-audit"
+func OpenAuditLog(dest string) (*AuditLog, error) {
+	if dest == "" {
+		return nil, fmt.Errorf("no audit log specified")
+	}
+
+	if dest == "syslog" || strings.HasPrefix(dest, "syslog:") {
+		tag := strings.TrimPrefix(strings.TrimPrefix(dest, "syslog"), ":")
+		if tag == "" {
+			tag = "certd-audit"
+		}
+		w, err := openSyslog(tag)
+		if err != nil {
+			return nil, err
+		}
+		a := NewAuditLog(w)
+		a.closer = w
+		return a, nil
+	}
+
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a := NewAuditLog(f)
+	a.closer = f
+	return a, nil
+}
+
+// Log records event along with the request details in ctx and attrs
+func (a *AuditLog) Log(ctx context.Context, event string, attrs ...any) {
+	if a == nil {
+		return
+	}
+	a.logger.With(requestAttrs(ctx)...).Info(event, attrs...)
+}
+
+// Close closes the underlying file or syslog connection
+func (a *AuditLog) Close() error {
+	if a == nil || a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package certd
+
+import (
+	"fmt"
+	"io"
+)
+
+func openSyslog(tag string) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("syslog is not supported on windows")
+}
@@ -0,0 +1,12 @@
+//go:build !windows && !plan9
+
+package certd
+
+import (
+	"io"
+	"log/syslog"
+)
+
+func openSyslog(tag string) (io.WriteCloser, error) {
+	return syslog.New(syslog.LOG_NOTICE|syslog.LOG_AUTH, tag)
+}
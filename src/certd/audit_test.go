@@ -0,0 +1,88 @@
+package certd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_AuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	s := newTestServer(t)
+	if s.Audit, err = OpenAuditLog(path); err != nil {
+		t.Fatal(err)
+	}
+
+	var issued IssuedCert
+	apiRequest(t, s, "POST", "/api/v1/certificates", strings.NewReader(`{"hosts":["a.local"]}`), &issued)
+	apiRequest(t, s, "POST", "/api/v1/certificates/"+issued.Serial+"/revoke", nil, nil)
+
+	req, _ := http.NewRequest("GET", "/ca", nil)
+	req.SetBasicAuth("mallory", "guess")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	s.Reload(&Settings{})
+	s.Audit.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var events []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("invalid audit line %q", scanner.Text())
+		}
+		events = append(events, e)
+	}
+
+	expected := []string{AuditCertIssued, AuditCertRevoked, AuditAuthFailure, AuditConfigRejected}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %v events got %v", len(expected), events)
+	}
+	for i, e := range events {
+		if e["msg"] != expected[i] {
+			t.Errorf("expected event %v got %v", expected[i], e["msg"])
+		}
+	}
+	if events[0]["user"] != DefaultUser || events[0]["serial"] != issued.Serial || events[0]["request_id"] == nil {
+		t.Errorf("issue event missing details %v", events[0])
+	}
+	if events[2]["attempted_user"] != "mallory" {
+		t.Errorf("auth failure event missing user %v", events[2])
+	}
+}
+
+func Test_AuditLog_nil(t *testing.T) {
+	var a *AuditLog
+	a.Log(context.Background(), AuditCertIssued)
+	if err := a.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_OpenAuditLog_error(t *testing.T) {
+	if _, err := OpenAuditLog(""); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if _, err := OpenAuditLog("does/not/exist/audit.log"); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
@@ -0,0 +1,290 @@
+package certd
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// autoCertRetry is how long AutoCert waits before retrying a failed
+// background renewal
+const autoCertRetry = time.Minute
+
+// AutoCert obtains certs on demand for the names clients ask for with SNI,
+// like golang.org/x/crypto/acme/autocert does from an ACME CA. Certs are
+// issued on the first handshake for a name allowed by HostPolicy, kept in
+// memory and in CacheDir, and renewed in the background once RenewAt of
+// their lifetime has passed.
+//
+// Issuer is a CAIssuer to sign with a local CA, or the Issuer of a
+// certd/client.Client to request certs from a running certd.
+type AutoCert struct {
+	Issuer Issuer
+	// HostPolicy limits the names certs are issued and served for, nothing
+	// is issued if it is nil. A client that sends no SNI gets a cert for the IP address
+	// it connected to, which must also be allowed.
+	HostPolicy *Policy
+	// CacheDir keeps the certs across restarts, they are only kept in
+	// memory if it is empty
+	CacheDir string
+	Profile  string
+	// KeyType of the keys generated for each cert, see NewCSR
+	KeyType string
+	// RenewAt is the fraction of the lifetime after which a cert is renewed,
+	// DefaultRenewAt if zero
+	RenewAt float64
+
+	mu    sync.Mutex
+	certs map[string]*autoCertEntry
+}
+
+// autoCertEntry is the state of the cert for one name
+type autoCertEntry struct {
+	name string
+	// obtainMu is held while a cert is obtained for a handshake that has
+	// none, so concurrent handshakes make a single request
+	obtainMu sync.Mutex
+
+	// protected by AutoCert.mu
+	cert     *tls.Certificate
+	renewing bool
+	retryAt  time.Time
+}
+
+// TLSConfig returns a tls.Config that gets its certs from m
+func (m *AutoCert) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: m.GetCertificate,
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (m *AutoCert) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" && hello.Conn != nil {
+		if addr, ok := hello.Conn.LocalAddr().(*net.TCPAddr); ok {
+			name = addr.IP.String()
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("missing server name")
+	}
+	ctx := hello.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return m.Certificate(ctx, name)
+}
+
+// Certificate returns the cert for name, obtaining one if there is none or
+// it has expired and starting a renewal in the background if it is due
+func (m *AutoCert) Certificate(ctx context.Context, name string) (*tls.Certificate, error) {
+	// checked before the policy as the name is used for the cache path
+	if net.ParseIP(name) == nil && (strings.HasPrefix(name, "*") || !validHostname(name)) {
+		return nil, &PolicyError{fmt.Sprintf("invalid hostname \"%v\"", name)}
+	}
+	// checked on every handshake so a name removed from the policy stops
+	// being served at once, even with a cert in memory or in the cache
+	if err := m.allowed(name); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	if m.certs == nil {
+		m.certs = make(map[string]*autoCertEntry)
+	}
+	e, ok := m.certs[name]
+	if !ok {
+		e = &autoCertEntry{name: name}
+		m.certs[name] = e
+	}
+	cert, ok := m.current(e)
+	m.mu.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	e.obtainMu.Lock()
+	defer e.obtainMu.Unlock()
+	m.mu.Lock()
+	cert, ok = m.current(e)
+	m.mu.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	if cert == nil {
+		cached, err := m.load(name)
+		if err != nil && !os.IsNotExist(err) {
+			logger.Error("failed to load cached cert", "name", name, "error", err)
+		}
+		if cached != nil {
+			m.mu.Lock()
+			e.cert = cached
+			cert, ok = m.current(e)
+			m.mu.Unlock()
+			if ok {
+				return cert, nil
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	cert, err := m.obtain(e)
+	var policyErr *PolicyError
+	if errors.As(err, &policyErr) {
+		// names that will never get a cert are not kept, clients could
+		// otherwise grow the map without bound
+		m.mu.Lock()
+		if e.cert == nil && m.certs[name] == e {
+			delete(m.certs, name)
+		}
+		m.mu.Unlock()
+	}
+	return cert, err
+}
+
+// current returns the cert of e and whether it can be used, starting a
+// renewal if it is due. m.mu must be held.
+func (m *AutoCert) current(e *autoCertEntry) (*tls.Certificate, bool) {
+	if e.cert == nil {
+		return nil, false
+	}
+	now := time.Now()
+	if !now.Before(e.cert.Leaf.NotAfter) {
+		return e.cert, false
+	}
+	if !e.renewing && !now.Before(m.renewTime(e.cert)) && !now.Before(e.retryAt) {
+		e.renewing = true
+		go m.renew(e)
+	}
+	return e.cert, true
+}
+
+// allowed checks HostPolicy allows certs for name
+func (m *AutoCert) allowed(name string) error {
+	if m.HostPolicy == nil {
+		return &PolicyError{"no host policy"}
+	}
+	return m.HostPolicy.Check([]string{name})
+}
+
+// obtain issues a cert for e and starts using it
+func (m *AutoCert) obtain(e *autoCertEntry) (*tls.Certificate, error) {
+	name := e.name
+	if err := m.allowed(name); err != nil {
+		return nil, err
+	}
+
+	csr, err := NewCSR(name, m.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := m.Issuer.Issue(csr, m.Profile)
+	if err != nil {
+		return nil, err
+	}
+	b := append(append([]byte{}, csr.PrivateKey...), certPEM...)
+	cert, err := parseKeyAndCerts(b)
+	if err != nil {
+		return nil, fmt.Errorf("issued cert: %v", err)
+	}
+	logger.Info("issued cert", "name", name, "serial", fmt.Sprintf("%x", cert.Leaf.SerialNumber), "not_after", cert.Leaf.NotAfter)
+
+	if m.CacheDir != "" {
+		if err := writeFileOwned(m.cachePath(name), b, 0600, -1, -1); err != nil {
+			logger.Error("failed to cache cert", "name", name, "error", err)
+		}
+	}
+	m.mu.Lock()
+	e.cert = cert
+	m.mu.Unlock()
+	return cert, nil
+}
+
+// renew replaces the cert of e in the background
+func (m *AutoCert) renew(e *autoCertEntry) {
+	e.obtainMu.Lock()
+	_, err := m.obtain(e)
+	e.obtainMu.Unlock()
+
+	m.mu.Lock()
+	e.renewing = false
+	if err != nil {
+		e.retryAt = time.Now().Add(autoCertRetry)
+	}
+	m.mu.Unlock()
+	if err != nil {
+		logger.Error("failed to renew cert", "name", e.name, "error", err)
+	}
+}
+
+// renewTime returns when cert is due for renewal
+func (m *AutoCert) renewTime(cert *tls.Certificate) time.Time {
+	renewAt := m.RenewAt
+	if renewAt <= 0 || renewAt >= 1 {
+		renewAt = DefaultRenewAt
+	}
+	leaf := cert.Leaf
+	return leaf.NotBefore.Add(time.Duration(float64(leaf.NotAfter.Sub(leaf.NotBefore)) * renewAt))
+}
+
+// load reads the cached cert for name, a missing cache is reported as a
+// not exist error
+func (m *AutoCert) load(name string) (*tls.Certificate, error) {
+	if m.CacheDir == "" {
+		return nil, os.ErrNotExist
+	}
+	b, err := ioutil.ReadFile(m.cachePath(name))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := parseKeyAndCerts(b)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", m.cachePath(name), err)
+	}
+	if !sameHosts(certHosts(cert.Leaf), []string{name}) {
+		return nil, fmt.Errorf("%v: cert is not for %v", m.cachePath(name), name)
+	}
+	return cert, nil
+}
+
+// cachePath returns the file the cert for name is cached in, colons in IPv6
+// addresses are replaced for Windows
+func (m *AutoCert) cachePath(name string) string {
+	return filepath.Join(m.CacheDir, strings.Replace(name, ":", "_", -1)+".pem")
+}
+
+// parseKeyAndCerts parses a PEM private key followed by a cert chain
+func parseKeyAndCerts(b []byte) (*tls.Certificate, error) {
+	var certPEM, keyPEM []byte
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		} else {
+			keyPEM = pem.EncodeToMemory(block)
+		}
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
@@ -0,0 +1,105 @@
+package certd
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_AutoCert(t *testing.T) {
+	s := newTestServer(t)
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &AutoCert{
+		Issuer:     &CAIssuer{CA: s.CA},
+		HostPolicy: &Policy{AllowedDomains: []string{"example.com"}, AllowedNetworks: []string{"127.0.0.0/8"}},
+		CacheDir:   dir,
+		Profile:    "server",
+		KeyType:    KeyECDSAP256,
+	}
+	ctx := context.Background()
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "Web.Example.com."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf.DNSNames[0] != "web.example.com" {
+		t.Errorf("unexpected names %v", cert.Leaf.DNSNames)
+	}
+	if again, _ := m.Certificate(ctx, "web.example.com"); again != cert {
+		t.Errorf("expected the cached cert")
+	}
+	if st, err := os.Stat(filepath.Join(dir, "web.example.com.pem")); err != nil || st.Mode().Perm() != 0600 {
+		t.Errorf("expected the cert to be cached with mode 0600 %v", err)
+	}
+	if ip, err := m.Certificate(ctx, "127.0.0.1"); err != nil || len(ip.Leaf.IPAddresses) != 1 {
+		t.Errorf("expected a cert for the IP %v", err)
+	}
+
+	for _, name := range []string{"other.org", "10.0.0.1", "*.example.com", "../x.example.com", ""} {
+		if _, err := m.Certificate(ctx, name); err == nil {
+			t.Errorf("%q: expected an error", name)
+		}
+	}
+	if len(m.certs) != 2 {
+		t.Errorf("expected refused names not to be kept got %v entries", len(m.certs))
+	}
+	if _, err := (&AutoCert{Issuer: m.Issuer}).Certificate(ctx, "web.example.com"); err == nil {
+		t.Errorf("expected an error without a host policy")
+	}
+
+	// a new AutoCert uses the cert from the cache
+	m2 := &AutoCert{Issuer: m.Issuer, HostPolicy: m.HostPolicy, CacheDir: dir}
+	cached, err := m2.Certificate(ctx, "web.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0 {
+		t.Errorf("expected the cert from the cache")
+	}
+
+	// a name the policy no longer allows is not served from the cache
+	m3 := &AutoCert{Issuer: m.Issuer, HostPolicy: &Policy{AllowedDomains: []string{"example.org"}}, CacheDir: dir}
+	if _, err := m3.Certificate(ctx, "web.example.com"); err == nil {
+		t.Errorf("expected the cached cert of a refused name not to be served")
+	}
+	if _, err := (&AutoCert{Issuer: m.Issuer, CacheDir: dir}).Certificate(ctx, "web.example.com"); err == nil {
+		t.Errorf("expected the cached cert not to be served without a host policy")
+	}
+
+	// a cert that is due is served until the replacement is ready
+	due := *cert
+	leaf := *cert.Leaf
+	leaf.NotBefore = time.Now().Add(-10 * leaf.NotAfter.Sub(time.Now()))
+	due.Leaf = &leaf
+	m.mu.Lock()
+	m.certs["web.example.com"].cert = &due
+	m.mu.Unlock()
+	if got, _ := m.Certificate(ctx, "web.example.com"); got != &due {
+		t.Errorf("expected the old cert while renewing")
+	}
+	for i := 0; ; i++ {
+		m.mu.Lock()
+		e := m.certs["web.example.com"]
+		current, renewing := e.cert, e.renewing
+		m.mu.Unlock()
+		if current != &due && !renewing {
+			break
+		}
+		if i > 100 {
+			t.Fatal("cert was not renewed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if renewed, err := m2.load("web.example.com"); err != nil || renewed.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) == 0 {
+		t.Errorf("expected the renewed cert in the cache %v", err)
+	}
+}
@@ -2,15 +2,19 @@ package certd
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"math/big"
 	"net"
 	"os"
@@ -21,8 +25,20 @@ import (
 const (
 	RSABits = 2048
 	OneYear = 365 * 24 * time.Hour
+
+	DefaultCALifetime = OneYear
+
+	DefaultCommonName = "CERTD"
 )
 
+// ErrLifetimeExceedsCA is returned when a cert is requested for longer than
+// the CA that would issue it is valid
+var ErrLifetimeExceedsCA = errors.New("requested lifetime exceeds the CA's remaining validity")
+
+// ErrSealed is returned when the CA key is needed but it is split into
+// shares and has not been unsealed
+var ErrSealed = errors.New("the CA is sealed")
+
 // Cert holds a cert and private key
 type Cert struct {
 	CertBytes []byte `json:"cert,omitempty"`
@@ -51,14 +67,77 @@ func (c *Cert) Plain() (string, error) {
 	return fmt.Sprintf("%v\n%v", string(c.CertBytes), string(c.KeyBytes)), nil
 }
 
+// X509 returns an x509.Certificate based on the contents of CertBytes
+func (c *Cert) X509() (*x509.Certificate, error) {
+	pemBlock, _ := pem.Decode(c.CertBytes)
+	if pemBlock == nil {
+		return nil, fmt.Errorf("pem.Decode failed")
+	}
+	return x509.ParseCertificate(pemBlock.Bytes)
+}
+
 // CA holds the cert and key for signing new certs
 type CA struct {
 	CertBytes []byte `json:"cert,omitempty"`
 	KeyBytes  []byte `json:"private_key,omitempty"`
+	// EncryptedKey is the key in a config where it is encrypted, LoadCA
+	// decrypts it into KeyBytes unless it is split into shares, then the CA
+	// is sealed until Unseal is called
+	EncryptedKey *EncryptedKey `json:"encrypted_private_key,omitempty"`
+	// PKCS11 is set when the key is kept in a PKCS#11 token instead
+	PKCS11 *PKCS11Key `json:"pkcs11,omitempty"`
+	// Rotation is set while the root is being replaced
+	Rotation *Rotation `json:"rotation,omitempty"`
+	// PreviousCerts are the retired roots
+	PreviousCerts [][]byte `json:"previous_certs,omitempty"`
+	// Chain holds the PEM certs above an intermediate CA up to its offline
+	// root, it is set by ImportCert
+	Chain []byte `json:"chain,omitempty"`
+	// Ledger records every issuance and revocation when set
+	Ledger *Ledger `json:"-"`
+	// Lifetime is how long a root made by GenerateCert is valid,
+	// DefaultCALifetime if zero
+	Lifetime time.Duration `json:"-"`
+	// CommonName of a root made by GenerateCert, DefaultCommonName if empty
+	CommonName string `json:"-"`
 }
 
-// LoadCA loads a CA from a JSON based config file
+// LoadCA loads a CA from a JSON based config file. An encrypted key is
+// decrypted with the passphrase from SetCAPassphrase, a key split into
+// shares is left sealed.
 func LoadCA(path string) (*CA, error) {
+	c, err := readCA(path)
+	if err != nil {
+		return nil, err
+	}
+	if c.EncryptedKey != nil && len(c.KeyBytes) == 0 && c.EncryptedKey.KDF != KDFShamir {
+		passphrase, err := getCAPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		if c.KeyBytes, err = c.EncryptedKey.Decrypt(passphrase); err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+		if next := c.nextRoot(); next != nil && next.EncryptedKey != nil {
+			if next.KeyBytes, err = next.EncryptedKey.Decrypt(passphrase); err != nil {
+				return nil, fmt.Errorf("%v: new root: %w", path, err)
+			}
+		}
+	}
+	return c, nil
+}
+
+// LoadCACert returns the CA cert from a config without decrypting the key
+func LoadCACert(path string) (*x509.Certificate, error) {
+	c, err := readCA(path)
+	if err != nil {
+		return nil, err
+	}
+	return c.Cert()
+}
+
+// readCA reads a CA config without decrypting the key
+func readCA(path string) (*CA, error) {
 	if path == "" {
 		return nil, fmt.Errorf("no config specified")
 	}
@@ -81,23 +160,189 @@ func LoadCA(path string) (*CA, error) {
 
 // SetupCA creates a new CA and stores its config at path
 func SetupCA(path string) (*CA, error) {
+	return SetupEncryptedCA(path, "")
+}
+
+// SetupEncryptedCA creates a new CA and stores its config at path with the
+// key encrypted with passphrase, unless it is empty
+func SetupEncryptedCA(path, passphrase string) (*CA, error) {
+	c := &CA{}
+	if err := c.Setup(path, passphrase); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SetupSharedCA creates a new CA and stores its config at path with the key
+// encrypted with a key split into n shares, threshold of which unseal it.
+// The shares are returned and are not stored anywhere.
+func SetupSharedCA(path string, n, threshold int) (*CA, []string, error) {
+	c := &CA{}
+	shares, err := c.SetupShares(path, n, threshold)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, shares, nil
+}
+
+// SetupPKCS11CA creates a new CA for the key in a PKCS#11 token and stores
+// its config at path
+func SetupPKCS11CA(path string, key *PKCS11Key) (*CA, error) {
+	c := &CA{PKCS11: key}
+	if err := c.Setup(path, ""); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Setup generates the root of c, valid for c.Lifetime, and stores its config
+// at path with the key encrypted with passphrase, unless it is empty. It is
+// used instead of the Setup functions to set Lifetime or PKCS11 first.
+func (c *CA) Setup(path, passphrase string) error {
+	if path == "" {
+		return fmt.Errorf("no config specified")
+	}
+	if err := c.GenerateCert(); err != nil {
+		return err
+	}
+	return c.Save(path, passphrase)
+}
+
+// SetupShares generates the root of c like Setup and stores its config at
+// path with the key split into shares like SetupSharedCA
+func (c *CA) SetupShares(path string, n, threshold int) ([]string, error) {
 	if path == "" {
 		return nil, fmt.Errorf("no config specified")
 	}
+	if err := c.GenerateCert(); err != nil {
+		return nil, err
+	}
+	return c.SaveShares(path, n, threshold)
+}
 
-	c := &CA{}
-	c.GenerateCert()
+// Save writes the CA config to path, with the key encrypted with passphrase
+// unless it is empty
+func (c *CA) Save(path, passphrase string) error {
+	if c.PKCS11 != nil && passphrase != "" {
+		return fmt.Errorf("the CA key is in a PKCS#11 token and can not be encrypted")
+	}
+	var ek *EncryptedKey
+	if passphrase != "" {
+		var err error
+		if ek, err = EncryptKey(c.KeyBytes, passphrase); err != nil {
+			return err
+		}
+	}
+	var nextKey *EncryptedKey
+	if next := c.nextRoot(); next != nil && passphrase != "" {
+		var err error
+		if nextKey, err = EncryptKey(next.KeyBytes, passphrase); err != nil {
+			return err
+		}
+	}
+	return c.save(path, ek, nextKey)
+}
 
-	b, err := json.MarshalIndent(c, "", "  ")
+// Update writes the CA config to path keeping the key protected as it was
+// when loaded, an encrypted key is encrypted again with the passphrase from
+// SetCAPassphrase
+func (c *CA) Update(path string) error {
+	if c.EncryptedKey == nil {
+		return c.Save(path, "")
+	}
+	if c.EncryptedKey.KDF == KDFShamir {
+		if c.Rotation != nil {
+			return fmt.Errorf("a CA key split into shares can not be rotated")
+		}
+		return c.save(path, c.EncryptedKey, nil)
+	}
+	passphrase, err := getCAPassphrase()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return c.Save(path, passphrase)
+}
+
+// nextRoot returns the new root of a rotation in progress, nil if there is
+// none
+func (c *CA) nextRoot() *CA {
+	if c.Rotation == nil {
+		return nil
+	}
+	return c.Rotation.Next
+}
 
-	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+// SaveShares writes the CA config to path with the key encrypted with a key
+// split into n shares, which are returned
+func (c *CA) SaveShares(path string, n, threshold int) ([]string, error) {
+	if c.Sealed() {
+		return nil, ErrSealed
+	}
+	if c.PKCS11 != nil {
+		return nil, fmt.Errorf("the CA key is in a PKCS#11 token and can not be split")
+	}
+	if c.Rotation != nil {
+		return nil, fmt.Errorf("the CA key can not be split while a rotation is in progress")
+	}
+	ek, shares, err := EncryptKeyShares(c.KeyBytes, n, threshold)
+	if err != nil {
 		return nil, err
 	}
+	if err := c.save(path, ek, nil); err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
 
-	return c, nil
+// save writes the CA config to path with the key encrypted as ek, or in the
+// clear if ek is nil, and the key of a new root encrypted as nextKey
+func (c *CA) save(path string, ek, nextKey *EncryptedKey) error {
+	out := CA{CertBytes: c.CertBytes, KeyBytes: c.KeyBytes, EncryptedKey: ek, PKCS11: c.PKCS11,
+		PreviousCerts: c.PreviousCerts, Chain: c.Chain}
+	if ek != nil {
+		out.KeyBytes = nil
+	}
+	if r := c.Rotation; r != nil {
+		rotation := *r
+		rotation.Next = &CA{CertBytes: r.Next.CertBytes, KeyBytes: r.Next.KeyBytes, EncryptedKey: nextKey}
+		if nextKey != nil {
+			rotation.Next.KeyBytes = nil
+		}
+		out.Rotation = &rotation
+	}
+
+	b, err := json.MarshalIndent(&out, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileOwned(path, b, 0600, -1, -1); err != nil {
+		return err
+	}
+	c.EncryptedKey = ek
+	return nil
+}
+
+// Sealed reports whether the key is split into shares and has not been
+// unsealed, a sealed CA can not sign anything
+func (c *CA) Sealed() bool {
+	return len(c.KeyBytes) == 0 && c.EncryptedKey != nil && c.EncryptedKey.KDF == KDFShamir
+}
+
+// Unseal decrypts the key with shares of its key-encryption key
+func (c *CA) Unseal(shares []string) error {
+	if c.EncryptedKey == nil || c.EncryptedKey.KDF != KDFShamir {
+		return fmt.Errorf("the CA key is not split into shares")
+	}
+	keyPEM, err := c.EncryptedKey.DecryptShares(shares)
+	if err != nil {
+		return err
+	}
+	c.KeyBytes = keyPEM
+	if err := c.Validate(); err != nil {
+		c.KeyBytes = nil
+		return err
+	}
+	return nil
 }
 
 // Cert returns an x509.Certificate based on the contents of CertBytes
@@ -113,8 +358,30 @@ func (c *CA) Cert() (*x509.Certificate, error) {
 	return caCRT, nil
 }
 
-// PrivateKey returns an rsa.PrivateKey based on the contents of KeyBytes
+// KeyProvider returns where the CA key is kept
+func (c *CA) KeyProvider() KeyProvider {
+	if c.PKCS11 != nil {
+		return c.PKCS11
+	}
+	return &FileKey{PEM: c.KeyBytes}
+}
+
+// Signer returns the signer for the CA key, ErrSealed if the CA is sealed.
+// Everything the CA signs is signed with it.
+func (c *CA) Signer() (crypto.Signer, error) {
+	if c.Sealed() {
+		return nil, ErrSealed
+	}
+	return c.KeyProvider().Signer()
+}
+
+// PrivateKey returns an rsa.PrivateKey based on the contents of KeyBytes,
+// ErrSealed if the CA is sealed. Use Signer for a key that may be in a
+// PKCS#11 token.
 func (c *CA) PrivateKey() (*rsa.PrivateKey, error) {
+	if c.Sealed() {
+		return nil, ErrSealed
+	}
 	pemBlock, _ := pem.Decode(c.KeyBytes)
 	if pemBlock == nil {
 		return nil, fmt.Errorf("pem.Decode failed")
@@ -126,62 +393,168 @@ func (c *CA) PrivateKey() (*rsa.PrivateKey, error) {
 	return caPrivateKey, nil
 }
 
+// Validate checks the CA cert and key can be parsed, that they belong together
+// and that the cert has not expired. Only the cert is checked while the CA
+// is sealed.
+func (c *CA) Validate() error {
+	crt, err := c.Cert()
+	if err != nil {
+		return err
+	}
+	if !c.Sealed() {
+		key, err := c.Signer()
+		if err != nil {
+			return err
+		}
+		if !publicKeysEqual(key.Public(), crt.PublicKey) {
+			return fmt.Errorf("private key does not match cert")
+		}
+	}
+	if next := c.nextRoot(); next != nil {
+		if err := next.Validate(); err != nil {
+			return fmt.Errorf("new root: %v", err)
+		}
+	}
+	if time.Now().After(crt.NotAfter) {
+		return fmt.Errorf("cert expired at %v", crt.NotAfter)
+	}
+	return nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of crt as colon separated hex,
+// the same format as "openssl x509 -fingerprint -sha256"
+func Fingerprint(crt *x509.Certificate) string {
+	sum := sha256.Sum256(crt.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// FingerprintMatches reports whether crt has fingerprint, which may be in
+// the format returned by Fingerprint or plain hex and may have a "sha256:"
+// prefix
+func FingerprintMatches(crt *x509.Certificate, fingerprint string) bool {
+	fingerprint = strings.TrimPrefix(strings.ToLower(fingerprint), "sha256:")
+	fingerprint = strings.ReplaceAll(fingerprint, ":", "")
+	want, err := hex.DecodeString(fingerprint)
+	if err != nil || len(want) != sha256.Size {
+		return false
+	}
+	sum := sha256.Sum256(crt.Raw)
+	return subtle.ConstantTimeCompare(sum[:], want) == 1
+}
+
 // WriteCert writes the CA cert to disk
 func (c *CA) WriteCert(path string) error {
 	return ioutil.WriteFile(path, c.CertBytes, 0600)
 }
 
-// CertFromCSR creates a cert from a certificate request
+// CertFromCSR creates a cert from a certificate request, issued by the new
+// root once a rotation has switched to it. The cert is a subordinate CA if
+// csr has Constraints. A cert without a lifetime is valid until the CA
+// expires, ErrLifetimeExceedsCA is returned if the lifetime would outlast
+// the CA.
 func (c *CA) CertFromCSR(csr *CSR) (*Cert, error) {
+	cert, pending, err := c.prepareCert(csr)
+	if err != nil {
+		return nil, err
+	}
+	pending.commit()
+	return cert, nil
+}
+
+// prepareCert signs the cert like CertFromCSR, its ledger entry is pending
+// until the caller has stored the cert
+func (c *CA) prepareCert(csr *CSR) (*Cert, *pendingEntry, error) {
 	clientCSR := csr.CertificateRequest
+	issuing := c.issuingCA(time.Now())
 
-	caPrivateKey, err := c.PrivateKey()
+	caPrivateKey, err := issuing.Signer()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	caCRT, err := c.Cert()
+	caCRT, err := issuing.Cert()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	notBefore := time.Now()
+	notAfter := caCRT.NotAfter
+	if csr.Lifetime > 0 {
+		if notBefore.Add(csr.Lifetime).After(notAfter) {
+			return nil, nil, fmt.Errorf("%w: %v requested, the CA expires at %v", ErrLifetimeExceedsCA, csr.Lifetime, caCRT.NotAfter)
+		}
+		notAfter = notBefore.Add(csr.Lifetime)
+	}
+
+	// serials are random so instances sharing a store do not collide
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// create client certificate template
+	// the signature algorithm is left for the CA key to decide, the CSR's
+	// key may be of a different type
 	template := x509.Certificate{
-		Signature:          clientCSR.Signature,
-		SignatureAlgorithm: clientCSR.SignatureAlgorithm,
-
 		PublicKeyAlgorithm: clientCSR.PublicKeyAlgorithm,
 		PublicKey:          clientCSR.PublicKey,
 
-		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		SerialNumber: serialNumber,
 		Issuer:       caCRT.Subject,
 		Subject:      clientCSR.Subject,
 
-		NotBefore: time.Now(),
-		NotAfter:  caCRT.NotAfter,
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
 
-		KeyUsage: x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		KeyUsage:    x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: csr.ExtKeyUsage,
 
 		IsCA: false,
 	}
 
-	for _, h := range strings.Split(csr.Hosts, ",") {
-		if ip := net.ParseIP(h); ip != nil {
-			template.IPAddresses = append(template.IPAddresses, ip)
-		} else {
-			template.DNSNames = append(template.DNSNames, h)
+	if cc := csr.Constraints; cc != nil {
+		template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		template.ExtKeyUsage = nil
+		template.BasicConstraintsValid = true
+		template.IsCA = true
+		template.MaxPathLen = cc.PathLen
+		template.MaxPathLenZero = cc.PathLen == 0
+		if cc.LimitNames {
+			template.PermittedDNSDomainsCritical = true
+			template.PermittedDNSDomains = cc.Domains
+			template.PermittedIPRanges = cc.Networks
+			if len(cc.Domains) == 0 {
+				template.PermittedDNSDomains = []string{noNames}
+			}
+			if len(cc.Networks) == 0 {
+				template.ExcludedIPRanges = allIPRanges
+			}
+			template.PermittedEmailAddresses = []string{noNames}
+			template.PermittedURIDomains = []string{noNames}
+		}
+	} else {
+		for _, h := range SplitHosts(csr.Hosts) {
+			if ip := net.ParseIP(h); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, h)
+			}
 		}
 	}
 
 	// create client certificate from template and CA public key
 	clientCRTRaw, err := x509.CreateCertificate(rand.Reader, &template, caCRT, clientCSR.PublicKey, caPrivateKey)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var buf bytes.Buffer
 	if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: clientCRTRaw}); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	cert := &Cert{
@@ -189,32 +562,102 @@ func (c *CA) CertFromCSR(csr *CSR) (*Cert, error) {
 		KeyBytes:  csr.PrivateKey,
 	}
 
-	return cert, nil
+	var pending *pendingEntry
+	if c.Ledger != nil {
+		sum := sha256.Sum256(clientCRTRaw)
+		entry := &LedgerEntry{
+			Event:      LedgerIssue,
+			Serial:     fmt.Sprintf("%x", template.SerialNumber),
+			Hosts:      SplitHosts(csr.Hosts),
+			CertSHA256: hex.EncodeToString(sum[:]),
+		}
+		if pending, err = c.Ledger.prepare(entry, caPrivateKey); err != nil {
+			return nil, nil, fmt.Errorf("failed to record issuance in the ledger: %v", err)
+		}
+	}
+
+	return cert, pending, nil
 }
 
-// GenerateCert creates the root CA
-func (c *CA) GenerateCert() error {
-	log.Println("generating new CA cert and key")
-	privateKey, err := rsa.GenerateKey(rand.Reader, RSABits)
+// RecordRevocation records the revocation of the cert with serial in the ledger
+func (c *CA) RecordRevocation(serial, reason string) error {
+	pending, err := c.prepareRevocation(serial, reason)
 	if err != nil {
 		return err
 	}
+	pending.commit()
+	return nil
+}
+
+// prepareRevocation writes the revocation to the ledger like
+// RecordRevocation, the entry is pending until the caller has stored the
+// revocation
+func (c *CA) prepareRevocation(serial, reason string) (*pendingEntry, error) {
+	if c.Ledger == nil {
+		return nil, nil
+	}
 
+	caPrivateKey, err := c.issuingCA(time.Now()).Signer()
+	if err != nil {
+		return nil, err
+	}
+	entry := &LedgerEntry{
+		Event:  LedgerRevoke,
+		Serial: serial,
+		Reason: reason,
+	}
+	pending, err := c.Ledger.prepare(entry, caPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record revocation in the ledger: %v", err)
+	}
+	return pending, nil
+}
+
+// GenerateCert creates the root CA, with a new key unless the key is in a
+// PKCS#11 token
+func (c *CA) GenerateCert() error {
+	var signer crypto.Signer
+	var keyPEM []byte
+	if c.PKCS11 != nil {
+		logger.Info("generating new CA cert for the PKCS#11 key", "label", c.PKCS11.Label)
+		var err error
+		if signer, err = c.PKCS11.Signer(); err != nil {
+			return err
+		}
+	} else {
+		logger.Info("generating new CA cert and key")
+		privateKey, err := rsa.GenerateKey(rand.Reader, RSABits)
+		if err != nil {
+			return err
+		}
+		var keyOut bytes.Buffer
+		pem.Encode(&keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+		signer, keyPEM = privateKey, keyOut.Bytes()
+	}
+
+	lifetime := c.Lifetime
+	if lifetime <= 0 {
+		lifetime = DefaultCALifetime
+	}
 	notBefore := time.Now()
 
-	notAfter := notBefore.Add(OneYear)
+	notAfter := notBefore.Add(lifetime)
 
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
 		return err
 	}
-	log.Printf("using generated serial number %v", serialNumber)
+	logger.Info("using generated serial number", "serial", serialNumber.String())
 
+	commonName := c.CommonName
+	if commonName == "" {
+		commonName = DefaultCommonName
+	}
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
-			CommonName: "CERTD",
+			CommonName: commonName,
 
 			Organization:       []string{"CERTD"},
 			OrganizationalUnit: []string{"CERTD"},
@@ -233,7 +676,7 @@ func (c *CA) GenerateCert() error {
 		IsCA: true,
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, signer.Public(), signer)
 	if err != nil {
 		return err
 	}
@@ -241,12 +684,9 @@ func (c *CA) GenerateCert() error {
 	var certOut bytes.Buffer
 	pem.Encode(&certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
 
-	var keyOut bytes.Buffer
-	pem.Encode(&keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
-
 	c.CertBytes = certOut.Bytes()
-	c.KeyBytes = keyOut.Bytes()
+	c.KeyBytes = keyPEM
 
-	log.Println("new CA cert and key generated successfully")
+	logger.Info("new CA cert and key generated successfully")
 	return nil
 }
@@ -1,13 +1,19 @@
 package certd
 
 import (
+	"bytes"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_CA(t *testing.T) {
@@ -157,6 +163,29 @@ func Test_CA_WriteCert(t *testing.T) {
 
 }
 
+func Test_Fingerprint(t *testing.T) {
+	s := newTestServer(t)
+	crt, err := s.CA.Cert()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fp := Fingerprint(crt)
+	if len(fp) != 95 {
+		t.Errorf("unexpected fingerprint %v", fp)
+	}
+	for _, f := range []string{fp, strings.ToLower(fp), "sha256:" + strings.Replace(fp, ":", "", -1)} {
+		if !FingerprintMatches(crt, f) {
+			t.Errorf("expected %v to match", f)
+		}
+	}
+	for _, f := range []string{"", "zz", fp[:len(fp)-3], strings.Replace(fp, fp[:2], "00", 1) + "00"} {
+		if FingerprintMatches(crt, f) {
+			t.Errorf("expected %v not to match", f)
+		}
+	}
+}
+
 func Test_CA_CertFromCSR(t *testing.T) {
 	tmpfile, err := ioutil.TempFile("", "certd")
 	if err != nil {
@@ -303,3 +332,129 @@ func Test_CA_genCert_noauth(t *testing.T) {
 	}
 
 }
+
+func Test_CA_encrypted_key(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "certd.conf")
+	defer SetCAPassphrase(envPassphrase)
+
+	c, err := SetupEncryptedCA(path, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(b), "PRIVATE KEY") || !strings.Contains(string(b), "encrypted_private_key") {
+		t.Errorf("expected the key to be encrypted in %s", b)
+	}
+	if st, _ := os.Stat(path); st.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600 got %v", st.Mode())
+	}
+
+	// the cert can be read without the passphrase
+	if crt, err := LoadCACert(path); err != nil || crt.Subject.CommonName != "CERTD" {
+		t.Errorf("unexpected CA cert %v", err)
+	}
+
+	SetCAPassphrase(func() (string, error) { return "wrong", nil })
+	if _, err := LoadCA(path); !errors.Is(err, ErrKeyPassphrase) {
+		t.Errorf("expected %v got %v", ErrKeyPassphrase, err)
+	}
+	SetCAPassphrase(func() (string, error) { return "first", nil })
+	loaded, err := LoadCA(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Validate(); err != nil || !bytes.Equal(loaded.KeyBytes, c.KeyBytes) {
+		t.Errorf("key was not decrypted %v", err)
+	}
+
+	// change the passphrase, then store it unencrypted
+	if err := loaded.Save(path, "second"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCA(path); !errors.Is(err, ErrKeyPassphrase) {
+		t.Errorf("expected the old passphrase to fail got %v", err)
+	}
+	SetCAPassphrase(func() (string, error) { return "second", nil })
+	if _, err := LoadCA(path); err != nil {
+		t.Error(err)
+	}
+	if err := loaded.Save(path, ""); err != nil {
+		t.Fatal(err)
+	}
+	SetCAPassphrase(func() (string, error) { return "", fmt.Errorf("should not be called") })
+	if plain, err := LoadCA(path); err != nil || plain.EncryptedKey != nil {
+		t.Errorf("expected an unencrypted key %v", err)
+	}
+}
+
+func Test_PassphraseSource(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString("from-fd\nignored\n")
+	w.Close()
+
+	f := PassphraseSource(int(r.Fd()), "CERTD_TEST_PASSPHRASE", "")
+	for i := 0; i < 2; i++ {
+		if p, err := f(); err != nil || p != "from-fd" {
+			t.Errorf("expected the passphrase from the fd got %q %v", p, err)
+		}
+	}
+
+	os.Setenv("CERTD_TEST_PASSPHRASE", "from-env")
+	defer os.Unsetenv("CERTD_TEST_PASSPHRASE")
+	if p, err := PassphraseSource(-1, "CERTD_TEST_PASSPHRASE", "")(); err != nil || p != "from-env" {
+		t.Errorf("expected the passphrase from the environment got %q %v", p, err)
+	}
+	if _, err := PassphraseSource(-1, "CERTD_TEST_UNSET", "")(); err == nil {
+		t.Errorf("expected an error without a passphrase")
+	}
+}
+
+func Test_CA_lifetime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &CA{Lifetime: 10 * OneYear}
+	if err := c.Setup(filepath.Join(dir, "certd.conf"), ""); err != nil {
+		t.Fatal(err)
+	}
+	crt, _ := c.Cert()
+	if d := crt.NotAfter.Sub(crt.NotBefore); d != 10*OneYear {
+		t.Errorf("expected a lifetime of 10 years got %v", d)
+	}
+
+	short := &CA{Lifetime: time.Hour}
+	if err := short.GenerateCert(); err != nil {
+		t.Fatal(err)
+	}
+	csr, _ := CreateCSR("localhost")
+	csr.Lifetime = 2 * time.Hour
+	if _, err := short.CertFromCSR(csr); !errors.Is(err, ErrLifetimeExceedsCA) {
+		t.Errorf("expected %v got %v", ErrLifetimeExceedsCA, err)
+	}
+	csr.Lifetime = 0
+	cert, err := short.CertFromCSR(csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := cert.X509()
+	if shortCrt, _ := short.Cert(); !leaf.NotAfter.Equal(shortCrt.NotAfter) {
+		t.Errorf("expected a cert without a lifetime to expire with the CA")
+	}
+
+	// the serving cert is shortened instead of refused
+	sc := newServingCert(func() *CA { return short }, "localhost", 24*time.Hour)
+	if _, err := sc.issue(); err != nil {
+		t.Errorf("expected the serving cert to be issued until the CA expires: %v", err)
+	}
+}
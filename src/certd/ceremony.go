@@ -0,0 +1,303 @@
+package certd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+const (
+	DefaultOfflineRootLifetime  = 10 * OneYear
+	DefaultIntermediateLifetime = 3 * OneYear
+	// DefaultRootCRLValidity is how long a CRL from an offline root is
+	// valid, a new one has to be signed before then
+	DefaultRootCRLValidity = 180 * 24 * time.Hour
+
+	// the common names keep the subjects of the root and an intermediate
+	// apart, chain builders that match on names take a cert whose issuer
+	// is its subject for a root
+	DefaultOfflineRootCommonName  = "CERTD Offline Root"
+	DefaultIntermediateCommonName = "CERTD Intermediate"
+)
+
+// Ceremony signs with an offline root. Everything it signs is recorded in
+// the root's transcript, a ledger signed by the root, along with who signed
+// it.
+type Ceremony struct {
+	CA         *CA
+	Transcript *Ledger
+	Operator   string
+}
+
+// NewCeremony opens the transcript at path for ca, operator is recorded with
+// every entry. The transcript must verify against the root, nothing is
+// signed from a transcript that was modified.
+func NewCeremony(ca *CA, path, operator string) (*Ceremony, error) {
+	if operator == "" {
+		return nil, fmt.Errorf("the operator performing the ceremony is required")
+	}
+	transcript, err := OpenLedger(path)
+	if err != nil {
+		return nil, err
+	}
+	cer := &Ceremony{CA: ca, Transcript: transcript, Operator: operator}
+	if _, err := cer.entries(); err != nil {
+		transcript.Close()
+		return nil, err
+	}
+	return cer, nil
+}
+
+// entries returns the entries in the transcript once they are verified
+// against the root
+func (cer *Ceremony) entries() ([]*LedgerEntry, error) {
+	root, err := cer.CA.Cert()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := cer.Transcript.Entries(root)
+	if err != nil {
+		return nil, fmt.Errorf("the transcript does not verify against the root: %v", err)
+	}
+	return entries, nil
+}
+
+// Close closes the transcript
+func (cer *Ceremony) Close() error {
+	return cer.Transcript.Close()
+}
+
+// record appends e to the transcript signed by the root
+func (cer *Ceremony) record(e *LedgerEntry) error {
+	signer, err := cer.CA.Signer()
+	if err != nil {
+		return err
+	}
+	e.Operator = cer.Operator
+	if err := cer.Transcript.Append(e, signer); err != nil {
+		return fmt.Errorf("failed to record in the transcript: %v", err)
+	}
+	return nil
+}
+
+// RecordRoot records the creation of the root
+func (cer *Ceremony) RecordRoot() error {
+	crt, err := cer.CA.Cert()
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(crt.Raw)
+	return cer.record(&LedgerEntry{
+		Event:      LedgerRootCreated,
+		Serial:     fmt.Sprintf("%x", crt.SerialNumber),
+		Subject:    crt.Subject.String(),
+		CertSHA256: hex.EncodeToString(sum[:]),
+	})
+}
+
+// SignIntermediate signs a PEM encoded CSR as an intermediate CA valid for
+// lifetime, DefaultIntermediateLifetime if zero. pathLen is how many CAs may
+// follow it in a chain.
+func (cer *Ceremony) SignIntermediate(csrPEM []byte, lifetime time.Duration, pathLen int) (*Cert, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("no certificate request found")
+	}
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.CheckSignature(); err != nil {
+		return nil, err
+	}
+	root, err := cer.CA.Cert()
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(req.RawSubjectPublicKeyInfo, root.RawSubjectPublicKeyInfo) {
+		return nil, fmt.Errorf("the CSR has the root's own key")
+	}
+	if bytes.Equal(req.RawSubject, root.RawSubject) {
+		return nil, fmt.Errorf("the CSR has the root's subject, give the intermediate another common name")
+	}
+	if pathLen < 0 {
+		return nil, fmt.Errorf("the path length can not be negative")
+	}
+	if lifetime <= 0 {
+		lifetime = DefaultIntermediateLifetime
+	}
+
+	cert, err := cer.CA.CertFromCSR(&CSR{
+		CertificateRequest: req,
+		Lifetime:           lifetime,
+		Constraints:        &CAConstraints{PathLen: pathLen},
+	})
+	if err != nil {
+		return nil, err
+	}
+	crt, err := cert.X509()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(crt.Raw)
+	err = cer.record(&LedgerEntry{
+		Event:      LedgerSignIntermediate,
+		Serial:     fmt.Sprintf("%x", crt.SerialNumber),
+		Subject:    crt.Subject.String(),
+		CertSHA256: hex.EncodeToString(sum[:]),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// Revoke records the revocation of the intermediate with serial, it is
+// listed in every CRL signed from then on
+func (cer *Ceremony) Revoke(serial, reason string) error {
+	entries, err := cer.entries()
+	if err != nil {
+		return err
+	}
+	signed := false
+	for _, e := range entries {
+		if e.Serial != serial {
+			continue
+		}
+		switch e.Event {
+		case LedgerSignIntermediate:
+			signed = true
+		case LedgerRevoke:
+			return ErrAlreadyRevoked
+		}
+	}
+	if !signed {
+		return fmt.Errorf("no intermediate with serial %v was signed by this root", serial)
+	}
+	return cer.record(&LedgerEntry{Event: LedgerRevoke, Serial: serial, Reason: reason})
+}
+
+// SignCRL signs a DER encoded CRL valid for validity, DefaultRootCRLValidity
+// if zero, listing the intermediates revoked in the transcript
+func (cer *Ceremony) SignCRL(validity time.Duration) ([]byte, error) {
+	if validity <= 0 {
+		validity = DefaultRootCRLValidity
+	}
+	entries, err := cer.entries()
+	if err != nil {
+		return nil, err
+	}
+	var revoked []x509.RevocationListEntry
+	for _, e := range entries {
+		if e.Event != LedgerRevoke {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(e.Serial, 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial %q in the transcript", e.Serial)
+		}
+		revoked = append(revoked, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: e.Time})
+	}
+
+	now := time.Now()
+	der, err := cer.CA.signCRL(revoked, now, now.Add(validity))
+	if err != nil {
+		return nil, err
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	err = cer.record(&LedgerEntry{
+		Event:     LedgerSignCRL,
+		Serial:    fmt.Sprintf("%x", crl.Number),
+		CRLSHA256: hex.EncodeToString(sum[:]),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return der, nil
+}
+
+// IntermediateCSR returns a PEM encoded CSR for the CA key with the subject
+// of the CA cert and commonName, DefaultIntermediateCommonName if empty, for
+// an offline root to sign with Ceremony.SignIntermediate
+func (c *CA) IntermediateCSR(commonName string) ([]byte, error) {
+	signer, err := c.Signer()
+	if err != nil {
+		return nil, err
+	}
+	crt, err := c.Cert()
+	if err != nil {
+		return nil, err
+	}
+	if commonName == "" {
+		commonName = DefaultIntermediateCommonName
+	}
+	subject := crt.Subject
+	subject.CommonName = commonName
+	// the raw names would be encoded instead of the changed subject
+	subject.Names = nil
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: subject}, signer)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// ImportCert makes the CA an intermediate with the PEM certs in b, the cert
+// an offline root signed for the CA key followed by the chain up to the
+// root. The CA key is not needed, the cert only has to be for the same key
+// as the current one.
+func (c *CA) ImportCert(b []byte) error {
+	if c.Rotation != nil {
+		return fmt.Errorf("a cert can not be imported while a rotation is in progress")
+	}
+	certs, err := ParseCertsPEM(b)
+	if err != nil {
+		return err
+	}
+	if len(certs) < 2 {
+		return fmt.Errorf("expected the cert followed by the chain up to its root")
+	}
+	current, err := c.Cert()
+	if err != nil {
+		return err
+	}
+	crt := certs[0]
+	if !publicKeysEqual(current.PublicKey, crt.PublicKey) {
+		return fmt.Errorf("the cert is not for the CA key")
+	}
+	if !crt.IsCA || !crt.BasicConstraintsValid {
+		return fmt.Errorf("the cert is not a CA")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	root := certs[len(certs)-1]
+	opts.Roots.AddCert(root)
+	for _, chain := range certs[1 : len(certs)-1] {
+		opts.Intermediates.AddCert(chain)
+	}
+	if _, err := crt.Verify(opts); err != nil {
+		return fmt.Errorf("the cert does not chain to %v: %v", root.Subject, err)
+	}
+
+	var chain bytes.Buffer
+	for _, chainCert := range certs[1:] {
+		pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: chainCert.Raw})
+	}
+	c.CertBytes = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})
+	c.Chain = chain.Bytes()
+	return nil
+}
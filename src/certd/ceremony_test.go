@@ -0,0 +1,166 @@
+package certd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCeremony(t *testing.T) (*Ceremony, string) {
+	dir := t.TempDir()
+	defer SetCAPassphrase(envPassphrase)
+	SetCAPassphrase(func() (string, error) { return "secret", nil })
+
+	root := &CA{Lifetime: DefaultOfflineRootLifetime, CommonName: DefaultOfflineRootCommonName}
+	if err := root.Setup(filepath.Join(dir, "root.json"), "secret"); err != nil {
+		t.Fatal(err)
+	}
+	transcript := filepath.Join(dir, "ceremony.jsonl")
+	cer, err := NewCeremony(root, transcript, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cer.Close() })
+	if err := cer.RecordRoot(); err != nil {
+		t.Fatal(err)
+	}
+	return cer, transcript
+}
+
+func Test_Ceremony_intermediate(t *testing.T) {
+	cer, transcript := newTestCeremony(t)
+	rootCert, _ := cer.CA.Cert()
+
+	path := filepath.Join(t.TempDir(), "certd.json")
+	online, err := SetupCA(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := online.IntermediateCSR("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameSubject := &CA{Lifetime: time.Hour}
+	if err := sameSubject.GenerateCert(); err != nil {
+		t.Fatal(err)
+	}
+	sameCSR, err := sameSubject.IntermediateCSR(DefaultOfflineRootCommonName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cer.SignIntermediate(sameCSR, 0, 0); err == nil {
+		t.Errorf("expected a CSR with the root's subject to be refused")
+	}
+	cert, err := cer.SignIntermediate(csr, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, _ := cert.X509()
+	if !crt.IsCA || !crt.MaxPathLenZero || crt.CheckSignatureFrom(rootCert) != nil {
+		t.Errorf("expected an intermediate signed by the root")
+	}
+	if crt.Subject.CommonName != DefaultIntermediateCommonName || crt.Issuer.String() == crt.Subject.String() {
+		t.Errorf("expected the intermediate's subject to differ from its issuer got %v issued by %v", crt.Subject, crt.Issuer)
+	}
+	if _, err := cer.SignIntermediate(csr, 2*DefaultOfflineRootLifetime, 0); err == nil {
+		t.Errorf("expected an intermediate outliving the root to be refused")
+	}
+
+	// the online CA imports the cert with the root and issues below it
+	if err := online.ImportCert(rootCert.Raw); err == nil {
+		t.Errorf("expected a cert for another key to be refused")
+	}
+	if err := online.ImportCert(append(cert.CertBytes, cer.CA.CertBytes...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := online.Update(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadCA(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Validate(); err != nil || !bytes.Equal(loaded.Chain, cer.CA.CertBytes) {
+		t.Fatalf("expected the intermediate and its chain to be saved %v", err)
+	}
+	leaf := issueTestCert(t, loaded)
+	chain, err := loaded.ChainCerts(time.Now())
+	if err != nil || len(chain) != 2 {
+		t.Fatalf("expected the intermediate and the root in the chain %v", err)
+	}
+	if err := verifyChain(leaf, []*x509.Certificate{rootCert}, chain); err != nil {
+		t.Errorf("expected the leaf to verify against the offline root: %v", err)
+	}
+	if err := loaded.StartRotation(time.Now(), time.Now()); err == nil {
+		t.Errorf("expected an intermediate not to be rotated")
+	}
+
+	b, _ := ioutil.ReadFile(transcript)
+	if n, err := VerifyLedger(bytes.NewReader(b), rootCert); err != nil || n != 2 {
+		t.Errorf("expected 2 valid transcript entries got %v: %v", n, err)
+	}
+	entries, _ := ReadLedger(bytes.NewReader(b), rootCert)
+	if len(entries) != 2 || entries[1].Event != LedgerSignIntermediate || entries[1].Operator != "alice" || entries[1].Subject != crt.Subject.String() {
+		t.Errorf("unexpected transcript %+v", entries)
+	}
+}
+
+func Test_Ceremony_CRL(t *testing.T) {
+	cer, transcript := newTestCeremony(t)
+	rootCert, _ := cer.CA.Cert()
+	csr, _ := NewCSR("intermediate", KeyECDSAP256)
+	cert, err := cer.SignIntermediate(csr.PEM(), time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, _ := cert.X509()
+	serial := crt.SerialNumber.Text(16)
+
+	if err := cer.Revoke("abcdef", ""); err == nil {
+		t.Errorf("expected a serial the root did not sign to be refused")
+	}
+	if err := cer.Revoke(serial, "superseded"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cer.Revoke(serial, ""); err != ErrAlreadyRevoked {
+		t.Errorf("expected %v got %v", ErrAlreadyRevoked, err)
+	}
+
+	der, err := cer.SignCRL(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crl.CheckSignatureFrom(rootCert) != nil || len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(crt.SerialNumber) != 0 {
+		t.Errorf("expected a CRL from the root listing the intermediate")
+	}
+
+	b, _ := ioutil.ReadFile(transcript)
+	if n, err := VerifyLedger(bytes.NewReader(b), rootCert); err != nil || n != 4 {
+		t.Errorf("expected 4 valid transcript entries got %v: %v", n, err)
+	}
+
+	// removing the revocation from the transcript does not un-revoke the
+	// intermediate, the root refuses to sign from it
+	lines := strings.SplitAfter(string(b), "\n")
+	ioutil.WriteFile(transcript, []byte(lines[0]+lines[1]+lines[3]), 0600)
+	if _, err := cer.SignCRL(0); err == nil {
+		t.Errorf("expected a CRL not to be signed from a modified transcript")
+	}
+	if _, err := NewCeremony(cer.CA, transcript, "bob"); err == nil {
+		t.Errorf("expected a modified transcript to be refused")
+	}
+}
+
+func Test_NewCeremony_operator(t *testing.T) {
+	if _, err := NewCeremony(&CA{}, filepath.Join(t.TempDir(), "ceremony.jsonl"), ""); err == nil {
+		t.Errorf("expected a ceremony without an operator to be refused")
+	}
+}
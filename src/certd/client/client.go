@@ -0,0 +1,479 @@
+// Package client is a client for the JSON API of a certd server.
+//
+// A Client issues, renews and revokes certs and fetches the CA and CRL.
+// A Renewer keeps a cert for a tls.Config renewed in the background, see
+// Client.ServerTLSConfig and Client.ClientTLSConfig.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"certd"
+)
+
+const (
+	// DefaultRetries is how many times a failed request is retried
+	DefaultRetries = 3
+	// DefaultRetryWait is the delay before the first retry, it doubles for
+	// each retry after that
+	DefaultRetryWait = time.Second
+	// DefaultTimeout is the timeout for each attempt at a request
+	DefaultTimeout = 30 * time.Second
+
+	maxRetryWait = 30 * time.Second
+)
+
+// Options configure a Client
+type Options struct {
+	User     string
+	Password string
+
+	// CAFingerprint pins the CA the server's cert must chain to, in the
+	// format returned by certd.Fingerprint. The server sends its CA along
+	// with its cert so nothing else is needed to trust it.
+	CAFingerprint string
+	// RootCAs are trusted for the server's cert if there is no
+	// CAFingerprint, the system roots are used if it is nil too
+	RootCAs *x509.CertPool
+
+	// Retries is how many times a request is retried after a network
+	// error or a 429, 502, 503 or 504 response, DefaultRetries if zero and
+	// none if negative
+	Retries int
+	// RetryWait is the delay before the first retry, DefaultRetryWait if
+	// zero
+	RetryWait time.Duration
+	// Timeout for each attempt, DefaultTimeout if zero
+	Timeout time.Duration
+}
+
+// Client talks to a certd server. It is safe for concurrent use.
+type Client struct {
+	base      *url.URL
+	user      string
+	password  string
+	http      *http.Client
+	retries   int
+	retryWait time.Duration
+}
+
+// New creates a Client for the certd at server, e.g. https://certd:4443
+func New(server string, opts Options) (*Client, error) {
+	base, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "https" {
+		return nil, fmt.Errorf("server must be an https:// URL")
+	}
+
+	config := &tls.Config{ServerName: base.Hostname(), RootCAs: opts.RootCAs}
+	if opts.CAFingerprint != "" {
+		// the chain is verified against the pinned CA instead of RootCAs
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = VerifyPinned(opts.CAFingerprint, base.Hostname())
+	}
+
+	c := &Client{
+		base:      base,
+		user:      opts.User,
+		password:  opts.Password,
+		retries:   opts.Retries,
+		retryWait: opts.RetryWait,
+		http: &http.Client{
+			Timeout:   opts.Timeout,
+			Transport: &http.Transport{TLSClientConfig: config, Proxy: http.ProxyFromEnvironment},
+		},
+	}
+	if c.retries == 0 {
+		c.retries = DefaultRetries
+	}
+	if c.retryWait <= 0 {
+		c.retryWait = DefaultRetryWait
+	}
+	if c.http.Timeout <= 0 {
+		c.http.Timeout = DefaultTimeout
+	}
+	return c, nil
+}
+
+// VerifyPinned returns a func for tls.Config.VerifyPeerCertificate that
+// requires the peer to present the CA with fingerprint and a cert for host
+// signed by it
+func VerifyPinned(fingerprint, host string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("server sent no certs")
+		}
+		var certs []*x509.Certificate
+		for _, raw := range rawCerts {
+			crt, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, crt)
+		}
+
+		roots := x509.NewCertPool()
+		intermediates := x509.NewCertPool()
+		pinned := false
+		for _, crt := range certs[1:] {
+			if certd.FingerprintMatches(crt, fingerprint) {
+				roots.AddCert(crt)
+				pinned = true
+			} else {
+				intermediates.AddCert(crt)
+			}
+		}
+		if !pinned {
+			return fmt.Errorf("server did not present the CA with the pinned fingerprint")
+		}
+
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			DNSName:       host,
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		return err
+	}
+}
+
+// retryable reports whether a request that got status should be retried
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// do sends a request to path, which is relative to the server's URL, and
+// decodes the JSON response into v. Failed requests are retried, which
+// means an issuance whose response was lost may be made twice.
+func (c *Client) do(ctx context.Context, method, path string, body, v interface{}) error {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	ref := &url.URL{Path: strings.TrimSuffix(c.base.Path, "/") + path}
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		ref.Path, ref.RawQuery = strings.TrimSuffix(c.base.Path, "/")+path[:i], path[i+1:]
+	}
+	u := c.base.ResolveReference(ref)
+
+	wait := c.retryWait
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, u, b)
+		if err == nil && !retryable(resp.StatusCode) {
+			defer resp.Body.Close()
+			return decodeResponse(resp, method, u, v)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt >= c.retries {
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			return decodeResponse(resp, method, u, v)
+		}
+
+		delay := wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+		if resp != nil {
+			if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+				delay = time.Duration(s) * time.Second
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if wait *= 2; wait > maxRetryWait {
+			wait = maxRetryWait
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method string, u *url.URL, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	if c.user != "" || c.password != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.http.Do(req)
+}
+
+// decodeResponse decodes a successful response into v, which may be a
+// *[]byte for the raw body, or an error response into a *certd.APIError
+func decodeResponse(resp *http.Response, method string, u *url.URL, v interface{}) error {
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error *certd.APIError `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == nil {
+			return fmt.Errorf("%v %v: %v", method, u.Path, resp.Status)
+		}
+		e.Error.Status = resp.StatusCode
+		return e.Error
+	}
+	if raw, ok := v.(*[]byte); ok {
+		var err error
+		*raw, err = ioutil.ReadAll(resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Request sends ir to the server and returns the issued cert
+func (c *Client) Request(ctx context.Context, ir *certd.IssueRequest) (*certd.IssuedCert, error) {
+	var issued certd.IssuedCert
+	if err := c.do(ctx, "POST", certd.APIPrefix+"certificates", ir, &issued); err != nil {
+		return nil, err
+	}
+	return &issued, nil
+}
+
+// Issue requests a cert for hosts. The server generates the private key and
+// returns it with the cert.
+func (c *Client) Issue(ctx context.Context, hosts []string, profile string) (*certd.IssuedCert, error) {
+	return c.Request(ctx, &certd.IssueRequest{Hosts: hosts, Profile: profile})
+}
+
+// SubmitCSR requests a cert for a PEM encoded CSR, the hosts are taken from
+// the CSR
+func (c *Client) SubmitCSR(ctx context.Context, csrPEM []byte, profile string) (*certd.IssuedCert, error) {
+	return c.Request(ctx, &certd.IssueRequest{CSR: string(csrPEM), Profile: profile})
+}
+
+// IssueSubordinate requests a subordinate CA for a team from a PEM encoded
+// CSR, it needs an admin
+func (c *Client) IssueSubordinate(ctx context.Context, sr *certd.SubordinateRequest) (*certd.CertRecord, error) {
+	var record certd.CertRecord
+	if err := c.do(ctx, "POST", certd.APIPrefix+"subordinates", sr, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Obtain requests a cert for hosts with a new key of keyType, see
+// certd.NewCSR, that never leaves this process
+func (c *Client) Obtain(ctx context.Context, hosts []string, profile, keyType string) (*tls.Certificate, error) {
+	csr, err := certd.NewCSR(strings.Join(hosts, ","), keyType)
+	if err != nil {
+		return nil, err
+	}
+	issued, err := c.Request(ctx, &certd.IssueRequest{Hosts: hosts, CSR: string(csr.PEM()), Profile: profile})
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair([]byte(issued.Cert), csr.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// Renew issues a replacement for the cert with serial, for the same hosts
+// and profile and with a new key of keyType. The old cert is left to expire.
+func (c *Client) Renew(ctx context.Context, serial, keyType string) (*tls.Certificate, error) {
+	record, err := c.Get(ctx, serial)
+	if err != nil {
+		return nil, err
+	}
+	return c.Obtain(ctx, record.Hosts, record.Profile, keyType)
+}
+
+// Get returns the record of the cert with serial
+func (c *Client) Get(ctx context.Context, serial string) (*certd.CertRecord, error) {
+	var record certd.CertRecord
+	if err := c.do(ctx, "GET", certd.APIPrefix+"certificates/"+url.PathEscape(serial), nil, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// List returns the records matching f
+func (c *Client) List(ctx context.Context, f certd.CertFilter) ([]*certd.CertRecord, error) {
+	q := url.Values{}
+	if f.Host != "" {
+		q.Set("host", f.Host)
+	}
+	if f.Status != "" {
+		q.Set("status", f.Status)
+	}
+	if !f.ExpiresBefore.IsZero() {
+		q.Set("expires_before", f.ExpiresBefore.Format(time.RFC3339))
+	}
+	path := certd.APIPrefix + "certificates"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+
+	var records []*certd.CertRecord
+	if err := c.do(ctx, "GET", path, nil, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Revoke revokes the cert with serial
+func (c *Client) Revoke(ctx context.Context, serial, reason string) (*certd.CertRecord, error) {
+	var record certd.CertRecord
+	err := c.do(ctx, "POST", certd.APIPrefix+"certificates/"+url.PathEscape(serial)+"/revoke", &certd.RevokeRequest{Reason: reason}, &record)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// CA returns the server's CA
+func (c *Client) CA(ctx context.Context) (*certd.CAInfo, error) {
+	var info certd.CAInfo
+	if err := c.do(ctx, "GET", certd.APIPrefix+"ca", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// CAs lists the other CAs hosted by the server, each can be used with a
+// Client for the server URL followed by /ca/{name}
+func (c *Client) CAs(ctx context.Context) ([]*certd.TenantInfo, error) {
+	var list []*certd.TenantInfo
+	if err := c.do(ctx, "GET", certd.APIPrefix+"cas", nil, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// CertPool returns a pool holding the server's CA, and during a root
+// rotation the new root too
+func (c *Client) CertPool(ctx context.Context) (*x509.CertPool, error) {
+	info, err := c.CA(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bundle := info.Bundle
+	if bundle == "" {
+		bundle = info.Cert
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(bundle)) {
+		return nil, errors.New("no CA cert in the response")
+	}
+	return pool, nil
+}
+
+// CRL returns the server's latest CRL
+func (c *Client) CRL(ctx context.Context) (*x509.RevocationList, error) {
+	var der []byte
+	if err := c.do(ctx, "GET", "/crl", nil, &der); err != nil {
+		return nil, err
+	}
+	return x509.ParseRevocationList(der)
+}
+
+// PreviousCRL returns the CRL of the previous root during a rotation, certs
+// it issued before the switch are checked against it
+func (c *Client) PreviousCRL(ctx context.Context) (*x509.RevocationList, error) {
+	var der []byte
+	if err := c.do(ctx, "GET", "/crl-previous", nil, &der); err != nil {
+		return nil, err
+	}
+	return x509.ParseRevocationList(der)
+}
+
+// SealStatus returns whether the server's CA is sealed
+func (c *Client) SealStatus(ctx context.Context) (*certd.SealStatus, error) {
+	var status certd.SealStatus
+	if err := c.do(ctx, "GET", "/sys/seal-status", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Unseal gives the server a share of the CA key, the returned status says
+// how many have been given and whether the CA is still sealed
+func (c *Client) Unseal(ctx context.Context, share string) (*certd.SealStatus, error) {
+	return c.unseal(ctx, &certd.UnsealRequest{Share: share})
+}
+
+// ResetUnseal discards the shares given to the server so far
+func (c *Client) ResetUnseal(ctx context.Context) (*certd.SealStatus, error) {
+	return c.unseal(ctx, &certd.UnsealRequest{Reset: true})
+}
+
+func (c *Client) unseal(ctx context.Context, ur *certd.UnsealRequest) (*certd.SealStatus, error) {
+	var status certd.SealStatus
+	if err := c.do(ctx, "POST", "/sys/unseal", ur, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Seal seals the server's CA so no certs are issued until it is unsealed
+func (c *Client) Seal(ctx context.Context) (*certd.SealStatus, error) {
+	var status certd.SealStatus
+	if err := c.do(ctx, "POST", "/sys/seal", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Issuer returns a certd.Issuer that submits CSRs to the server, for use
+// with certd.Agent
+func (c *Client) Issuer() certd.Issuer {
+	return issuer{c}
+}
+
+type issuer struct {
+	c *Client
+}
+
+// Issue implements certd.Issuer
+func (i issuer) Issue(csr *certd.CSR, profile string) (string, error) {
+	issued, err := i.c.Request(context.Background(), &certd.IssueRequest{
+		Hosts:   certd.SplitHosts(csr.Hosts),
+		CSR:     string(csr.PEM()),
+		Profile: profile,
+	})
+	if err != nil {
+		return "", err
+	}
+	return issued.Cert, nil
+}
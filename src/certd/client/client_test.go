@@ -0,0 +1,283 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"certd"
+)
+
+// newTestServer starts a certd serving a cert from its own CA, as certd
+// does, and returns it with a client that pins the CA
+func newTestServer(t *testing.T, h func(http.Handler) http.Handler) (*certd.Server, *httptest.Server, *Client) {
+	tmpfile, err := ioutil.TempFile("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpfile.Close()
+	t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+
+	ca, err := certd.SetupCA(tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := certd.NewServer(ca, "127.0.0.1", "4443", "")
+
+	csr, err := certd.NewCSR("127.0.0.1", certd.KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ca.CertFromCSR(csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serving, err := tls.X509KeyPair(c.CertBytes, c.KeyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := ca.Cert()
+	serving.Certificate = append(serving.Certificate, caCert.Raw)
+
+	var handler http.Handler = s
+	if h != nil {
+		handler = h(s)
+	}
+	ts := httptest.NewUnstartedServer(handler)
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{serving}}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	client, err := New(ts.URL, Options{
+		User:          certd.DefaultUser,
+		Password:      certd.DefaultPassword,
+		CAFingerprint: certd.Fingerprint(caCert),
+		RetryWait:     time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, ts, client
+}
+
+func Test_Client(t *testing.T) {
+	_, _, c := newTestServer(t, nil)
+	ctx := context.Background()
+
+	issued, err := c.Issue(ctx, []string{"a.example.com"}, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued.PrivateKey == "" || issued.Profile != "server" {
+		t.Errorf("unexpected issued cert %+v", issued)
+	}
+
+	csr, _ := certd.NewCSR("b.example.com", certd.KeyEd25519)
+	fromCSR, err := c.SubmitCSR(ctx, csr.PEM(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromCSR.PrivateKey != "" || len(fromCSR.Hosts) != 1 || fromCSR.Hosts[0] != "b.example.com" {
+		t.Errorf("unexpected issued cert %+v", fromCSR)
+	}
+
+	renewed, err := c.Renew(ctx, issued.Serial, certd.KeyECDSAP384)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Leaf.DNSNames[0] != "a.example.com" || len(renewed.Leaf.ExtKeyUsage) != 1 {
+		t.Errorf("renewed cert does not match the original %v %v", renewed.Leaf.DNSNames, renewed.Leaf.ExtKeyUsage)
+	}
+
+	if l, err := c.List(ctx, certd.CertFilter{Host: "a.example.com"}); err != nil || len(l) != 2 {
+		t.Errorf("expected 2 records, got %v %v", l, err)
+	}
+
+	if _, err := c.Revoke(ctx, issued.Serial, "superseded"); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := c.Get(ctx, issued.Serial); err != nil || !r.Revoked {
+		t.Errorf("expected the cert to be revoked %+v %v", r, err)
+	}
+	crl, err := c.CRL(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 {
+		t.Errorf("expected 1 revoked cert in the CRL, got %v", len(crl.RevokedCertificateEntries))
+	}
+
+	info, err := c.CA(ctx)
+	if err != nil || info.Fingerprint == "" {
+		t.Errorf("unexpected CA info %+v %v", info, err)
+	}
+
+	var apiErr *certd.APIError
+	if _, err := c.Issue(ctx, []string{"a"}, "nope"); !errors.As(err, &apiErr) || apiErr.Code != certd.ErrCodeUnknownProfile || apiErr.Status != http.StatusBadRequest {
+		t.Errorf("expected an unknown profile error, got %v", err)
+	}
+}
+
+func Test_Client_pinning(t *testing.T) {
+	_, ts, _ := newTestServer(t, nil)
+
+	c, err := New(ts.URL, Options{CAFingerprint: "00:11", Retries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CA(context.Background()); err == nil {
+		t.Errorf("expected the wrong fingerprint to be rejected")
+	}
+
+	// without a pin the system roots do not trust the CA
+	c, _ = New(ts.URL, Options{Retries: -1})
+	if _, err := c.CA(context.Background()); err == nil {
+		t.Errorf("expected the server's cert not to be trusted")
+	}
+
+	if _, err := New("http://certd", Options{}); err == nil {
+		t.Errorf("expected error for a plain HTTP URL")
+	}
+}
+
+func Test_Client_retries(t *testing.T) {
+	var attempts int32
+	failFirst := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if atomic.AddInt32(&attempts, 1) <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			h.ServeHTTP(w, req)
+		})
+	}
+	_, _, c := newTestServer(t, failFirst)
+
+	if _, err := c.CA(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts got %v", attempts)
+	}
+
+	atomic.StoreInt32(&attempts, -10)
+	c.retries = 2
+	if _, err := c.CA(context.Background()); err == nil {
+		t.Errorf("expected an error once the retries ran out")
+	}
+	if attempts != -7 {
+		t.Errorf("expected 3 attempts got %v", attempts+10)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.CA(ctx); err != context.Canceled {
+		t.Errorf("expected %v got %v", context.Canceled, err)
+	}
+}
+
+func Test_Renewer(t *testing.T) {
+	_, _, c := newTestServer(t, nil)
+	r := c.NewRenewer([]string{"a.example.com"}, "")
+	r.RenewAt = 0.3
+
+	first, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := r.GetCertificate(nil); again != first {
+		t.Errorf("expected the cached cert")
+	}
+
+	// make the cert due for renewal, it is still served until the
+	// replacement is ready
+	due := *first
+	leaf := *first.Leaf
+	leaf.NotBefore = time.Now().Add(-leaf.NotAfter.Sub(time.Now()))
+	due.Leaf = &leaf
+	r.mu.Lock()
+	r.cert = &due
+	r.mu.Unlock()
+	if got, _ := r.GetCertificate(nil); got != &due {
+		t.Errorf("expected the old cert while renewing")
+	}
+	for i := 0; ; i++ {
+		r.mu.Lock()
+		cert, renewing := r.cert, r.renewing
+		r.mu.Unlock()
+		if cert != &due && !renewing {
+			break
+		}
+		if i > 100 {
+			t.Fatal("cert was not renewed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// an expired cert is replaced before returning
+	expired := *first
+	leaf = *first.Leaf
+	leaf.NotAfter = time.Now().Add(-time.Minute)
+	expired.Leaf = &leaf
+	r.mu.Lock()
+	r.cert = &expired
+	r.mu.Unlock()
+	if got, err := r.GetCertificate(nil); err != nil || got == &expired {
+		t.Errorf("expected a new cert, got %v", err)
+	}
+}
+
+func Test_TLSConfig(t *testing.T) {
+	_, _, c := newTestServer(t, nil)
+	ctx := context.Background()
+
+	serverConfig, _, err := c.ServerTLSConfig(ctx, []string{"127.0.0.1"}, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	var peer string
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		peer = req.TLS.PeerCertificates[0].DNSNames[0]
+	}))
+	// httptest.StartTLS would add its own cert, which is preferred over
+	// GetCertificate when the client sends no SNI
+	ts.Listener = tls.NewListener(ts.Listener, serverConfig)
+	ts.Start()
+	defer ts.Close()
+	serverURL := "https://" + ts.Listener.Addr().String()
+
+	clientConfig, _, err := c.ClientTLSConfig(ctx, []string{"client.example.com"}, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+	resp, err := hc.Get(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if peer != "client.example.com" {
+		t.Errorf("unexpected client cert %q", peer)
+	}
+
+	// no client cert
+	clientConfig, r, err := c.ClientTLSConfig(ctx, nil, "")
+	if err != nil || r != nil {
+		t.Fatal(err)
+	}
+	hc = &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+	if _, err := hc.Get(serverURL); err == nil {
+		t.Errorf("expected the server to require a client cert")
+	}
+	if clientConfig.RootCAs == nil {
+		t.Errorf("expected the CA to be trusted")
+	}
+}
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"certd"
+)
+
+// renewerRetry is how long a Renewer waits before retrying a failed
+// background renewal
+const renewerRetry = time.Minute
+
+// Renewer holds a cert for a tls.Config and renews it before it expires.
+// A cert is obtained on first use and renewed in the background once
+// RenewAt of its lifetime has passed, the old cert is served until the new
+// one is ready.
+type Renewer struct {
+	client  *Client
+	hosts   []string
+	profile string
+	// KeyType of the keys generated for each cert, see certd.NewCSR
+	KeyType string
+	// RenewAt is the fraction of the lifetime after which the cert is
+	// renewed, certd.DefaultRenewAt if zero
+	RenewAt float64
+	// OnError is called when a background renewal fails, it may be nil
+	OnError func(error)
+
+	// obtainMu is held while a cert is obtained for a caller that has
+	// none, so concurrent handshakes make a single request
+	obtainMu sync.Mutex
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	renewing bool
+	retryAt  time.Time
+}
+
+// NewRenewer creates a Renewer for a cert for hosts with profile
+func (c *Client) NewRenewer(hosts []string, profile string) *Renewer {
+	return &Renewer{client: c, hosts: hosts, profile: profile}
+}
+
+// Certificate returns the current cert, obtaining one if there is none or
+// it has expired and starting a renewal in the background if it is due
+func (r *Renewer) Certificate(ctx context.Context) (*tls.Certificate, error) {
+	r.mu.Lock()
+	cert := r.cert
+	now := time.Now()
+	if cert != nil && now.Before(cert.Leaf.NotAfter) {
+		if !r.renewing && !now.Before(r.renewTime()) && !now.Before(r.retryAt) {
+			r.renewing = true
+			go r.renew()
+		}
+		r.mu.Unlock()
+		return cert, nil
+	}
+	r.mu.Unlock()
+
+	r.obtainMu.Lock()
+	defer r.obtainMu.Unlock()
+	r.mu.Lock()
+	cert = r.cert
+	r.mu.Unlock()
+	if cert != nil && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+	return r.obtain(ctx)
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *Renewer) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	ctx := context.Background()
+	if hello != nil {
+		ctx = hello.Context()
+	}
+	return r.Certificate(ctx)
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate
+func (r *Renewer) GetClientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	ctx := context.Background()
+	if info != nil {
+		ctx = info.Context()
+	}
+	return r.Certificate(ctx)
+}
+
+// obtain gets a new cert and starts using it
+func (r *Renewer) obtain(ctx context.Context) (*tls.Certificate, error) {
+	cert, err := r.client.Obtain(ctx, r.hosts, r.profile, r.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.cert = cert
+	r.mu.Unlock()
+	return cert, nil
+}
+
+// renew replaces the cert in the background
+func (r *Renewer) renew() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	_, err := r.obtain(ctx)
+
+	r.mu.Lock()
+	r.renewing = false
+	if err != nil {
+		r.retryAt = time.Now().Add(renewerRetry)
+	}
+	r.mu.Unlock()
+
+	if err != nil && r.OnError != nil {
+		r.OnError(err)
+	}
+}
+
+// renewTime returns when the current cert is due for renewal, r.mu must
+// be held
+func (r *Renewer) renewTime() time.Time {
+	renewAt := r.RenewAt
+	if renewAt <= 0 || renewAt >= 1 {
+		renewAt = certd.DefaultRenewAt
+	}
+	leaf := r.cert.Leaf
+	return leaf.NotBefore.Add(time.Duration(float64(leaf.NotAfter.Sub(leaf.NotBefore)) * renewAt))
+}
+
+// ServerTLSConfig returns a tls.Config for a server with a cert for hosts
+// that is renewed automatically. Client certs are verified against the
+// server's CA if ClientAuth is set on the returned config.
+func (c *Client) ServerTLSConfig(ctx context.Context, hosts []string, profile string) (*tls.Config, *Renewer, error) {
+	pool, err := c.CertPool(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := c.NewRenewer(hosts, profile)
+	if _, err := r.Certificate(ctx); err != nil {
+		return nil, nil, err
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+		ClientCAs:      pool,
+	}, r, nil
+}
+
+// ClientTLSConfig returns a tls.Config for a client that trusts the
+// server's CA. If hosts is not empty the config presents a client cert for
+// them that is renewed automatically.
+func (c *Client) ClientTLSConfig(ctx context.Context, hosts []string, profile string) (*tls.Config, *Renewer, error) {
+	pool, err := c.CertPool(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    pool,
+	}
+	if len(hosts) == 0 {
+		return config, nil, nil
+	}
+	r := c.NewRenewer(hosts, profile)
+	if _, err := r.Certificate(ctx); err != nil {
+		return nil, nil, err
+	}
+	config.GetClientCertificate = r.GetClientCertificate
+	return config, r, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"os/signal"
+	"syscall"
+
+	"certd"
+)
+
+// runAgent keeps the certs in the agent config renewed, using the server
+// in remote if there is one or else the CA in config
+func runAgent(agentConfig, config, ledger string, remote *remoteOptions, once bool) error {
+	ac, err := certd.LoadAgentConfig(agentConfig)
+	if err != nil {
+		return err
+	}
+
+	var issuer certd.Issuer
+	if remote.server != "" {
+		c, err := remote.connect()
+		if err != nil {
+			return err
+		}
+		issuer = c.Issuer()
+	} else {
+		c, err := certd.LoadCA(config)
+		if err != nil {
+			return err
+		}
+		if c.Sealed() {
+			if err := unsealLocal(c); err != nil {
+				return err
+			}
+		}
+		if ledger != "" {
+			if c.Ledger, err = certd.OpenLedger(ledger); err != nil {
+				return err
+			}
+			defer c.Ledger.Close()
+		}
+		issuer = &certd.CAIssuer{CA: c}
+	}
+
+	agent := certd.NewAgent(ac, issuer)
+	if once {
+		return agent.RunOnce()
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	agent.Run(ctx)
+	return nil
+}
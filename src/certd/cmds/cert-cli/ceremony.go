@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"certd"
+)
+
+// ceremonyOptions are the flags of the offline root commands
+type ceremonyOptions struct {
+	config         string
+	transcript     string
+	operator       string
+	caLifetime     time.Duration
+	commonName     string
+	lifetime       time.Duration
+	pathLen        int
+	crlValidity    time.Duration
+	revoke         string
+	reason         string
+	out            string
+	caFile         string
+	caPassphraseFD int
+	outputJSON     bool
+}
+
+// runCeremony runs one of the commands for an offline root: root-init,
+// root-sign and root-crl on the offline machine, intermediate-csr and
+// import for the CA of a certd, and transcript to review a transcript
+func runCeremony(command string, args []string, opts *ceremonyOptions) error {
+	switch command {
+	case "transcript":
+		return printTranscript(args, opts)
+	case "intermediate-csr":
+		return runIntermediateCSR(opts)
+	case "import":
+		return runImport(args, opts)
+	}
+
+	if opts.config == "" || opts.transcript == "" {
+		return fmt.Errorf("%v needs -config and -transcript", command)
+	}
+	if command == "root-init" {
+		return runRootInit(opts)
+	}
+
+	root, err := certd.LoadCA(opts.config)
+	if err != nil {
+		return err
+	}
+	if root.EncryptedKey == nil {
+		return fmt.Errorf("the key in \"%v\" is not encrypted, it is not an offline root", opts.config)
+	}
+	if root.Sealed() {
+		if err := unsealLocal(root); err != nil {
+			return err
+		}
+	}
+	cer, err := certd.NewCeremony(root, opts.transcript, opts.operator)
+	if err != nil {
+		return err
+	}
+	defer cer.Close()
+
+	switch command {
+	case "root-sign":
+		return runRootSign(cer, args, opts)
+	case "root-crl":
+		return runRootCRL(cer, opts)
+	}
+	return fmt.Errorf("unknown command \"%v\"", command)
+}
+
+// runRootInit creates an offline root with its key encrypted and starts its
+// transcript
+func runRootInit(opts *ceremonyOptions) error {
+	if _, err := os.Stat(opts.config); err == nil {
+		return fmt.Errorf("\"%v\" already exists", opts.config)
+	}
+	if opts.operator == "" {
+		return fmt.Errorf("root-init needs -operator")
+	}
+	passphrase, err := setupPassphrase(opts.caPassphraseFD)
+	if err != nil {
+		return err
+	}
+	if passphrase == "" {
+		return fmt.Errorf("an offline root must be encrypted with a passphrase")
+	}
+	lifetime := opts.caLifetime
+	if lifetime <= 0 {
+		lifetime = certd.DefaultOfflineRootLifetime
+	}
+	commonName := opts.commonName
+	if commonName == "" {
+		commonName = certd.DefaultOfflineRootCommonName
+	}
+	root := &certd.CA{Lifetime: lifetime, CommonName: commonName}
+	if err := root.Setup(opts.config, passphrase); err != nil {
+		return err
+	}
+	cer, err := certd.NewCeremony(root, opts.transcript, opts.operator)
+	if err != nil {
+		return err
+	}
+	defer cer.Close()
+	if err := cer.RecordRoot(); err != nil {
+		return err
+	}
+
+	crt, err := root.Cert()
+	if err != nil {
+		return err
+	}
+	if opts.out != "" {
+		if err := ioutil.WriteFile(opts.out, root.CertBytes, 0644); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("offline root %v written to \"%v\", expires %v\n", certd.Fingerprint(crt), opts.config, crt.NotAfter)
+	return nil
+}
+
+// runRootSign signs the intermediate CSR in args and writes it followed by
+// the root to -out
+func runRootSign(cer *certd.Ceremony, args []string, opts *ceremonyOptions) error {
+	if len(args) != 1 || opts.out == "" {
+		return fmt.Errorf("root-sign needs -out and a CSR file")
+	}
+	csr, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	cert, err := cer.SignIntermediate(csr, opts.lifetime, opts.pathLen)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(opts.out, append(cert.CertBytes, cer.CA.CertBytes...), 0644); err != nil {
+		return err
+	}
+	crt, err := cert.X509()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("intermediate %x for \"%v\" written to \"%v\", expires %v\n", crt.SerialNumber, crt.Subject, opts.out, crt.NotAfter)
+	return nil
+}
+
+// runRootCRL records the revocation given with -revoke, if any, and writes
+// a CRL of the root to -out
+func runRootCRL(cer *certd.Ceremony, opts *ceremonyOptions) error {
+	if opts.out == "" {
+		return fmt.Errorf("root-crl needs -out")
+	}
+	if opts.revoke != "" {
+		if err := cer.Revoke(opts.revoke, opts.reason); err != nil {
+			return err
+		}
+		fmt.Printf("intermediate %v revoked\n", opts.revoke)
+	}
+	crl, err := cer.SignCRL(opts.crlValidity)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(opts.out, crl, 0644); err != nil {
+		return err
+	}
+	parsed, err := x509.ParseRevocationList(crl)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("CRL with %v revoked intermediates written to \"%v\", next update %v\n", len(parsed.RevokedCertificateEntries), opts.out, parsed.NextUpdate)
+	return nil
+}
+
+// runIntermediateCSR writes a CSR for the key of the CA in -config to -out
+// for the offline root to sign
+func runIntermediateCSR(opts *ceremonyOptions) error {
+	if opts.config == "" || opts.out == "" {
+		return fmt.Errorf("intermediate-csr needs -config and -out")
+	}
+	c, err := certd.LoadCA(opts.config)
+	if err != nil {
+		return err
+	}
+	if c.Sealed() {
+		if err := unsealLocal(c); err != nil {
+			return err
+		}
+	}
+	csr, err := c.IntermediateCSR(opts.commonName)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(opts.out, csr, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("CSR for the CA in \"%v\" written to \"%v\"\n", opts.config, opts.out)
+	return nil
+}
+
+// runImport makes the CA in -config an intermediate with the cert and chain
+// signed by the offline root
+func runImport(args []string, opts *ceremonyOptions) error {
+	if opts.config == "" || len(args) != 1 {
+		return fmt.Errorf("import needs -config and the file written by root-sign")
+	}
+	b, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	c, err := certd.LoadCA(opts.config)
+	if err != nil {
+		return err
+	}
+	if err := c.ImportCert(b); err != nil {
+		return err
+	}
+	if err := c.Update(opts.config); err != nil {
+		return err
+	}
+	crt, err := c.Cert()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("intermediate %v imported into \"%v\", reload certd and distribute the new trust bundle\n", certd.Fingerprint(crt), opts.config)
+	return nil
+}
+
+// printTranscript verifies the transcript in args against the root in
+// -ca-file and prints its entries
+func printTranscript(args []string, opts *ceremonyOptions) error {
+	if opts.caFile == "" || len(args) != 1 {
+		return fmt.Errorf("transcript needs -ca-file with the root and a transcript file")
+	}
+	pemBytes, err := ioutil.ReadFile(opts.caFile)
+	if err != nil {
+		return err
+	}
+	roots, err := certd.ParseCertsPEM(pemBytes)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	entries, err := certd.ReadLedger(bytes.NewReader(b), roots...)
+	if err != nil {
+		return fmt.Errorf("transcript verification failed: %v", err)
+	}
+
+	if opts.outputJSON {
+		out, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+	for _, e := range entries {
+		fmt.Printf("%v %v %-17v by %v", e.Seq, e.Time.Format(time.RFC3339), e.Event, e.Operator)
+		switch e.Event {
+		case certd.LedgerRootCreated, certd.LedgerSignIntermediate:
+			fmt.Printf(": %v serial %v sha256 %v", e.Subject, e.Serial, e.CertSHA256)
+		case certd.LedgerRevoke:
+			fmt.Printf(": serial %v %v", e.Serial, e.Reason)
+		case certd.LedgerSignCRL:
+			fmt.Printf(": number %v sha256 %v", e.Serial, e.CRLSHA256)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("transcript OK, %v entries verified\n", len(entries))
+	return nil
+}
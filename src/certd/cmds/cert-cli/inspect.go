@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"certd"
+)
+
+// runInspect prints a description of the objects in each file
+func runInspect(files []string, password string, outputJSON bool) error {
+	if len(files) == 0 {
+		return fmt.Errorf("usage: certd-cli inspect [-json] [-pkcs12-password pw] file...")
+	}
+	var all []*certd.ObjectInfo
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		infos, err := certd.Inspect(b, password)
+		if err != nil {
+			return fmt.Errorf("%v: %v", file, err)
+		}
+		if !outputJSON {
+			for _, info := range infos {
+				fmt.Printf("%v: %v\n", file, describe(info))
+			}
+		}
+		all = append(all, infos...)
+	}
+	if outputJSON {
+		b, err := json.MarshalIndent(all, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	}
+	return nil
+}
+
+// describe returns a human readable description of info
+func describe(info *certd.ObjectInfo) string {
+	var b strings.Builder
+	b.WriteString(strings.Replace(info.Type, "_", " ", -1))
+	if info.Source != "" {
+		fmt.Fprintf(&b, " (from %v)", info.Source)
+	}
+	b.WriteString("\n")
+
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "  %-20v %v\n", name+":", value)
+		}
+	}
+	list := func(name string, values []string) {
+		field(name, strings.Join(values, ", "))
+	}
+	when := func(name string, t *time.Time) {
+		if t != nil {
+			field(name, t.UTC().Format(time.RFC3339))
+		}
+	}
+
+	field("subject", info.Subject)
+	field("issuer", info.Issuer)
+	field("serial", info.Serial)
+	when("not before", info.NotBefore)
+	if info.NotAfter != nil {
+		field("not after", fmt.Sprintf("%v (%v)", info.NotAfter.UTC().Format(time.RFC3339), expiresIn(*info.NotAfter)))
+	}
+	list("dns names", info.DNSNames)
+	list("ip addresses", info.IPAddresses)
+	list("email addresses", info.EmailAddresses)
+	list("uris", info.URIs)
+	if info.IsCA {
+		field("ca", "true")
+		if info.MaxPathLen != nil {
+			field("max path len", fmt.Sprint(*info.MaxPathLen))
+		}
+	}
+	list("key usage", info.KeyUsage)
+	list("ext key usage", info.ExtKeyUsage)
+	field("public key", info.PublicKey)
+	field("public key sha256", info.PublicKeySHA256)
+	field("subject key id", info.SubjectKeyID)
+	field("authority key id", info.AuthorityKeyID)
+	field("signature", info.SignatureAlgorithm)
+	field("sha256 fingerprint", info.Fingerprint)
+	when("this update", info.ThisUpdate)
+	when("next update", info.NextUpdate)
+	field("number", info.Number)
+	if info.Type == certd.ObjectCRL {
+		field("revoked", fmt.Sprint(len(info.Revoked)))
+		for _, r := range info.Revoked {
+			fmt.Fprintf(&b, "    %v at %v\n", r.Serial, r.RevokedAt.UTC().Format(time.RFC3339))
+		}
+	}
+	return b.String()
+}
+
+func expiresIn(t time.Time) string {
+	d := time.Until(t)
+	if d < 0 {
+		return fmt.Sprintf("expired %v ago", roundDuration(-d))
+	}
+	return fmt.Sprintf("expires in %v", roundDuration(d))
+}
+
+func roundDuration(d time.Duration) string {
+	if d >= 48*time.Hour {
+		return fmt.Sprintf("%v days", int(d.Hours()/24))
+	}
+	return d.Round(time.Minute).String()
+}
+
+// runVerify checks the cert in file against the CA from config or the
+// bundle in caFile
+func runVerify(files []string, config, caFile, crlFile, host, usage string) error {
+	if len(files) != 1 {
+		return fmt.Errorf("usage: certd-cli verify (-config certd.conf | -ca-file bundle.pem) [-host name] [-usage server|client] [-crl file] cert.pem")
+	}
+	b, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		return err
+	}
+	certs, err := certd.ParseCertsPEM(b)
+	if err != nil {
+		return fmt.Errorf("%v: %v", files[0], err)
+	}
+
+	opts := certd.VerifyOptions{Host: host, Usage: usage}
+	switch {
+	case caFile != "":
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		if opts.Bundle, err = certd.ParseCertsPEM(b); err != nil {
+			return fmt.Errorf("%v: %v", caFile, err)
+		}
+	case config != "":
+		caCert, err := certd.LoadCACert(config)
+		if err != nil {
+			return err
+		}
+		opts.Bundle = append(opts.Bundle, caCert)
+	default:
+		return fmt.Errorf("verify needs -config or -ca-file")
+	}
+	if crlFile != "" {
+		b, err := ioutil.ReadFile(crlFile)
+		if err != nil {
+			return err
+		}
+		if opts.CRL, err = certd.ParseCRL(b); err != nil {
+			return fmt.Errorf("%v: %v", crlFile, err)
+		}
+	}
+
+	chains, err := certd.VerifyCert(certs, opts)
+	if err != nil {
+		return fmt.Errorf("%v: verification failed: %v", files[0], err)
+	}
+	fmt.Printf("%v: OK\n", files[0])
+	for i, crt := range chains[0] {
+		fmt.Printf("  %v%v (%v)\n", strings.Repeat(" ", i), crt.Subject, expiresIn(crt.NotAfter))
+	}
+	return nil
+}
+
+// runMatch checks that the key in the second file belongs to the cert in the
+// first
+func runMatch(files []string) error {
+	if len(files) != 2 {
+		return fmt.Errorf("usage: certd-cli match cert.pem key.pem")
+	}
+	b, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		return err
+	}
+	certs, err := certd.ParseCertsPEM(b)
+	if err != nil {
+		return fmt.Errorf("%v: %v", files[0], err)
+	}
+	key, err := ioutil.ReadFile(files[1])
+	if err != nil {
+		return err
+	}
+	if err := certd.CheckKeyPair(certs[0], key); err != nil {
+		return fmt.Errorf("%v: %v", files[1], err)
+	}
+	fmt.Printf("%v matches %v\n", files[1], files[0])
+	return nil
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
 	"certd"
 )
@@ -13,20 +18,195 @@ func fail(err error) {
 	os.Exit(1)
 }
 
+// setupPassphrase returns the passphrase to encrypt a new CA key with, from
+// fd, $CERTD_CA_PASSPHRASE or a prompt
+func setupPassphrase(fd int) (string, error) {
+	if fd != -1 {
+		return certd.PassphraseSource(fd, "", "")()
+	}
+	return certd.NewPassphrase(certd.CAPassphraseEnv)
+}
+
 func main() {
 	config := ""
+	hashPassword := false
+	ledger := ""
 	outputJSON := false
 	request := ""
 	setup := false
+	verifyAudit := ""
+	printFingerprint := false
+	remote := &remoteOptions{}
+	agentConfig := ""
+	once := false
+	pkcs12Password := ""
+	host := ""
+	usage := ""
+	crl := ""
+	keyFormat := ""
+	caPassphraseFD := -1
+	encryptKey := false
+	changePassphrase := false
+	keyPassphraseFile := ""
+	keyShares := 0
+	pkcs11Key := &certd.PKCS11Key{}
+	keyThreshold := 0
+	reset := false
+	rotate := &rotateOptions{}
+	caLifetime := time.Duration(0)
+	ceremony := &ceremonyOptions{}
 
 	flag.BoolVar(&outputJSON, "json", outputJSON, "output request in json")
 	flag.BoolVar(&setup, "setup", setup, "setup a CA")
 	flag.StringVar(&config, "config", config, "path to config")
+	flag.IntVar(&caPassphraseFD, "ca-passphrase-fd", caPassphraseFD, "file descriptor to read the passphrase of an encrypted CA key from, otherwise $CERTD_CA_PASSPHRASE or a prompt")
+	flag.BoolVar(&encryptKey, "encrypt-key", encryptKey, "with -setup, encrypt the CA key with a passphrase")
+	flag.IntVar(&keyShares, "key-shares", keyShares, "split the key encrypting the CA key into this many shares, with -setup or for the CA in config")
+	flag.IntVar(&keyThreshold, "key-threshold", keyThreshold, "number of the -key-shares needed to unseal the CA key")
+	flag.StringVar(&pkcs11Key.Module, "pkcs11-module", "", "with -setup, path of the PKCS#11 module holding the CA key, the PIN is read from $CERTD_PKCS11_PIN")
+	flag.UintVar(&pkcs11Key.Slot, "pkcs11-slot", 0, "with -setup, PKCS#11 slot of the token holding the CA key")
+	flag.StringVar(&pkcs11Key.Label, "pkcs11-label", "", "with -setup, label of the CA key in the PKCS#11 token")
+	flag.BoolVar(&reset, "reset", reset, "with unseal, discard the shares given to -server so far")
+	flag.DurationVar(&caLifetime, "ca-lifetime", caLifetime, "with -setup or rotate, how long the new root is valid, e.g. 87600h for 10 years, defaults to a year or with rotate the old root's lifetime")
+	flag.DurationVar(&rotate.switchAfter, "switch-after", 7*24*time.Hour, "with rotate, how long until certs are issued by the new root")
+	flag.DurationVar(&rotate.retireAfter, "retire-after", 30*24*time.Hour, "with rotate, how long after the switch the old root can be retired")
+	flag.BoolVar(&rotate.status, "status", false, "with rotate, only print the rotation in progress")
+	flag.BoolVar(&rotate.retire, "retire", false, "with rotate, retire the old root and make the new root the CA")
+	flag.BoolVar(&rotate.abort, "abort", false, "with rotate, discard the new root before the switch")
+	flag.BoolVar(&rotate.force, "force", false, "with rotate -retire, retire the old root before it is due")
+	flag.StringVar(&ceremony.transcript, "transcript", "", "with root-init, root-sign and root-crl, path of the offline root's ceremony transcript")
+	flag.StringVar(&ceremony.operator, "operator", "", "with root-init, root-sign and root-crl, who is performing the ceremony, recorded in the transcript")
+	flag.DurationVar(&ceremony.lifetime, "lifetime", 0, "with root-sign, how long the intermediate is valid, defaults to 3 years")
+	flag.StringVar(&ceremony.commonName, "common-name", "", "with root-init or intermediate-csr, the common name of the root or the intermediate, defaults to \""+certd.DefaultOfflineRootCommonName+"\" or \""+certd.DefaultIntermediateCommonName+"\"")
+	flag.IntVar(&ceremony.pathLen, "path-len", 0, "with root-sign, how many CAs may follow the intermediate in a chain")
+	flag.DurationVar(&ceremony.crlValidity, "crl-validity", certd.DefaultRootCRLValidity, "with root-crl, how long the CRL is valid, sign a new one before then")
+	flag.BoolVar(&changePassphrase, "change-passphrase", changePassphrase, "encrypt the CA key in config with a new passphrase from $CERTD_NEW_CA_PASSPHRASE or a prompt")
+	flag.BoolVar(&hashPassword, "hash-password", hashPassword, "read a password from stdin and print its hash for use in a users file")
+	flag.StringVar(&ledger, "ledger", ledger, "path to the ledger to record issued certs in")
 	flag.StringVar(&request, "request", request, "comma seperated list of IPs/hostnames")
-	flag.Parse()
+	flag.StringVar(&verifyAudit, "verify-audit", verifyAudit, "path of a ledger to verify against the CA in config")
+	flag.BoolVar(&printFingerprint, "fingerprint", printFingerprint, "print the fingerprint of the CA in config for pinning in clients")
+	flag.StringVar(&remote.server, "server", "", "URL of a running certd to use instead of a local CA, e.g. https://certd:4443")
+	flag.StringVar(&remote.user, "user", "", "user for -server, defaults to $CERTD_USER")
+	flag.StringVar(&remote.password, "password", "", "password for -server, defaults to $CERTD_PASS")
+	flag.StringVar(&remote.fingerprint, "ca-fingerprint", "", "SHA-256 fingerprint of the CA to trust for -server")
+	flag.StringVar(&remote.caFile, "ca-file", "", "PEM file with the CA to trust for -server, or the bundle for verify")
+	flag.StringVar(&remote.csr, "csr", "", "path to a PEM CSR to submit to -server")
+	flag.StringVar(&remote.profile, "profile", "", "profile to request from -server")
+	flag.BoolVar(&remote.getCA, "get-ca", false, "download the CA cert from -server")
+	flag.StringVar(&remote.revoke, "revoke", "", "serial of a cert to revoke on -server, or with root-crl of an intermediate to revoke")
+	flag.StringVar(&remote.reason, "reason", "", "reason for -revoke")
+	flag.StringVar(&remote.out, "out", "", "with -server, write the cert to <out>.crt and key to <out>.key, or with -get-ca the CA to <out>/ca.pem, or with rotate the trust bundle to <out>, or the file written by root-init, root-sign, root-crl or intermediate-csr")
+	flag.StringVar(&agentConfig, "agent-config", agentConfig, "path to the list of certs for \"certd-cli agent\" to keep renewed")
+	flag.BoolVar(&once, "once", once, "with agent, renew the certs that are due and exit")
+	flag.StringVar(&keyFormat, "key-format", keyFormat, "format of a generated key, pkcs1 or pkcs8")
+	flag.StringVar(&keyPassphraseFile, "key-passphrase-file", keyPassphraseFile, "file with a passphrase to encrypt a generated key with as PKCS#8")
+	flag.StringVar(&pkcs12Password, "pkcs12-password", pkcs12Password, "password for PKCS#12 files and encrypted keys given to inspect")
+	flag.StringVar(&host, "host", host, "hostname or IP the cert given to verify must be valid for")
+	flag.StringVar(&usage, "usage", usage, "usage the cert given to verify must allow, server or client")
+	flag.StringVar(&crl, "crl", crl, "CRL to check the cert given to verify against")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %v [agent|inspect|verify|match|unseal|seal|seal-status|rotate|root-init|root-sign|root-crl|intermediate-csr|import|transcript] [flags] [files]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	// an optional command comes first, its flags and files follow it
+	args := os.Args[1:]
+	command := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	flag.CommandLine.Parse(args)
 
 	c := &certd.CA{}
 	var err error
+	certd.SetCAPassphrase(certd.PassphraseSource(caPassphraseFD, certd.CAPassphraseEnv, "CA passphrase: "))
+
+	passphrase := ""
+	if keyPassphraseFile != "" {
+		b, err := ioutil.ReadFile(keyPassphraseFile)
+		if err != nil {
+			fail(err)
+		}
+		passphrase = strings.TrimRight(string(b), "\r\n")
+	}
+	if err := certd.CheckKeyFormat(keyFormat, passphrase); err != nil {
+		fail(err)
+	}
+
+	if hashPassword {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			fail(err)
+		}
+		hash, err := certd.HashPassword(strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(hash)
+		return
+	}
+
+	switch command {
+	case "":
+	case "inspect":
+		if err := runInspect(flag.Args(), pkcs12Password, outputJSON); err != nil {
+			fail(err)
+		}
+		return
+	case "verify":
+		if err := runVerify(flag.Args(), config, remote.caFile, crl, host, usage); err != nil {
+			fail(err)
+		}
+		return
+	case "match":
+		if err := runMatch(flag.Args()); err != nil {
+			fail(err)
+		}
+		return
+	case "unseal", "seal", "seal-status":
+		if err := runSeal(command, remote, reset, outputJSON); err != nil {
+			fail(err)
+		}
+		return
+	case "rotate":
+		rotate.lifetime = caLifetime
+		if err := runRotate(config, rotate, remote.out, outputJSON); err != nil {
+			fail(err)
+		}
+		return
+	case "root-init", "root-sign", "root-crl", "intermediate-csr", "import", "transcript":
+		ceremony.config, ceremony.caLifetime, ceremony.caPassphraseFD = config, caLifetime, caPassphraseFD
+		ceremony.revoke, ceremony.reason = remote.revoke, remote.reason
+		ceremony.out, ceremony.caFile, ceremony.outputJSON = remote.out, remote.caFile, outputJSON
+		if err := runCeremony(command, flag.Args(), ceremony); err != nil {
+			fail(err)
+		}
+		return
+	case "agent":
+		if agentConfig == "" {
+			fail(fmt.Errorf("agent needs -agent-config"))
+		}
+		if remote.server == "" && config == "" {
+			fail(fmt.Errorf("agent needs -server or -config"))
+		}
+		if err := runAgent(agentConfig, config, ledger, remote, once); err != nil {
+			fail(err)
+		}
+		return
+	default:
+		fail(fmt.Errorf("unknown command \"%v\"", command))
+	}
+
+	if remote.server != "" {
+		remote.request = request
+		remote.outputJSON = outputJSON
+		remote.keyFormat, remote.passphrase = keyFormat, passphrase
+		if err := runRemote(remote); err != nil {
+			fail(err)
+		}
+		return
+	}
 
 	if config == "" {
 		fmt.Println("error: no config specified\nusage:")
@@ -34,8 +214,45 @@ func main() {
 		os.Exit(1)
 	}
 
-	if setup {
-		if c, err = certd.SetupCA(config); err != nil {
+	// the fingerprint only needs the cert, the key is not decrypted
+	if printFingerprint && !setup {
+		caCert, err := certd.LoadCACert(config)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(certd.Fingerprint(caCert))
+		return
+	}
+
+	if keyShares > 0 && encryptKey {
+		fail(fmt.Errorf("-key-shares and -encrypt-key can not be used together"))
+	}
+	if pkcs11Key.Module != "" && (keyShares > 0 || encryptKey) {
+		fail(fmt.Errorf("a CA key in a PKCS#11 token can not be encrypted or split"))
+	}
+	if setup && pkcs11Key.Module != "" {
+		c = &certd.CA{PKCS11: pkcs11Key, Lifetime: caLifetime}
+		if err = c.Setup(config, ""); err != nil {
+			fail(err)
+		}
+		fmt.Printf("config successfully written to \"%v\"\n", config)
+	} else if setup && keyShares > 0 {
+		var shares []string
+		c = &certd.CA{Lifetime: caLifetime}
+		if shares, err = c.SetupShares(config, keyShares, keyThreshold); err != nil {
+			fail(err)
+		}
+		fmt.Printf("config successfully written to \"%v\"\n", config)
+		printShares(config, shares, keyThreshold)
+	} else if setup {
+		passphrase := ""
+		if encryptKey {
+			if passphrase, err = setupPassphrase(caPassphraseFD); err != nil {
+				fail(err)
+			}
+		}
+		c = &certd.CA{Lifetime: caLifetime}
+		if err = c.Setup(config, passphrase); err != nil {
 			fail(err)
 		}
 		fmt.Printf("config successfully written to \"%v\"\n", config)
@@ -43,6 +260,68 @@ func main() {
 		if c, err = certd.LoadCA(config); err != nil {
 			fail(err)
 		}
+		if c.Sealed() && (request != "" || changePassphrase || keyShares > 0) {
+			if err := unsealLocal(c); err != nil {
+				fail(err)
+			}
+		}
+	}
+
+	if printFingerprint {
+		caCert, err := c.Cert()
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(certd.Fingerprint(caCert))
+		return
+	}
+
+	if keyShares > 0 && !setup {
+		shares, err := c.SaveShares(config, keyShares, keyThreshold)
+		if err != nil {
+			fail(err)
+		}
+		printShares(config, shares, keyThreshold)
+		return
+	}
+
+	if changePassphrase {
+		passphrase, err := certd.NewPassphrase(certd.NewCAPassphraseEnv)
+		if err != nil {
+			fail(err)
+		}
+		if err := c.Save(config, passphrase); err != nil {
+			fail(err)
+		}
+		fmt.Printf("CA key in \"%v\" encrypted with the new passphrase\n", config)
+		return
+	}
+
+	if verifyAudit != "" {
+		roots, err := c.RootCerts()
+		if err != nil {
+			fail(err)
+		}
+		f, err := os.Open(verifyAudit)
+		if err != nil {
+			fail(err)
+		}
+		defer f.Close()
+
+		n, err := certd.VerifyLedger(f, roots...)
+		if err != nil {
+			fmt.Printf("ledger verification failed after %v valid entries: %v\n", n, err)
+			os.Exit(1)
+		}
+		fmt.Printf("ledger OK, %v entries verified\n", n)
+		return
+	}
+
+	if ledger != "" {
+		if c.Ledger, err = certd.OpenLedger(ledger); err != nil {
+			fail(err)
+		}
+		defer c.Ledger.Close()
 	}
 
 	if request != "" {
@@ -55,6 +334,9 @@ func main() {
 		if err != nil {
 			fail(err)
 		}
+		if cert.KeyBytes, err = certd.FormatKey(cert.KeyBytes, keyFormat, passphrase); err != nil {
+			fail(err)
+		}
 		if outputJSON {
 			if j, err := cert.JSON(); err == nil {
 				fmt.Println(j)
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"certd"
+	"certd/client"
+)
+
+// readCSR reads a PEM encoded CSR from path and checks its signature
+func readCSR(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return "", fmt.Errorf("%v: no PEM certificate request found", path)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", path, err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return "", fmt.Errorf("%v: %v", path, err)
+	}
+	return string(b), nil
+}
+
+// writeOutput writes b to path with perm, replacing any existing file
+// atomically. The mode is set explicitly so the umask can not widen it.
+func writeOutput(path string, b []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// writeCert writes the cert to out.crt and, if there is one, the key to
+// out.key which only the owner can read
+func writeCert(out, cert, key string) error {
+	if key != "" {
+		if err := writeOutput(out+".key", []byte(key), 0600); err != nil {
+			return err
+		}
+		fmt.Printf("private key written to \"%v.key\"\n", out)
+	}
+	if err := writeOutput(out+".crt", []byte(cert), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("cert written to \"%v.crt\"\n", out)
+	return nil
+}
+
+// remoteOptions are the command line options for remote mode
+type remoteOptions struct {
+	server      string
+	user        string
+	password    string
+	fingerprint string
+	caFile      string
+	request     string
+	csr         string
+	profile     string
+	keyFormat   string
+	passphrase  string
+	getCA       bool
+	revoke      string
+	reason      string
+	out         string
+	outputJSON  bool
+}
+
+// connect creates the client for the server in o. The server's cert must
+// chain to the CA with the pinned fingerprint or to the CA in the CA file.
+func (o *remoteOptions) connect() (*client.Client, error) {
+	opts := client.Options{
+		User:          o.user,
+		Password:      o.password,
+		CAFingerprint: o.fingerprint,
+	}
+	if opts.User == "" {
+		opts.User = os.Getenv("CERTD_USER")
+	}
+	if opts.Password == "" {
+		opts.Password = os.Getenv("CERTD_PASS")
+	}
+
+	switch {
+	case o.caFile != "":
+		b, err := ioutil.ReadFile(o.caFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.RootCAs = x509.NewCertPool()
+		if !opts.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certs found in %v", o.caFile)
+		}
+	case o.fingerprint == "":
+		return nil, fmt.Errorf("the CA must be trusted with -ca-fingerprint or -ca-file")
+	}
+	return client.New(o.server, opts)
+}
+
+// runRemote carries out the operations in o against a running certd
+func runRemote(o *remoteOptions) error {
+	c, err := o.connect()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	var result interface{}
+	switch {
+	case o.getCA:
+		info, err := c.CA(ctx)
+		if err != nil {
+			return err
+		}
+		if o.out != "" {
+			path := filepath.Join(o.out, "ca.pem")
+			if err := writeOutput(path, []byte(info.Cert), 0644); err != nil {
+				return err
+			}
+			fmt.Printf("CA cert written to \"%v\", fingerprint %v\n", path, info.Fingerprint)
+			return nil
+		}
+		result = info
+		if !o.outputJSON {
+			fmt.Print(info.Cert)
+			return nil
+		}
+	case o.revoke != "":
+		record, err := c.Revoke(ctx, o.revoke, o.reason)
+		if err != nil {
+			return err
+		}
+		result = record
+		if !o.outputJSON {
+			fmt.Printf("revoked %v\n", record.Serial)
+			return nil
+		}
+	case o.request != "" || o.csr != "":
+		ir := &certd.IssueRequest{Profile: o.profile}
+		if o.csr != "" {
+			if ir.CSR, err = readCSR(o.csr); err != nil {
+				return err
+			}
+		} else {
+			ir.Hosts = strings.Split(o.request, ",")
+			ir.KeyFormat, ir.Passphrase = o.keyFormat, o.passphrase
+		}
+		issued, err := c.Request(ctx, ir)
+		if err != nil {
+			return err
+		}
+		if o.out != "" {
+			return writeCert(o.out, issued.Cert, issued.PrivateKey)
+		}
+		result = issued
+		if !o.outputJSON {
+			fmt.Print(issued.Cert)
+			fmt.Print(issued.PrivateKey)
+			return nil
+		}
+	default:
+		return fmt.Errorf("nothing to do, use -request, -csr, -get-ca or -revoke")
+	}
+
+	b, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"certd"
+)
+
+// rotateOptions are the flags of the rotate command
+type rotateOptions struct {
+	lifetime    time.Duration
+	switchAfter time.Duration
+	retireAfter time.Duration
+	status      bool
+	retire      bool
+	abort       bool
+	force       bool
+}
+
+// runRotate starts, reports on, retires or aborts a rotation of the root of
+// the CA in config. A running certd picks the change up when it is reloaded.
+func runRotate(config string, opts *rotateOptions, bundleOut string, outputJSON bool) error {
+	if config == "" {
+		return fmt.Errorf("rotate needs -config")
+	}
+	c, err := certd.LoadCA(config)
+	if err != nil {
+		return err
+	}
+	c.Lifetime = opts.lifetime
+	now := time.Now()
+
+	switch {
+	case opts.status:
+	case opts.abort:
+		if err := c.AbortRotation(now); err != nil {
+			return err
+		}
+		if err := c.Update(config); err != nil {
+			return err
+		}
+		fmt.Printf("rotation aborted, the new root was discarded from \"%v\"\n", config)
+		return nil
+	case opts.retire:
+		if r := c.Rotation; r != nil && now.Before(r.RetireAt) && !opts.force {
+			return fmt.Errorf("the old root is not due to be retired until %v, use -force to retire it now", r.RetireAt)
+		}
+		old, err := c.Cert()
+		if err != nil {
+			return err
+		}
+		if err := c.Retire(now); err != nil {
+			return err
+		}
+		if err := c.Update(config); err != nil {
+			return err
+		}
+		fmt.Printf("root %v retired, reload certd and remove it from clients' trust stores\n", certd.Fingerprint(old))
+	default:
+		switchAt := now.Add(opts.switchAfter).Truncate(time.Second)
+		if err := c.StartRotation(switchAt, switchAt.Add(opts.retireAfter)); err != nil {
+			return err
+		}
+		if err := c.Update(config); err != nil {
+			return err
+		}
+		fmt.Printf("rotation started in \"%v\", reload certd and distribute the trust bundle to clients before the switch\n", config)
+	}
+
+	if bundleOut != "" {
+		if err := ioutil.WriteFile(bundleOut, c.TrustBundle(), 0644); err != nil {
+			return err
+		}
+	}
+	return printRotation(c, now, outputJSON)
+}
+
+// rotationStatus is the JSON output of the rotate command
+type rotationStatus struct {
+	Fingerprint string              `json:"fingerprint"`
+	NotAfter    time.Time           `json:"not_after"`
+	Rotation    *certd.RotationInfo `json:"rotation,omitempty"`
+}
+
+// printRotation prints the root of c and any rotation in progress
+func printRotation(c *certd.CA, now time.Time, outputJSON bool) error {
+	crt, err := c.Cert()
+	if err != nil {
+		return err
+	}
+	status := &rotationStatus{Fingerprint: certd.Fingerprint(crt), NotAfter: crt.NotAfter}
+	var next *x509.Certificate
+	if r := c.Rotation; r != nil {
+		if next, err = r.Next.Cert(); err != nil {
+			return err
+		}
+		status.Rotation = &certd.RotationInfo{
+			NextFingerprint: certd.Fingerprint(next),
+			SwitchAt:        r.SwitchAt,
+			RetireAt:        r.RetireAt,
+			Switched:        r.Switched(now),
+		}
+	}
+
+	if outputJSON {
+		b, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	fmt.Printf("root:     %v expires %v\n", status.Fingerprint, status.NotAfter)
+	if r := status.Rotation; r != nil {
+		fmt.Printf("new root: %v expires %v\n", r.NextFingerprint, next.NotAfter)
+		if r.Switched {
+			fmt.Printf("issuing from the new root since %v\n", r.SwitchAt)
+		} else {
+			fmt.Printf("issuing from the new root from %v\n", r.SwitchAt)
+		}
+		fmt.Printf("the old root can be retired from %v\n", r.RetireAt)
+	}
+	return nil
+}
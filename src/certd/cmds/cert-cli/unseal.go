@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"certd"
+)
+
+// printShares prints the shares of a CA key split with -key-shares
+func printShares(config string, shares []string, threshold int) {
+	fmt.Printf("the CA key in \"%v\" is split into %v shares, %v of them unseal it\n", config, len(shares), threshold)
+	fmt.Println("give each share to a different person, they are not stored anywhere:")
+	for i, share := range shares {
+		fmt.Printf("  share %v: %v\n", i+1, share)
+	}
+}
+
+// unsealLocal prompts for enough shares to unseal c
+func unsealLocal(c *certd.CA) error {
+	threshold := c.EncryptedKey.Threshold
+	shares := make([]string, threshold)
+	for i := range shares {
+		var err error
+		if shares[i], err = certd.PromptPassphrase(fmt.Sprintf("Unseal share %v of %v: ", i+1, threshold)); err != nil {
+			return err
+		}
+	}
+	return c.Unseal(shares)
+}
+
+// runSeal runs the unseal, seal and seal-status commands against the server
+// in remote. unseal reads a share from $CERTD_UNSEAL_SHARE or a prompt.
+func runSeal(command string, remote *remoteOptions, reset, outputJSON bool) error {
+	if remote.server == "" {
+		return fmt.Errorf("%v needs -server", command)
+	}
+	c, err := remote.connect()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	var status *certd.SealStatus
+	switch {
+	case command == "seal":
+		status, err = c.Seal(ctx)
+	case command == "seal-status":
+		status, err = c.SealStatus(ctx)
+	case reset:
+		status, err = c.ResetUnseal(ctx)
+	default:
+		var share string
+		if share, err = certd.PassphraseSource(-1, certd.UnsealShareEnv, "Unseal share: ")(); err != nil {
+			return err
+		}
+		status, err = c.Unseal(ctx, share)
+	}
+	if err != nil {
+		return err
+	}
+
+	if outputJSON {
+		b, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	if status.Sealed {
+		fmt.Printf("sealed, %v of %v shares given\n", status.Progress, status.Threshold)
+	} else {
+		fmt.Println("unsealed")
+	}
+	return nil
+}
@@ -1,43 +1,270 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"certd"
 )
 
 func main() {
+	auditLog := ""
+	caExpiryWarning := certd.DefaultCAExpiryWarning
+	caLifetime := certd.DefaultCALifetime
+	caPassphraseFD := -1
 	certAddrs := ""
 	config := ""
+	crlInterval := certd.DefaultCRLInterval
+	crlPath := ""
+	expiryWindow := certd.DefaultExpiryWindow
+	inventory := ""
+	lease := ""
+	leaseInterval := certd.DefaultLeaseInterval
+	ledger := ""
 	listen := "localhost"
+	logFormat := "json"
+	logLevel := "info"
+	metricsListen := ""
+	policy := ""
 	port := "4443"
+	serverConfig := ""
 	setup := false
+	servingCertLifetime := certd.DefaultServingCertLifetime
+	shutdownTimeout := certd.DefaultShutdownTimeout
+	store := ""
+	tenants := ""
+	tlsMinVersion := "1.2"
+	trustedProxies := ""
+	users := ""
 
 	flag.BoolVar(&setup, "setup", setup, "setup a CA")
+	flag.StringVar(&auditLog, "audit-log", auditLog, "file to append security events to, or \"syslog\"")
+	flag.DurationVar(&caExpiryWarning, "ca-expiry-warning", caExpiryWarning, "warn in the log, metrics and readiness when the CA expires within this long")
+	flag.DurationVar(&caLifetime, "ca-lifetime", caLifetime, "with -setup, how long the new CA is valid")
+	flag.IntVar(&caPassphraseFD, "ca-passphrase-fd", caPassphraseFD, "file descriptor to read the passphrase of an encrypted CA key from, otherwise $CERTD_CA_PASSPHRASE or a prompt")
 	flag.StringVar(&certAddrs, "cert-addrs", listen, "IPs and hostnames to generate certs for")
 	flag.StringVar(&config, "config", config, "path to existing config")
+	flag.DurationVar(&crlInterval, "crl-interval", crlInterval, "how often the leader regenerates the CRL")
+	flag.StringVar(&crlPath, "crl", crlPath, "path the leader writes the CRL to, every instance serves it on /crl")
+	flag.DurationVar(&expiryWindow, "expiry-window", expiryWindow, "certs expiring within this window are counted by the metrics")
+	flag.StringVar(&inventory, "inventory", inventory, "path to store the record of issued certs in, the same as -store json:<path>")
+	flag.StringVar(&lease, "lease", lease, "file to lock to elect a leader when several instances share a store")
+	flag.DurationVar(&leaseInterval, "lease-interval", leaseInterval, "how often a standby tries to take the lease")
+	flag.StringVar(&ledger, "ledger", ledger, "path to the tamper-evident ledger of issued and revoked certs")
 	flag.StringVar(&listen, "listen", listen, "address to listen on")
+	flag.StringVar(&logFormat, "log-format", logFormat, "log format, json or text")
+	flag.StringVar(&logLevel, "log-level", logLevel, "log level, debug, info, warn or error")
+	flag.StringVar(&metricsListen, "metrics-listen", metricsListen, "address to serve metrics on without authentication, e.g. :9100")
+	flag.StringVar(&policy, "policy", policy, "path to a JSON file with the policy and profiles")
 	flag.StringVar(&port, "port", port, "port to listen on")
+	flag.StringVar(&serverConfig, "server-config", serverConfig, "path to a TOML server config file, flags override its values")
+	flag.DurationVar(&servingCertLifetime, "serving-cert-lifetime", servingCertLifetime, "lifetime of the server's own cert, it is renewed before it expires")
+	flag.StringVar(&store, "store", store, "where to store the record of issued certs, json:certs.json, dir:/path/to/dir or kv:certd.db")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "how long to wait for requests to finish on shutdown")
+	flag.StringVar(&tenants, "tenants", tenants, "path to a JSON file with more CAs to host, each routed by /ca/{name}/ or its hosts")
+	flag.StringVar(&tlsMinVersion, "tls-min-version", tlsMinVersion, "minimum TLS version accepted, 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&trustedProxies, "trusted-proxies", trustedProxies, "CIDRs of reverse proxies whose Forwarded and X-Forwarded-For headers are believed")
+	flag.StringVar(&users, "users", users, "path to a JSON file with the users that can authenticate")
 	flag.Parse()
 
+	// flags given on the command line override the server config, on reload
+	// as well
+	cmdline := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { cmdline[f.Name] = true })
+	configFlag := func(cfg *certd.ServerConfig, name string) string {
+		f := flag.Lookup(name)
+		if cmdline[name] {
+			return f.Value.String()
+		}
+		if v, ok := cfg.Flags[name]; ok {
+			return v
+		}
+		return f.DefValue
+	}
+
+	var cfg *certd.ServerConfig
+	if serverConfig != "" {
+		var err error
+		if cfg, err = certd.LoadServerConfig(serverConfig); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := cfg.ApplyFlags(flag.CommandLine); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	minVersion, err := certd.ParseTLSVersion(tlsMinVersion)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	proxies, err := certd.ParseCIDRs(trustedProxies)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	logger, err := certd.NewLogger(os.Stderr, logFormat, logLevel)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	certd.SetLogger(logger)
+	certd.SetCAPassphrase(certd.PassphraseSource(caPassphraseFD, certd.CAPassphraseEnv, "CA passphrase: "))
+
 	if _, err := os.Stat(config); os.IsNotExist(err) && setup {
-		if _, err = certd.SetupCA(config); err != nil {
+		c := &certd.CA{Lifetime: caLifetime}
+		if err = c.Setup(config, ""); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
 	}
 
-	c, err := certd.LoadCA(config)
+	// the policy, profiles and subordinates in the server config are used
+	// unless -policy is given, on SIGHUP the server config is read again for
+	// them, the users file, the cert addresses and the static credentials
+	loadSettings := func(sc *certd.ServerConfig, usersPath, addrs string) (*certd.Settings, error) {
+		st, err := certd.LoadSettings(config, usersPath, policy, addrs)
+		if err != nil || sc == nil {
+			return st, err
+		}
+		if policy == "" {
+			sc.Apply(st)
+		}
+		return st, st.Validate()
+	}
+
+	settings, err := loadSettings(cfg, users, certAddrs)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	s := certd.NewServer(c, listen, port, certAddrs)
+	if ledger != "" {
+		if settings.CA.Ledger, err = certd.OpenLedger(ledger); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer settings.CA.Ledger.Close()
+	}
+
+	s := certd.NewServer(settings.CA, listen, port, certAddrs)
+	s.ServingCertLifetime = servingCertLifetime
+	s.ShutdownTimeout = shutdownTimeout
+	s.MetricsAddr = metricsListen
+	s.ExpiryWindow = expiryWindow
+	s.CAExpiryWarning = caExpiryWarning
+	s.ConfigPath = config
+	s.TLSMinVersion = minVersion
+	s.CRLPath = crlPath
+	s.CRLInterval = crlInterval
+	s.LeaseInterval = leaseInterval
+	s.TrustedProxies = proxies
+	if lease != "" {
+		s.Lease = certd.NewFileLease(lease)
+	}
+	if cfg != nil && cfg.User != "" {
+		s.SetCredentials(cfg.User, cfg.Password)
+	}
+
+	if auditLog != "" {
+		if s.Audit, err = certd.OpenAuditLog(auditLog); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer s.Audit.Close()
+	}
+	if err := s.Reload(settings); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if crt, err := settings.CA.Cert(); err == nil {
+		logger.Info("CA loaded, pin this fingerprint in clients", "fingerprint", certd.Fingerprint(crt))
+	}
+	if settings.CA.Sealed() {
+		logger.Warn("the CA key is sealed, no certs will be issued until enough shares are given to /sys/unseal",
+			"threshold", settings.CA.EncryptedKey.Threshold)
+	}
+
+	if store == "" && inventory != "" {
+		store = "json:" + inventory
+	}
+	if store != "" {
+		if s.Inventory, err = certd.OpenStore(store); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer s.Inventory.Close()
+	}
+
+	if tenants != "" {
+		list, err := certd.LoadTenants(tenants)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		for _, tc := range list {
+			if _, err := s.OpenTenant(tc); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		defer s.CloseTenants()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logger.Info("SIGHUP received, reloading settings")
+			// the new values are only used once the settings are accepted
+			newCfg, newUsers, newCertAddrs := cfg, users, certAddrs
+			if serverConfig != "" {
+				var err error
+				if newCfg, err = certd.LoadServerConfig(serverConfig); err != nil {
+					logger.Error("reload failed, continuing with the current settings", "error", err)
+					continue
+				}
+				if v := configFlag(newCfg, "config"); v != config {
+					logger.Warn("storage.ca_config changed, restart certd to use it", "ca_config", v)
+				}
+				newUsers = configFlag(newCfg, "users")
+				newCertAddrs = configFlag(newCfg, "cert-addrs")
+			}
+			settings, err := loadSettings(newCfg, newUsers, newCertAddrs)
+			if err == nil {
+				err = s.Reload(settings)
+			}
+			if err != nil {
+				logger.Error("reload failed, continuing with the current settings", "error", err)
+				continue
+			}
+			cfg, users, certAddrs = newCfg, newUsers, newCertAddrs
+			if cfg != nil {
+				// removing auth.user goes back to the default credentials
+				if cfg.User != "" {
+					s.SetCredentials(cfg.User, cfg.Password)
+				} else {
+					s.SetCredentials(certd.DefaultCredentials())
+				}
+			}
+			if err := s.ReloadTenants(); err != nil {
+				logger.Error("tenant reload failed, continuing with their current settings", "error", err)
+			}
+		}
+	}()
 
-	if err := s.Run(); err != nil {
+	if err := s.RunContext(ctx); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
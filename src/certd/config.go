@@ -0,0 +1,518 @@
+package certd
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configOption maps a key in the server config file to the command line flag
+// it sets
+type configOption struct {
+	flag string
+	// list options also accept an array which is joined with ","
+	list  bool
+	check func(string) error
+}
+
+var configOptions = map[string]configOption{
+	"server.listen":             {flag: "listen"},
+	"server.port":               {flag: "port", check: checkPort},
+	"server.cert_addrs":         {flag: "cert-addrs", list: true},
+	"server.metrics_listen":     {flag: "metrics-listen"},
+	"server.shutdown_timeout":   {flag: "shutdown-timeout", check: checkDuration},
+	"server.expiry_window":      {flag: "expiry-window", check: checkDuration},
+	"server.trusted_proxies":    {flag: "trusted-proxies", list: true, check: checkCIDRs},
+	"server.tenants":            {flag: "tenants"},
+	"ha.lease":                  {flag: "lease"},
+	"ha.lease_interval":         {flag: "lease-interval", check: checkDuration},
+	"crl.path":                  {flag: "crl"},
+	"crl.interval":              {flag: "crl-interval", check: checkDuration},
+	"tls.min_version":           {flag: "tls-min-version", check: checkTLSVersion},
+	"tls.serving_cert_lifetime": {flag: "serving-cert-lifetime", check: checkDuration},
+	"auth.users_file":           {flag: "users"},
+	"storage.ca_config":         {flag: "config"},
+	"ca.lifetime":               {flag: "ca-lifetime", check: checkDuration},
+	"ca.expiry_warning":         {flag: "ca-expiry-warning", check: checkDuration},
+	"storage.inventory":         {flag: "inventory"},
+	"storage.store":             {flag: "store"},
+	"storage.ledger":            {flag: "ledger"},
+	"logging.level":             {flag: "log-level", check: checkLogLevel},
+	"logging.format":            {flag: "log-format", check: checkLogFormat},
+	"logging.audit_log":         {flag: "audit-log"},
+}
+
+// auth backends
+const (
+	AuthStatic    = "static"
+	AuthUsersFile = "users_file"
+)
+
+// ServerConfig is the server's configuration file. Options that have a
+// command line flag are kept in Flags and set with ApplyFlags, the rest
+// have no flag equivalent.
+type ServerConfig struct {
+	Path string
+	// Flags holds the flag values from the file keyed by flag name
+	Flags map[string]string
+	// User and Password are the credentials for the static auth backend
+	User         string
+	Password     string
+	Policy       *Policy
+	Profiles     map[string]*Profile
+	Subordinates map[string]*Subordinate
+}
+
+// ConfigError holds every problem found in a config file
+type ConfigError struct {
+	Path   string
+	Errors []*PosError
+}
+
+func (e *ConfigError) Error() string {
+	lines := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		if err.Pos.Line == 0 {
+			lines[i] = fmt.Sprintf("%v: %v", e.Path, err.Msg)
+		} else {
+			lines[i] = fmt.Sprintf("%v:%v", e.Path, err)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// LoadServerConfig loads and validates the config file at path. All the
+// problems found are returned together in a *ConfigError.
+func LoadServerConfig(path string) (*ServerConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseServerConfig(path, string(b))
+}
+
+// ParseServerConfig parses and validates a config file, path is only used
+// in errors. "${VAR}" in strings is replaced with the environment variable
+// VAR, "${VAR:-default}" gives a value to use when it is unset and "$$" is
+// a literal "$".
+func ParseServerConfig(path, src string) (*ServerConfig, error) {
+	values, errs := parseTOML(src)
+	c := &ServerConfig{
+		Path:  path,
+		Flags: make(map[string]string),
+	}
+	d := &configDecoder{values: values, errs: errs}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var backend *tomlValue
+	for _, key := range keys {
+		v := values[key]
+		if opt, ok := configOptions[key]; ok {
+			if s, ok := d.flagValue(key, v, opt); ok {
+				c.Flags[opt.flag] = s
+			}
+			continue
+		}
+
+		switch {
+		case key == "auth.backend":
+			if s, ok := d.string(key, v); ok {
+				if s != AuthStatic && s != AuthUsersFile {
+					d.errorf(v.pos, "%v must be \"%v\" or \"%v\"", key, AuthStatic, AuthUsersFile)
+				}
+				backend = &tomlValue{pos: v.pos, value: s}
+			}
+		case key == "auth.user":
+			c.User, _ = d.string(key, v)
+		case key == "auth.password":
+			c.Password, _ = d.string(key, v)
+		case strings.HasPrefix(key, "policy."):
+			if c.Policy == nil {
+				c.Policy = &Policy{}
+			}
+			d.policy(c.Policy, key, v)
+		case strings.HasPrefix(key, "profiles."):
+			if c.Profiles == nil {
+				c.Profiles = make(map[string]*Profile)
+			}
+			d.profile(c.Profiles, key, v)
+		case strings.HasPrefix(key, "subordinates."):
+			if c.Subordinates == nil {
+				c.Subordinates = make(map[string]*Subordinate)
+			}
+			d.subordinate(c.Subordinates, key, v)
+		default:
+			d.errorf(v.keyPos, "unknown key %q", key)
+		}
+	}
+
+	d.checkAuth(c, backend)
+	if c.Policy != nil {
+		if err := c.Policy.Validate(); err != nil {
+			d.errorf(values[firstKey(keys, "policy.")].pos, "invalid policy: %v", err)
+		}
+	}
+	if c.Profiles != nil {
+		if _, ok := c.Profiles[DefaultProfile]; !ok {
+			d.errorf(values[firstKey(keys, "profiles.")].pos, "no \"%v\" profile configured", DefaultProfile)
+		}
+	}
+
+	if len(d.errs) > 0 {
+		sort.SliceStable(d.errs, func(i, j int) bool {
+			a, b := d.errs[i].Pos, d.errs[j].Pos
+			return a.Line < b.Line || a.Line == b.Line && a.Col < b.Col
+		})
+		return nil, &ConfigError{path, d.errs}
+	}
+	return c, nil
+}
+
+func firstKey(keys []string, prefix string) string {
+	for _, k := range keys {
+		if strings.HasPrefix(k, prefix) {
+			return k
+		}
+	}
+	return ""
+}
+
+// ApplyFlags sets the flags in fs from the config file, flags that were
+// given on the command line are left alone so they override the file
+func (c *ServerConfig) ApplyFlags(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for name, value := range c.Flags {
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%v: %v: %v", c.Path, name, err)
+		}
+	}
+	return nil
+}
+
+// Apply replaces the policy, profiles and subordinates in st with those
+// from the config file, if it has any
+func (c *ServerConfig) Apply(st *Settings) {
+	if c.Policy != nil {
+		st.Policy = c.Policy
+	}
+	if c.Profiles != nil {
+		st.Profiles = c.Profiles
+	}
+	if c.Subordinates != nil {
+		st.Subordinates = c.Subordinates
+	}
+}
+
+type configDecoder struct {
+	values map[string]*tomlValue
+	errs   []*PosError
+}
+
+func (d *configDecoder) errorf(pos Pos, format string, args ...interface{}) {
+	d.errs = append(d.errs, &PosError{pos, fmt.Sprintf(format, args...)})
+}
+
+// string returns v as a string with environment variables expanded
+func (d *configDecoder) string(key string, v *tomlValue) (string, bool) {
+	s, ok := v.value.(string)
+	if !ok {
+		d.errorf(v.pos, "%v must be a string", key)
+		return "", false
+	}
+	s, err := expandEnv(s)
+	if err != nil {
+		d.errorf(v.pos, "%v: %v", key, err)
+		return "", false
+	}
+	return s, true
+}
+
+func (d *configDecoder) strings(key string, v *tomlValue) ([]string, bool) {
+	list, ok := v.value.([]*tomlValue)
+	if !ok {
+		d.errorf(v.pos, "%v must be an array of strings", key)
+		return nil, false
+	}
+	values := make([]string, 0, len(list))
+	for _, item := range list {
+		s, ok := d.string(key, item)
+		if !ok {
+			return nil, false
+		}
+		values = append(values, s)
+	}
+	return values, true
+}
+
+func (d *configDecoder) flagValue(key string, v *tomlValue, opt configOption) (string, bool) {
+	var s string
+	switch value := v.value.(type) {
+	case []*tomlValue:
+		if !opt.list {
+			d.errorf(v.pos, "%v must be a string", key)
+			return "", false
+		}
+		list, ok := d.strings(key, v)
+		if !ok {
+			return "", false
+		}
+		s = strings.Join(list, ",")
+	case int64:
+		s = strconv.FormatInt(value, 10)
+	default:
+		var ok bool
+		if s, ok = d.string(key, v); !ok {
+			return "", false
+		}
+	}
+
+	if opt.check != nil {
+		if err := opt.check(s); err != nil {
+			d.errorf(v.pos, "%v: %v", key, err)
+			return "", false
+		}
+	}
+	return s, true
+}
+
+func (d *configDecoder) policy(p *Policy, key string, v *tomlValue) {
+	switch key {
+	case "policy.allowed_domains":
+		p.AllowedDomains, _ = d.strings(key, v)
+	case "policy.allowed_networks":
+		p.AllowedNetworks, _ = d.strings(key, v)
+	case "policy.max_hosts":
+		n, ok := v.value.(int64)
+		if !ok || n < 0 {
+			d.errorf(v.pos, "%v must be a positive integer", key)
+			return
+		}
+		p.MaxHosts = int(n)
+	default:
+		d.errorf(v.keyPos, "unknown key %q", key)
+	}
+}
+
+func (d *configDecoder) profile(profiles map[string]*Profile, key string, v *tomlValue) {
+	parts := strings.Split(key, ".")
+	if len(parts) != 3 {
+		d.errorf(v.keyPos, "unknown key %q, profiles are configured in [profiles.<name>] tables", key)
+		return
+	}
+	p := profiles[parts[1]]
+	if p == nil {
+		p = &Profile{}
+		profiles[parts[1]] = p
+	}
+
+	switch parts[2] {
+	case "lifetime":
+		s, ok := d.string(key, v)
+		if !ok {
+			return
+		}
+		lifetime, err := time.ParseDuration(s)
+		if err != nil || lifetime < 0 {
+			d.errorf(v.pos, "%v: invalid duration %q", key, s)
+			return
+		}
+		p.Lifetime = Duration(lifetime)
+	case "usages":
+		p.Usages, _ = d.strings(key, v)
+		if _, err := p.ExtKeyUsage(); err != nil {
+			d.errorf(v.pos, "%v: %v", key, err)
+		}
+	default:
+		d.errorf(v.keyPos, "unknown key %q", key)
+	}
+}
+
+func (d *configDecoder) subordinate(subordinates map[string]*Subordinate, key string, v *tomlValue) {
+	parts := strings.Split(key, ".")
+	if len(parts) != 3 {
+		d.errorf(v.keyPos, "unknown key %q, subordinates are configured in [subordinates.<team>] tables", key)
+		return
+	}
+	sub := subordinates[parts[1]]
+	if sub == nil {
+		sub = &Subordinate{}
+		subordinates[parts[1]] = sub
+	}
+
+	switch parts[2] {
+	case "domains":
+		sub.Domains, _ = d.strings(key, v)
+	case "networks":
+		sub.Networks, _ = d.strings(key, v)
+		for _, n := range sub.Networks {
+			if _, _, err := net.ParseCIDR(n); err != nil {
+				d.errorf(v.pos, "%v: %v", key, err)
+			}
+		}
+	case "max_path_len":
+		n, ok := v.value.(int64)
+		if !ok || n < 0 {
+			d.errorf(v.pos, "%v must be a positive integer", key)
+			return
+		}
+		sub.MaxPathLen = int(n)
+	case "max_lifetime":
+		s, ok := d.string(key, v)
+		if !ok {
+			return
+		}
+		lifetime, err := time.ParseDuration(s)
+		if err != nil || lifetime < 0 {
+			d.errorf(v.pos, "%v: invalid duration %q", key, s)
+			return
+		}
+		sub.MaxLifetime = Duration(lifetime)
+	default:
+		d.errorf(v.keyPos, "unknown key %q", key)
+	}
+}
+
+func (d *configDecoder) checkAuth(c *ServerConfig, backend *tomlValue) {
+	usersFile, hasUsersFile := d.values["auth.users_file"]
+	user, hasUser := d.values["auth.user"]
+	password, hasPassword := d.values["auth.password"]
+
+	if hasUsersFile && hasUser {
+		d.errorf(user.pos, "auth.user can not be used with auth.users_file")
+	}
+	if hasUser != hasPassword {
+		if hasUser {
+			d.errorf(user.pos, "auth.user is set without auth.password")
+		} else {
+			d.errorf(password.pos, "auth.password is set without auth.user")
+		}
+	}
+	if backend == nil {
+		return
+	}
+
+	switch backend.value {
+	case AuthStatic:
+		if hasUsersFile {
+			d.errorf(usersFile.pos, "auth.users_file can not be used with the %q backend", AuthStatic)
+		}
+		if !hasUser {
+			d.errorf(backend.pos, "the %q backend needs auth.user and auth.password", AuthStatic)
+		}
+	case AuthUsersFile:
+		if !hasUsersFile {
+			d.errorf(backend.pos, "the %q backend needs auth.users_file", AuthUsersFile)
+		}
+	}
+}
+
+// expandEnv replaces "${VAR}" and "${VAR:-default}" in s, it is an error
+// for VAR to be unset when there is no default
+func expandEnv(s string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		b.WriteString(s[:i])
+		s = s[i+1:]
+
+		switch {
+		case strings.HasPrefix(s, "$"):
+			b.WriteByte('$')
+			s = s[1:]
+		case strings.HasPrefix(s, "{"):
+			end := strings.IndexByte(s, '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated \"${\"")
+			}
+			name, def, hasDefault := strings.Cut(s[1:end], ":-")
+			if name == "" {
+				return "", fmt.Errorf("empty variable name in \"${}\"")
+			}
+			value, ok := os.LookupEnv(name)
+			switch {
+			case ok:
+				b.WriteString(value)
+			case hasDefault:
+				b.WriteString(def)
+			default:
+				return "", fmt.Errorf("environment variable %v is not set", name)
+			}
+			s = s[end+1:]
+		default:
+			b.WriteByte('$')
+		}
+	}
+}
+
+func checkPort(s string) error {
+	if n, err := strconv.Atoi(s); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q", s)
+	}
+	return nil
+}
+
+func checkDuration(s string) error {
+	if d, err := time.ParseDuration(s); err != nil || d <= 0 {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	return nil
+}
+
+func checkTLSVersion(s string) error {
+	_, err := ParseTLSVersion(s)
+	return err
+}
+
+func checkLogLevel(s string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return fmt.Errorf("invalid log level %q", s)
+	}
+	return nil
+}
+
+func checkLogFormat(s string) error {
+	switch strings.ToLower(s) {
+	case "json", "text":
+		return nil
+	}
+	return fmt.Errorf("invalid log format %q", s)
+}
+
+// ParseTLSVersion parses a TLS version such as "1.2"
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", s)
+}
@@ -0,0 +1,208 @@
+package certd
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testServerConfig = `
+# certd server config
+[server]
+listen = "0.0.0.0"
+port = 8443
+cert_addrs = [
+  "localhost",  # the default
+  "10.0.0.1",
+]
+
+[tls]
+min_version = "1.3"
+
+[auth]
+backend = "static"
+user = "${TEST_CERTD_USER}"
+password = "${TEST_CERTD_PASS:-secret}"
+
+[policy]
+allowed_domains = ["example.com"]
+max_hosts = 5
+
+[profiles.default]
+lifetime = "24h"
+
+[profiles.server]
+usages = ["server"]
+
+[subordinates.mesh]
+domains = ["mesh.example.com"]
+networks = ["10.1.0.0/16"]
+max_path_len = 1
+max_lifetime = "720h"
+
+[storage]
+ca_config = 'certd.conf'
+
+[logging]
+level = "debug"
+`
+
+func Test_ParseServerConfig(t *testing.T) {
+	os.Setenv("TEST_CERTD_USER", "alice")
+	defer os.Unsetenv("TEST_CERTD_USER")
+
+	c, err := ParseServerConfig("certd.toml", testServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"listen":          "0.0.0.0",
+		"port":            "8443",
+		"cert-addrs":      "localhost,10.0.0.1",
+		"tls-min-version": "1.3",
+		"config":          "certd.conf",
+		"log-level":       "debug",
+	}
+	for k, v := range want {
+		if c.Flags[k] != v {
+			t.Errorf("flag %v = %q, expected %q", k, c.Flags[k], v)
+		}
+	}
+	if len(c.Flags) != len(want) {
+		t.Errorf("unexpected flags %v", c.Flags)
+	}
+	if c.User != "alice" || c.Password != "secret" {
+		t.Errorf("unexpected credentials %q %q", c.User, c.Password)
+	}
+	if c.Policy.MaxHosts != 5 || len(c.Policy.AllowedDomains) != 1 {
+		t.Errorf("unexpected policy %+v", c.Policy)
+	}
+	if time.Duration(c.Profiles["default"].Lifetime) != 24*time.Hour || c.Profiles["server"].Usages[0] != "server" {
+		t.Errorf("unexpected profiles %+v", c.Profiles)
+	}
+	if sub := c.Subordinates["mesh"]; sub == nil || sub.Domains[0] != "mesh.example.com" || sub.MaxPathLen != 1 || time.Duration(sub.MaxLifetime) != 720*time.Hour {
+		t.Errorf("unexpected subordinates %+v", c.Subordinates)
+	}
+}
+
+func Test_ParseServerConfig_Errors(t *testing.T) {
+	os.Unsetenv("TEST_CERTD_MISSING")
+	src := `[server]
+port = "http"
+bogus = 1
+listen = ${nope}
+
+[tls]
+serving_cert_lifetime = "soon"
+
+[auth]
+user = "${TEST_CERTD_MISSING}"
+
+[profiles.server]
+usages = ["teapot"]
+`
+	_, err := ParseServerConfig("certd.toml", src)
+	cerr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("expected *ConfigError, got %v", err)
+	}
+
+	expected := []string{
+		"certd.toml:2:8: server.port",
+		"certd.toml:3:1: unknown key \"server.bogus\"",
+		"certd.toml:4:10: invalid value",
+		"certd.toml:7:25: tls.serving_cert_lifetime",
+		"certd.toml:10:8: auth.user: environment variable TEST_CERTD_MISSING is not set",
+		"certd.toml:10:8: auth.user is set without auth.password",
+		"certd.toml:13:10: profiles.server.usages",
+		"certd.toml:13:10: no \"default\" profile",
+	}
+	lines := strings.Split(cerr.Error(), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %v errors, got:\n%v", len(expected), cerr)
+	}
+	for i, e := range expected {
+		if !strings.HasPrefix(lines[i], e) {
+			t.Errorf("expected error %q, got %q", e, lines[i])
+		}
+	}
+}
+
+func Test_parseTOML_Errors(t *testing.T) {
+	tests := map[string]string{
+		"a = \"open":             "1:5: unterminated string",
+		"a = 1\na = 2":           "2:1: key \"a\" already defined at 1:1",
+		"[t]\n[t]":               "2:1: table [t] already defined at 1:1",
+		"a = [1, 2":              "1:5: unterminated array",
+		"a = 1 2":                "1:7: unexpected '2'",
+		"a 1":                    "1:1: expected \"=\"",
+		"[[servers]]":            "1:1: arrays of tables are not supported",
+		"a = \"\\q\"":            "1:7: invalid escape",
+		"a =":                    "1:4: missing value",
+		"a = 1\r\nb = \"x\"\r\n": "",
+	}
+	for src, expected := range tests {
+		_, errs := parseTOML(src)
+		if expected == "" {
+			if len(errs) > 0 {
+				t.Errorf("%q: unexpected error %v", src, errs[0])
+			}
+			continue
+		}
+		if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), expected) {
+			t.Errorf("%q: expected %q, got %v", src, expected, errs)
+		}
+	}
+}
+
+func Test_ServerConfig_ApplyFlags(t *testing.T) {
+	c, err := ParseServerConfig("certd.toml", "[server]\nlisten = \"0.0.0.0\"\nport = \"8443\"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("certd", flag.ContinueOnError)
+	listen := fs.String("listen", "localhost", "")
+	port := fs.String("port", "4443", "")
+	if err := fs.Parse([]string{"-port", "9443"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ApplyFlags(fs); err != nil {
+		t.Fatal(err)
+	}
+	if *listen != "0.0.0.0" {
+		t.Errorf("expected listen from the file, got %q", *listen)
+	}
+	if *port != "9443" {
+		t.Errorf("expected the port flag to override the file, got %q", *port)
+	}
+}
+
+func Test_expandEnv(t *testing.T) {
+	os.Setenv("TEST_CERTD_VAR", "value")
+	defer os.Unsetenv("TEST_CERTD_VAR")
+	os.Unsetenv("TEST_CERTD_UNSET")
+
+	tests := map[string]string{
+		"plain":                         "plain",
+		"${TEST_CERTD_VAR}/x":           "value/x",
+		"${TEST_CERTD_UNSET:-default}":  "default",
+		"$$5 and $x":                    "$5 and $x",
+		"${TEST_CERTD_VAR:-unused}-end": "value-end",
+	}
+	for in, expected := range tests {
+		out, err := expandEnv(in)
+		if err != nil || out != expected {
+			t.Errorf("expandEnv(%q) = %q, %v expected %q", in, out, err, expected)
+		}
+	}
+
+	for _, in := range []string{"${TEST_CERTD_UNSET}", "${", "${}"} {
+		if _, err := expandEnv(in); err == nil {
+			t.Errorf("expected error for %q", in)
+		}
+	}
+}
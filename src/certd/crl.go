@@ -0,0 +1,175 @@
+package certd
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const DefaultCRLInterval = time.Hour
+
+// CreateCRL creates a DER encoded CRL listing the revoked records, it is
+// valid for twice interval so a late regeneration does not leave clients
+// without one. It is signed by the root that issues certs, which lists the
+// revocations of both roots during a rotation.
+func (c *CA) CreateCRL(records []*CertRecord, interval time.Duration) ([]byte, error) {
+	now := time.Now()
+	return c.issuingCA(now).signCRL(revocationEntries(records, now), now, now.Add(2*interval))
+}
+
+// CreatePreviousCRL creates the same CRL as CreateCRL signed by the current
+// root once a rotation has switched issuance to the new one. Certs issued
+// before the switch are still valid until the root is retired and clients
+// check them against a CRL from their issuer. It returns nil when there is
+// no rotation past its switch.
+func (c *CA) CreatePreviousCRL(records []*CertRecord, interval time.Duration) ([]byte, error) {
+	now := time.Now()
+	if c.Rotation == nil || !c.Rotation.Switched(now) {
+		return nil, nil
+	}
+	return c.signCRL(revocationEntries(records, now), now, now.Add(2*interval))
+}
+
+// revocationEntries returns the CRL entries for the revoked records that
+// have not expired at now
+func revocationEntries(records []*CertRecord, now time.Time) []x509.RevocationListEntry {
+	var entries []x509.RevocationListEntry
+	for _, r := range records {
+		if !r.Revoked || now.After(r.NotAfter) {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(r.Serial, 16)
+		if !ok {
+			continue
+		}
+		entry := x509.RevocationListEntry{SerialNumber: serial, RevocationTime: now}
+		if r.RevokedAt != nil {
+			entry.RevocationTime = *r.RevokedAt
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// signCRL signs a CRL listing entries with the root of c
+func (c *CA) signCRL(entries []x509.RevocationListEntry, now, nextUpdate time.Time) ([]byte, error) {
+	key, err := c.Signer()
+	if err != nil {
+		return nil, err
+	}
+	crt, err := c.Cert()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.RevocationList{
+		// the time keeps the number increasing across leaders
+		Number:                    big.NewInt(now.UnixNano()),
+		ThisUpdate:                now,
+		NextUpdate:                nextUpdate,
+		RevokedCertificateEntries: entries,
+	}
+	return x509.CreateRevocationList(rand.Reader, template, crt, key)
+}
+
+// generateCRL creates a CRL from the store, it is run by the leader. During
+// a rotation past its switch the CRL of the previous root is created too.
+func (s *Server) generateCRL() error {
+	ca := s.settings().CA
+	if ca.Sealed() {
+		logger.Warn("not generating CRL, the CA is sealed")
+		return nil
+	}
+	revoked := s.Inventory.List(CertFilter{Status: "revoked"})
+	crl, err := ca.CreateCRL(revoked, s.crlInterval())
+	if err != nil {
+		return err
+	}
+	previous, err := ca.CreatePreviousCRL(revoked, s.crlInterval())
+	if err != nil {
+		return err
+	}
+
+	if s.CRLPath != "" {
+		if err := writeFileAtomic(s.CRLPath, crl, 0644); err != nil {
+			return err
+		}
+		path := previousCRLPath(s.CRLPath)
+		if previous != nil {
+			err = writeFileAtomic(path, previous, 0644)
+		} else if err = os.Remove(path); os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.crl = crl
+	s.previousCRL = previous
+	s.mu.Unlock()
+	logger.Info("generated CRL", "previous_root", previous != nil)
+	return nil
+}
+
+// previousCRLPath is where the CRL of the previous root is written next to
+// the one at path, certd.crl becomes certd-previous.crl
+func previousCRLPath(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-previous" + ext
+}
+
+func (s *Server) crlInterval() time.Duration {
+	if s.CRLInterval <= 0 {
+		return DefaultCRLInterval
+	}
+	return s.CRLInterval
+}
+
+// serveCRL serves the latest CRL without authentication so relying parties
+// can fetch it. Standbys read the CRL the leader wrote to CRLPath.
+func (s *Server) serveCRL(w http.ResponseWriter, req *http.Request) {
+	s.mu.RLock()
+	crl := s.crl
+	s.mu.RUnlock()
+	s.serveCRLFile(w, req, s.CRLPath, crl)
+}
+
+// servePreviousCRL serves the CRL of the previous root during a rotation,
+// certs it issued before the switch are checked against it
+func (s *Server) servePreviousCRL(w http.ResponseWriter, req *http.Request) {
+	s.mu.RLock()
+	crl := s.previousCRL
+	s.mu.RUnlock()
+	path := ""
+	if s.CRLPath != "" {
+		path = previousCRLPath(s.CRLPath)
+	}
+	s.serveCRLFile(w, req, path, crl)
+}
+
+// serveCRLFile serves the CRL at path, or crl if path is empty
+func (s *Server) serveCRLFile(w http.ResponseWriter, req *http.Request, path string, crl []byte) {
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			loggerFrom(req.Context()).Error("failed to read CRL", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		crl = b
+	}
+
+	if len(crl) == 0 {
+		http.Error(w, "no CRL has been generated yet", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
+}
@@ -0,0 +1,114 @@
+package certd
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_CreateCRL(t *testing.T) {
+	s := newTestServer(t)
+	now := time.Now()
+	records := []*CertRecord{
+		{Serial: "0a", Revoked: true, RevokedAt: &now, NotAfter: now.Add(time.Hour)},
+		{Serial: "0b", Revoked: true, NotAfter: now.Add(-time.Hour)},
+		{Serial: "0c", NotAfter: now.Add(time.Hour)},
+	}
+	der, err := s.CA.CreateCRL(records, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := s.CA.Cert()
+	if err := crl.CheckSignatureFrom(caCert); err != nil {
+		t.Error(err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Int64() != 10 {
+		t.Errorf("unexpected entries %+v", crl.RevokedCertificateEntries)
+	}
+}
+
+func Test_Server_CRL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	leader := newTestServer(t)
+	leader.CRLPath = filepath.Join(dir, "certd.crl")
+	standby := NewServer(leader.CA, "127.0.0.1", "4443", "")
+	standby.CRLPath = leader.CRLPath
+	standby.Inventory = leader.Inventory
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/crl", nil)
+	standby.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected %v got %v", http.StatusNotFound, rr.Code)
+	}
+
+	// revoking on the leader regenerates the CRL straight away
+	var issued IssuedCert
+	apiRequest(t, leader, "POST", "/api/v1/certificates", strings.NewReader(`{"hosts":["c.local"]}`), &issued)
+	apiRequest(t, leader, "POST", "/api/v1/certificates/"+issued.Serial+"/revoke", nil, nil)
+
+	rr = httptest.NewRecorder()
+	standby.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/pkix-crl" {
+		t.Fatalf("unexpected response %v %v", rr.Code, rr.Body.String())
+	}
+	crl, err := x509.ParseRevocationList(rr.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Text(16) != issued.Serial {
+		t.Errorf("unexpected entries %+v", crl.RevokedCertificateEntries)
+	}
+
+	// the previous root's CRL is only served during a rotation past its
+	// switch
+	previousReq, _ := http.NewRequest("GET", "/crl-previous", nil)
+	rr = httptest.NewRecorder()
+	standby.ServeHTTP(rr, previousReq)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected no previous CRL got %v", rr.Code)
+	}
+	if err := leader.CA.StartRotation(time.Now(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.generateCRL(); err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	standby.ServeHTTP(rr, previousReq)
+	previous, err := x509.ParseRevocationList(rr.Body.Bytes())
+	if err != nil {
+		t.Fatalf("expected the previous CRL got %v %v", rr.Code, err)
+	}
+	oldRoot, _ := leader.CA.Cert()
+	if previous.CheckSignatureFrom(oldRoot) != nil || len(previous.RevokedCertificateEntries) != 1 {
+		t.Errorf("expected the revocation in a CRL from the old root")
+	}
+
+	if err := leader.CA.Retire(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.generateCRL(); err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	standby.ServeHTTP(rr, previousReq)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected the previous CRL to be removed after retiring got %v", rr.Code)
+	}
+}
@@ -1,7 +1,10 @@
 package certd
 
 import (
-	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -9,6 +12,7 @@ import (
 	"encoding/asn1"
 	"encoding/pem"
 	"fmt"
+	"net"
 	"strings"
 	"time"
 )
@@ -18,15 +22,102 @@ type CSR struct {
 	PrivateKey         []byte
 	CertificateRequest *x509.CertificateRequest
 	Hosts              string
+	// Lifetime of the issued cert, zero means it is valid until the CA expires
+	Lifetime time.Duration
+	// ExtKeyUsage is added to the issued cert
+	ExtKeyUsage []x509.ExtKeyUsage
+	// Constraints makes the issued cert a subordinate CA limited by them
+	Constraints *CAConstraints
+}
+
+// CAConstraints limit a subordinate CA
+type CAConstraints struct {
+	// PathLen is how many CAs may follow it in a chain, 0 means it can only
+	// issue leaf certs
+	PathLen int
+	// LimitNames limits the names it can issue certs for to Domains and
+	// Networks, names of any other type are excluded. Without it the CA can
+	// issue certs for any name.
+	LimitNames bool
+	Domains    []string
+	Networks   []*net.IPNet
+}
+
+// noNames is the only name permitted for a type of name a CA must not issue
+// certs for, an empty list would permit every name. The TLD is reserved so
+// it never resolves.
+const noNames = "invalid"
+
+// allIPRanges are excluded from a CA that must not issue certs for IPs
+var allIPRanges = []*net.IPNet{
+	{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+	{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+}
+
+// Key types for NewCSR
+const (
+	KeyRSA       = "rsa"
+	KeyECDSAP256 = "ecdsa-p256"
+	KeyECDSAP384 = "ecdsa-p384"
+	KeyEd25519   = "ed25519"
+)
+
+// GenerateKey generates a private key of keyType, an empty keyType is
+// KeyRSA. The key is returned along with its PEM encoding.
+func GenerateKey(keyType string) (crypto.Signer, []byte, error) {
+	var key crypto.Signer
+	var block *pem.Block
+	switch keyType {
+	case "", KeyRSA:
+		k, err := rsa.GenerateKey(rand.Reader, RSABits)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, block = k, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	case KeyECDSAP256, KeyECDSAP384:
+		curve := elliptic.P256()
+		if keyType == KeyECDSAP384 {
+			curve = elliptic.P384()
+		}
+		k, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, block = k, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case KeyEd25519:
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, block = k, &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	default:
+		return nil, nil, fmt.Errorf("unknown key type \"%v\"", keyType)
+	}
+	return key, pem.EncodeToMemory(block), nil
 }
 
 // CreateCSR creates a certificate signing request for the given hosts/ips
+// with a new RSA key
 func CreateCSR(hosts string) (*CSR, error) {
+	return NewCSR(hosts, KeyRSA)
+}
+
+// NewCSR creates a certificate signing request for the given hosts/ips with
+// a new key of keyType
+func NewCSR(hosts, keyType string) (*CSR, error) {
 	if hosts == "" {
 		return nil, fmt.Errorf("no hosts specified")
 	}
 
-	privateKey, err := rsa.GenerateKey(rand.Reader, RSABits)
+	privateKey, keyPEM, err := GenerateKey(keyType)
 	if err != nil {
 		return nil, err
 	}
@@ -37,15 +128,21 @@ func CreateCSR(hosts string) (*CSR, error) {
 		OrganizationalUnit: []string{"CERTD"},
 		Locality:           []string{"Cork"},
 		Province:           []string{"Cork"},
-		SerialNumber:       string(time.Now().UnixNano()),
+		SerialNumber:       fmt.Sprint(time.Now().UnixNano()),
 		CommonName:         strings.Split(hosts, ",")[0],
 	}
 	raw := name.ToRDNSequence()
 
 	asn1Subj, _ := asn1.Marshal(raw)
 	template := x509.CertificateRequest{
-		RawSubject:         asn1Subj,
-		SignatureAlgorithm: x509.SHA256WithRSA,
+		RawSubject: asn1Subj,
+	}
+	for _, h := range SplitHosts(hosts) {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
 	}
 
 	certReq, err := x509.CreateCertificateRequest(rand.Reader, &template, privateKey)
@@ -53,10 +150,7 @@ func CreateCSR(hosts string) (*CSR, error) {
 		return nil, err
 	}
 
-	pemBlock := &pem.Block{Type: "CERTIFICATE REQUEST", Bytes: certReq}
-	pem.EncodeToMemory(pemBlock)
-
-	clientCSR, err := x509.ParseCertificateRequest(pemBlock.Bytes)
+	clientCSR, err := x509.ParseCertificateRequest(certReq)
 	if err != nil {
 		return nil, err
 	}
@@ -64,14 +158,50 @@ func CreateCSR(hosts string) (*CSR, error) {
 		return nil, err
 	}
 
-	var keyOut bytes.Buffer
-	pem.Encode(&keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
-
 	csr := &CSR{
-		PrivateKey:         keyOut.Bytes(),
+		PrivateKey:         keyPEM,
 		CertificateRequest: clientCSR,
 		Hosts:              hosts,
 	}
 
 	return csr, nil
 }
+
+// PEM returns the PEM encoded certificate request
+func (c *CSR) PEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: c.CertificateRequest.Raw})
+}
+
+// ParseCSR parses a PEM encoded certificate request. If hosts is empty the
+// hosts are taken from the request's SANs, falling back to its common name.
+func ParseCSR(pemBytes []byte, hosts string) (*CSR, error) {
+	pemBlock, _ := pem.Decode(pemBytes)
+	if pemBlock == nil || pemBlock.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("no certificate request found")
+	}
+
+	certReq, err := x509.ParseCertificateRequest(pemBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err = certReq.CheckSignature(); err != nil {
+		return nil, err
+	}
+
+	if hosts == "" {
+		var sans []string
+		sans = append(sans, certReq.DNSNames...)
+		for _, ip := range certReq.IPAddresses {
+			sans = append(sans, ip.String())
+		}
+		if len(sans) == 0 && certReq.Subject.CommonName != "" {
+			sans = append(sans, certReq.Subject.CommonName)
+		}
+		hosts = strings.Join(sans, ",")
+	}
+	if hosts == "" {
+		return nil, fmt.Errorf("no hosts specified")
+	}
+
+	return &CSR{CertificateRequest: certReq, Hosts: hosts}, nil
+}
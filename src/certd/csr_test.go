@@ -9,3 +9,31 @@ func Test_CreateCSR(t *testing.T) {
 		t.Errorf("excpected error creating CSR got %v", err)
 	}
 }
+
+func Test_NewCSR_key_types(t *testing.T) {
+	s := newTestServer(t)
+	for _, kt := range []string{KeyRSA, KeyECDSAP256, KeyECDSAP384, KeyEd25519} {
+		csr, err := NewCSR("a.example.com,10.0.0.1", kt)
+		if err != nil {
+			t.Fatalf("%v: %v", kt, err)
+		}
+		if len(csr.CertificateRequest.DNSNames) != 1 || len(csr.CertificateRequest.IPAddresses) != 1 {
+			t.Errorf("%v: unexpected SANs in the CSR", kt)
+		}
+		// the RSA CA signs certs for keys of any type
+		cert, err := s.CA.CertFromCSR(csr)
+		if err != nil {
+			t.Fatalf("%v: %v", kt, err)
+		}
+		crt, err := cert.X509()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := CheckKeyPair(crt, csr.PrivateKey); err != nil {
+			t.Errorf("%v: %v", kt, err)
+		}
+	}
+	if _, err := NewCSR("a", "dsa"); err == nil {
+		t.Errorf("expected error for unknown key type")
+	}
+}
@@ -0,0 +1,76 @@
+package certd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DirStore is a Store that keeps each record in its own JSON file named
+// after the serial, suitable for small setups. Each file is replaced
+// atomically but a transaction changing several records is not.
+type DirStore struct {
+	recordStore
+	dir string
+}
+
+// OpenDirStore opens the store in dir, creating dir if it does not exist
+func OpenDirStore(dir string) (*DirStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("no store directory specified")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &DirStore{dir: dir}
+	s.idx = newCertIndex()
+	s.persist = s.save
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var r CertRecord
+		if err := json.Unmarshal(b, &r); err != nil {
+			return nil, fmt.Errorf("%v: %v", f, err)
+		}
+		if strings.ToLower(r.Serial)+".json" != filepath.Base(f) {
+			return nil, fmt.Errorf("%v: serial %v does not match the file name", f, r.Serial)
+		}
+		s.idx.put(&r)
+	}
+	return s, nil
+}
+
+func (s *DirStore) save(changed []*CertRecord) error {
+	for _, r := range changed {
+		b, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(s.dir, strings.ToLower(r.Serial)+".json")
+		if err := writeFileAtomic(path, b, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check verifies the directory can be written to
+func (s *DirStore) Check() error {
+	return checkWritable(s.dir)
+}
+
+// Close does nothing, every change is already on disk
+func (s *DirStore) Close() error {
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build windows || plan9
+
+package certd
+
+import (
+	"fmt"
+	"os"
+)
+
+// file locks are not available so stores and ledgers can not be shared
+// between instances, a single instance works as normal
+
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
+
+func tryLockFile(f *os.File) (bool, error) {
+	return false, fmt.Errorf("file leases are not supported on this platform")
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,152 @@
+package certd
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const DefaultCAExpiryWarning = 30 * 24 * time.Hour
+
+// check statuses, a warning does not stop the server being ready
+const (
+	CheckOK   = "ok"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+)
+
+// Check is the result of a single readiness check
+type Check struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// Readiness is the result of all the readiness checks
+type Readiness struct {
+	Status string   `json:"status"`
+	Checks []*Check `json:"checks"`
+}
+
+func (s *Server) healthz(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, req, http.StatusOK, map[string]string{"status": CheckOK})
+}
+
+func (s *Server) readyz(w http.ResponseWriter, req *http.Request) {
+	r := s.Ready()
+	status := http.StatusOK
+	if r.Status == CheckFail {
+		status = http.StatusServiceUnavailable
+		loggerFrom(req.Context()).Warn("not ready", "checks", r.Checks)
+	}
+	writeJSON(w, req, status, r)
+}
+
+// Ready runs the readiness checks against the CA and inventory
+func (s *Server) Ready() *Readiness {
+	ca := s.settings().CA
+	r := &Readiness{Status: CheckOK}
+	add := func(name string, err error, warning string) {
+		c := &Check{Name: name, Status: CheckOK}
+		switch {
+		case err != nil:
+			c.Status, c.Message = CheckFail, err.Error()
+			r.Status = CheckFail
+		case warning != "":
+			c.Status, c.Message = CheckWarn, warning
+			if r.Status == CheckOK {
+				r.Status = CheckWarn
+			}
+		}
+		r.Checks = append(r.Checks, c)
+	}
+
+	if s.ConfigPath != "" {
+		_, err := readCA(s.ConfigPath)
+		add("config", err, "")
+	}
+
+	crt, err := ca.Cert()
+	add("ca_cert", err, "")
+	// a sealed CA fails so load balancers stop sending it requests it can
+	// only refuse, it is unsealed through /sys/unseal on the instance
+	// itself. The other checks still run, except those that need the key.
+	var key crypto.Signer
+	var keyErr error
+	if ca.Sealed() {
+		add("ca_key", fmt.Errorf("sealed, no certs can be issued until it is unsealed"), "")
+	} else {
+		key, keyErr = ca.Signer()
+		add("ca_key", keyErr, "")
+	}
+	if err != nil || keyErr != nil {
+		return r
+	}
+
+	if key != nil {
+		if !publicKeysEqual(key.Public(), crt.PublicKey) {
+			add("ca_key_matches_cert", fmt.Errorf("private key does not match cert"), "")
+		} else {
+			add("ca_key_matches_cert", nil, "")
+		}
+	}
+
+	now := time.Now()
+	switch {
+	case now.After(crt.NotAfter):
+		add("ca_expiry", fmt.Errorf("expired at %v", crt.NotAfter), "")
+	case s.caExpiring(crt, now):
+		add("ca_expiry", nil, fmt.Sprintf("expires at %v", crt.NotAfter))
+	default:
+		add("ca_expiry", nil, "")
+	}
+
+	if rot := ca.Rotation; rot != nil {
+		retire := ""
+		if now.After(rot.RetireAt) {
+			retire = fmt.Sprintf("the old root was due to be retired at %v", rot.RetireAt)
+		}
+		add("ca_rotation", rot.Next.Validate(), retire)
+	}
+
+	add("store", s.Inventory.Check(), "")
+	if key == nil {
+		return r
+	}
+
+	msg := []byte("certd readiness check " + now.String())
+	digest := sha256.Sum256(msg)
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err == nil {
+		err = crt.CheckSignature(signatureAlgorithm(crt.PublicKey), msg, sig)
+	}
+	add("test_signature", err, "")
+
+	return r
+}
+
+// caExpiring reports whether crt is within CAExpiryWarning of expiring at now
+func (s *Server) caExpiring(crt *x509.Certificate, now time.Time) bool {
+	warning := s.CAExpiryWarning
+	if warning <= 0 {
+		warning = DefaultCAExpiryWarning
+	}
+	return now.Add(warning).After(crt.NotAfter)
+}
+
+// warnCAExpiry logs a warning if ca is close to expiring, certs can not be
+// issued for longer than it has left
+func (s *Server) warnCAExpiry(ca *CA) {
+	crt, err := ca.Cert()
+	if err != nil {
+		return
+	}
+	if now := time.Now(); s.caExpiring(crt, now) {
+		logger.Warn("the CA expires soon, rotate it before certs can no longer be issued",
+			"not_after", crt.NotAfter, "remaining", crt.NotAfter.Sub(now).Round(time.Second).String())
+	}
+}
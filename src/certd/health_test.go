@@ -0,0 +1,113 @@
+package certd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Server_healthz(t *testing.T) {
+	s := newTestServer(t)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected %v got %v", http.StatusOK, rr.Code)
+	}
+}
+
+func Test_Server_readyz(t *testing.T) {
+	s := newTestServer(t)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected %v got %v: %v", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	r := s.Ready()
+	if r.Status != CheckOK || len(r.Checks) != 6 {
+		t.Errorf("unexpected readiness %+v", r)
+	}
+}
+
+func Test_Server_readyz_expiry_warning(t *testing.T) {
+	s := newTestServer(t)
+	s.CAExpiryWarning = 2 * 365 * 24 * time.Hour
+
+	if r := s.Ready(); r.Status != CheckWarn {
+		t.Errorf("expected %v got %v", CheckWarn, r.Status)
+	}
+	var buf bytes.Buffer
+	s.writeMetrics(&buf)
+	if !strings.Contains(buf.String(), "certd_ca_expiring 1\n") {
+		t.Errorf("expected the CA to be reported as expiring:\n%v", buf.String())
+	}
+}
+
+func Test_Server_readyz_fail(t *testing.T) {
+	s := newTestServer(t)
+	other := newTestServer(t)
+	s.CA = &CA{CertBytes: s.CA.CertBytes, KeyBytes: other.CA.KeyBytes}
+
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s.ConfigPath = filepath.Join(dir, "missing.conf")
+	s.Inventory, _ = LoadInventory(filepath.Join(dir, "gone", "certs.json"))
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %v got %v", http.StatusServiceUnavailable, rr.Code)
+	}
+
+	failed := map[string]bool{}
+	for _, c := range s.Ready().Checks {
+		if c.Status == CheckFail {
+			failed[c.Name] = true
+		}
+	}
+	for _, name := range []string{"config", "ca_key_matches_cert", "store", "test_signature"} {
+		if !failed[name] {
+			t.Errorf("expected check %v to fail", name)
+		}
+	}
+}
+
+func Test_Server_readyz_sealed(t *testing.T) {
+	s, _ := newSealedTestServer(t)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %v got %v: %v", http.StatusServiceUnavailable, rr.Code, rr.Body.String())
+	}
+
+	// the checks that do not need the key still run
+	checks := map[string]string{}
+	for _, c := range s.Ready().Checks {
+		checks[c.Name] = c.Status
+	}
+	want := map[string]string{"config": CheckOK, "ca_cert": CheckOK, "ca_key": CheckFail, "ca_expiry": CheckOK, "store": CheckOK}
+	for name, status := range want {
+		if checks[name] != status {
+			t.Errorf("expected check %v to be %v got %v", name, status, checks[name])
+		}
+	}
+	if _, ok := checks["test_signature"]; ok {
+		t.Errorf("expected the test signature to be skipped while sealed")
+	}
+}
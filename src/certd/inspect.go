@@ -0,0 +1,385 @@
+package certd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Object types returned by Inspect
+const (
+	ObjectCert       = "certificate"
+	ObjectCSR        = "certificate_request"
+	ObjectPrivateKey = "private_key"
+	ObjectPublicKey  = "public_key"
+	ObjectCRL        = "crl"
+)
+
+// ObjectInfo describes a cert, CSR, key or CRL found by Inspect
+type ObjectInfo struct {
+	Type string `json:"type"`
+	// Source is "pkcs12" for objects found in a PKCS#12 file and
+	// "encrypted pkcs8" for encrypted PKCS#8 keys
+	Source string `json:"source,omitempty"`
+
+	Subject            string     `json:"subject,omitempty"`
+	Issuer             string     `json:"issuer,omitempty"`
+	Serial             string     `json:"serial,omitempty"`
+	NotBefore          *time.Time `json:"not_before,omitempty"`
+	NotAfter           *time.Time `json:"not_after,omitempty"`
+	DNSNames           []string   `json:"dns_names,omitempty"`
+	IPAddresses        []string   `json:"ip_addresses,omitempty"`
+	EmailAddresses     []string   `json:"email_addresses,omitempty"`
+	URIs               []string   `json:"uris,omitempty"`
+	IsCA               bool       `json:"is_ca,omitempty"`
+	MaxPathLen         *int       `json:"max_path_len,omitempty"`
+	KeyUsage           []string   `json:"key_usage,omitempty"`
+	ExtKeyUsage        []string   `json:"ext_key_usage,omitempty"`
+	SubjectKeyID       string     `json:"subject_key_id,omitempty"`
+	AuthorityKeyID     string     `json:"authority_key_id,omitempty"`
+	SignatureAlgorithm string     `json:"signature_algorithm,omitempty"`
+	Fingerprint        string     `json:"sha256_fingerprint,omitempty"`
+
+	// PublicKey describes the key, e.g. "RSA 2048" or "ECDSA P-256"
+	PublicKey string `json:"public_key,omitempty"`
+	// PublicKeySHA256 is the hash of the public key, it is the same for a
+	// key and the certs and CSRs made from it
+	PublicKeySHA256 string `json:"public_key_sha256,omitempty"`
+
+	ThisUpdate *time.Time    `json:"this_update,omitempty"`
+	NextUpdate *time.Time    `json:"next_update,omitempty"`
+	Number     string        `json:"number,omitempty"`
+	Revoked    []RevokedInfo `json:"revoked,omitempty"`
+}
+
+// RevokedInfo is an entry in a CRL
+type RevokedInfo struct {
+	Serial    string    `json:"serial"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// Inspect describes the objects in b, which may hold any number of PEM
+// blocks or a single DER encoded object. password is used for PKCS#12 files
+// and encrypted keys.
+func Inspect(b []byte, password string) ([]*ObjectInfo, error) {
+	var infos []*ObjectInfo
+	rest := b
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		info, err := inspectPEM(block, password)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info...)
+	}
+	if len(infos) > 0 {
+		return infos, nil
+	}
+	if bytes.Contains(b, []byte("-----BEGIN")) {
+		return nil, fmt.Errorf("no supported PEM blocks found")
+	}
+	return inspectDER(b, password)
+}
+
+func inspectPEM(block *pem.Block, password string) ([]*ObjectInfo, error) {
+	var info *ObjectInfo
+	var err error
+	switch block.Type {
+	case "CERTIFICATE":
+		var crt *x509.Certificate
+		if crt, err = x509.ParseCertificate(block.Bytes); err == nil {
+			info = certInfo(crt)
+		}
+	case "CERTIFICATE REQUEST", "NEW CERTIFICATE REQUEST":
+		var csr *x509.CertificateRequest
+		if csr, err = x509.ParseCertificateRequest(block.Bytes); err == nil {
+			info = csrInfo(csr)
+		}
+	case "X509 CRL":
+		var crl *x509.RevocationList
+		if crl, err = x509.ParseRevocationList(block.Bytes); err == nil {
+			info = crlInfo(crl)
+		}
+	case "PUBLIC KEY":
+		var pub crypto.PublicKey
+		if pub, err = x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+			info = &ObjectInfo{Type: ObjectPublicKey}
+			setPublicKey(info, pub)
+		}
+	case "RSA PRIVATE KEY", "EC PRIVATE KEY", "PRIVATE KEY":
+		var key crypto.PrivateKey
+		if key, err = ParsePrivateKeyPEM(pem.EncodeToMemory(block)); err == nil {
+			info, err = keyInfo(key)
+		}
+	case "ENCRYPTED PRIVATE KEY":
+		var key crypto.PrivateKey
+		if key, err = DecryptPKCS8(block.Bytes, password); err == nil {
+			if info, err = keyInfo(key); err == nil {
+				info.Source = "encrypted pkcs8"
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block \"%v\"", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", strings.ToLower(block.Type), err)
+	}
+	return []*ObjectInfo{info}, nil
+}
+
+func inspectDER(der []byte, password string) ([]*ObjectInfo, error) {
+	if crt, err := x509.ParseCertificate(der); err == nil {
+		return []*ObjectInfo{certInfo(crt)}, nil
+	}
+	if csr, err := x509.ParseCertificateRequest(der); err == nil {
+		return []*ObjectInfo{csrInfo(csr)}, nil
+	}
+	if crl, err := x509.ParseRevocationList(der); err == nil {
+		return []*ObjectInfo{crlInfo(crl)}, nil
+	}
+	if key, err := parsePrivateKeyDER(der); err == nil {
+		info, err := keyInfo(key)
+		if err != nil {
+			return nil, err
+		}
+		return []*ObjectInfo{info}, nil
+	}
+	if pub, err := x509.ParsePKIXPublicKey(der); err == nil {
+		info := &ObjectInfo{Type: ObjectPublicKey}
+		setPublicKey(info, pub)
+		return []*ObjectInfo{info}, nil
+	}
+	if pkcs12Like(der) {
+		certs, keys, err := DecodePKCS12(der, password)
+		if err != nil {
+			return nil, err
+		}
+		var infos []*ObjectInfo
+		for _, crt := range certs {
+			infos = append(infos, certInfo(crt))
+		}
+		for _, key := range keys {
+			info, err := keyInfo(key)
+			if err != nil {
+				return nil, err
+			}
+			infos = append(infos, info)
+		}
+		for _, info := range infos {
+			info.Source = "pkcs12"
+		}
+		return infos, nil
+	}
+	return nil, fmt.Errorf("unrecognised file, expected PEM, a DER cert, CSR, CRL or key, or PKCS#12")
+}
+
+// ParsePrivateKeyPEM parses a PKCS#1, SEC 1 or PKCS#8 private key
+func ParsePrivateKeyPEM(b []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM private key found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported private key type \"%v\"", block.Type)
+}
+
+func parsePrivateKeyDER(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	return x509.ParseECPrivateKey(der)
+}
+
+// CheckKeyPair checks that the PEM encoded private key is the key for crt
+func CheckKeyPair(crt *x509.Certificate, keyPEM []byte) error {
+	key, err := ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported private key")
+	}
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(crt.PublicKey) {
+		return fmt.Errorf("private key does not match the cert")
+	}
+	return nil
+}
+
+func certInfo(crt *x509.Certificate) *ObjectInfo {
+	info := &ObjectInfo{
+		Type:               ObjectCert,
+		Subject:            crt.Subject.String(),
+		Issuer:             crt.Issuer.String(),
+		Serial:             fmt.Sprintf("%x", crt.SerialNumber),
+		NotBefore:          &crt.NotBefore,
+		NotAfter:           &crt.NotAfter,
+		DNSNames:           crt.DNSNames,
+		EmailAddresses:     crt.EmailAddresses,
+		IsCA:               crt.IsCA,
+		KeyUsage:           keyUsageNames(crt.KeyUsage),
+		ExtKeyUsage:        extKeyUsageNames(crt.ExtKeyUsage),
+		SubjectKeyID:       hexOrEmpty(crt.SubjectKeyId),
+		AuthorityKeyID:     hexOrEmpty(crt.AuthorityKeyId),
+		SignatureAlgorithm: crt.SignatureAlgorithm.String(),
+		Fingerprint:        Fingerprint(crt),
+	}
+	for _, ip := range crt.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	for _, u := range crt.URIs {
+		info.URIs = append(info.URIs, u.String())
+	}
+	if crt.IsCA && crt.BasicConstraintsValid && (crt.MaxPathLen > 0 || crt.MaxPathLenZero) {
+		n := crt.MaxPathLen
+		info.MaxPathLen = &n
+	}
+	setPublicKey(info, crt.PublicKey)
+	return info
+}
+
+func csrInfo(csr *x509.CertificateRequest) *ObjectInfo {
+	info := &ObjectInfo{
+		Type:               ObjectCSR,
+		Subject:            csr.Subject.String(),
+		DNSNames:           csr.DNSNames,
+		EmailAddresses:     csr.EmailAddresses,
+		SignatureAlgorithm: csr.SignatureAlgorithm.String(),
+	}
+	for _, ip := range csr.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	for _, u := range csr.URIs {
+		info.URIs = append(info.URIs, u.String())
+	}
+	setPublicKey(info, csr.PublicKey)
+	return info
+}
+
+func crlInfo(crl *x509.RevocationList) *ObjectInfo {
+	info := &ObjectInfo{
+		Type:               ObjectCRL,
+		Issuer:             crl.Issuer.String(),
+		ThisUpdate:         &crl.ThisUpdate,
+		AuthorityKeyID:     hexOrEmpty(crl.AuthorityKeyId),
+		SignatureAlgorithm: crl.SignatureAlgorithm.String(),
+	}
+	if !crl.NextUpdate.IsZero() {
+		info.NextUpdate = &crl.NextUpdate
+	}
+	if crl.Number != nil {
+		info.Number = crl.Number.String()
+	}
+	for _, r := range crl.RevokedCertificateEntries {
+		info.Revoked = append(info.Revoked, RevokedInfo{Serial: fmt.Sprintf("%x", r.SerialNumber), RevokedAt: r.RevocationTime})
+	}
+	return info
+}
+
+func keyInfo(key crypto.PrivateKey) (*ObjectInfo, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key %T", key)
+	}
+	info := &ObjectInfo{Type: ObjectPrivateKey}
+	setPublicKey(info, signer.Public())
+	return info, nil
+}
+
+func setPublicKey(info *ObjectInfo, pub crypto.PublicKey) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		info.PublicKey = fmt.Sprintf("RSA %v", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		info.PublicKey = "ECDSA " + k.Curve.Params().Name
+	case ed25519.PublicKey:
+		info.PublicKey = "Ed25519"
+	default:
+		info.PublicKey = fmt.Sprintf("%T", pub)
+	}
+	if der, err := x509.MarshalPKIXPublicKey(pub); err == nil {
+		sum := sha256.Sum256(der)
+		info.PublicKeySHA256 = hex.EncodeToString(sum[:])
+	}
+}
+
+func hexOrEmpty(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+var keyUsages = []struct {
+	usage x509.KeyUsage
+	name  string
+}{
+	{x509.KeyUsageDigitalSignature, "digital_signature"},
+	{x509.KeyUsageContentCommitment, "content_commitment"},
+	{x509.KeyUsageKeyEncipherment, "key_encipherment"},
+	{x509.KeyUsageDataEncipherment, "data_encipherment"},
+	{x509.KeyUsageKeyAgreement, "key_agreement"},
+	{x509.KeyUsageCertSign, "cert_sign"},
+	{x509.KeyUsageCRLSign, "crl_sign"},
+	{x509.KeyUsageEncipherOnly, "encipher_only"},
+	{x509.KeyUsageDecipherOnly, "decipher_only"},
+}
+
+func keyUsageNames(ku x509.KeyUsage) []string {
+	var names []string
+	for _, u := range keyUsages {
+		if ku&u.usage != 0 {
+			names = append(names, u.name)
+		}
+	}
+	return names
+}
+
+func extKeyUsageNames(usages []x509.ExtKeyUsage) []string {
+	var names []string
+	for _, u := range usages {
+		switch u {
+		case x509.ExtKeyUsageServerAuth:
+			names = append(names, "server")
+		case x509.ExtKeyUsageClientAuth:
+			names = append(names, "client")
+		case x509.ExtKeyUsageCodeSigning:
+			names = append(names, "code_signing")
+		case x509.ExtKeyUsageEmailProtection:
+			names = append(names, "email_protection")
+		case x509.ExtKeyUsageTimeStamping:
+			names = append(names, "time_stamping")
+		case x509.ExtKeyUsageOCSPSigning:
+			names = append(names, "ocsp_signing")
+		case x509.ExtKeyUsageAny:
+			names = append(names, "any")
+		default:
+			names = append(names, fmt.Sprintf("unknown(%v)", int(u)))
+		}
+	}
+	return names
+}
@@ -0,0 +1,83 @@
+package certd
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Inspect(t *testing.T) {
+	s := newTestServer(t)
+	csr, err := NewCSR("a.example.com,10.0.0.1", KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := s.CA.CertFromCSR(csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a cert, its key and its CSR in one file
+	b := append(append(append([]byte{}, cert.CertBytes...), csr.PrivateKey...), csr.PEM()...)
+	infos, err := Inspect(b, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 3 || infos[0].Type != ObjectCert || infos[1].Type != ObjectPrivateKey || infos[2].Type != ObjectCSR {
+		t.Fatalf("unexpected objects %+v", infos)
+	}
+	if infos[0].PublicKey != "ECDSA P-256" || infos[0].PublicKeySHA256 == "" {
+		t.Errorf("unexpected public key %v %v", infos[0].PublicKey, infos[0].PublicKeySHA256)
+	}
+	for _, info := range infos[1:] {
+		if info.PublicKeySHA256 != infos[0].PublicKeySHA256 {
+			t.Errorf("%v: public key hash differs from the cert's", info.Type)
+		}
+	}
+	if len(infos[0].DNSNames) != 1 || len(infos[0].IPAddresses) != 1 || infos[0].NotAfter == nil {
+		t.Errorf("unexpected cert info %+v", infos[0])
+	}
+
+	// DER
+	block, _ := pem.Decode(cert.CertBytes)
+	if infos, err := Inspect(block.Bytes, ""); err != nil || len(infos) != 1 || infos[0].Fingerprint == "" {
+		t.Errorf("unexpected DER cert info %+v %v", infos, err)
+	}
+
+	now := time.Now()
+	der, err := s.CA.CreateCRL([]*CertRecord{{Serial: "0a", Revoked: true, RevokedAt: &now, NotAfter: now.Add(time.Hour)}}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infos, err := Inspect(der, ""); err != nil || len(infos) != 1 || infos[0].Type != ObjectCRL || len(infos[0].Revoked) != 1 || infos[0].Revoked[0].Serial != "a" {
+		t.Errorf("unexpected CRL info %+v %v", infos, err)
+	}
+
+	p12, _ := ioutil.ReadFile("testdata/modern.p12")
+	infos, err = Inspect(p12, "secret")
+	if err != nil || len(infos) != 2 || infos[0].Source != "pkcs12" || infos[1].Type != ObjectPrivateKey {
+		t.Errorf("unexpected PKCS#12 info %+v %v", infos, err)
+	}
+
+	for _, bad := range []string{"nothing", "-----BEGIN FOO-----\nAAAA\n-----END FOO-----\n"} {
+		if _, err := Inspect([]byte(bad), ""); err == nil {
+			t.Errorf("expected error inspecting %q", bad)
+		}
+	}
+}
+
+func Test_CheckKeyPair(t *testing.T) {
+	s := newTestServer(t)
+	csr, _ := NewCSR("a", KeyEd25519)
+	cert, _ := s.CA.CertFromCSR(csr)
+	crt, _ := cert.X509()
+	if err := CheckKeyPair(crt, csr.PrivateKey); err != nil {
+		t.Error(err)
+	}
+	other, _ := NewCSR("a", KeyEd25519)
+	if err := CheckKeyPair(crt, other.PrivateKey); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("expected a mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package certd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	ErrCertNotFound   = errors.New("cert not found")
+	ErrAlreadyRevoked = errors.New("cert already revoked")
+)
+
+// CertRecord describes a cert issued by the CA
+type CertRecord struct {
+	Serial           string     `json:"serial"`
+	Hosts            []string   `json:"hosts"`
+	Profile          string     `json:"profile,omitempty"`
+	NotBefore        time.Time  `json:"not_before"`
+	NotAfter         time.Time  `json:"not_after"`
+	Cert             string     `json:"cert"`
+	Revoked          bool       `json:"revoked"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+	RevocationReason string     `json:"revocation_reason,omitempty"`
+	// CA is set for a subordinate CA, Hosts are then the names it is
+	// limited to and Team the team it was issued to
+	CA   bool   `json:"ca,omitempty"`
+	Team string `json:"team,omitempty"`
+}
+
+// NewCertRecord creates a CertRecord describing cert
+func NewCertRecord(cert *Cert, profile string) (*CertRecord, error) {
+	crt, err := cert.X509()
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := append([]string{}, crt.DNSNames...)
+	for _, ip := range crt.IPAddresses {
+		hosts = append(hosts, ip.String())
+	}
+	if crt.IsCA {
+		for _, d := range crt.PermittedDNSDomains {
+			if d != noNames {
+				hosts = append(hosts, d)
+			}
+		}
+		for _, n := range crt.PermittedIPRanges {
+			hosts = append(hosts, n.String())
+		}
+	}
+
+	return &CertRecord{
+		Serial:    fmt.Sprintf("%x", crt.SerialNumber),
+		Hosts:     hosts,
+		Profile:   profile,
+		CA:        crt.IsCA,
+		NotBefore: crt.NotBefore,
+		NotAfter:  crt.NotAfter,
+		Cert:      string(cert.CertBytes),
+	}, nil
+}
+
+// Status returns "valid", "revoked" or "expired"
+func (r *CertRecord) Status(now time.Time) string {
+	switch {
+	case r.Revoked:
+		return "revoked"
+	case now.After(r.NotAfter):
+		return "expired"
+	}
+	return "valid"
+}
+
+// CertFilter selects records from an Inventory, zero fields match everything
+type CertFilter struct {
+	Host          string
+	Status        string
+	ExpiresBefore time.Time
+}
+
+func (f *CertFilter) match(r *CertRecord, now time.Time) bool {
+	if f.Status != "" && r.Status(now) != f.Status {
+		return false
+	}
+	if !f.ExpiresBefore.IsZero() && !r.NotAfter.Before(f.ExpiresBefore) {
+		return false
+	}
+	if f.Host != "" {
+		for _, h := range r.Hosts {
+			if strings.EqualFold(h, f.Host) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Inventory is a Store kept in memory. If it has a path every change is
+// written to it as JSON.
+type Inventory struct {
+	recordStore
+	path string
+}
+
+// NewInventory creates an in-memory Inventory
+func NewInventory() *Inventory {
+	i := &Inventory{}
+	i.idx = newCertIndex()
+	i.persist = i.save
+	return i
+}
+
+// LoadInventory loads an Inventory from path, an empty Inventory is
+// returned if path does not exist yet
+func LoadInventory(path string) (*Inventory, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no inventory specified")
+	}
+
+	i := NewInventory()
+	i.path = path
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return i, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var records []*CertRecord
+	if err := json.Unmarshal(b, &records); err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		i.idx.put(r)
+	}
+	return i, nil
+}
+
+// Check verifies the inventory can be written to
+func (i *Inventory) Check() error {
+	if i.path == "" {
+		return nil
+	}
+	return checkWritable(filepath.Dir(i.path))
+}
+
+// Close does nothing, every change is already on disk
+func (i *Inventory) Close() error {
+	return nil
+}
+
+// save writes the whole inventory to disk, it is called with the lock held
+func (i *Inventory) save(changed []*CertRecord) error {
+	if i.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(i.idx.all(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(i.path, b, 0600)
+}
+
+// checkWritable verifies a file can be created in dir
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".certd-check")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// writeFileAtomic writes b to a temporary file and renames it to path so
+// readers never see a partially written file
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
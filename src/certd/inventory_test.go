@@ -0,0 +1,78 @@
+package certd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_Inventory_persist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "certs.json")
+
+	i, err := LoadInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &CertRecord{Serial: "abc", Hosts: []string{"localhost"}, NotAfter: time.Now().Add(time.Hour)}
+	if err := i.Add(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Add(r); err == nil {
+		t.Errorf("expected error adding duplicate serial")
+	}
+	if _, err := i.Revoke("ABC", "test"); err != nil {
+		t.Error(err)
+	}
+	if _, err := i.Revoke("abc", "test"); err != ErrAlreadyRevoked {
+		t.Errorf("expected %v got %v", ErrAlreadyRevoked, err)
+	}
+
+	i, err = LoadInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = i.Get("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Revoked || r.RevocationReason != "test" {
+		t.Errorf("revocation not persisted: %+v", r)
+	}
+}
+
+func Test_Inventory_Load_error(t *testing.T) {
+	if _, err := LoadInventory(""); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if _, err := LoadInventory("ca.go"); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func Test_Inventory_List(t *testing.T) {
+	i := NewInventory()
+	now := time.Now()
+	i.Add(&CertRecord{Serial: "1", Hosts: []string{"a"}, NotAfter: now.Add(2 * time.Hour)})
+	i.Add(&CertRecord{Serial: "2", Hosts: []string{"b"}, NotAfter: now.Add(time.Hour)})
+	i.Add(&CertRecord{Serial: "3", Hosts: []string{"a"}, NotAfter: now.Add(-time.Hour)})
+
+	if l := i.List(CertFilter{}); len(l) != 3 || l[0].Serial != "3" {
+		t.Errorf("unexpected list %v", l)
+	}
+	if l := i.List(CertFilter{Host: "A", Status: "valid"}); len(l) != 1 || l[0].Serial != "1" {
+		t.Errorf("unexpected list %v", l)
+	}
+	if l := i.List(CertFilter{Status: "expired"}); len(l) != 1 || l[0].Serial != "3" {
+		t.Errorf("unexpected list %v", l)
+	}
+	if l := i.List(CertFilter{ExpiresBefore: now.Add(90 * time.Minute)}); len(l) != 2 {
+		t.Errorf("unexpected list %v", l)
+	}
+}
@@ -0,0 +1,197 @@
+package certd
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Key derivation functions for encrypted keys, with KDFShamir the key is
+// random and split into shares rather than derived from a passphrase
+const (
+	KDFScrypt = "scrypt"
+	KDFShamir = "shamir"
+)
+
+// ErrKeyShares is returned when key shares do not decrypt a key
+var ErrKeyShares = errors.New("the shares do not decrypt the key")
+
+// scrypt cost for new encrypted keys, 32MB and about 100ms
+const (
+	keyEncN = 1 << 15
+	keyEncR = 8
+	keyEncP = 1
+)
+
+// EncryptedKey is a PEM private key encrypted with AES-256-GCM under a key
+// derived from a passphrase with scrypt, or a random key split into shares
+type EncryptedKey struct {
+	KDF  string `json:"kdf"`
+	N    int    `json:"n,omitempty"`
+	R    int    `json:"r,omitempty"`
+	P    int    `json:"p,omitempty"`
+	Salt []byte `json:"salt,omitempty"`
+	// Shares, Threshold and ShareID describe a key split with KDFShamir,
+	// the ID is part of every share so shares of another key are rejected
+	Shares     int    `json:"shares,omitempty"`
+	Threshold  int    `json:"threshold,omitempty"`
+	ShareID    string `json:"share_id,omitempty"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// EncryptKey encrypts keyPEM with passphrase
+func EncryptKey(keyPEM []byte, passphrase string) (*EncryptedKey, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	k := &EncryptedKey{KDF: KDFScrypt, N: keyEncN, R: keyEncR, P: keyEncP, Salt: make([]byte, 16)}
+	if _, err := rand.Read(k.Salt); err != nil {
+		return nil, err
+	}
+	aead, err := k.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.seal(aead, keyPEM); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// EncryptKeyShares encrypts keyPEM with a random key that is split into n
+// shares, any threshold of which decrypt it with DecryptShares
+func EncryptKeyShares(keyPEM []byte, n, threshold int) (*EncryptedKey, []string, error) {
+	kek := make([]byte, 32)
+	id := make([]byte, 4)
+	for _, b := range [][]byte{kek, id} {
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+	}
+	parts, err := SplitSecret(kek, n, threshold)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	k := &EncryptedKey{KDF: KDFShamir, Shares: n, Threshold: threshold, ShareID: hex.EncodeToString(id)}
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := k.seal(aead, keyPEM); err != nil {
+		return nil, nil, err
+	}
+	shares := make([]string, n)
+	for i, part := range parts {
+		shares[i] = k.ShareID + "-" + hex.EncodeToString(part)
+	}
+	return k, shares, nil
+}
+
+// CheckShare checks share is one of the shares of k and returns it decoded
+func (k *EncryptedKey) CheckShare(share string) ([]byte, error) {
+	if k.KDF != KDFShamir {
+		return nil, fmt.Errorf("the key is not split into shares")
+	}
+	share = strings.TrimSpace(share)
+	id, data, ok := strings.Cut(share, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid share")
+	}
+	if id != k.ShareID {
+		return nil, fmt.Errorf("the share is for a different key")
+	}
+	b, err := hex.DecodeString(data)
+	if err != nil || len(b) != 33 || b[32] == 0 {
+		return nil, fmt.Errorf("invalid share")
+	}
+	return b, nil
+}
+
+// DecryptShares returns the PEM private key, at least Threshold shares must
+// be given. ErrKeyShares is returned if they do not decrypt it.
+func (k *EncryptedKey) DecryptShares(shares []string) ([]byte, error) {
+	if len(shares) < k.Threshold {
+		return nil, fmt.Errorf("%v shares are needed, got %v", k.Threshold, len(shares))
+	}
+	parts := make([][]byte, len(shares))
+	for i, share := range shares {
+		var err error
+		if parts[i], err = k.CheckShare(share); err != nil {
+			return nil, err
+		}
+	}
+	kek, err := CombineShares(parts)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := k.open(aead)
+	if err != nil {
+		return nil, ErrKeyShares
+	}
+	return keyPEM, nil
+}
+
+// Decrypt returns the PEM private key, ErrKeyPassphrase if passphrase is
+// wrong
+func (k *EncryptedKey) Decrypt(passphrase string) ([]byte, error) {
+	aead, err := k.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := k.open(aead)
+	if err != nil {
+		return nil, ErrKeyPassphrase
+	}
+	return keyPEM, nil
+}
+
+// seal encrypts keyPEM with a new nonce
+func (k *EncryptedKey) seal(aead cipher.AEAD, keyPEM []byte) error {
+	k.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(k.Nonce); err != nil {
+		return err
+	}
+	k.Ciphertext = aead.Seal(nil, k.Nonce, keyPEM, nil)
+	return nil
+}
+
+func (k *EncryptedKey) open(aead cipher.AEAD) ([]byte, error) {
+	if len(k.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+	return aead.Open(nil, k.Nonce, k.Ciphertext, nil)
+}
+
+func (k *EncryptedKey) aead(passphrase string) (cipher.AEAD, error) {
+	switch k.KDF {
+	case KDFScrypt:
+	case KDFShamir:
+		return nil, fmt.Errorf("the key is split into shares, unseal it with %v of them", k.Threshold)
+	default:
+		return nil, fmt.Errorf("unsupported key derivation function \"%v\"", k.KDF)
+	}
+	key, err := scryptKey([]byte(passphrase), k.Salt, k.N, k.R, k.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key)
+}
+
+// newAEAD returns AES-256-GCM with key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,369 @@
+package certd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The kv store file starts with kvMagic followed by batches. Each batch is
+// its length and CRC32 as big endian uint32s followed by a JSON kvBatch. A
+// batch is only applied if it is complete and its checksum matches, so a
+// transaction is either stored entirely or not at all.
+
+const kvMagic = "certd-kv\n"
+
+// buckets in the kv store
+const (
+	kvMeta  = "meta"
+	kvCerts = "certs"
+)
+
+// kvCompactRatio is how many times more batches than live keys the log can
+// hold before it is compacted when opened
+const kvCompactRatio = 4
+
+type kvOp struct {
+	Bucket string `json:"b"`
+	Key    string `json:"k"`
+	// Value is nil when the key is deleted
+	Value json.RawMessage `json:"v,omitempty"`
+}
+
+type kvBatch struct {
+	Ops []kvOp `json:"ops"`
+}
+
+// kvMigration upgrades the data in the store to the next schema version,
+// the ops it returns are applied in the same batch as the version change
+type kvMigration func(data map[string]map[string][]byte) ([]kvOp, error)
+
+// kvMigrations are applied in order, the schema version of a store is the
+// number of migrations that have been applied to it
+var kvMigrations = []kvMigration{
+	// 1: certs are stored in the certs bucket keyed by serial
+	func(data map[string]map[string][]byte) ([]kvOp, error) {
+		return nil, nil
+	},
+}
+
+// KVStore is a Store in an embedded, append-only key/value file. Records
+// are indexed in memory by serial, host and expiry. Several instances can
+// share the file, each takes a lock on it and reads what the others have
+// written before every read and transaction.
+type KVStore struct {
+	recordStore
+	path string
+	f    *os.File
+	data map[string]map[string][]byte
+	// offset is the end of the last batch read or written
+	offset  int64
+	batches int
+}
+
+// OpenKVStore opens the store at path, creating it if it does not exist, and
+// applies any migrations it needs
+func OpenKVStore(path string) (*KVStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no store specified")
+	}
+
+	s := &KVStore{path: path}
+	s.persist = s.save
+	s.shared = s.lock
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	release, err := s.lock(true)
+	if err != nil {
+		s.f.Close()
+		return nil, err
+	}
+	defer release()
+
+	if err := s.migrate(); err != nil {
+		s.f.Close()
+		return nil, err
+	}
+	if s.batches > kvCompactRatio*(len(s.data[kvCerts])+1) {
+		if err := s.compact(); err != nil {
+			s.f.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// open opens the file, it is read by catchUp once it is locked
+func (s *KVStore) open() error {
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	s.f = f
+	s.data = make(map[string]map[string][]byte)
+	s.idx = newCertIndex()
+	s.offset = 0
+	s.batches = 0
+	return nil
+}
+
+// lock takes a lock on the file across instances and reads the batches
+// written since it was last locked. If another instance has replaced the
+// file by compacting it, the new file is read from the start.
+func (s *KVStore) lock(write bool) (func(), error) {
+	for {
+		if err := lockFile(s.f, write); err != nil {
+			return nil, err
+		}
+		fi, err := s.f.Stat()
+		if err != nil {
+			unlockFile(s.f)
+			return nil, err
+		}
+		if pi, err := os.Stat(s.path); err == nil && os.SameFile(fi, pi) {
+			break
+		}
+		unlockFile(s.f)
+		s.f.Close()
+		if err := s.open(); err != nil {
+			return nil, err
+		}
+	}
+
+	f := s.f
+	release := func() { unlockFile(f) }
+	if err := s.catchUp(write); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// catchUp applies the batches after offset. An incomplete batch at the end
+// of the file is left by a crash while writing, it is removed when the
+// file is locked for writing.
+func (s *KVStore) catchUp(write bool) error {
+	st, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(io.NewSectionReader(s.f, s.offset, st.Size()-s.offset))
+
+	if s.offset == 0 {
+		magic := make([]byte, len(kvMagic))
+		if n, err := io.ReadFull(r, magic); n == 0 && err == io.EOF {
+			if !write {
+				return nil
+			}
+			if _, err := s.f.WriteAt([]byte(kvMagic), 0); err != nil {
+				return err
+			}
+			s.offset = int64(len(kvMagic))
+			return s.f.Sync()
+		} else if err != nil || string(magic) != kvMagic {
+			return fmt.Errorf("%v: not a certd kv store", s.path)
+		}
+		s.offset = int64(len(kvMagic))
+	}
+
+	for {
+		b, err := readKVBatch(r)
+		if err == io.EOF {
+			return nil
+		} else if errors.Is(err, io.ErrUnexpectedEOF) {
+			if !write {
+				return nil
+			}
+			logger.Warn("removing incomplete transaction from the end of the store", "path", s.path, "offset", s.offset)
+			return s.f.Truncate(s.offset)
+		} else if err != nil {
+			return fmt.Errorf("%v: offset %v: %v", s.path, s.offset, err)
+		}
+		if err := s.apply(b.ops); err != nil {
+			return fmt.Errorf("%v: offset %v: %v", s.path, s.offset, err)
+		}
+		s.batches++
+		s.offset += b.size
+	}
+}
+
+type kvRead struct {
+	ops  []kvOp
+	size int64
+}
+
+func readKVBatch(r io.Reader) (*kvRead, error) {
+	var header [8]byte
+	if n, err := io.ReadFull(r, header[:]); n == 0 && err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	sum := binary.BigEndian.Uint32(header[4:])
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return nil, fmt.Errorf("checksum mismatch, the store is corrupt")
+	}
+
+	var b kvBatch
+	if err := json.Unmarshal(payload, &b); err != nil {
+		return nil, err
+	}
+	return &kvRead{b.Ops, int64(len(header)) + int64(size)}, nil
+}
+
+func encodeKVBatch(ops []kvOp) ([]byte, error) {
+	payload, err := json.Marshal(&kvBatch{ops})
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(b[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(payload))
+	return append(b, payload...), nil
+}
+
+// apply updates the data and the cert index with ops
+func (s *KVStore) apply(ops []kvOp) error {
+	for _, op := range ops {
+		if op.Value == nil {
+			delete(s.data[op.Bucket], op.Key)
+			if op.Bucket == kvCerts {
+				s.idx.remove(op.Key)
+			}
+			continue
+		}
+		if s.data[op.Bucket] == nil {
+			s.data[op.Bucket] = make(map[string][]byte)
+		}
+		s.data[op.Bucket][op.Key] = op.Value
+		if op.Bucket == kvCerts {
+			var r CertRecord
+			if err := json.Unmarshal(op.Value, &r); err != nil {
+				return fmt.Errorf("cert %v: %v", op.Key, err)
+			}
+			s.idx.put(&r)
+		}
+	}
+	return nil
+}
+
+// write appends ops as a single batch, the file must be locked for writing
+func (s *KVStore) write(ops []kvOp) error {
+	b, err := encodeKVBatch(ops)
+	if err != nil {
+		return err
+	}
+	if _, err := s.f.WriteAt(b, s.offset); err != nil {
+		s.f.Truncate(s.offset)
+		return err
+	}
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+	s.offset += int64(len(b))
+	s.batches++
+	return s.apply(ops)
+}
+
+// SchemaVersion returns the number of migrations applied to the store
+func (s *KVStore) SchemaVersion() int {
+	var v int
+	json.Unmarshal(s.data[kvMeta]["schema_version"], &v)
+	return v
+}
+
+func (s *KVStore) migrate() error {
+	version := s.SchemaVersion()
+	if version > len(kvMigrations) {
+		return fmt.Errorf("%v: schema version %v is newer than this version of certd supports", s.path, version)
+	}
+	for ; version < len(kvMigrations); version++ {
+		ops, err := kvMigrations[version](s.data)
+		if err != nil {
+			return fmt.Errorf("%v: migration %v: %v", s.path, version+1, err)
+		}
+		v, _ := json.Marshal(version + 1)
+		ops = append(ops, kvOp{Bucket: kvMeta, Key: "schema_version", Value: v})
+		if err := s.write(ops); err != nil {
+			return err
+		}
+		logger.Info("migrated store", "path", s.path, "schema_version", version+1)
+	}
+	return nil
+}
+
+// compact rewrites the file with a single batch holding the live keys
+func (s *KVStore) compact() error {
+	var ops []kvOp
+	buckets := make([]string, 0, len(s.data))
+	for bucket := range s.data {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	for _, bucket := range buckets {
+		for key, value := range s.data[bucket] {
+			ops = append(ops, kvOp{Bucket: bucket, Key: key, Value: value})
+		}
+	}
+	b, err := encodeKVBatch(ops)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, append([]byte(kvMagic), b...), 0600); err != nil {
+		return err
+	}
+
+	// closing the old file releases its lock, instances waiting for it
+	// then see it has been replaced
+	f, err := os.OpenFile(s.path, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	s.f.Close()
+	s.f = f
+	s.offset = int64(len(kvMagic) + len(b))
+	s.batches = 1
+	logger.Info("compacted store", "path", s.path)
+	return nil
+}
+
+// save writes the records changed by a transaction as one batch
+func (s *KVStore) save(changed []*CertRecord) error {
+	ops := make([]kvOp, 0, len(changed))
+	for _, r := range changed {
+		v, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, kvOp{Bucket: kvCerts, Key: strings.ToLower(r.Serial), Value: v})
+	}
+	return s.write(ops)
+}
+
+// Check verifies the store can be written to
+func (s *KVStore) Check() error {
+	return checkWritable(filepath.Dir(s.path))
+}
+
+// Close closes the store file
+func (s *KVStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
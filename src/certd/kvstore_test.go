@@ -0,0 +1,240 @@
+package certd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_KVStore_incomplete_batch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "certd.db")
+
+	s, err := OpenKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(&CertRecord{Serial: "1"})
+	s.Close()
+
+	// simulate a crash part way through writing a batch
+	st, _ := os.Stat(path)
+	b, _ := encodeKVBatch([]kvOp{{Bucket: kvCerts, Key: "2", Value: json.RawMessage(`{"serial":"2"}`)}})
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write(b[:len(b)-3])
+	f.Close()
+
+	s, err = OpenKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("2"); err != ErrCertNotFound {
+		t.Errorf("expected the incomplete batch to be ignored, got %v", err)
+	}
+	if err := s.Add(&CertRecord{Serial: "3"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = OpenKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if l := s.List(CertFilter{}); len(l) != 2 {
+		t.Errorf("expected 2 records, got %v", l)
+	}
+	if st2, _ := os.Stat(path); st2.Size() <= st.Size() {
+		t.Errorf("expected the store to have grown")
+	}
+}
+
+func Test_KVStore_corrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "certd.db")
+
+	s, err := OpenKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(&CertRecord{Serial: "abcdef"})
+	s.Close()
+
+	b, _ := ioutil.ReadFile(path)
+	b[len(b)-5] ^= 0xff
+	ioutil.WriteFile(path, b, 0600)
+	if _, err := OpenKVStore(path); err == nil {
+		t.Errorf("expected error opening a corrupt store")
+	}
+
+	ioutil.WriteFile(path, []byte("something else"), 0600)
+	if _, err := OpenKVStore(path); err == nil {
+		t.Errorf("expected error opening a file that is not a store")
+	}
+}
+
+func Test_KVStore_migrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "certd.db")
+
+	s, err := OpenKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := s.SchemaVersion(); v != len(kvMigrations) {
+		t.Errorf("expected schema version %v got %v", len(kvMigrations), v)
+	}
+	s.Add(&CertRecord{Serial: "1", Hosts: []string{"a"}})
+	s.Close()
+
+	defer func(m []kvMigration) { kvMigrations = m }(kvMigrations)
+	kvMigrations = append(kvMigrations, func(data map[string]map[string][]byte) ([]kvOp, error) {
+		var ops []kvOp
+		for key, value := range data[kvCerts] {
+			var r CertRecord
+			json.Unmarshal(value, &r)
+			r.Profile = "migrated"
+			v, _ := json.Marshal(&r)
+			ops = append(ops, kvOp{Bucket: kvCerts, Key: key, Value: v})
+		}
+		return ops, nil
+	})
+
+	s, err = OpenKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := s.SchemaVersion(); v != len(kvMigrations) {
+		t.Errorf("expected schema version %v got %v", len(kvMigrations), v)
+	}
+	if r, _ := s.Get("1"); r == nil || r.Profile != "migrated" {
+		t.Errorf("migration not applied: %+v", r)
+	}
+	s.Close()
+
+	kvMigrations = kvMigrations[:1]
+	if _, err := OpenKVStore(path); err == nil {
+		t.Errorf("expected error opening a store with a newer schema")
+	}
+}
+
+func Test_KVStore_compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "certd.db")
+
+	s, err := OpenKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		s.Add(&CertRecord{Serial: fmt.Sprint(i)})
+	}
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 5; j++ {
+			s.Update(func(tx StoreTx) error {
+				r, _ := tx.Get(fmt.Sprint(i))
+				r.RevocationReason = fmt.Sprint(j)
+				return tx.Put(r)
+			})
+		}
+	}
+	s.Close()
+	before, _ := os.Stat(path)
+
+	s, err = OpenKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.batches != 1 {
+		t.Errorf("expected the store to be compacted, it has %v batches", s.batches)
+	}
+	if after, _ := os.Stat(path); after.Size() >= before.Size() {
+		t.Errorf("expected compaction to shrink the store from %v, got %v", before.Size(), after.Size())
+	}
+	if r, _ := s.Get("4"); r == nil || r.RevocationReason != "4" {
+		t.Errorf("unexpected record after compaction %+v", r)
+	}
+	if err := s.Add(&CertRecord{Serial: "5"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_KVStore_shared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "certd.db")
+
+	a, err := OpenKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := OpenKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Add(&CertRecord{Serial: "1", Hosts: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(&CertRecord{Serial: "1"}); err == nil {
+		t.Errorf("expected error adding a serial added by another instance")
+	}
+	if _, err := b.Revoke("1", "shared"); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := a.Get("1"); err != nil || !r.Revoked {
+		t.Errorf("revocation by another instance not seen: %+v %v", r, err)
+	}
+
+	// enough updates for the next instance to open the store to compact it
+	for i := 0; i < 10; i++ {
+		b.Update(func(tx StoreTx) error {
+			r, _ := tx.Get("1")
+			r.RevocationReason = fmt.Sprint(i)
+			return tx.Put(r)
+		})
+	}
+	b.Close()
+	c, err := OpenKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.batches != 1 {
+		t.Fatalf("expected the store to be compacted, it has %v batches", c.batches)
+	}
+
+	if err := a.Add(&CertRecord{Serial: "2", Hosts: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if l := c.List(CertFilter{Host: "a"}); len(l) != 2 {
+		t.Errorf("expected 2 records after compaction, got %v", l)
+	}
+	if r, _ := a.Get("1"); r == nil || r.RevocationReason != "9" {
+		t.Errorf("unexpected record after compaction %+v", r)
+	}
+}
@@ -0,0 +1,154 @@
+package certd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const DefaultLeaseInterval = 10 * time.Second
+
+// Lease elects a single leader among certd instances sharing a store. Every
+// instance issues certs but only the leader runs the scheduled jobs, such as
+// generating the CRL.
+type Lease interface {
+	// TryAcquire takes or renews the lease without blocking and reports
+	// whether this instance holds it
+	TryAcquire() (bool, error)
+	// Release gives up the lease if it is held
+	Release() error
+}
+
+// FileLease is a Lease held with an exclusive lock on a file that every
+// instance can reach. The OS releases the lock if the process dies so a
+// standby takes over on its next attempt.
+type FileLease struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+// NewFileLease creates a FileLease using the file at path
+func NewFileLease(path string) *FileLease {
+	return &FileLease{path: path}
+}
+
+// TryAcquire implements Lease
+func (l *FileLease) TryAcquire() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f != nil {
+		return true, nil
+	}
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return false, err
+	}
+	ok, err := tryLockFile(f)
+	if !ok {
+		f.Close()
+		return false, err
+	}
+
+	// record who holds the lease for anyone looking at the file
+	host, _ := os.Hostname()
+	f.Truncate(0)
+	f.WriteAt([]byte(fmt.Sprintf("%v %v %v\n", host, os.Getpid(), time.Now().UTC().Format(time.RFC3339))), 0)
+	l.f = f
+	return true, nil
+}
+
+// Release implements Lease
+func (l *FileLease) Release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	unlockFile(l.f)
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// leaderJob is a job only the leader runs, every interval
+type leaderJob struct {
+	name     string
+	interval time.Duration
+	run      func() error
+	last     time.Time
+}
+
+// IsLeader reports whether this instance holds the lease, an instance with
+// no Lease is always the leader. A tenant leads when its server does.
+func (s *Server) IsLeader() bool {
+	if s.parent != nil {
+		return s.parent.IsLeader()
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Lease == nil || s.leader
+}
+
+func (s *Server) setLeader(leader bool) {
+	s.mu.Lock()
+	changed := s.leader != leader
+	s.leader = leader
+	s.mu.Unlock()
+
+	switch {
+	case changed && leader:
+		logger.Info("acquired the lease, this instance is the leader")
+	case changed:
+		logger.Warn("lost the lease, this instance is a standby")
+	}
+}
+
+// runLeader tries to acquire the lease every LeaseInterval and, while it is
+// held, runs the leader's jobs when they are due. The lease is released
+// when ctx is cancelled.
+func (s *Server) runLeader(ctx context.Context, jobs []*leaderJob) {
+	interval := s.LeaseInterval
+	if interval <= 0 {
+		interval = DefaultLeaseInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		leader := true
+		if s.Lease != nil {
+			var err error
+			if leader, err = s.Lease.TryAcquire(); err != nil {
+				logger.Error("failed to acquire the lease", "error", err)
+			}
+			s.setLeader(leader)
+		}
+
+		if leader {
+			for _, job := range jobs {
+				if time.Since(job.last) < job.interval {
+					continue
+				}
+				job.last = time.Now()
+				if err := job.run(); err != nil {
+					logger.Error("leader job failed", "job", job.name, "error", err)
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if s.Lease != nil {
+				s.Lease.Release()
+				s.setLeader(false)
+			}
+			return
+		}
+	}
+}
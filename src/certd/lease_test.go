@@ -0,0 +1,86 @@
+package certd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_FileLease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "certd.lease")
+
+	a, b := NewFileLease(path), NewFileLease(path)
+	if ok, err := a.TryAcquire(); !ok || err != nil {
+		t.Fatalf("expected to acquire the lease: %v", err)
+	}
+	if ok, _ := a.TryAcquire(); !ok {
+		t.Errorf("expected the holder to renew the lease")
+	}
+	if ok, err := b.TryAcquire(); ok || err != nil {
+		t.Errorf("expected the lease to be held: %v %v", ok, err)
+	}
+
+	a.Release()
+	if ok, err := b.TryAcquire(); !ok || err != nil {
+		t.Errorf("expected to acquire the released lease: %v", err)
+	}
+	b.Release()
+}
+
+type testLease struct {
+	held atomic.Bool
+}
+
+func (l *testLease) TryAcquire() (bool, error) {
+	return l.held.Load(), nil
+}
+
+func (l *testLease) Release() error {
+	return nil
+}
+
+func Test_Server_runLeader(t *testing.T) {
+	s := newTestServer(t)
+	lease := &testLease{}
+	s.Lease = lease
+	s.LeaseInterval = 10 * time.Millisecond
+
+	var runs atomic.Int32
+	jobs := []*leaderJob{{name: "test", interval: time.Millisecond, run: func() error {
+		runs.Add(1)
+		return nil
+	}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.runLeader(ctx, jobs)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if runs.Load() != 0 || s.IsLeader() {
+		t.Errorf("standby ran %v jobs", runs.Load())
+	}
+
+	lease.held.Store(true)
+	time.Sleep(50 * time.Millisecond)
+	if runs.Load() == 0 || !s.IsLeader() {
+		t.Errorf("expected the leader to run jobs")
+	}
+
+	cancel()
+	<-done
+	if s.IsLeader() {
+		t.Errorf("expected the lease to be released")
+	}
+}
@@ -0,0 +1,333 @@
+package certd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ledger events
+const (
+	LedgerIssue  = "issue"
+	LedgerRevoke = "revoke"
+	// events of an offline root's ceremony transcript
+	LedgerRootCreated      = "root_created"
+	LedgerSignIntermediate = "sign_intermediate"
+	LedgerSignCRL          = "sign_crl"
+)
+
+// LedgerEntry records an issuance or revocation. Each entry contains the hash
+// of the one before it and is signed by the CA so any edit, insertion or
+// removal breaks the chain. The ceremony transcript of an offline root is a
+// ledger too, its entries also record the operator, the subject of a cert
+// and the hash of a CRL.
+type LedgerEntry struct {
+	Seq        uint64    `json:"seq"`
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Serial     string    `json:"serial"`
+	Hosts      []string  `json:"hosts,omitempty"`
+	CertSHA256 string    `json:"cert_sha256,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Operator   string    `json:"operator,omitempty"`
+	Subject    string    `json:"subject,omitempty"`
+	CRLSHA256  string    `json:"crl_sha256,omitempty"`
+	PrevHash   string    `json:"prev_hash"`
+	Hash       string    `json:"hash"`
+	Signature  []byte    `json:"signature"`
+}
+
+// digest returns the hash of the entry, which covers every field except the
+// hash and signature
+func (e *LedgerEntry) digest() (string, error) {
+	c := *e
+	c.Hash = ""
+	c.Signature = nil
+	b, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// LedgerError describes the first broken link found by VerifyLedger
+type LedgerError struct {
+	Line   int
+	Seq    uint64
+	Reason string
+}
+
+func (e *LedgerError) Error() string {
+	return fmt.Sprintf("line %v (seq %v): %v", e.Line, e.Seq, e.Reason)
+}
+
+// Ledger is an append-only, hash-chained file of LedgerEntry in JSON lines.
+// Instances sharing a ledger lock it while appending and read the entries
+// the others have added so the chain stays intact.
+type Ledger struct {
+	mu       sync.Mutex
+	f        *os.File
+	seq      uint64
+	lastHash string
+	// offset is the end of the last entry read or written
+	offset int64
+}
+
+// OpenLedger opens the ledger at path, creating it if it does not exist
+func OpenLedger(path string) (*Ledger, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no ledger specified")
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Ledger{f: f}
+	if err := lockFile(f, false); err != nil {
+		f.Close()
+		return nil, err
+	}
+	defer unlockFile(f)
+	if err := l.catchUp(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return l, nil
+}
+
+// catchUp reads the entries after offset, the file must be locked
+func (l *Ledger) catchUp() error {
+	st, err := l.f.Stat()
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(io.NewSectionReader(l.f, l.offset, st.Size()-l.offset))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e LedgerEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("corrupt entry after seq %v: %v", l.seq, err)
+		}
+		l.seq = e.Seq
+		l.lastHash = e.Hash
+		l.offset += int64(len(scanner.Bytes())) + 1
+	}
+	return scanner.Err()
+}
+
+// Append chains, signs and writes e to the ledger
+func (l *Ledger) Append(e *LedgerEntry, signer crypto.Signer) error {
+	p, err := l.prepare(e, signer)
+	if err != nil {
+		return err
+	}
+	p.commit()
+	return nil
+}
+
+// pendingEntry is an entry written by prepare, the ledger stays locked until
+// commit keeps it or rollback removes it
+type pendingEntry struct {
+	l *Ledger
+	// the end of the ledger before the entry
+	offset   int64
+	seq      uint64
+	lastHash string
+}
+
+// prepare chains, signs and writes e like Append but keeps the ledger locked
+// so the entry can be removed if what it records is not stored
+func (l *Ledger) prepare(e *LedgerEntry, signer crypto.Signer) (*pendingEntry, error) {
+	l.mu.Lock()
+	if err := lockFile(l.f, true); err != nil {
+		l.mu.Unlock()
+		return nil, err
+	}
+	p := &pendingEntry{l: l}
+	if err := l.catchUp(); err != nil {
+		p.unlock()
+		return nil, err
+	}
+	p.offset, p.seq, p.lastHash = l.offset, l.seq, l.lastHash
+
+	e.Seq = l.seq + 1
+	e.Time = time.Now().UTC()
+	e.PrevHash = l.lastHash
+	hash, err := e.digest()
+	if err != nil {
+		p.unlock()
+		return nil, err
+	}
+	e.Hash = hash
+
+	digest := sha256.Sum256([]byte(e.Hash))
+	if e.Signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+		p.unlock()
+		return nil, err
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		p.unlock()
+		return nil, err
+	}
+	// a partly written entry is removed so the chain stays readable
+	if _, err := l.f.Write(append(b, '\n')); err != nil {
+		p.rollback()
+		return nil, err
+	}
+	if err := l.f.Sync(); err != nil {
+		p.rollback()
+		return nil, err
+	}
+	l.offset += int64(len(b)) + 1
+
+	l.seq = e.Seq
+	l.lastHash = e.Hash
+	return p, nil
+}
+
+// commit keeps the entry, p may be nil when there is no ledger
+func (p *pendingEntry) commit() {
+	if p != nil {
+		p.unlock()
+	}
+}
+
+// rollback removes the entry from the ledger
+func (p *pendingEntry) rollback() error {
+	l := p.l
+	defer p.unlock()
+	if err := l.f.Truncate(p.offset); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.offset, l.seq, l.lastHash = p.offset, p.seq, p.lastHash
+	return nil
+}
+
+// finish commits the entry if err is nil and rolls it back otherwise, p may
+// be nil when there is no ledger
+func (p *pendingEntry) finish(err error) {
+	if p == nil {
+		return
+	}
+	if err == nil {
+		p.commit()
+		return
+	}
+	if err := p.rollback(); err != nil {
+		logger.Error("failed to remove a ledger entry that was not stored", "seq", p.seq+1, "error", err)
+	}
+}
+
+func (p *pendingEntry) unlock() {
+	unlockFile(p.l.f)
+	p.l.mu.Unlock()
+}
+
+// Entries returns the entries in the ledger once they are verified against
+// caCerts like VerifyLedger does
+func (l *Ledger) Entries(caCerts ...*x509.Certificate) ([]*LedgerEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	st, err := l.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return ReadLedger(io.NewSectionReader(l.f, 0, st.Size()), caCerts...)
+}
+
+// Close closes the ledger file
+func (l *Ledger) Close() error {
+	return l.f.Close()
+}
+
+// VerifyLedger walks the chain in r checking every hash, link and signature
+// against caCerts, every root that has signed entries. It returns the number
+// of valid entries and a *LedgerError describing the first broken or missing
+// link.
+func VerifyLedger(r io.Reader, caCerts ...*x509.Certificate) (int, error) {
+	return walkLedger(r, caCerts, func(*LedgerEntry) {})
+}
+
+// ReadLedger returns the entries in r, each is verified like VerifyLedger
+// does and a *LedgerError is returned for the first broken or missing link
+func ReadLedger(r io.Reader, caCerts ...*x509.Certificate) ([]*LedgerEntry, error) {
+	var entries []*LedgerEntry
+	if _, err := walkLedger(r, caCerts, func(e *LedgerEntry) { entries = append(entries, e) }); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// walkLedger verifies the entries in r against caCerts and calls fn with
+// each valid one
+func walkLedger(r io.Reader, caCerts []*x509.Certificate, fn func(*LedgerEntry)) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line := 0
+	prev := LedgerEntry{}
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			return line - 1, &LedgerError{line, prev.Seq + 1, "empty line"}
+		}
+
+		var e LedgerEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return line - 1, &LedgerError{line, prev.Seq + 1, "unreadable entry: " + err.Error()}
+		}
+		if e.Seq != prev.Seq+1 {
+			return line - 1, &LedgerError{line, e.Seq, fmt.Sprintf("expected seq %v, entries are missing or out of order", prev.Seq+1)}
+		}
+		if e.PrevHash != prev.Hash {
+			return line - 1, &LedgerError{line, e.Seq, "previous hash does not match, the chain is broken"}
+		}
+		hash, err := e.digest()
+		if err != nil {
+			return line - 1, &LedgerError{line, e.Seq, err.Error()}
+		}
+		if hash != e.Hash {
+			return line - 1, &LedgerError{line, e.Seq, "hash does not match contents, the entry was modified"}
+		}
+		if err := checkLedgerSignature(caCerts, e); err != nil {
+			return line - 1, &LedgerError{line, e.Seq, "invalid signature: " + err.Error()}
+		}
+		valid := e
+		fn(&valid)
+		prev = e
+	}
+	if err := scanner.Err(); err != nil {
+		return line, err
+	}
+	return line, nil
+}
+
+// checkLedgerSignature checks e was signed by one of caCerts
+func checkLedgerSignature(caCerts []*x509.Certificate, e LedgerEntry) error {
+	err := fmt.Errorf("no CA cert to check against")
+	for _, caCert := range caCerts {
+		if err = caCert.CheckSignature(signatureAlgorithm(caCert.PublicKey), []byte(e.Hash), e.Signature); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,248 @@
+package certd
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestLedger(t *testing.T) (*CA, string) {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	c, err := SetupCA(filepath.Join(dir, "certd.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "ledger.jsonl")
+	if c.Ledger, err = OpenLedger(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Ledger.Close() })
+
+	for _, hosts := range []string{"a.local", "b.local,127.0.0.1"} {
+		csr, _ := CreateCSR(hosts)
+		if _, err := c.CertFromCSR(csr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.RecordRevocation("abc", "testing"); err != nil {
+		t.Fatal(err)
+	}
+	return c, path
+}
+
+func Test_Ledger_verify(t *testing.T) {
+	c, path := newTestLedger(t)
+	caCert, _ := c.Cert()
+
+	b, _ := ioutil.ReadFile(path)
+	n, err := VerifyLedger(bytes.NewReader(b), caCert)
+	if err != nil || n != 3 {
+		t.Fatalf("expected 3 valid entries got %v: %v", n, err)
+	}
+
+	// reopening continues the chain
+	c.Ledger.Close()
+	if c.Ledger, err = OpenLedger(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RecordRevocation("def", ""); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadFile(path)
+	if n, err := VerifyLedger(bytes.NewReader(b), caCert); err != nil || n != 4 {
+		t.Errorf("expected 4 valid entries got %v: %v", n, err)
+	}
+}
+
+func Test_Ledger_tampered(t *testing.T) {
+	c, path := newTestLedger(t)
+	caCert, _ := c.Cert()
+	b, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+
+	tests := map[string]struct {
+		lines []string
+		line  int
+	}{
+		"modified":  {[]string{lines[0], strings.Replace(lines[1], "b.local", "evil.local", 1), lines[2]}, 2},
+		"removed":   {[]string{lines[0], lines[2]}, 2},
+		"reordered": {[]string{lines[1], lines[0], lines[2]}, 1},
+		"garbage":   {[]string{lines[0], "{", lines[2]}, 2},
+	}
+	for name, tt := range tests {
+		n, err := VerifyLedger(strings.NewReader(strings.Join(tt.lines, "\n")), caCert)
+		le, ok := err.(*LedgerError)
+		if !ok {
+			t.Errorf("%v: expected LedgerError got %v", name, err)
+			continue
+		}
+		if le.Line != tt.line || n != tt.line-1 {
+			t.Errorf("%v: expected failure at line %v got %v (%v valid)", name, tt.line, le.Line, n)
+		}
+	}
+
+	other := newTestServer(t)
+	otherCert, _ := other.CA.Cert()
+	if _, err := VerifyLedger(bytes.NewReader(b), otherCert); err == nil {
+		t.Errorf("expected signature check to fail for another CA")
+	}
+}
+
+func Test_Ledger_server_revoke(t *testing.T) {
+	c, path := newTestLedger(t)
+	s := NewServer(c, "127.0.0.1", "4443", "")
+
+	var issued IssuedCert
+	apiRequest(t, s, "POST", "/api/v1/certificates", strings.NewReader(`{"hosts":["c.local"]}`), &issued)
+	// concurrent revocations are recorded once
+	var wg sync.WaitGroup
+	codes := make(chan int, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- apiRequest(t, s, "POST", "/api/v1/certificates/"+issued.Serial+"/revoke", nil, nil).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	revoked := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			revoked++
+		}
+	}
+	if revoked != 1 {
+		t.Errorf("expected one revocation to succeed got %v", revoked)
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 5 || !strings.Contains(lines[4], `"event":"revoke","serial":"`+issued.Serial+`"`) {
+		t.Errorf("revocation not recorded: %v", lines)
+	}
+}
+
+// failingStore fails to store any change
+type failingStore struct{ Store }
+
+type failingTx struct{ StoreTx }
+
+func (s failingStore) Revoke(serial, reason string) (*CertRecord, error) {
+	return nil, errors.New("store failed")
+}
+
+func (s failingStore) Update(fn func(tx StoreTx) error) error {
+	return s.Store.Update(func(tx StoreTx) error { return fn(failingTx{tx}) })
+}
+
+func (tx failingTx) Put(r *CertRecord) error {
+	return errors.New("store failed")
+}
+
+func Test_Ledger_server_revoke_failed(t *testing.T) {
+	c, path := newTestLedger(t)
+	s := NewServer(c, "127.0.0.1", "4443", "")
+	var issued IssuedCert
+	apiRequest(t, s, "POST", "/api/v1/certificates", strings.NewReader(`{"hosts":["c.local"]}`), &issued)
+
+	// a revocation the store fails to record is not in the ledger
+	s.Inventory = failingStore{s.Inventory}
+	if rr := apiRequest(t, s, "POST", "/api/v1/certificates/"+issued.Serial+"/revoke", nil, nil); rr.Code == http.StatusOK {
+		t.Fatalf("expected the revocation to fail")
+	}
+	b, _ := ioutil.ReadFile(path)
+	if lines := strings.Split(strings.TrimSpace(string(b)), "\n"); len(lines) != 4 {
+		t.Errorf("expected no revocation in the ledger got %v entries", len(lines))
+	}
+}
+
+func Test_Ledger_server_persist_failed(t *testing.T) {
+	c, path := newTestLedger(t)
+	s := NewServer(c, "127.0.0.1", "4443", "")
+	fail := false
+	inv := NewInventory()
+	inv.persist = func([]*CertRecord) error {
+		if fail {
+			return errors.New("disk full")
+		}
+		return nil
+	}
+	s.Inventory = inv
+	var issued IssuedCert
+	apiRequest(t, s, "POST", "/api/v1/certificates", strings.NewReader(`{"hosts":["c.local"]}`), &issued)
+
+	// an issuance or revocation the store fails to commit is removed from
+	// the ledger again
+	fail = true
+	if rr := apiRequest(t, s, "POST", "/api/v1/certificates", strings.NewReader(`{"hosts":["d.local"]}`), nil); rr.Code == http.StatusCreated {
+		t.Fatalf("expected the issuance to fail")
+	}
+	if rr := apiRequest(t, s, "POST", "/api/v1/certificates/"+issued.Serial+"/revoke", nil, nil); rr.Code == http.StatusOK {
+		t.Fatalf("expected the revocation to fail")
+	}
+	b, _ := ioutil.ReadFile(path)
+	if lines := strings.Split(strings.TrimSpace(string(b)), "\n"); len(lines) != 4 {
+		t.Errorf("expected 4 entries in the ledger got %v", len(lines))
+	}
+	if r, _ := s.Inventory.Get(issued.Serial); r == nil || r.Revoked {
+		t.Errorf("expected the cert to be stored and not revoked got %+v", r)
+	}
+
+	// the chain continues from the last stored entry
+	fail = false
+	if rr := apiRequest(t, s, "POST", "/api/v1/certificates/"+issued.Serial+"/revoke", nil, nil); rr.Code != http.StatusOK {
+		t.Fatalf("expected %v got %v: %v", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	caCert, _ := c.Cert()
+	b, _ = ioutil.ReadFile(path)
+	if n, err := VerifyLedger(bytes.NewReader(b), caCert); err != nil || n != 5 {
+		t.Errorf("expected 5 valid entries got %v: %v", n, err)
+	}
+}
+
+func Test_OpenLedger_error(t *testing.T) {
+	if _, err := OpenLedger(""); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if _, err := OpenLedger("ca.go"); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func Test_Ledger_shared(t *testing.T) {
+	c, path := newTestLedger(t)
+	caCert, _ := c.Cert()
+
+	other, err := OpenLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	key, _ := c.PrivateKey()
+	for i := 0; i < 3; i++ {
+		if err := other.Append(&LedgerEntry{Event: LedgerRevoke, Serial: "other"}, key); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.RecordRevocation("mine", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	if n, err := VerifyLedger(bytes.NewReader(b), caCert); err != nil || n != 9 {
+		t.Errorf("expected 9 valid entries got %v: %v", n, err)
+	}
+}
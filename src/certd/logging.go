@@ -2,15 +2,143 @@ package certd
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
 )
 
+var logger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
 func init() {
 	// should only be used during testing
 	if os.Getenv("RUNNING_TESTS") == "1" {
 		b := make([]byte, 8192)
 		buf := bytes.NewBuffer(b)
 		log.SetOutput(buf)
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+}
+
+// SetLogger sets the logger used by the package
+func SetLogger(l *slog.Logger) {
+	logger = l
+	slog.SetDefault(l)
+}
+
+// NewLogger creates a logger that writes to w, format is "json" or "text"
+// and level is one of "debug", "info", "warn" or "error"
+func NewLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level \"%v\"", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+
+	switch strings.ToLower(format) {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format \"%v\"", format)
+}
+
+type requestInfoKey struct{}
+
+// requestInfo is attached to the context of each request so everything
+// logged while handling it can be tied together
+type requestInfo struct {
+	id         string
+	remoteAddr string
+
+	mu   sync.Mutex
+	user string
+	// ca is the name of the tenant handling the request
+	ca string
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withRequestInfo returns a copy of req with a new request ID
+func withRequestInfo(req *http.Request) (*http.Request, *requestInfo) {
+	info := &requestInfo{id: newRequestID(), remoteAddr: req.RemoteAddr}
+	return req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, info)), info
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// setUser records the authenticated user for the request
+func setUser(ctx context.Context, user string) {
+	if info := requestInfoFrom(ctx); info != nil {
+		info.mu.Lock()
+		info.user = user
+		info.mu.Unlock()
+	}
+}
+
+// userFrom returns the authenticated user for the request
+func userFrom(ctx context.Context) string {
+	if info := requestInfoFrom(ctx); info != nil {
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		return info.user
+	}
+	return ""
+}
+
+// requestAttrs returns the request ID, remote address and user of the request
+func requestAttrs(ctx context.Context) []any {
+	info := requestInfoFrom(ctx)
+	if info == nil {
+		return nil
+	}
+	attrs := []any{"request_id", info.id, "remote_addr", info.remoteAddr}
+	if info.ca != "" {
+		attrs = append(attrs, "ca", info.ca)
+	}
+	if user := userFrom(ctx); user != "" {
+		attrs = append(attrs, "user", user)
+	}
+	return attrs
+}
+
+// loggerFrom returns the package logger annotated with the details of the
+// request in ctx
+func loggerFrom(ctx context.Context) *slog.Logger {
+	return logger.With(requestAttrs(ctx)...)
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
 	}
+	return r.ResponseWriter.Write(b)
 }
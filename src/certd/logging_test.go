@@ -0,0 +1,70 @@
+package certd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_NewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := NewLogger(&buf, "json", "warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Info("hidden")
+	l.Warn("shown")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected a single JSON line got %q", buf.String())
+	}
+	if line["msg"] != "shown" {
+		t.Errorf("unexpected line %v", line)
+	}
+
+	if _, err := NewLogger(&buf, "xml", "info"); err == nil {
+		t.Errorf("expected error for invalid format")
+	}
+	if _, err := NewLogger(&buf, "text", "loud"); err == nil {
+		t.Errorf("expected error for invalid level")
+	}
+}
+
+func Test_loggerFrom_request(t *testing.T) {
+	var buf bytes.Buffer
+	l, _ := NewLogger(&buf, "json", "info")
+	orig := logger
+	logger = l
+	defer func() { logger = orig }()
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:1138"
+	req, info := withRequestInfo(req)
+	setUser(req.Context(), "alice")
+	loggerFrom(req.Context()).Info("test")
+
+	var line map[string]interface{}
+	json.Unmarshal(buf.Bytes(), &line)
+	if line["request_id"] != info.id || line["user"] != "alice" || line["remote_addr"] != "127.0.0.1:1138" {
+		t.Errorf("unexpected line %v", line)
+	}
+
+	if attrs := requestAttrs(context.Background()); attrs != nil {
+		t.Errorf("unexpected attrs %v", attrs)
+	}
+}
+
+func Test_Server_request_id(t *testing.T) {
+	s := newTestServer(t)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	s.ServeHTTP(rr, req)
+	if len(rr.Header().Get("X-Request-ID")) != 16 {
+		t.Errorf("unexpected request ID %q", rr.Header().Get("X-Request-ID"))
+	}
+}
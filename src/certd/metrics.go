@@ -0,0 +1,219 @@
+package certd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultExpiryWindow = 30 * 24 * time.Hour
+
+// issuance outcomes
+const (
+	OutcomeSuccess  = "success"
+	OutcomeRejected = "rejected"
+	OutcomeError    = "error"
+)
+
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name string) {
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%v_bucket{le=\"%v\"} %v\n", name, b, h.counts[i])
+	}
+	fmt.Fprintf(w, "%v_bucket{le=\"+Inf\"} %v\n", name, h.count)
+	fmt.Fprintf(w, "%v_sum %v\n", name, h.sum)
+	fmt.Fprintf(w, "%v_count %v\n", name, h.count)
+}
+
+type issuedKey struct {
+	profile string
+	outcome string
+}
+
+// Metrics counts what the server is doing, they are exposed in the
+// Prometheus text format
+type Metrics struct {
+	mu            sync.Mutex
+	issued        map[issuedKey]uint64
+	authFailures  uint64
+	revocations   uint64
+	keyGeneration *histogram
+	signing       *histogram
+}
+
+// NewMetrics creates an empty set of Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		issued:        make(map[issuedKey]uint64),
+		keyGeneration: newHistogram(latencyBuckets),
+		signing:       newHistogram(latencyBuckets),
+	}
+}
+
+// Issued counts an attempt to issue a cert
+func (m *Metrics) Issued(profile, outcome string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.issued[issuedKey{profile, outcome}]++
+}
+
+// AuthFailure counts a request with invalid credentials
+func (m *Metrics) AuthFailure() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.authFailures++
+}
+
+// Revoked counts a revoked cert
+func (m *Metrics) Revoked() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.revocations++
+}
+
+// KeyGeneration records how long it took to generate a key and CSR
+func (m *Metrics) KeyGeneration(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keyGeneration.observe(d.Seconds())
+}
+
+// Signing records how long it took to sign a cert
+func (m *Metrics) Signing(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.signing.observe(d.Seconds())
+}
+
+// Write writes the metrics in the Prometheus text format
+func (m *Metrics) Write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]issuedKey, 0, len(m.issued))
+	for k := range m.issued {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		if keys[a].profile != keys[b].profile {
+			return keys[a].profile < keys[b].profile
+		}
+		return keys[a].outcome < keys[b].outcome
+	})
+
+	fmt.Fprintln(w, "# HELP certd_issued_total Requests to issue a cert by profile and outcome.")
+	fmt.Fprintln(w, "# TYPE certd_issued_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "certd_issued_total{profile=\"%v\",outcome=\"%v\"} %v\n", escapeLabel(k.profile), k.outcome, m.issued[k])
+	}
+
+	fmt.Fprintln(w, "# HELP certd_auth_failures_total Requests with invalid credentials.")
+	fmt.Fprintln(w, "# TYPE certd_auth_failures_total counter")
+	fmt.Fprintf(w, "certd_auth_failures_total %v\n", m.authFailures)
+
+	fmt.Fprintln(w, "# HELP certd_revocations_total Certs revoked.")
+	fmt.Fprintln(w, "# TYPE certd_revocations_total counter")
+	fmt.Fprintf(w, "certd_revocations_total %v\n", m.revocations)
+
+	fmt.Fprintln(w, "# HELP certd_key_generation_seconds Time taken to generate a private key and CSR.")
+	fmt.Fprintln(w, "# TYPE certd_key_generation_seconds histogram")
+	m.keyGeneration.write(w, "certd_key_generation_seconds")
+
+	fmt.Fprintln(w, "# HELP certd_signing_seconds Time taken to sign a cert.")
+	fmt.Fprintln(w, "# TYPE certd_signing_seconds histogram")
+	m.signing.write(w, "certd_signing_seconds")
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// writeMetrics writes the server's counters along with gauges describing the
+// CA and inventory
+func (s *Server) writeMetrics(w io.Writer) {
+	s.Metrics.Write(w)
+
+	if crt, err := s.settings().CA.Cert(); err == nil {
+		fmt.Fprintln(w, "# HELP certd_ca_expiry_timestamp_seconds When the CA cert expires.")
+		fmt.Fprintln(w, "# TYPE certd_ca_expiry_timestamp_seconds gauge")
+		fmt.Fprintf(w, "certd_ca_expiry_timestamp_seconds %v\n", crt.NotAfter.Unix())
+
+		expiring := 0
+		if s.caExpiring(crt, time.Now()) {
+			expiring = 1
+		}
+		fmt.Fprintln(w, "# HELP certd_ca_expiring Whether the CA cert expires within the warning threshold.")
+		fmt.Fprintln(w, "# TYPE certd_ca_expiring gauge")
+		fmt.Fprintf(w, "certd_ca_expiring %v\n", expiring)
+	}
+
+	window := s.ExpiryWindow
+	if window <= 0 {
+		window = DefaultExpiryWindow
+	}
+	active := s.Inventory.List(CertFilter{Status: "valid"})
+	expiring := 0
+	soon := time.Now().Add(window)
+	for _, r := range active {
+		if r.NotAfter.Before(soon) {
+			expiring++
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP certd_active_certs Issued certs that have not expired or been revoked.")
+	fmt.Fprintln(w, "# TYPE certd_active_certs gauge")
+	fmt.Fprintf(w, "certd_active_certs %v\n", len(active))
+
+	fmt.Fprintln(w, "# HELP certd_certs_expiring Active certs that expire within the window.")
+	fmt.Fprintln(w, "# TYPE certd_certs_expiring gauge")
+	fmt.Fprintf(w, "certd_certs_expiring{days=\"%v\"} %v\n", int(window.Hours()/24), expiring)
+}
+
+// MetricsHandler serves the metrics without requiring authentication, it is
+// intended for a separate listener
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/metrics" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		bw := bufio.NewWriter(w)
+		s.writeMetrics(bw)
+		bw.Flush()
+	})
+}
+
+func (s *Server) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	if !s.Authorized(w, req) {
+		return
+	}
+	s.MetricsHandler().ServeHTTP(w, req)
+}
@@ -0,0 +1,95 @@
+package certd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Metrics_histogram(t *testing.T) {
+	h := newHistogram([]float64{0.1, 1})
+	h.observe(0.05)
+	h.observe(0.5)
+	h.observe(5)
+
+	var b strings.Builder
+	h.write(&b, "test")
+	expected := `test_bucket{le="0.1"} 1
+test_bucket{le="1"} 2
+test_bucket{le="+Inf"} 3
+test_sum 5.55
+test_count 3
+`
+	if b.String() != expected {
+		t.Errorf("unexpected output:\n%v", b.String())
+	}
+}
+
+func Test_Server_metrics(t *testing.T) {
+	s := newTestServer(t)
+	s.Policy = &Policy{AllowedDomains: []string{"example.com"}}
+
+	var issued IssuedCert
+	apiRequest(t, s, "POST", "/api/v1/certificates", strings.NewReader(`{"hosts":["a.example.com"],"profile":"server"}`), &issued)
+	apiRequest(t, s, "POST", "/api/v1/certificates", strings.NewReader(`{"hosts":["other.org"]}`), nil)
+	apiRequest(t, s, "POST", "/api/v1/certificates", strings.NewReader(`{"hosts":["a.example.com"]}`), nil)
+	apiRequest(t, s, "POST", "/api/v1/certificates/"+issued.Serial+"/revoke", nil, nil)
+
+	req, _ := http.NewRequest("GET", "/ca", nil)
+	req.SetBasicAuth(DefaultUser, "wrong")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	rr := apiRequest(t, s, "GET", "/metrics", nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %v got %v", http.StatusOK, rr.Code)
+	}
+
+	body := rr.Body.String()
+	for _, line := range []string{
+		`certd_issued_total{profile="server",outcome="success"} 1`,
+		`certd_issued_total{profile="default",outcome="success"} 1`,
+		`certd_issued_total{profile="default",outcome="rejected"} 1`,
+		`certd_auth_failures_total 1`,
+		`certd_revocations_total 1`,
+		`certd_key_generation_seconds_count 2`,
+		`certd_signing_seconds_count 2`,
+		`certd_active_certs 1`,
+		`certd_certs_expiring{days="30"} 0`,
+		`certd_ca_expiry_timestamp_seconds `,
+		`certd_ca_expiring 0`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics missing %q:\n%v", line, body)
+		}
+	}
+}
+
+func Test_Server_metrics_auth(t *testing.T) {
+	s := newTestServer(t)
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected %v got %v", http.StatusUnauthorized, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected %v got %v", http.StatusOK, rr.Code)
+	}
+}
+
+func Test_Server_metrics_expiring(t *testing.T) {
+	s := newTestServer(t)
+	s.ExpiryWindow = 400 * 24 * time.Hour
+	apiRequest(t, s, "POST", "/api/v1/certificates", strings.NewReader(`{"hosts":["a.local"]}`), nil)
+
+	rr := apiRequest(t, s, "GET", "/metrics", nil, nil)
+	if !strings.Contains(rr.Body.String(), `certd_certs_expiring{days="400"} 1`) {
+		t.Errorf("expected expiring cert to be counted:\n%v", rr.Body.String())
+	}
+}
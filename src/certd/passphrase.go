@@ -0,0 +1,142 @@
+package certd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Environment variables passphrases, unseal shares and PINs are read from
+const (
+	CAPassphraseEnv    = "CERTD_CA_PASSPHRASE"
+	NewCAPassphraseEnv = "CERTD_NEW_CA_PASSPHRASE"
+	UnsealShareEnv     = "CERTD_UNSEAL_SHARE"
+	PKCS11PINEnv       = "CERTD_PKCS11_PIN"
+)
+
+// PassphraseFunc returns a passphrase
+type PassphraseFunc func() (string, error)
+
+var (
+	caPassphraseMu sync.Mutex
+	caPassphrase   PassphraseFunc = envPassphrase
+)
+
+func envPassphrase() (string, error) {
+	if p := os.Getenv(CAPassphraseEnv); p != "" {
+		return p, nil
+	}
+	return "", fmt.Errorf("the CA key is encrypted, set %v", CAPassphraseEnv)
+}
+
+// SetCAPassphrase sets where LoadCA gets the passphrase for an encrypted CA
+// key, by default it is read from CERTD_CA_PASSPHRASE
+func SetCAPassphrase(f PassphraseFunc) {
+	caPassphraseMu.Lock()
+	defer caPassphraseMu.Unlock()
+	caPassphrase = f
+}
+
+func getCAPassphrase() (string, error) {
+	caPassphraseMu.Lock()
+	f := caPassphrase
+	caPassphraseMu.Unlock()
+	return f()
+}
+
+// PassphraseSource returns a PassphraseFunc that reads the passphrase from
+// the file descriptor fd unless it is -1, then from the environment variable
+// env, then by prompting on the terminal if prompt is not empty. The
+// passphrase is remembered so it is only read once, which lets a reload
+// decrypt the key again.
+func PassphraseSource(fd int, env, prompt string) PassphraseFunc {
+	var mu sync.Mutex
+	var cached string
+	return func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if cached != "" {
+			return cached, nil
+		}
+
+		var p string
+		var err error
+		switch {
+		case fd != -1:
+			f := os.NewFile(uintptr(fd), "passphrase")
+			if f == nil {
+				return "", fmt.Errorf("invalid passphrase file descriptor %v", fd)
+			}
+			p, err = readPassphraseLine(f)
+			f.Close()
+		case os.Getenv(env) != "":
+			p = os.Getenv(env)
+		case prompt != "":
+			p, err = PromptPassphrase(prompt)
+		default:
+			return "", fmt.Errorf("no passphrase given, set %v", env)
+		}
+		if err != nil {
+			return "", err
+		}
+		if p == "" {
+			return "", fmt.Errorf("empty passphrase")
+		}
+		cached = p
+		return p, nil
+	}
+}
+
+// NewPassphrase reads a new passphrase from the environment variable env or
+// by prompting twice on the terminal
+func NewPassphrase(env string) (string, error) {
+	if p := os.Getenv(env); p != "" {
+		return p, nil
+	}
+	p, err := PromptPassphrase("New passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if p == "" {
+		return "", fmt.Errorf("empty passphrase")
+	}
+	again, err := PromptPassphrase("Repeat the passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if again != p {
+		return "", fmt.Errorf("the passphrases do not match")
+	}
+	return p, nil
+}
+
+// PromptPassphrase prints prompt on the terminal and reads a line from it
+// without echoing it
+func PromptPassphrase(prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("no terminal to prompt for a passphrase on: %v", err)
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	defer fmt.Fprintln(tty)
+	restore, err := disableEcho(tty)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+	return readPassphraseLine(tty)
+}
+
+// readPassphraseLine reads the first line from r
+func readPassphraseLine(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package certd
+
+import (
+	"fmt"
+	"os"
+)
+
+// disableEcho is only implemented on Linux, elsewhere passphrases are read
+// from a file descriptor or the environment
+func disableEcho(tty *os.File) (func(), error) {
+	return nil, fmt.Errorf("prompting for a passphrase is not supported, set %v", CAPassphraseEnv)
+}
@@ -0,0 +1,439 @@
+package certd
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"unicode/utf16"
+)
+
+// ErrPKCS12Password is returned when the password for a PKCS#12 file is wrong
+var ErrPKCS12Password = errors.New("pkcs12: wrong password")
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+
+	oidKeyBag         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidShroudedKeyBag = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Cert       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+
+	oidPBEWithSHA3DES = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidAES128CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3   = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+type pfx struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm algorithmIdentifier
+	Digest    []byte
+}
+
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm algorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     algorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc algorithmIdentifier
+	EncryptionScheme  algorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                 `asn1:"optional"`
+	PRF        algorithmIdentifier `asn1:"optional"`
+}
+
+// DecodePKCS12 returns the certs and private keys in a DER encoded PKCS#12
+// file. Bags encrypted with PBES2 (AES) or the legacy 3DES scheme are
+// supported, RC2 is not.
+func DecodePKCS12(der []byte, password string) ([]*x509.Certificate, []crypto.PrivateKey, error) {
+	var p pfx
+	rest, err := asn1.Unmarshal(der, &p)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pkcs12: %v", err)
+	}
+	if len(rest) != 0 {
+		return nil, nil, errors.New("pkcs12: trailing data")
+	}
+	if p.Version != 3 {
+		return nil, nil, fmt.Errorf("pkcs12: unsupported version %v", p.Version)
+	}
+	if !p.AuthSafe.ContentType.Equal(oidData) {
+		return nil, nil, errors.New("pkcs12: only password integrity is supported")
+	}
+	var authSafe []byte
+	if _, err := asn1.Unmarshal(p.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		return nil, nil, fmt.Errorf("pkcs12: %v", err)
+	}
+
+	if len(p.MacData.Mac.Algorithm.Algorithm) > 0 {
+		if err := p.MacData.verify(authSafe, password); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var contents []contentInfo
+	if _, err := asn1.Unmarshal(authSafe, &contents); err != nil {
+		return nil, nil, fmt.Errorf("pkcs12: %v", err)
+	}
+
+	var certs []*x509.Certificate
+	var keys []crypto.PrivateKey
+	for _, ci := range contents {
+		var data []byte
+		switch {
+		case ci.ContentType.Equal(oidData):
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &data); err != nil {
+				return nil, nil, fmt.Errorf("pkcs12: %v", err)
+			}
+		case ci.ContentType.Equal(oidEncryptedData):
+			var ed encryptedData
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+				return nil, nil, fmt.Errorf("pkcs12: %v", err)
+			}
+			eci := ed.EncryptedContentInfo
+			if data, err = pbeDecrypt(eci.ContentEncryptionAlgorithm, eci.EncryptedContent, password); err != nil {
+				return nil, nil, err
+			}
+		default:
+			return nil, nil, fmt.Errorf("pkcs12: unsupported content type %v", ci.ContentType)
+		}
+
+		var bags []safeBag
+		if _, err := asn1.Unmarshal(data, &bags); err != nil {
+			if ci.ContentType.Equal(oidEncryptedData) {
+				return nil, nil, ErrPKCS12Password
+			}
+			return nil, nil, fmt.Errorf("pkcs12: %v", err)
+		}
+		for _, bag := range bags {
+			switch {
+			case bag.ID.Equal(oidCertBag):
+				var cb certBag
+				if _, err := asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+					return nil, nil, fmt.Errorf("pkcs12: %v", err)
+				}
+				if !cb.ID.Equal(oidX509Cert) {
+					continue
+				}
+				crt, err := x509.ParseCertificate(cb.Data)
+				if err != nil {
+					return nil, nil, fmt.Errorf("pkcs12: %v", err)
+				}
+				certs = append(certs, crt)
+			case bag.ID.Equal(oidKeyBag):
+				key, err := x509.ParsePKCS8PrivateKey(bag.Value.Bytes)
+				if err != nil {
+					return nil, nil, fmt.Errorf("pkcs12: %v", err)
+				}
+				keys = append(keys, key)
+			case bag.ID.Equal(oidShroudedKeyBag):
+				var epki encryptedPrivateKeyInfo
+				if _, err := asn1.Unmarshal(bag.Value.Bytes, &epki); err != nil {
+					return nil, nil, fmt.Errorf("pkcs12: %v", err)
+				}
+				b, err := pbeDecrypt(epki.Algorithm, epki.EncryptedData, password)
+				if err != nil {
+					return nil, nil, err
+				}
+				key, err := x509.ParsePKCS8PrivateKey(b)
+				if err != nil {
+					return nil, nil, ErrPKCS12Password
+				}
+				keys = append(keys, key)
+			}
+		}
+	}
+	return certs, keys, nil
+}
+
+// verify checks the MAC over the authenticated safe
+func (m *macData) verify(content []byte, password string) error {
+	h, err := hashForOID(m.Mac.Algorithm.Algorithm)
+	if err != nil {
+		return err
+	}
+	passwords := [][]byte{bmpString(password)}
+	if password == "" {
+		// some tools encode an empty password without the terminator
+		passwords = append(passwords, nil)
+	}
+	for _, p := range passwords {
+		key := pkcs12KDF(h, p, m.MacSalt, m.Iterations, 3, h().Size())
+		mac := hmac.New(h, key)
+		mac.Write(content)
+		if hmac.Equal(mac.Sum(nil), m.Mac.Digest) {
+			return nil
+		}
+	}
+	return ErrPKCS12Password
+}
+
+// pbeDecrypt decrypts data encrypted with the password based scheme in alg
+func pbeDecrypt(alg algorithmIdentifier, data []byte, password string) ([]byte, error) {
+	var block cipher.Block
+	var iv []byte
+	switch {
+	case alg.Algorithm.Equal(oidPBEWithSHA3DES):
+		var params pbeParams
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, fmt.Errorf("pkcs12: %v", err)
+		}
+		pass := bmpString(password)
+		key := pkcs12KDF(sha1.New, pass, params.Salt, params.Iterations, 1, 24)
+		iv = pkcs12KDF(sha1.New, pass, params.Salt, params.Iterations, 2, des.BlockSize)
+		var err error
+		if block, err = des.NewTripleDESCipher(key); err != nil {
+			return nil, err
+		}
+	case alg.Algorithm.Equal(oidPBES2):
+		var err error
+		if block, iv, err = pbes2Cipher(alg, password); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("pkcs12: unsupported encryption algorithm %v", alg.Algorithm)
+	}
+
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 || len(iv) != block.BlockSize() {
+		return nil, errors.New("pkcs12: invalid encrypted data")
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+
+	// a wrong password shows up as bad padding
+	n := int(out[len(out)-1])
+	if n == 0 || n > block.BlockSize() {
+		return nil, ErrPKCS12Password
+	}
+	for _, b := range out[len(out)-n:] {
+		if int(b) != n {
+			return nil, ErrPKCS12Password
+		}
+	}
+	return out[:len(out)-n], nil
+}
+
+// pbes2Cipher returns the cipher and IV for PBES2 with PBKDF2
+func pbes2Cipher(alg algorithmIdentifier, password string) (cipher.Block, []byte, error) {
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+		return nil, nil, fmt.Errorf("pkcs12: %v", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, nil, fmt.Errorf("pkcs12: unsupported key derivation function %v", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, nil, fmt.Errorf("pkcs12: %v", err)
+	}
+	prf := sha1.New
+	if len(kdf.PRF.Algorithm) > 0 {
+		var err error
+		if prf, err = hashForOID(kdf.PRF.Algorithm); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var keyLen int
+	var newCipher func([]byte) (cipher.Block, error)
+	enc := params.EncryptionScheme.Algorithm
+	switch {
+	case enc.Equal(oidAES128CBC):
+		keyLen, newCipher = 16, aes.NewCipher
+	case enc.Equal(oidAES192CBC):
+		keyLen, newCipher = 24, aes.NewCipher
+	case enc.Equal(oidAES256CBC):
+		keyLen, newCipher = 32, aes.NewCipher
+	case enc.Equal(oidDESEDE3):
+		keyLen, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, nil, fmt.Errorf("pkcs12: unsupported encryption algorithm %v", enc)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, nil, fmt.Errorf("pkcs12: %v", err)
+	}
+
+	key, err := pbkdf2.Key(prf, password, kdf.Salt, kdf.Iterations, keyLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return block, iv, nil
+}
+
+// hashForOID returns the hash for a digest or HMAC algorithm
+func hashForOID(oid asn1.ObjectIdentifier) (func() hash.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA1), oid.Equal(oidHMACSHA1):
+		return sha1.New, nil
+	case oid.Equal(oidSHA256), oid.Equal(oidHMACSHA256):
+		return sha256.New, nil
+	case oid.Equal(oidSHA384), oid.Equal(oidHMACSHA384):
+		return sha512.New384, nil
+	case oid.Equal(oidSHA512), oid.Equal(oidHMACSHA512):
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("pkcs12: unsupported hash %v", oid)
+}
+
+// bmpString encodes s as a null terminated BMPString as used by the PKCS#12
+// key derivation function
+func bmpString(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 0, 2*len(u)+2)
+	for _, r := range u {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	return append(b, 0, 0)
+}
+
+// pkcs12KDF derives n bytes of key material for id (1 key, 2 IV, 3 MAC)
+// as described in RFC 7292 appendix B.2
+func pkcs12KDF(h func() hash.Hash, password, salt []byte, iterations int, id byte, n int) []byte {
+	v := h().BlockSize()
+
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	D := make([]byte, v)
+	for i := range D {
+		D[i] = id
+	}
+	I := append(fill(salt), fill(password)...)
+
+	one := big.NewInt(1)
+	var out []byte
+	for len(out) < n {
+		hh := h()
+		hh.Write(D)
+		hh.Write(I)
+		A := hh.Sum(nil)
+		for i := 1; i < iterations; i++ {
+			hh = h()
+			hh.Write(A)
+			A = hh.Sum(A[:0])
+		}
+		out = append(out, A...)
+
+		// I_j = (I_j + B + 1) mod 2^(v*8) for each v byte block of I
+		B := new(big.Int).SetBytes(fill(A)[:v])
+		B.Add(B, one)
+		for j := 0; j < len(I); j += v {
+			Ij := new(big.Int).SetBytes(I[j : j+v])
+			Ij.Add(Ij, B)
+			b := Ij.Bytes()
+			if len(b) > v {
+				b = b[len(b)-v:]
+			}
+			block := I[j : j+v]
+			for k := range block {
+				block[k] = 0
+			}
+			copy(block[v-len(b):], b)
+		}
+	}
+	return out[:n]
+}
+
+// pkcs12Like reports whether der looks like a PKCS#12 file
+func pkcs12Like(der []byte) bool {
+	var p pfx
+	_, err := asn1.Unmarshal(der, &p)
+	return err == nil && p.Version == 3
+}
@@ -0,0 +1,42 @@
+package certd
+
+import (
+	"crypto/ecdsa"
+	"io/ioutil"
+	"testing"
+)
+
+func Test_DecodePKCS12(t *testing.T) {
+	for file, password := range map[string]string{
+		"testdata/modern.p12": "secret",
+		"testdata/legacy.p12": "secret",
+		"testdata/empty.p12":  "",
+	} {
+		der, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs, keys, err := DecodePKCS12(der, password)
+		if err != nil {
+			t.Errorf("%v: %v", file, err)
+			continue
+		}
+		if len(certs) != 1 || certs[0].Subject.CommonName != "p12.example.com" {
+			t.Errorf("%v: unexpected certs %v", file, certs)
+		}
+		if len(keys) != 1 {
+			t.Fatalf("%v: expected 1 key got %v", file, len(keys))
+		}
+		if key, ok := keys[0].(*ecdsa.PrivateKey); !ok || !key.PublicKey.Equal(certs[0].PublicKey) {
+			t.Errorf("%v: key does not match the cert", file)
+		}
+	}
+
+	der, _ := ioutil.ReadFile("testdata/modern.p12")
+	if _, _, err := DecodePKCS12(der, "wrong"); err != ErrPKCS12Password {
+		t.Errorf("expected %v got %v", ErrPKCS12Password, err)
+	}
+	if _, _, err := DecodePKCS12(der[:100], "secret"); err == nil {
+		t.Errorf("expected error decoding a truncated file")
+	}
+}
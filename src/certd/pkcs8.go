@@ -0,0 +1,161 @@
+package certd
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// Formats generated private keys are returned in
+const (
+	// KeyFormatPKCS1 is PKCS#1 for RSA keys and SEC 1 for ECDSA keys,
+	// Ed25519 keys only have a PKCS#8 encoding
+	KeyFormatPKCS1 = "pkcs1"
+	KeyFormatPKCS8 = "pkcs8"
+)
+
+// PKCS8Iterations is the PBKDF2 iteration count for encrypted keys
+const PKCS8Iterations = 100000
+
+// ErrKeyPassphrase is returned when an encrypted key can not be decrypted
+// with the passphrase
+var ErrKeyPassphrase = errors.New("wrong passphrase for the private key")
+
+// CheckKeyFormat checks format and passphrase can be used with FormatKey
+func CheckKeyFormat(format, passphrase string) error {
+	switch format {
+	case "", KeyFormatPKCS8:
+	case KeyFormatPKCS1:
+		if passphrase != "" {
+			return fmt.Errorf("encrypted keys must use the %v format", KeyFormatPKCS8)
+		}
+	default:
+		return fmt.Errorf("unknown key format \"%v\"", format)
+	}
+	return nil
+}
+
+// FormatKey re-encodes the PEM private key keyPEM in format. With a
+// passphrase the key is encrypted PKCS#8, see EncryptPKCS8. An empty format
+// leaves an unencrypted key as it is.
+func FormatKey(keyPEM []byte, format, passphrase string) ([]byte, error) {
+	if err := CheckKeyFormat(format, passphrase); err != nil {
+		return nil, err
+	}
+	if format == "" && passphrase == "" {
+		return keyPEM, nil
+	}
+	key, err := ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if passphrase != "" {
+		return EncryptPKCS8(key, passphrase)
+	}
+
+	var block *pem.Block
+	switch format {
+	case KeyFormatPKCS8:
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	case KeyFormatPKCS1:
+		// keys are generated in this format already
+		return keyPEM, nil
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// EncryptPKCS8 returns key as a PEM encrypted PKCS#8 private key. It is
+// encrypted with PBES2 using PBKDF2 with HMAC-SHA256 and AES-256-CBC, which
+// OpenSSL and most TLS libraries can read.
+func EncryptPKCS8(key interface{}, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	k, err := pbkdf2.Key(sha256.New, passphrase, salt, PKCS8Iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	n := aes.BlockSize - len(der)%aes.BlockSize
+	data := append(der, make([]byte, n)...)
+	for i := len(der); i < len(data); i++ {
+		data[i] = byte(n)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:       salt,
+		Iterations: PKCS8Iterations,
+		PRF:        algorithmIdentifier{Algorithm: oidHMACSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: algorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  algorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	out, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     algorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: out}), nil
+}
+
+// DecryptPKCS8 decrypts a DER encrypted PKCS#8 private key encrypted with
+// PBES2 or the legacy PKCS#12 3DES scheme
+func DecryptPKCS8(der []byte, passphrase string) (interface{}, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	plain, err := pbeDecrypt(info.Algorithm, info.EncryptedData, passphrase)
+	if errors.Is(err, ErrPKCS12Password) {
+		return nil, ErrKeyPassphrase
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(plain)
+	if err != nil {
+		// bad padding is not always noticed, the key then does not parse
+		return nil, ErrKeyPassphrase
+	}
+	return key, nil
+}
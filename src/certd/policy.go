@@ -0,0 +1,190 @@
+package certd
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const DefaultProfile = "default"
+
+// Duration is a time.Duration that is encoded as a string such as "720h" in JSON
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Profile describes the type of cert that is issued
+type Profile struct {
+	// Lifetime of certs issued with this profile, zero means they are valid
+	// until the CA expires
+	Lifetime Duration `json:"lifetime,omitempty"`
+	// Usages is a list of extended key usages, "server" and/or "client"
+	Usages []string `json:"usages,omitempty"`
+}
+
+// DefaultProfiles returns the profiles that are available when none are configured
+func DefaultProfiles() map[string]*Profile {
+	return map[string]*Profile{
+		DefaultProfile: {},
+		"server":       {Usages: []string{"server"}},
+		"client":       {Usages: []string{"client"}},
+	}
+}
+
+// ExtKeyUsage returns the x509 extended key usages for the profile
+func (p *Profile) ExtKeyUsage() ([]x509.ExtKeyUsage, error) {
+	var usages []x509.ExtKeyUsage
+	for _, u := range p.Usages {
+		switch u {
+		case "server":
+			usages = append(usages, x509.ExtKeyUsageServerAuth)
+		case "client":
+			usages = append(usages, x509.ExtKeyUsageClientAuth)
+		default:
+			return nil, fmt.Errorf("unknown usage \"%v\"", u)
+		}
+	}
+	return usages, nil
+}
+
+// Apply sets the lifetime and usages of csr from the profile
+func (p *Profile) Apply(csr *CSR) error {
+	usages, err := p.ExtKeyUsage()
+	if err != nil {
+		return err
+	}
+	csr.Lifetime = time.Duration(p.Lifetime)
+	csr.ExtKeyUsage = usages
+	return nil
+}
+
+// PolicyError is returned when a request is rejected by a Policy
+type PolicyError struct {
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return "policy violation: " + e.Reason
+}
+
+// Policy restricts the hosts certs can be issued for. The zero value allows
+// any well formed hostname or IP.
+type Policy struct {
+	// AllowedDomains limits hostnames to these domains and their subdomains
+	AllowedDomains []string `json:"allowed_domains,omitempty"`
+	// AllowedNetworks limits IPs to these CIDRs
+	AllowedNetworks []string `json:"allowed_networks,omitempty"`
+	// MaxHosts limits the number of hosts in a single cert
+	MaxHosts int `json:"max_hosts,omitempty"`
+}
+
+// Check returns a *PolicyError if hosts are not allowed by the policy
+func (p *Policy) Check(hosts []string) error {
+	if len(hosts) == 0 {
+		return &PolicyError{"no hosts specified"}
+	}
+	if p != nil && p.MaxHosts > 0 && len(hosts) > p.MaxHosts {
+		return &PolicyError{fmt.Sprintf("%v hosts requested, at most %v allowed", len(hosts), p.MaxHosts)}
+	}
+
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			if !p.ipAllowed(ip) {
+				return &PolicyError{fmt.Sprintf("IP \"%v\" is not allowed", h)}
+			}
+			continue
+		}
+		if !validHostname(h) {
+			return &PolicyError{fmt.Sprintf("invalid hostname \"%v\"", h)}
+		}
+		if !p.hostAllowed(h) {
+			return &PolicyError{fmt.Sprintf("hostname \"%v\" is not allowed", h)}
+		}
+	}
+	return nil
+}
+
+func (p *Policy) ipAllowed(ip net.IP) bool {
+	if p == nil || len(p.AllowedNetworks) == 0 {
+		return true
+	}
+	for _, n := range p.AllowedNetworks {
+		if _, cidr, err := net.ParseCIDR(n); err == nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) hostAllowed(h string) bool {
+	if p == nil || len(p.AllowedDomains) == 0 {
+		return true
+	}
+	h = strings.ToLower(h)
+	for _, d := range p.AllowedDomains {
+		d = strings.ToLower(strings.TrimPrefix(d, "."))
+		if h == d || strings.HasSuffix(h, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the networks in the policy are valid CIDRs
+func (p *Policy) Validate() error {
+	for _, n := range p.AllowedNetworks {
+		if _, _, err := net.ParseCIDR(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validHostname(h string) bool {
+	h = strings.TrimPrefix(h, "*.")
+	if h == "" || len(h) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(h, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// SplitHosts splits a comma separated list of hosts, dropping empty entries
+func SplitHosts(hosts string) []string {
+	var out []string
+	for _, h := range strings.Split(hosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			out = append(out, h)
+		}
+	}
+	return out
+}
@@ -0,0 +1,80 @@
+package certd
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func Test_Policy_Check(t *testing.T) {
+	p := &Policy{
+		AllowedDomains:  []string{"example.com"},
+		AllowedNetworks: []string{"10.0.0.0/8"},
+		MaxHosts:        2,
+	}
+
+	allowed := [][]string{
+		{"example.com"},
+		{"a.example.com", "10.1.2.3"},
+		{"*.example.com"},
+	}
+	for _, hosts := range allowed {
+		if err := p.Check(hosts); err != nil {
+			t.Errorf("%v: unexpected error %v", hosts, err)
+		}
+	}
+
+	denied := [][]string{
+		{},
+		{"badexample.com"},
+		{"192.168.1.1"},
+		{"a.example.com", "b.example.com", "c.example.com"},
+		{"bad host.example.com"},
+	}
+	for _, hosts := range denied {
+		if err, ok := p.Check(hosts).(*PolicyError); !ok {
+			t.Errorf("%v: expected PolicyError got %v", hosts, err)
+		}
+	}
+}
+
+func Test_Policy_nil(t *testing.T) {
+	var p *Policy
+	if err := p.Check([]string{"anything.local", "::1"}); err != nil {
+		t.Error(err)
+	}
+	if err := p.Check([]string{"-bad"}); err == nil {
+		t.Errorf("expected error for invalid hostname")
+	}
+}
+
+func Test_Policy_Validate(t *testing.T) {
+	p := &Policy{AllowedNetworks: []string{"10.0.0.0"}}
+	if err := p.Validate(); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func Test_Profile_Apply(t *testing.T) {
+	var p Profile
+	if err := json.Unmarshal([]byte(`{"lifetime":"24h","usages":["server","client"]}`), &p); err != nil {
+		t.Fatal(err)
+	}
+
+	csr := &CSR{}
+	if err := p.Apply(csr); err != nil {
+		t.Fatal(err)
+	}
+	if csr.Lifetime != 24*time.Hour {
+		t.Errorf("expected lifetime of 24h got %v", csr.Lifetime)
+	}
+	if len(csr.ExtKeyUsage) != 2 || csr.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Errorf("unexpected usages %v", csr.ExtKeyUsage)
+	}
+
+	p.Usages = []string{"bogus"}
+	if err := p.Apply(csr); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
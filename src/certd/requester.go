@@ -0,0 +1,157 @@
+package certd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Resolver does the DNS lookups used to find the names of a requester,
+// *net.Resolver implements it
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// ParseCIDRs parses a comma separated list of CIDRs, a plain IP is a network
+// of one address
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range SplitHosts(s) {
+		if ip := net.ParseIP(c); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", c)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func checkCIDRs(s string) error {
+	_, err := ParseCIDRs(s)
+	return err
+}
+
+func (s *Server) trustedProxy(ip net.IP) bool {
+	for _, n := range s.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requesterIP returns the IP of the client that made req. The forwarding
+// headers are only believed when the connection is from a trusted proxy,
+// and only as far back as the proxies they name are trusted too.
+func (s *Server) requesterIP(req *http.Request) (net.IP, error) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid remote address %q", req.RemoteAddr)
+	}
+	if !s.trustedProxy(ip) {
+		return ip, nil
+	}
+
+	hops := forwardedFor(req.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseForwardedIP(hops[i])
+		if hop == nil {
+			return nil, fmt.Errorf("unusable forwarded address %q", hops[i])
+		}
+		ip = hop
+		if !s.trustedProxy(ip) {
+			break
+		}
+	}
+	return ip, nil
+}
+
+// forwardedFor returns the addresses from the Forwarded header, or from
+// X-Forwarded-For when there is none, the client first
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, v := range values {
+			for _, elem := range strings.Split(v, ",") {
+				for _, pair := range strings.Split(elem, ";") {
+					kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+					if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+						hops = append(hops, strings.Trim(kv[1], "\""))
+					}
+				}
+			}
+		}
+		return hops
+	}
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseForwardedIP parses an address from a forwarding header, which may
+// have a port and IPv6 addresses may be in brackets. Obfuscated identifiers
+// and "unknown" return nil.
+func parseForwardedIP(s string) net.IP {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+// requesterHosts returns ip and the names its PTR records point to that
+// resolve back to it. Lookup failures leave out the names, an unconfirmed
+// name could be set by whoever controls the reverse zone.
+func (s *Server) requesterHosts(ctx context.Context, ip net.IP) []string {
+	hosts := []string{ip.String()}
+	r := s.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	names, err := r.LookupAddr(ctx, ip.String())
+	if err != nil {
+		loggerFrom(ctx).Debug("reverse lookup failed", "ip", ip, "error", err)
+		return hosts
+	}
+	seen := make(map[string]bool)
+	var confirmed []string
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if seen[name] || !validHostname(name) || strings.HasPrefix(name, "*") {
+			continue
+		}
+		seen[name] = true
+		addrs, err := r.LookupIPAddr(ctx, name)
+		if err != nil {
+			loggerFrom(ctx).Debug("forward lookup failed", "name", name, "error", err)
+			continue
+		}
+		for _, a := range addrs {
+			if a.IP.Equal(ip) {
+				confirmed = append(confirmed, name)
+				break
+			}
+		}
+	}
+	sort.Strings(confirmed)
+	return append(hosts, confirmed...)
+}
@@ -0,0 +1,155 @@
+package certd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// testResolver answers lookups from maps
+type testResolver struct {
+	ptr map[string][]string
+	a   map[string][]string
+}
+
+func (r *testResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	names, ok := r.ptr[addr]
+	if !ok {
+		return nil, fmt.Errorf("no PTR for %v", addr)
+	}
+	return names, nil
+}
+
+func (r *testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r.a[host]
+	if !ok {
+		return nil, fmt.Errorf("no such host %v", host)
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func Test_ParseCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs("10.0.0.0/8, 192.168.1.1,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nets) != 3 || nets[1].String() != "192.168.1.1/32" || nets[2].String() != "::1/128" {
+		t.Errorf("unexpected networks %v", nets)
+	}
+	if _, err := ParseCIDRs("10.0.0.0/33"); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func Test_Server_requesterIP(t *testing.T) {
+	s := &Server{}
+	s.TrustedProxies, _ = ParseCIDRs("10.0.0.0/8")
+
+	for _, test := range []struct {
+		remote  string
+		headers map[string]string
+		ip      string
+	}{
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		// headers from an untrusted client are ignored
+		{"192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "192.0.2.1"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		// only the entries added by trusted proxies are believed
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.9, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"10.0.0.1:1234", map[string]string{"Forwarded": `for=198.51.100.1;proto=https, for="10.0.0.2:80"`}, "198.51.100.1"},
+		{"10.0.0.1:1234", map[string]string{"Forwarded": `For="[2001:db8::1]:4711"`}, "2001:db8::1"},
+		// Forwarded is preferred
+		{"10.0.0.1:1234", map[string]string{"Forwarded": "for=198.51.100.1", "X-Forwarded-For": "198.51.100.2"}, "198.51.100.1"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3"}, "10.0.0.3"},
+	} {
+		req := httptest.NewRequest("GET", "/req", nil)
+		req.RemoteAddr = test.remote
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+		ip, err := s.requesterIP(req)
+		if err != nil || ip.String() != test.ip {
+			t.Errorf("%v %v: expected %v got %v %v", test.remote, test.headers, test.ip, ip, err)
+		}
+	}
+
+	for _, hops := range []string{"for=unknown", "for=_hidden", "for=198.51.100.1, for=_hidden"} {
+		req := httptest.NewRequest("GET", "/req", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("Forwarded", hops)
+		if _, err := s.requesterIP(req); err == nil {
+			t.Errorf("%v: expected an error", hops)
+		}
+	}
+}
+
+func Test_Server_requesterHosts(t *testing.T) {
+	s := &Server{Resolver: &testResolver{
+		ptr: map[string][]string{
+			"192.0.2.1": {"web.example.com.", "Alias.Example.com.", "spoofed.example.org.", "gone.example.com."},
+		},
+		a: map[string][]string{
+			"web.example.com":     {"192.0.2.1"},
+			"alias.example.com":   {"192.0.2.5", "192.0.2.1"},
+			"spoofed.example.org": {"203.0.113.1"},
+		},
+	}}
+	ctx := context.Background()
+
+	hosts := s.requesterHosts(ctx, net.ParseIP("192.0.2.1"))
+	if expected := []string{"192.0.2.1", "alias.example.com", "web.example.com"}; !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("expected %v got %v", expected, hosts)
+	}
+	if hosts := s.requesterHosts(ctx, net.ParseIP("192.0.2.2")); !reflect.DeepEqual(hosts, []string{"192.0.2.2"}) {
+		t.Errorf("expected only the IP got %v", hosts)
+	}
+}
+
+func Test_Server_genCert_requester(t *testing.T) {
+	s := newTestServer(t)
+	s.TrustedProxies, _ = ParseCIDRs("10.0.0.1")
+	s.Resolver = &testResolver{
+		ptr: map[string][]string{"192.0.2.1": {"web.example.com."}},
+		a:   map[string][]string{"web.example.com": {"192.0.2.1"}},
+	}
+
+	req := httptest.NewRequest("GET", "/req", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	req.SetBasicAuth(DefaultUser, DefaultPassword)
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %v got %v", http.StatusOK, rr.Code)
+	}
+	var out struct {
+		Cert string `json:"cert"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	crt, err := parseCertPEM([]byte(out.Cert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(certHosts(crt), []string{"web.example.com", "192.0.2.1"}) {
+		t.Errorf("unexpected hosts %v", certHosts(crt))
+	}
+
+	req.Header.Set("X-Forwarded-For", "garbage")
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected %v got %v", http.StatusBadRequest, rr.Code)
+	}
+}
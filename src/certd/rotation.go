@@ -0,0 +1,224 @@
+package certd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Rotation is a root rotation in progress. Until SwitchAt certs are issued
+// by the current root, from then on by Next. Both roots are trusted until
+// the rotation is finished with Retire, which should be done once no cert
+// from the current root is still needed.
+type Rotation struct {
+	Next *CA `json:"next"`
+	// CrossCert certifies Next's key with the current root so certs from
+	// Next verify for clients that only trust the current root.
+	// ReverseCrossCert certifies the current root's key with Next for
+	// clients that only trust Next.
+	CrossCert        []byte    `json:"cross_cert"`
+	ReverseCrossCert []byte    `json:"reverse_cross_cert"`
+	SwitchAt         time.Time `json:"switch_at"`
+	RetireAt         time.Time `json:"retire_at"`
+}
+
+// Switched reports whether certs are issued by the new root at now
+func (r *Rotation) Switched(now time.Time) bool {
+	return !now.Before(r.SwitchAt)
+}
+
+// StartRotation creates a new root and cross-signs it with the current one
+// and vice versa. Issuance switches to the new root at switchAt, retireAt is
+// when the current root is expected to be retired. The new root is valid for
+// c.Lifetime, or as long as the current root was if it is zero.
+func (c *CA) StartRotation(switchAt, retireAt time.Time) error {
+	if c.Rotation != nil {
+		return fmt.Errorf("a rotation is already in progress")
+	}
+	if c.PKCS11 != nil || (c.EncryptedKey != nil && c.EncryptedKey.KDF == KDFShamir) {
+		return fmt.Errorf("rotation is only supported for CA keys stored in the config")
+	}
+	if c.Chain != nil {
+		return fmt.Errorf("an intermediate CA is replaced by importing a new cert from its root")
+	}
+	if retireAt.Before(switchAt) {
+		return fmt.Errorf("the old root can not be retired before the switch")
+	}
+
+	crt, err := c.Cert()
+	if err != nil {
+		return err
+	}
+	next := &CA{Lifetime: c.Lifetime}
+	if next.Lifetime <= 0 {
+		next.Lifetime = crt.NotAfter.Sub(crt.NotBefore)
+	}
+	if err := next.GenerateCert(); err != nil {
+		return err
+	}
+	cross, err := crossSign(c, next)
+	if err != nil {
+		return err
+	}
+	reverse, err := crossSign(next, c)
+	if err != nil {
+		return err
+	}
+	c.Rotation = &Rotation{
+		Next:             next,
+		CrossCert:        cross,
+		ReverseCrossCert: reverse,
+		SwitchAt:         switchAt,
+		RetireAt:         retireAt,
+	}
+	return nil
+}
+
+// AbortRotation discards the new root, which is only possible before the
+// switch as certs from it would no longer verify
+func (c *CA) AbortRotation(now time.Time) error {
+	if c.Rotation == nil {
+		return fmt.Errorf("no rotation in progress")
+	}
+	if c.Rotation.Switched(now) {
+		return fmt.Errorf("certs are already issued by the new root, it can not be discarded")
+	}
+	c.Rotation = nil
+	return nil
+}
+
+// Retire finishes the rotation, the new root replaces the current one which
+// is kept in PreviousCerts so the ledger can still be verified
+func (c *CA) Retire(now time.Time) error {
+	r := c.Rotation
+	if r == nil {
+		return fmt.Errorf("no rotation in progress")
+	}
+	if !r.Switched(now) {
+		return fmt.Errorf("issuance does not switch to the new root until %v", r.SwitchAt)
+	}
+	c.PreviousCerts = append(c.PreviousCerts, c.CertBytes)
+	c.CertBytes, c.KeyBytes = r.Next.CertBytes, r.Next.KeyBytes
+	c.Rotation = nil
+	return nil
+}
+
+// issuingCA returns the root that issues certs at now
+func (c *CA) issuingCA(now time.Time) *CA {
+	if c.Rotation != nil && c.Rotation.Switched(now) {
+		return c.Rotation.Next
+	}
+	return c
+}
+
+// ChainCerts returns the certs to send after a cert issued at now: the root
+// that issued it and, during a rotation, the cross cert and the other root
+// so clients that trust or pin either root can verify it. An intermediate
+// CA is followed by its chain.
+func (c *CA) ChainCerts(now time.Time) ([]*x509.Certificate, error) {
+	issuing := c.issuingCA(now)
+	pems := [][]byte{issuing.CertBytes}
+	if r := c.Rotation; r != nil {
+		if issuing == c {
+			pems = append(pems, r.ReverseCrossCert, r.Next.CertBytes)
+		} else {
+			pems = append(pems, r.CrossCert, c.CertBytes)
+		}
+	}
+
+	var certs []*x509.Certificate
+	for _, b := range pems {
+		crt, err := (&Cert{CertBytes: b}).X509()
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, crt)
+	}
+	if c.Chain != nil {
+		chain, err := ParseCertsPEM(c.Chain)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, chain...)
+	}
+	return certs, nil
+}
+
+// TrustBundle returns the PEM certs clients should trust, the root and
+// during a rotation the new root and both cross certs. For an intermediate
+// CA it is followed by its chain.
+func (c *CA) TrustBundle() []byte {
+	var buf bytes.Buffer
+	buf.Write(c.CertBytes)
+	buf.Write(c.Chain)
+	if r := c.Rotation; r != nil {
+		buf.Write(r.Next.CertBytes)
+		buf.Write(r.CrossCert)
+		buf.Write(r.ReverseCrossCert)
+	}
+	return buf.Bytes()
+}
+
+// RootCerts returns every root the CA has used, the current one first
+func (c *CA) RootCerts() ([]*x509.Certificate, error) {
+	pems := [][]byte{c.CertBytes}
+	if c.Rotation != nil {
+		pems = append(pems, c.Rotation.Next.CertBytes)
+	}
+	pems = append(pems, c.PreviousCerts...)
+
+	var certs []*x509.Certificate
+	for _, b := range pems {
+		crt, err := (&Cert{CertBytes: b}).X509()
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, crt)
+	}
+	return certs, nil
+}
+
+// crossSign certifies the subject and key of subject's root with issuer's
+// root. The cross cert is valid until either root expires.
+func crossSign(issuer, subject *CA) ([]byte, error) {
+	signer, err := issuer.Signer()
+	if err != nil {
+		return nil, err
+	}
+	issuerCert, err := issuer.Cert()
+	if err != nil {
+		return nil, err
+	}
+	subjectCert, err := subject.Cert()
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	notAfter := subjectCert.NotAfter
+	if issuerCert.NotAfter.Before(notAfter) {
+		notAfter = issuerCert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subjectCert.Subject,
+		SubjectKeyId:          subjectCert.SubjectKeyId,
+		NotBefore:             time.Now(),
+		NotAfter:              notAfter,
+		KeyUsage:              subjectCert.KeyUsage,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuerCert, subjectCert.PublicKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
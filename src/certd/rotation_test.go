@@ -0,0 +1,296 @@
+package certd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// verifyChain verifies crt against roots with intermediates
+func verifyChain(crt *x509.Certificate, roots, intermediates []*x509.Certificate) error {
+	opts := x509.VerifyOptions{Roots: x509.NewCertPool(), Intermediates: x509.NewCertPool()}
+	for _, c := range roots {
+		opts.Roots.AddCert(c)
+	}
+	for _, c := range intermediates {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := crt.Verify(opts)
+	return err
+}
+
+func issueTestCert(t *testing.T, c *CA) *x509.Certificate {
+	csr, _ := CreateCSR("localhost")
+	cert, err := c.CertFromCSR(csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := cert.X509()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt
+}
+
+func Test_CA_rotation(t *testing.T) {
+	c := &CA{}
+	if err := c.GenerateCert(); err != nil {
+		t.Fatal(err)
+	}
+	oldRoot, _ := c.Cert()
+
+	now := time.Now()
+	if err := c.StartRotation(now.Add(time.Hour), now.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartRotation(now, now); err == nil {
+		t.Errorf("expected a second rotation to be refused")
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	newRoot, _ := c.Rotation.Next.Cert()
+
+	// before the switch the old root issues, clients that only trust the
+	// new root verify through the reverse cross cert
+	crt := issueTestCert(t, c)
+	if err := crt.CheckSignatureFrom(oldRoot); err != nil {
+		t.Errorf("expected the old root to issue before the switch: %v", err)
+	}
+	chain, err := c.ChainCerts(time.Now())
+	if err != nil || len(chain) != 3 || !chain[0].Equal(oldRoot) {
+		t.Fatalf("unexpected chain before the switch %v", err)
+	}
+	if err := verifyChain(crt, []*x509.Certificate{newRoot}, chain); err != nil {
+		t.Errorf("expected a cert from the old root to verify against the new root: %v", err)
+	}
+
+	// after the switch the new root issues and clients that only trust
+	// the old root verify through the cross cert
+	c.Rotation.SwitchAt = now
+	crt = issueTestCert(t, c)
+	if err := crt.CheckSignatureFrom(newRoot); err != nil {
+		t.Errorf("expected the new root to issue after the switch: %v", err)
+	}
+	chain, err = c.ChainCerts(time.Now())
+	if err != nil || !chain[0].Equal(newRoot) {
+		t.Fatalf("unexpected chain after the switch %v", err)
+	}
+	if err := verifyChain(crt, []*x509.Certificate{oldRoot}, chain); err != nil {
+		t.Errorf("expected a cert from the new root to verify against the old root: %v", err)
+	}
+	if err := verifyChain(crt, []*x509.Certificate{newRoot}, nil); err != nil {
+		t.Error(err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(c.TrustBundle()) || len(pool.Subjects()) != 4 {
+		t.Errorf("expected both roots and cross certs in the bundle")
+	}
+	if err := c.AbortRotation(time.Now()); err == nil {
+		t.Errorf("expected a rotation not to be aborted after the switch")
+	}
+
+	der, err := c.CreateCRL(nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, _ := x509.ParseRevocationList(der)
+	if err := crl.CheckSignatureFrom(newRoot); err != nil {
+		t.Errorf("expected the CRL to be signed by the new root: %v", err)
+	}
+
+	if err := c.Retire(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if previous, err := c.CreatePreviousCRL(nil, time.Hour); err != nil || previous != nil {
+		t.Errorf("expected no CRL from the retired root %v", err)
+	}
+	if crt, _ := c.Cert(); !crt.Equal(newRoot) || c.Rotation != nil || len(c.PreviousCerts) != 1 {
+		t.Errorf("expected the new root to replace the old one")
+	}
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_CA_rotation_abort(t *testing.T) {
+	c := &CA{}
+	if err := c.GenerateCert(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := c.StartRotation(now.Add(time.Hour), now); err == nil {
+		t.Errorf("expected retiring before the switch to be refused")
+	}
+	if err := c.StartRotation(now.Add(time.Hour), now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Retire(now); err == nil {
+		t.Errorf("expected retiring before the switch to fail")
+	}
+	if err := c.AbortRotation(now); err != nil || c.Rotation != nil {
+		t.Errorf("expected the rotation to be aborted %v", err)
+	}
+
+	shared, _, err := SetupSharedCA(filepath.Join(t.TempDir(), "ca.json"), 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shared.StartRotation(now, now); err == nil {
+		t.Errorf("expected a CA key split into shares not to be rotated")
+	}
+}
+
+func Test_CA_rotation_saved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ca.json")
+	defer SetCAPassphrase(envPassphrase)
+	SetCAPassphrase(func() (string, error) { return "secret", nil })
+
+	c, err := SetupEncryptedCA(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Ledger, err = OpenLedger(filepath.Join(t.TempDir(), "ledger.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Ledger.Close()
+	issueTestCert(t, c)
+
+	now := time.Now()
+	if err := c.StartRotation(now, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Update(path); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(b), "PRIVATE KEY") {
+		t.Errorf("expected the new root's key to be encrypted in %s", b)
+	}
+
+	loaded, err := LoadCA(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Rotation == nil || !bytes.Equal(loaded.Rotation.Next.KeyBytes, c.Rotation.Next.KeyBytes) {
+		t.Fatalf("expected the rotation to be loaded with the new root's key")
+	}
+	loaded.Ledger = c.Ledger
+	issueTestCert(t, loaded)
+
+	if err := loaded.Retire(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Update(path); err != nil {
+		t.Fatal(err)
+	}
+	retired, err := LoadCA(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := retired.Validate(); err != nil || len(retired.PreviousCerts) != 1 {
+		t.Errorf("expected the retired root to be kept %v", err)
+	}
+
+	// the ledger has entries signed by both roots
+	roots, err := retired.RootCerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadFile(c.Ledger.f.Name())
+	if n, err := VerifyLedger(bytes.NewReader(b), roots...); err != nil || n != 2 {
+		t.Errorf("expected 2 valid entries got %v: %v", n, err)
+	}
+	if _, err := VerifyLedger(bytes.NewReader(b), roots[0]); err == nil {
+		t.Errorf("expected entries from the retired root not to verify against the new root alone")
+	}
+}
+
+func Test_API_ca_rotation(t *testing.T) {
+	s := newTestServer(t)
+	now := time.Now()
+	if err := s.CA.StartRotation(now.Add(time.Hour), now.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	var info CAInfo
+	apiRequest(t, s, "GET", "/api/v1/ca", nil, &info)
+	next, _ := s.CA.Rotation.Next.Cert()
+	if info.Rotation == nil || info.Rotation.NextFingerprint != Fingerprint(next) || info.Rotation.Switched {
+		t.Errorf("unexpected rotation %+v", info.Rotation)
+	}
+	if info.Bundle != string(s.CA.TrustBundle()) {
+		t.Errorf("expected the trust bundle in the CA info")
+	}
+
+	rr := apiRequest(t, s, "GET", "/ca-bundle", nil, nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != info.Bundle {
+		t.Errorf("expected the trust bundle got %v %v", rr.Code, rr.Body.String())
+	}
+	if r := s.Ready(); r.Status != CheckOK {
+		t.Errorf("expected ready during a rotation got %+v", r)
+	}
+	s.CA.Rotation.RetireAt = now
+	if r := s.Ready(); r.Status != CheckWarn {
+		t.Errorf("expected a warning once the old root is due to be retired got %+v", r)
+	}
+}
+
+func Test_CA_rotation_previous_CRL(t *testing.T) {
+	c := &CA{}
+	if err := c.GenerateCert(); err != nil {
+		t.Fatal(err)
+	}
+	oldRoot, _ := c.Cert()
+	now := time.Now()
+	if err := c.StartRotation(now.Add(time.Hour), now.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if previous, err := c.CreatePreviousCRL(nil, time.Hour); err != nil || previous != nil {
+		t.Errorf("expected no previous CRL before the switch %v", err)
+	}
+	leaf := issueTestCert(t, c)
+	chain, _ := c.ChainCerts(time.Now())
+
+	// the cert from the old root is revoked after the switch
+	c.Rotation.SwitchAt = now
+	revokedAt := time.Now()
+	records := []*CertRecord{{
+		Serial:    fmt.Sprintf("%x", leaf.SerialNumber),
+		NotAfter:  leaf.NotAfter,
+		Revoked:   true,
+		RevokedAt: &revokedAt,
+	}}
+	crl := func(der []byte, err error) *x509.RevocationList {
+		if err != nil {
+			t.Fatal(err)
+		}
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return crl
+	}
+	current := crl(c.CreateCRL(records, time.Hour))
+	previous := crl(c.CreatePreviousCRL(records, time.Hour))
+
+	trustBundle, _ := ParseCertsPEM(c.TrustBundle())
+	for _, bundle := range [][]*x509.Certificate{{oldRoot}, trustBundle} {
+		opts := VerifyOptions{Bundle: bundle, CRL: current}
+		if _, err := VerifyCert(append([]*x509.Certificate{leaf}, chain...), opts); err == nil || strings.Contains(err.Error(), "revoked") {
+			t.Errorf("expected the new root's CRL not to apply to the old root's cert: %v", err)
+		}
+		opts.CRL = previous
+		if _, err := VerifyCert(append([]*x509.Certificate{leaf}, chain...), opts); err == nil || !strings.Contains(err.Error(), "revoked") {
+			t.Errorf("expected the old root's cert to be revoked by its CRL: %v", err)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package certd
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func Test_scryptKey(t *testing.T) {
+	// test vectors from RFC 7914
+	for _, test := range []struct {
+		password, salt string
+		n, r, p        int
+		key            string
+	}{
+		{"", "", 16, 1, 1, "77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16, "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b3731622eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+	} {
+		key, err := scryptKey([]byte(test.password), []byte(test.salt), test.n, test.r, test.p, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(key) != test.key {
+			t.Errorf("%q N=%v: expected %v got %x", test.password, test.n, test.key, key)
+		}
+	}
+
+	for _, n := range []int{0, 1, 1000} {
+		if _, err := scryptKey(nil, nil, n, 8, 1, 32); err == nil {
+			t.Errorf("N=%v: expected an error", n)
+		}
+	}
+}
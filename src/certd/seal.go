@@ -0,0 +1,197 @@
+package certd
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+)
+
+// SealStatus describes whether the CA key is sealed and how many of the
+// Threshold shares needed to unseal it have been given
+type SealStatus struct {
+	Sealed    bool `json:"sealed"`
+	Threshold int  `json:"threshold,omitempty"`
+	Shares    int  `json:"shares,omitempty"`
+	Progress  int  `json:"progress"`
+}
+
+// UnsealRequest is the body of a request to /sys/unseal, Reset discards the
+// shares given so far
+type UnsealRequest struct {
+	Share string `json:"share,omitempty"`
+	Reset bool   `json:"reset,omitempty"`
+}
+
+// SealStatus returns the seal status of the CA
+func (s *Server) SealStatus() *SealStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sealStatus()
+}
+
+// sealStatus must be called with s.mu held
+func (s *Server) sealStatus() *SealStatus {
+	st := &SealStatus{Sealed: s.CA.Sealed(), Progress: len(s.unsealShares)}
+	if ek := s.CA.EncryptedKey; ek != nil && ek.KDF == KDFShamir {
+		st.Threshold, st.Shares = ek.Threshold, ek.Shares
+	}
+	return st
+}
+
+// Unseal adds share to the shares given so far, once there are enough the
+// CA key is decrypted and certs can be issued again. If the shares do not
+// decrypt the key they are all discarded.
+func (s *Server) Unseal(ctx context.Context, share string) (*SealStatus, error) {
+	s.mu.Lock()
+	ca := s.CA
+	if !ca.Sealed() {
+		defer s.mu.Unlock()
+		return s.sealStatus(), nil
+	}
+	b, err := ca.EncryptedKey.CheckShare(share)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, &APIError{http.StatusBadRequest, ErrCodeInvalidRequest, err.Error()}
+	}
+	for _, given := range s.unsealShares {
+		if prev, _ := ca.EncryptedKey.CheckShare(given); bytes.Equal(prev, b) {
+			defer s.mu.Unlock()
+			return s.sealStatus(), nil
+		}
+	}
+	s.unsealShares = append(s.unsealShares, share)
+	if len(s.unsealShares) < ca.EncryptedKey.Threshold {
+		defer s.mu.Unlock()
+		loggerFrom(ctx).Info("unseal share accepted", "progress", len(s.unsealShares), "threshold", ca.EncryptedKey.Threshold)
+		return s.sealStatus(), nil
+	}
+
+	shares := s.unsealShares
+	s.unsealShares = nil
+	unsealed := *ca
+	if err := unsealed.Unseal(shares); err != nil {
+		s.mu.Unlock()
+		loggerFrom(ctx).Warn("unseal failed", "error", err)
+		s.Audit.Log(ctx, AuditUnsealFailed, "error", err.Error())
+		return nil, &APIError{http.StatusBadRequest, ErrCodeInvalidRequest, "the shares do not unseal the CA key, the shares given so far have been discarded"}
+	}
+	s.CA = &unsealed
+	status := s.sealStatus()
+	serving := s.serving
+	s.mu.Unlock()
+
+	loggerFrom(ctx).Info("CA unsealed")
+	s.Audit.Log(ctx, AuditCAUnsealed)
+	if serving != nil {
+		serving.Renew()
+	}
+	if s.IsLeader() {
+		if err := s.generateCRL(); err != nil {
+			loggerFrom(ctx).Error("failed to generate CRL", "error", err)
+		}
+	}
+	return status, nil
+}
+
+// ResetUnseal discards the shares given so far
+func (s *Server) ResetUnseal() *SealStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unsealShares = nil
+	return s.sealStatus()
+}
+
+// Seal discards the decrypted CA key so nothing can be signed until it is
+// unsealed again. Only a key split into shares can be sealed.
+func (s *Server) Seal(ctx context.Context) (*SealStatus, error) {
+	s.mu.Lock()
+	ca := s.CA
+	if ek := ca.EncryptedKey; ek == nil || ek.KDF != KDFShamir {
+		s.mu.Unlock()
+		return nil, &APIError{http.StatusBadRequest, ErrCodeInvalidRequest, "the CA key is not split into shares so it could not be unsealed"}
+	}
+	sealed := *ca
+	sealed.KeyBytes = nil
+	s.CA = &sealed
+	s.unsealShares = nil
+	status := s.sealStatus()
+	serving := s.serving
+	s.mu.Unlock()
+
+	loggerFrom(ctx).Info("CA sealed")
+	s.Audit.Log(ctx, AuditCASealed)
+	if serving != nil {
+		serving.Renew()
+	}
+	return status, nil
+}
+
+// serveSys routes the /sys/ endpoints. Unsealing and the status do not need
+// authentication, the credentials may not be usable until the CA is
+// unsealed and the shares are what authorises an unseal.
+func (s *Server) serveSys(w http.ResponseWriter, req *http.Request) {
+	var h http.HandlerFunc
+	var allowed string
+	switch req.URL.Path {
+	case "/sys/seal-status":
+		allowed = "GET"
+		if req.Method == "GET" {
+			h = func(w http.ResponseWriter, req *http.Request) {
+				writeJSON(w, req, http.StatusOK, s.SealStatus())
+			}
+		}
+	case "/sys/unseal":
+		allowed = "POST"
+		if req.Method == "POST" {
+			h = s.sysUnseal
+		}
+	case "/sys/seal":
+		allowed = "POST"
+		if req.Method == "POST" {
+			h = s.apiAdmin(s.sysSeal)
+		}
+	default:
+		writeAPIError(w, req, &APIError{http.StatusNotFound, ErrCodeNotFound, "no such endpoint"})
+		return
+	}
+
+	if h == nil {
+		w.Header().Set("Allow", allowed)
+		writeAPIError(w, req, &APIError{http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, req.Method + " is not allowed"})
+		return
+	}
+	h(w, req)
+}
+
+func (s *Server) sysUnseal(w http.ResponseWriter, req *http.Request) {
+	var ur UnsealRequest
+	if err := decodeJSON(w, req, &ur); err != nil {
+		writeAPIError(w, req, err)
+		return
+	}
+
+	var status *SealStatus
+	var err error
+	switch {
+	case ur.Reset:
+		status = s.ResetUnseal()
+	case ur.Share == "":
+		err = &APIError{http.StatusBadRequest, ErrCodeInvalidRequest, "share or reset is required"}
+	default:
+		status, err = s.Unseal(req.Context(), ur.Share)
+	}
+	if err != nil {
+		writeAPIError(w, req, err)
+		return
+	}
+	writeJSON(w, req, http.StatusOK, status)
+}
+
+func (s *Server) sysSeal(w http.ResponseWriter, req *http.Request) {
+	status, err := s.Seal(req.Context())
+	if err != nil {
+		writeAPIError(w, req, err)
+		return
+	}
+	writeJSON(w, req, http.StatusOK, status)
+}
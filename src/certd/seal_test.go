@@ -0,0 +1,150 @@
+package certd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newSealedTestServer returns a server whose CA key is split into 3 shares
+// with a threshold of 2, loaded sealed as it is when certd starts
+func newSealedTestServer(t *testing.T) (*Server, []string) {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "ca.json")
+	_, shares, err := SetupSharedCA(path, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadCA(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Sealed() {
+		t.Fatal("expected the CA to be loaded sealed")
+	}
+	s := NewServer(c, "127.0.0.1", "4443", "")
+	s.ConfigPath = path
+	return s, shares
+}
+
+func Test_Server_unseal(t *testing.T) {
+	s, shares := newSealedTestServer(t)
+
+	var apiErr apiErrorBody
+	rr := apiRequest(t, s, "POST", "/api/v1/certificates", strings.NewReader(`{"hosts":["localhost"]}`), &apiErr)
+	if rr.Code != http.StatusServiceUnavailable || apiErr.Error.Code != ErrCodeSealed {
+		t.Fatalf("expected issuance to be refused while sealed got %v %v", rr.Code, rr.Body.String())
+	}
+	if r := s.Ready(); r.Status != CheckFail {
+		t.Errorf("expected a sealed CA to fail got %+v", r)
+	}
+
+	var status SealStatus
+	apiRequest(t, s, "GET", "/sys/seal-status", nil, &status)
+	if status != (SealStatus{Sealed: true, Threshold: 2, Shares: 3}) {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	rr = apiRequest(t, s, "POST", "/sys/unseal", strings.NewReader(`{"share":"`+shares[1]+`"}`), &status)
+	if rr.Code != http.StatusOK || !status.Sealed || status.Progress != 1 {
+		t.Fatalf("expected 1 share to be accepted got %v %+v", rr.Code, status)
+	}
+	// giving the same share again does not count
+	apiRequest(t, s, "POST", "/sys/unseal", strings.NewReader(`{"share":"`+shares[1]+`"}`), &status)
+	if status.Progress != 1 {
+		t.Errorf("expected a repeated share to be ignored got %+v", status)
+	}
+	rr = apiRequest(t, s, "POST", "/sys/unseal", strings.NewReader(`{"share":"not a share"}`), &apiErr)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected %v got %v", http.StatusBadRequest, rr.Code)
+	}
+
+	apiRequest(t, s, "POST", "/sys/unseal", strings.NewReader(`{"share":"`+shares[2]+`"}`), &status)
+	if status.Sealed || status.Progress != 0 {
+		t.Fatalf("expected the CA to be unsealed got %+v", status)
+	}
+	rr = apiRequest(t, s, "POST", "/api/v1/certificates", strings.NewReader(`{"hosts":["localhost"]}`), nil)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected %v got %v: %v", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	if r := s.Ready(); r.Status != CheckOK {
+		t.Errorf("expected ready got %+v", r)
+	}
+
+	// a reload of the same config keeps the CA unsealed
+	st, err := LoadSettings(s.ConfigPath, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(st); err != nil {
+		t.Fatal(err)
+	}
+	if s.SealStatus().Sealed {
+		t.Errorf("expected the CA to stay unsealed after a reload")
+	}
+
+	unauthenticated := httptest.NewRecorder()
+	s.ServeHTTP(unauthenticated, httptest.NewRequest("POST", "/sys/seal", nil))
+	if rr := unauthenticated; rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected sealing to need credentials got %v", rr.Code)
+	}
+	rr = apiRequest(t, s, "POST", "/sys/seal", nil, &status)
+	if rr.Code != http.StatusOK || !status.Sealed {
+		t.Fatalf("expected the CA to be sealed got %v %+v", rr.Code, status)
+	}
+	rr = apiRequest(t, s, "POST", "/api/v1/certificates", strings.NewReader(`{"hosts":["localhost"]}`), nil)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected issuance to be refused after sealing got %v", rr.Code)
+	}
+}
+
+func Test_Server_unseal_wrong_shares(t *testing.T) {
+	s, shares := newSealedTestServer(t)
+	_, other, err := SetupSharedCA(filepath.Join(filepath.Dir(s.ConfigPath), "other.json"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var status SealStatus
+	rr := apiRequest(t, s, "POST", "/sys/unseal", strings.NewReader(`{"share":"`+other[0]+`"}`), nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected a share of another CA to be rejected got %v", rr.Code)
+	}
+
+	apiRequest(t, s, "POST", "/sys/unseal", strings.NewReader(`{"share":"`+shares[0]+`"}`), &status)
+	apiRequest(t, s, "POST", "/sys/unseal", strings.NewReader(`{"reset":true}`), &status)
+	if status.Progress != 0 {
+		t.Errorf("expected reset to discard the shares got %+v", status)
+	}
+
+	s2 := newTestServer(t)
+	rr = apiRequest(t, s2, "POST", "/sys/seal", nil, nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected a CA without shares not to be sealed got %v", rr.Code)
+	}
+}
+
+func Test_servingCert_sealed(t *testing.T) {
+	s, _ := newSealedTestServer(t)
+	sc := newServingCert(func() *CA { return s.settings().CA }, "localhost", 0)
+	cert, err := sc.issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := s.CA.Cert()
+	if err := cert.Leaf.CheckSignatureFrom(caCert); err == nil {
+		t.Errorf("expected the serving cert not to be signed by the sealed CA")
+	}
+	if len(cert.Certificate) != 2 {
+		t.Errorf("expected the temporary CA to be sent with the serving cert")
+	}
+}
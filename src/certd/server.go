@@ -1,18 +1,24 @@
 package certd
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	DefaultUser     = "admin"
-	DefaultPassword = "password"
+	DefaultUser            = "admin"
+	DefaultPassword        = "password"
+	DefaultShutdownTimeout = 30 * time.Second
 )
 
 // Server is what used to serve API requests for new certs
@@ -21,10 +27,66 @@ type Server struct {
 	CertAddrs  string
 	HTTPSPort  string
 	ListenAddr string
-	user       string
-	password   string
+	Inventory  Store
+	Users      *Users
+	Policy     *Policy
+	Profiles   map[string]*Profile
+	// Subordinates are the subordinate CAs each team can be issued
+	Subordinates map[string]*Subordinate
+	// ServingCertLifetime is the lifetime of the server's own cert, it is
+	// renewed in the background before it expires
+	ServingCertLifetime time.Duration
+	// ShutdownTimeout is how long to wait for requests to finish on shutdown
+	ShutdownTimeout time.Duration
+	Metrics         *Metrics
+	// Audit records security events, it is disabled when nil
+	Audit *AuditLog
+	// MetricsAddr is an optional address to serve the metrics on without
+	// authentication
+	MetricsAddr string
+	// ExpiryWindow is used by the metrics to count certs that expire soon
+	ExpiryWindow time.Duration
+	// ConfigPath is the CA config, readiness checks it can still be loaded
+	ConfigPath string
+	// CAExpiryWarning is how long before the CA expires readiness warns
+	CAExpiryWarning time.Duration
+	// TLSMinVersion is the minimum TLS version accepted, the crypto/tls
+	// default is used when it is zero
+	TLSMinVersion uint16
+	// Lease elects the leader when several instances share a store, with
+	// no Lease this instance is always the leader
+	Lease Lease
+	// LeaseInterval is how often the lease is acquired or renewed
+	LeaseInterval time.Duration
+	// CRLPath is where the leader writes the CRL for every instance to serve
+	CRLPath string
+	// CRLInterval is how often the leader regenerates the CRL
+	CRLInterval time.Duration
+	// TrustedProxies are the networks of the reverse proxies whose
+	// Forwarded and X-Forwarded-For headers give the requester's address
+	TrustedProxies []*net.IPNet
+	// Resolver looks up the names of requesters, net.DefaultResolver if nil
+	Resolver Resolver
+	user     string
+	password string
+
+	// mu guards the fields that can be changed by Reload
+	mu      sync.RWMutex
+	serving *servingCert
+	leader  bool
+	crl     []byte
+	// previousCRL is signed by the previous root during a rotation
+	previousCRL []byte
+	// unsealShares are the shares given so far while the CA is sealed
+	unsealShares []string
+	// tenants are the other CAs hosted by the server, parent is the
+	// server hosting this one when it is a tenant
+	tenants map[string]*Tenant
+	parent  *Server
 }
 
+var ErrUnknownProfile = errors.New("unknown profile")
+
 // NewServer creates a new Server
 func NewServer(ca *CA, listenAddr, port, certAddrs string) *Server {
 	s := Server{
@@ -32,25 +94,125 @@ func NewServer(ca *CA, listenAddr, port, certAddrs string) *Server {
 		CertAddrs:  certAddrs,
 		HTTPSPort:  port,
 		ListenAddr: listenAddr,
-		user:       DefaultUser,
-		password:   DefaultPassword,
+		Inventory:  NewInventory(),
+		Profiles:   DefaultProfiles(),
+
+		ServingCertLifetime: DefaultServingCertLifetime,
+		ShutdownTimeout:     DefaultShutdownTimeout,
+		Metrics:             NewMetrics(),
+		ExpiryWindow:        DefaultExpiryWindow,
+		CAExpiryWarning:     DefaultCAExpiryWarning,
+		LeaseInterval:       DefaultLeaseInterval,
+		CRLInterval:         DefaultCRLInterval,
 	}
 
+	s.user, s.password = DefaultCredentials()
+	return &s
+}
+
+// DefaultCredentials returns the static credentials a server starts with,
+// $CERTD_USER and $CERTD_PASS or DefaultUser and DefaultPassword
+func DefaultCredentials() (user, password string) {
+	user, password = DefaultUser, DefaultPassword
 	if u := os.Getenv("CERTD_USER"); u != "" {
-		s.user = u
+		user = u
 	}
 	if p := os.Getenv("CERTD_PASS"); p != "" {
-		s.password = p
+		password = p
 	}
-	return &s
+	return user, password
+}
+
+// settings returns a consistent snapshot of the settings that can be reloaded
+func (s *Server) settings() *Settings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return &Settings{
+		CA:           s.CA,
+		CertAddrs:    s.CertAddrs,
+		Users:        s.Users,
+		Policy:       s.Policy,
+		Profiles:     s.Profiles,
+		Subordinates: s.Subordinates,
+	}
+}
+
+// Reload replaces the CA, users, policy, profiles and subordinates. Invalid
+// settings are rejected and the server continues to use the current ones.
+func (s *Server) Reload(st *Settings) error {
+	if err := st.Validate(); err != nil {
+		logger.Error("rejecting new settings", "error", err)
+		s.Audit.Log(context.Background(), AuditConfigRejected, "error", err.Error())
+		return err
+	}
+
+	s.mu.Lock()
+	if st.CA.Ledger == nil {
+		st.CA.Ledger = s.CA.Ledger
+	}
+	// a rotation changes the trust bundle but not the cert
+	caChanged := !bytes.Equal(s.CA.TrustBundle(), st.CA.TrustBundle())
+	// a reloaded config is sealed again, keep the key if it was unsealed
+	if st.CA.Sealed() && !s.CA.Sealed() && !caChanged {
+		st.CA.KeyBytes = s.CA.KeyBytes
+	}
+	if caChanged {
+		s.unsealShares = nil
+	}
+	s.CA = st.CA
+	s.CertAddrs = st.CertAddrs
+	s.Users = st.Users
+	s.Policy = st.Policy
+	s.Profiles = st.Profiles
+	s.Subordinates = st.Subordinates
+	serving := s.serving
+	s.mu.Unlock()
+
+	if serving != nil {
+		serving.SetHosts(s.servingHosts(st.CertAddrs))
+		if caChanged {
+			serving.Renew()
+		}
+	}
+	s.warnCAExpiry(st.CA)
+	logger.Info("settings reloaded")
+	s.Audit.Log(context.Background(), AuditConfigChanged, "ca_changed", caChanged, "cert_addrs", st.CertAddrs)
+	return nil
 }
 
 // ServeHTTP reoutes requests
-func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	req, info := withRequestInfo(req)
+	w := &statusRecorder{ResponseWriter: rw}
+	start := time.Now()
+	defer func() {
+		loggerFrom(req.Context()).Info("request", "method", req.Method, "path", req.URL.Path,
+			"status", w.status, "duration", time.Since(start))
+	}()
+
 	w.Header().Set("Cache-Control", "private, max-age=0")
 	w.Header().Set("Expires", "0")
+	w.Header().Set("X-Request-ID", info.id)
+
+	if t, treq := s.routeTenant(req); t != nil {
+		info.ca = t.Name
+		t.handle(w, treq)
+		return
+	}
+	s.handle(w, req)
+}
 
-	log.Printf("%v - %v", req.RemoteAddr, req.URL.Path)
+// handle routes a request to the server's own CA
+func (s *Server) handle(w http.ResponseWriter, req *http.Request) {
+	if strings.HasPrefix(req.URL.Path, APIPrefix) {
+		s.serveAPI(w, req)
+		return
+	}
+	if strings.HasPrefix(req.URL.Path, "/sys/") {
+		s.serveSys(w, req)
+		return
+	}
 
 	switch req.URL.Path {
 	case "/":
@@ -59,6 +221,18 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		s.genCert(w, req)
 	case "/ca":
 		s.dumpCA(w, req)
+	case "/ca-bundle":
+		s.dumpCABundle(w, req)
+	case "/metrics":
+		s.serveMetrics(w, req)
+	case "/healthz":
+		s.healthz(w, req)
+	case "/readyz":
+		s.readyz(w, req)
+	case "/crl":
+		s.serveCRL(w, req)
+	case "/crl-previous":
+		s.servePreviousCRL(w, req)
 	default:
 		http.NotFound(w, req)
 	}
@@ -71,7 +245,19 @@ func (s *Server) dumpCA(w http.ResponseWriter, req *http.Request) {
 
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Disposition", "inline; filename=ca.crt")
-	w.Write(s.CA.CertBytes)
+	w.Write(s.settings().CA.CertBytes)
+}
+
+// dumpCABundle sends the certs clients should trust, which differ from /ca
+// during a rotation
+func (s *Server) dumpCABundle(w http.ResponseWriter, req *http.Request) {
+	if !s.Authorized(w, req) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "inline; filename=ca-bundle.crt")
+	w.Write(s.settings().CA.TrustBundle())
 }
 
 func (s *Server) genCert(w http.ResponseWriter, req *http.Request) {
@@ -80,33 +266,45 @@ func (s *Server) genCert(w http.ResponseWriter, req *http.Request) {
 	}
 
 	if err := req.ParseForm(); err != nil {
-		log.Println(err)
+		loggerFrom(req.Context()).Warn("invalid form", "error", err)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
-	hosts := req.FormValue("hosts")
-	if hosts == "" {
-		remoteAddr, _, _ := net.SplitHostPort(req.RemoteAddr)
-		if hostAddrs, err := net.LookupIP(remoteAddr); err == nil {
-			for _, h := range hostAddrs {
-				hosts = fmt.Sprintf("%v,%v", h, hosts)
-			}
+	// without hosts the cert is for the requester, its IP and the names
+	// that resolve to it
+	hosts := SplitHosts(req.FormValue("hosts"))
+	if len(hosts) == 0 {
+		ip, err := s.requesterIP(req)
+		if err != nil {
+			loggerFrom(req.Context()).Warn("unable to determine requester", "error", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
 		}
-		hosts = strings.TrimRight(hosts, ",")
+		hosts = s.requesterHosts(req.Context(), ip)
 	}
-	log.Printf("generating cert for \"%v\"", hosts)
 
-	csr, err := CreateCSR(hosts)
-	if err != nil {
-		log.Println(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	cert, _, err := s.issueRequest(req.Context(), &IssueRequest{
+		Hosts:      hosts,
+		KeyFormat:  req.FormValue("key_format"),
+		Passphrase: req.FormValue("passphrase"),
+	})
+	var policyErr *PolicyError
+	var apiErr *APIError
+	if errors.As(err, &policyErr) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 		return
-	}
-
-	cert, err := s.CA.CertFromCSR(csr)
-	if err != nil {
-		log.Println(err)
+	} else if errors.Is(err, ErrSealed) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if errors.Is(err, ErrLifetimeExceedsCA) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.As(err, &apiErr) {
+		http.Error(w, apiErr.Message, apiErr.Status)
+		return
+	} else if err != nil {
+		loggerFrom(req.Context()).Error("failed to issue cert", "error", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -121,7 +319,7 @@ func (s *Server) genCert(w http.ResponseWriter, req *http.Request) {
 		fileName = "cert.json"
 		output, err = cert.JSON()
 		if err != nil {
-			log.Println(err)
+			loggerFrom(req.Context()).Error("failed to encode cert", "error", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
@@ -132,69 +330,354 @@ func (s *Server) genCert(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(w, "%v\n", output)
 }
 
-func (s *Server) listenHTTPS() error {
-	addrs := s.CertAddrs
-	if addrs == "" {
-		addrs = s.ListenAddr
+// servingHosts returns the hosts the server's own cert is issued for
+func (s *Server) servingHosts(certAddrs string) string {
+	if certAddrs == "" {
+		return s.ListenAddr
 	}
+	return certAddrs
+}
 
-	log.Printf("generating cert for: %v", addrs)
-	csr, err := CreateCSR(addrs)
-	if err != nil {
+func (s *Server) listenHTTPS(ctx context.Context) error {
+	serving := newServingCert(func() *CA { return s.settings().CA }, s.servingHosts(s.settings().CertAddrs), s.ServingCertLifetime)
+	if _, err := serving.issue(); err != nil {
 		return err
 	}
+	done := make(chan struct{})
+	defer close(done)
+	go serving.run(done)
+
+	s.mu.Lock()
+	s.serving = serving
+	s.mu.Unlock()
+
+	// tenants with hosts get a serving cert from their own CA, picked by
+	// the TLS server name
+	for _, t := range s.Tenants() {
+		if len(t.Hosts) == 0 {
+			continue
+		}
+		ts := t.Server
+		tserving := newServingCert(func() *CA { return ts.settings().CA }, strings.Join(t.Hosts, ","), s.ServingCertLifetime)
+		if _, err := tserving.issue(); err != nil {
+			return fmt.Errorf("tenant \"%v\": %v", t.Name, err)
+		}
+		go tserving.run(done)
+		ts.mu.Lock()
+		ts.serving = tserving
+		ts.mu.Unlock()
+	}
 
-	c, err := s.CA.CertFromCSR(csr)
+	config := &tls.Config{
+		GetCertificate: s.getCertificate,
+		MinVersion:     s.TLSMinVersion,
+	}
+
+	listener, err := tls.Listen("tcp", net.JoinHostPort(s.ListenAddr, s.HTTPSPort), config)
 	if err != nil {
 		return err
 	}
-	certBytes, keyBytes := c.CertBytes, c.KeyBytes
 
-	cert, err := tls.X509KeyPair(certBytes, keyBytes)
-	if err != nil {
+	srv := http.Server{
+		Handler: s,
+	}
+
+	errChan := make(chan error, 2)
+	go func() {
+		errChan <- srv.Serve(listener)
+	}()
+	logger.Info("listening for HTTPS connections", "addr", listener.Addr().String())
+
+	var metricsSrv *http.Server
+	if s.MetricsAddr != "" {
+		metricsListener, err := net.Listen("tcp", s.MetricsAddr)
+		if err != nil {
+			srv.Close()
+			return err
+		}
+		metricsSrv = &http.Server{Handler: s.MetricsHandler()}
+		go func() {
+			errChan <- metricsSrv.Serve(metricsListener)
+		}()
+		logger.Info("serving metrics", "addr", metricsListener.Addr().String())
+	}
+
+	select {
+	case err := <-errChan:
+		srv.Close()
+		if metricsSrv != nil {
+			metricsSrv.Close()
+		}
 		return err
+	case <-ctx.Done():
 	}
 
-	config := &tls.Config{
-		Certificates: []tls.Certificate{cert},
+	logger.Info("shutting down, waiting for requests to finish", "timeout", s.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+	if metricsSrv != nil {
+		metricsSrv.Shutdown(shutdownCtx)
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+		return fmt.Errorf("shutdown: %v", err)
 	}
+	logger.Info("shutdown complete")
+	return nil
+}
 
-	listener, err := tls.Listen("tcp", net.JoinHostPort(s.ListenAddr, s.HTTPSPort), config)
+// getCertificate returns the serving cert of the tenant for the TLS server
+// name, or the server's own
+func (s *Server) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	sc := s
+	if t := s.tenantForHost(hello.ServerName); t != nil {
+		sc = t.Server
+	}
+	sc.mu.RLock()
+	serving := sc.serving
+	sc.mu.RUnlock()
+	if serving == nil {
+		s.mu.RLock()
+		serving = s.serving
+		s.mu.RUnlock()
+	}
+	return serving.GetCertificate(hello)
+}
+
+// SetCredentials changes the user and password used when no users file is
+// configured
+func (s *Server) SetCredentials(user, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.user = user
+	s.password = password
+}
+
+// credentials returns the static credentials, a tenant uses those of the
+// server hosting it so changes made with SetCredentials apply to every CA
+func (s *Server) credentials() (string, string) {
+	if s.parent != nil {
+		return s.parent.credentials()
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.user, s.password
+}
+
+// SetCertAddrs changes the IPs and hostnames the server's own cert is issued
+// for, if the server is running a new cert is issued straight away
+func (s *Server) SetCertAddrs(addrs string) {
+	s.mu.Lock()
+	s.CertAddrs = addrs
+	serving := s.serving
+	s.mu.Unlock()
+
+	if serving != nil {
+		serving.SetHosts(s.servingHosts(addrs))
+	}
+}
+
+// issueRequest checks ir against the policy, generates a key and CSR if
+// needed and issues the cert
+func (s *Server) issueRequest(ctx context.Context, ir *IssueRequest) (cert *Cert, record *CertRecord, err error) {
+	st := s.settings()
+	log := loggerFrom(ctx)
+
+	profile := ir.Profile
+	if profile == "" {
+		profile = DefaultProfile
+	}
+	defer func() {
+		label := profile
+		if _, ok := st.Profiles[profile]; !ok {
+			label = "unknown"
+		}
+		outcome := issueOutcome(err)
+		s.Metrics.Issued(label, outcome)
+		switch outcome {
+		case OutcomeSuccess:
+			log.Info("cert issued", "serial", record.Serial, "hosts", record.Hosts, "profile", profile)
+			s.Audit.Log(ctx, AuditCertIssued, "serial", record.Serial, "hosts", record.Hosts, "profile", profile, "not_after", record.NotAfter)
+		case OutcomeRejected:
+			log.Warn("cert request rejected", "profile", profile, "error", err)
+		}
+	}()
+
+	if st.CA.Sealed() {
+		return nil, nil, ErrSealed
+	}
+
+	hosts := strings.Join(ir.Hosts, ",")
+	var csr *CSR
+	if ir.CSR != "" {
+		if csr, err = ParseCSR([]byte(ir.CSR), hosts); err != nil {
+			return nil, nil, &APIError{http.StatusBadRequest, ErrCodeInvalidRequest, err.Error()}
+		}
+		hosts = csr.Hosts
+		if ir.KeyFormat != "" || ir.Passphrase != "" {
+			return nil, nil, &APIError{http.StatusBadRequest, ErrCodeInvalidRequest, "key_format and passphrase can not be used with a CSR"}
+		}
+	}
+	if err := CheckKeyFormat(ir.KeyFormat, ir.Passphrase); err != nil {
+		return nil, nil, &APIError{http.StatusBadRequest, ErrCodeInvalidRequest, err.Error()}
+	}
+
+	if err := st.Policy.Check(SplitHosts(hosts)); err != nil {
+		return nil, nil, err
+	}
+	if _, ok := st.Profiles[profile]; !ok {
+		return nil, nil, fmt.Errorf("%w \"%v\"", ErrUnknownProfile, profile)
+	}
+
+	if csr == nil {
+		log.Info("generating cert", "hosts", hosts)
+		start := time.Now()
+		if csr, err = CreateCSR(hosts); err != nil {
+			return nil, nil, err
+		}
+		s.Metrics.KeyGeneration(time.Since(start))
+	} else {
+		log.Info("signing CSR", "hosts", hosts)
+	}
+
+	if cert, record, err = s.issue(st, csr, profile); err != nil {
+		return nil, nil, err
+	}
+	if csr.PrivateKey != nil {
+		if cert.KeyBytes, err = FormatKey(cert.KeyBytes, ir.KeyFormat, ir.Passphrase); err != nil {
+			return nil, nil, err
+		}
+	}
+	return cert, record, nil
+}
+
+// issueOutcome returns the outcome of an issuance for the metrics
+func issueOutcome(err error) string {
+	var apiErr *APIError
+	var policyErr *PolicyError
+	switch {
+	case err == nil:
+		return OutcomeSuccess
+	case errors.As(err, &apiErr), errors.As(err, &policyErr), errors.Is(err, ErrUnknownProfile), errors.Is(err, ErrSealed),
+		errors.Is(err, ErrLifetimeExceedsCA):
+		return OutcomeRejected
+	}
+	return OutcomeError
+}
+
+// issue signs csr using the named profile and records the new cert in the
+// store. Both happen in one transaction so a cert is only returned once it
+// has been stored.
+func (s *Server) issue(st *Settings, csr *CSR, profile string) (*Cert, *CertRecord, error) {
+	if profile == "" {
+		profile = DefaultProfile
+	}
+	p, ok := st.Profiles[profile]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w \"%v\"", ErrUnknownProfile, profile)
+	}
+	if err := p.Apply(csr); err != nil {
+		return nil, nil, err
+	}
+
+	var cert *Cert
+	var record *CertRecord
+	var pending *pendingEntry
+	err := s.Inventory.Update(func(tx StoreTx) error {
+		start := time.Now()
+		var err error
+		if cert, pending, err = st.CA.prepareCert(csr); err != nil {
+			return err
+		}
+		s.Metrics.Signing(time.Since(start))
+
+		if record, err = NewCertRecord(cert, profile); err != nil {
+			return err
+		}
+		return insertRecord(tx, record)
+	})
+	// the issuance stays in the ledger only if the cert was stored
+	pending.finish(err)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	return cert, record, nil
+}
 
-	srv := http.Server{
-		Handler: s,
+// authenticate checks the credentials supplied with the request
+func (s *Server) authenticate(req *http.Request) bool {
+	_, ok := s.authenticateRole(req)
+	return ok
+}
+
+// authenticateRole checks the credentials supplied with the request and
+// returns the user's role, the static credentials are an admin
+func (s *Server) authenticateRole(req *http.Request) (string, bool) {
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	role := RoleAdmin
+	if users := s.settings().Users; users != nil {
+		var u *User
+		if u, ok = users.Authenticate(user, password); ok && !u.IsAdmin() {
+			role = u.Role
+		}
+	} else {
+		wantUser, wantPassword := s.credentials()
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(wantUser)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(wantPassword)) == 1
+		ok = userOK && passwordOK
 	}
 
-	log.Printf("listening for HTTPS connections on %v:%v", s.ListenAddr, s.HTTPSPort)
-	return srv.Serve(listener)
+	if !ok {
+		s.Metrics.AuthFailure()
+		loggerFrom(req.Context()).Warn("authentication failed", "attempted_user", user)
+		s.Audit.Log(req.Context(), AuditAuthFailure, "attempted_user", user)
+		return "", false
+	}
+	setUser(req.Context(), user)
+	return role, true
 }
 
 // Authorized determines if the request is authorized
 func (s *Server) Authorized(w http.ResponseWriter, req *http.Request) bool {
-	if user, password, ok := req.BasicAuth(); ok {
-		if (user == s.user) && (password == s.password) {
-			return true
-		} else {
-			w.Header().Set("WWW-Authenticate", "Basic realm=\"depot\"")
-			w.WriteHeader(http.StatusUnauthorized)
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			return false
-		}
-	} else {
-		w.Header().Set("WWW-Authenticate", "Basic realm=\"certd\"")
-		w.WriteHeader(http.StatusUnauthorized)
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		return false
+	if s.authenticate(req) {
+		return true
 	}
+	w.Header().Set("WWW-Authenticate", "Basic realm=\"certd\"")
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 	return false
 }
 
 // Run starts the Server
 func (s *Server) Run() error {
-	return s.listenHTTPS()
+	return s.RunContext(context.Background())
+}
+
+// RunContext starts the Server, when ctx is cancelled the server stops
+// accepting connections and waits up to ShutdownTimeout for requests in
+// progress to finish
+func (s *Server) RunContext(ctx context.Context) error {
+	leaderCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		jobs := []*leaderJob{
+			{name: "crl", interval: s.crlInterval(), run: s.generateCRL},
+		}
+		for _, t := range s.Tenants() {
+			jobs = append(jobs, &leaderJob{name: "crl:" + t.Name, interval: t.crlInterval(), run: t.generateCRL})
+		}
+		s.runLeader(leaderCtx, jobs)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	return s.listenHTTPS(ctx)
 }
 
 var IndexPage = `<html>
@@ -300,12 +783,13 @@ form input[type="text"] {
 
 
 <h4>CA Cert</h4>
-<p>The root CA can be downloaded <a href="/ca">here</a>.</p>
+<p>The root CA can be downloaded <a href="/ca">here</a>, the <a href="/ca-bundle">trust bundle</a> also holds the new root while it is being replaced.</p>
 
 <h4>API Usage</h4>
 <p>Request certs from this CA by making a GET request to <i>/req</i>. By default a cert will be generated for the requesting host.</p>
 <p>Use the option "hosts" for a different host.</p>
 <p>Example: <i>/req?hosts=192.168.1.138,some-host.local</i></p>
+<p>A JSON API is available under <i>/api/v1/</i>, see the README for details.</p>
 
 </div>
 
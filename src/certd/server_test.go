@@ -1,6 +1,7 @@
 package certd
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -239,3 +240,60 @@ func Test_Server_404(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
 	}
 }
+
+func Test_Server_Reload(t *testing.T) {
+	s := newTestServer(t)
+	other := newTestServer(t)
+
+	invalid := &Settings{CA: &CA{CertBytes: other.CA.CertBytes, KeyBytes: s.CA.KeyBytes}, Profiles: DefaultProfiles()}
+	if err := s.Reload(invalid); err == nil {
+		t.Errorf("expected invalid settings to be rejected")
+	}
+	if s.settings().CA == invalid.CA {
+		t.Errorf("invalid settings were applied")
+	}
+
+	valid := &Settings{CA: other.CA, Policy: &Policy{MaxHosts: 1}, Profiles: DefaultProfiles()}
+	if err := s.Reload(valid); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/req?hosts=a.local,b.local", nil)
+	req.SetBasicAuth(DefaultUser, DefaultPassword)
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("reloaded policy not applied, got %v", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/ca", nil)
+	req.SetBasicAuth(DefaultUser, DefaultPassword)
+	s.ServeHTTP(rr, req)
+	if rr.Body.String() != string(other.CA.CertBytes) {
+		t.Errorf("reloaded CA not served")
+	}
+}
+
+func Test_Server_RunContext_shutdown(t *testing.T) {
+	s := newTestServer(t)
+	s.HTTPSPort = "0"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error)
+	go func() {
+		errChan <- s.RunContext(ctx)
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("server did not shut down")
+	}
+}
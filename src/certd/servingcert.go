@@ -0,0 +1,189 @@
+package certd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultServingCertLifetime = 24 * time.Hour
+	// servingCertRetry is how long to wait before retrying a failed renewal
+	servingCertRetry = time.Minute
+)
+
+// servingCert issues and renews the cert used by the HTTPS listener
+type servingCert struct {
+	ca       func() *CA
+	lifetime time.Duration
+
+	mu    sync.RWMutex
+	hosts string
+	cert  *tls.Certificate
+	// sealedCA signs the cert while the CA is sealed, it is generated when
+	// first needed and only kept in memory
+	sealedCA *CA
+	// renew is signalled when the hosts change
+	renew chan struct{}
+}
+
+func newServingCert(ca func() *CA, hosts string, lifetime time.Duration) *servingCert {
+	if lifetime <= 0 {
+		lifetime = DefaultServingCertLifetime
+	}
+	return &servingCert{
+		ca:       ca,
+		lifetime: lifetime,
+		hosts:    hosts,
+		renew:    make(chan struct{}, 1),
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (sc *servingCert) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	sc.mu.RLock()
+	cert := sc.cert
+	sc.mu.RUnlock()
+	if cert != nil {
+		return cert, nil
+	}
+	return sc.issue()
+}
+
+// SetHosts changes the hosts the cert is issued for, a new cert is issued
+// in the background
+func (sc *servingCert) SetHosts(hosts string) {
+	sc.mu.Lock()
+	changed := hosts != sc.hosts
+	sc.hosts = hosts
+	sc.mu.Unlock()
+
+	if changed {
+		sc.Renew()
+	}
+}
+
+// Renew issues a new cert in the background
+func (sc *servingCert) Renew() {
+	select {
+	case sc.renew <- struct{}{}:
+	default:
+	}
+}
+
+// issue creates a new cert for the current hosts and starts serving it
+func (sc *servingCert) issue() (*tls.Certificate, error) {
+	sc.mu.RLock()
+	hosts := sc.hosts
+	sc.mu.RUnlock()
+
+	logger.Info("generating serving cert", "hosts", hosts)
+	csr, err := CreateCSR(hosts)
+	if err != nil {
+		return nil, err
+	}
+	csr.Lifetime = sc.lifetime
+	csr.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+
+	ca := sc.ca()
+	if ca.Sealed() {
+		if ca, err = sc.temporaryCA(); err != nil {
+			return nil, err
+		}
+	}
+	// the serving cert is needed whatever the CA has left, near its expiry
+	// the cert is valid until the CA expires
+	if caCert, err := ca.issuingCA(time.Now()).Cert(); err == nil && time.Now().Add(csr.Lifetime).After(caCert.NotAfter) {
+		csr.Lifetime = 0
+	}
+	c, err := ca.CertFromCSR(csr)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := ca.ChainCerts(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(c.CertBytes, c.KeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	// send the CA too so clients can check it against a pinned fingerprint,
+	// during a rotation both roots and the cross cert between them
+	for _, crt := range chain {
+		cert.Certificate = append(cert.Certificate, crt.Raw)
+	}
+
+	sc.mu.Lock()
+	sc.cert = &cert
+	sc.mu.Unlock()
+	logger.Info("serving cert issued", "hosts", hosts, "not_after", cert.Leaf.NotAfter)
+	return &cert, nil
+}
+
+// temporaryCA returns the CA that signs the serving cert while the real CA
+// is sealed. Its fingerprint is logged so the unseal requests can pin it.
+func (sc *servingCert) temporaryCA() (*CA, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.sealedCA == nil {
+		ca := &CA{}
+		if err := ca.GenerateCert(); err != nil {
+			return nil, err
+		}
+		crt, err := ca.Cert()
+		if err != nil {
+			return nil, err
+		}
+		logger.Warn("the CA is sealed, serving with a temporary CA until it is unsealed", "fingerprint", Fingerprint(crt))
+		sc.sealedCA = ca
+	}
+	return sc.sealedCA, nil
+}
+
+// renewAt returns when the current cert should be replaced, which is once two
+// thirds of its lifetime have passed or when a rotation switches to the new
+// root if that is sooner
+func (sc *servingCert) renewAt() time.Time {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+
+	if sc.cert == nil {
+		return time.Now()
+	}
+	leaf := sc.cert.Leaf
+	at := leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) * 2 / 3)
+	if r := sc.ca().Rotation; r != nil && leaf.NotBefore.Before(r.SwitchAt) && r.SwitchAt.Before(at) {
+		at = r.SwitchAt
+	}
+	return at
+}
+
+// run renews the cert before it expires until done is closed
+func (sc *servingCert) run(done <-chan struct{}) {
+	wait := time.Until(sc.renewAt())
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-sc.renew:
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		if _, err := sc.issue(); err != nil {
+			logger.Error("failed to renew serving cert", "retry_in", servingCertRetry, "error", err)
+			wait = servingCertRetry
+			continue
+		}
+		wait = time.Until(sc.renewAt())
+	}
+}
@@ -0,0 +1,72 @@
+package certd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func Test_servingCert_GetCertificate(t *testing.T) {
+	s := newTestServer(t)
+	sc := newServingCert(func() *CA { return s.CA }, "localhost,127.0.0.1", time.Hour)
+
+	cert, err := sc.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore); d > time.Hour+time.Second {
+		t.Errorf("expected a lifetime of 1h got %v", d)
+	}
+	if len(cert.Leaf.DNSNames) != 1 || len(cert.Leaf.IPAddresses) != 1 {
+		t.Errorf("unexpected SANs %v %v", cert.Leaf.DNSNames, cert.Leaf.IPAddresses)
+	}
+
+	caCert, _ := s.CA.Cert()
+	if len(cert.Certificate) != 2 || !bytes.Equal(cert.Certificate[1], caCert.Raw) {
+		t.Errorf("expected the chain to include the CA")
+	}
+
+	again, _ := sc.GetCertificate(nil)
+	if again != cert {
+		t.Errorf("expected the cached cert to be returned")
+	}
+
+	renewAt := sc.renewAt()
+	if renewAt.Before(time.Now().Add(30*time.Minute)) || renewAt.After(time.Now().Add(45*time.Minute)) {
+		t.Errorf("unexpected renewal time %v", renewAt)
+	}
+}
+
+func Test_servingCert_run(t *testing.T) {
+	s := newTestServer(t)
+	sc := newServingCert(func() *CA { return s.CA }, "localhost", time.Hour)
+	first, err := sc.issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go sc.run(done)
+
+	sc.SetHosts("other.local")
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		cert, _ := sc.GetCertificate(nil)
+		if cert != first {
+			if len(cert.Leaf.DNSNames) != 1 || cert.Leaf.DNSNames[0] != "other.local" {
+				t.Errorf("unexpected SANs %v", cert.Leaf.DNSNames)
+			}
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Errorf("cert was not renewed after the hosts changed")
+}
+
+func Test_servingCert_default_lifetime(t *testing.T) {
+	sc := newServingCert(nil, "localhost", 0)
+	if sc.lifetime != DefaultServingCertLifetime {
+		t.Errorf("expected %v got %v", DefaultServingCertLifetime, sc.lifetime)
+	}
+}
@@ -0,0 +1,105 @@
+package certd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Settings are the parts of the server's configuration that can be changed
+// while it is running
+type Settings struct {
+	CA        *CA
+	CertAddrs string
+	// Users is nil when the single user from CERTD_USER/CERTD_PASS is used
+	Users    *Users
+	Policy   *Policy
+	Profiles map[string]*Profile
+	// Subordinates are the subordinate CAs each team can be issued
+	Subordinates map[string]*Subordinate
+}
+
+// PolicyFile is the format of the file holding the policy, profiles and
+// subordinates
+type PolicyFile struct {
+	Policy       *Policy                 `json:"policy,omitempty"`
+	Profiles     map[string]*Profile     `json:"profiles,omitempty"`
+	Subordinates map[string]*Subordinate `json:"subordinates,omitempty"`
+}
+
+// LoadSettings loads the CA from config and, if their paths are not empty,
+// the users and policy files
+func LoadSettings(config, users, policy, certAddrs string) (*Settings, error) {
+	ca, err := LoadCA(config)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &Settings{
+		CA:        ca,
+		CertAddrs: certAddrs,
+		Profiles:  DefaultProfiles(),
+	}
+
+	if users != "" {
+		if st.Users, err = LoadUsers(users); err != nil {
+			return nil, err
+		}
+	}
+
+	if policy != "" {
+		b, err := ioutil.ReadFile(policy)
+		if err != nil {
+			return nil, err
+		}
+		var pf PolicyFile
+		if err := json.Unmarshal(b, &pf); err != nil {
+			return nil, fmt.Errorf("%v: %v", policy, err)
+		}
+		st.Policy = pf.Policy
+		if len(pf.Profiles) > 0 {
+			st.Profiles = pf.Profiles
+		}
+		st.Subordinates = pf.Subordinates
+	}
+
+	if err := st.Validate(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Validate checks the settings are usable
+func (st *Settings) Validate() error {
+	if st.CA == nil {
+		return fmt.Errorf("no CA configured")
+	}
+	if err := st.CA.Validate(); err != nil {
+		return fmt.Errorf("invalid CA: %v", err)
+	}
+	if st.Policy != nil {
+		if err := st.Policy.Validate(); err != nil {
+			return fmt.Errorf("invalid policy: %v", err)
+		}
+	}
+	if _, ok := st.Profiles[DefaultProfile]; !ok {
+		return fmt.Errorf("no \"%v\" profile configured", DefaultProfile)
+	}
+	for name, p := range st.Profiles {
+		if p == nil {
+			return fmt.Errorf("profile \"%v\" is empty", name)
+		}
+		if _, err := p.ExtKeyUsage(); err != nil {
+			return fmt.Errorf("profile \"%v\": %v", name, err)
+		}
+	}
+	for team, sub := range st.Subordinates {
+		if sub == nil {
+			return fmt.Errorf("subordinates for team \"%v\" are empty", team)
+		}
+		if err := sub.Validate(st.Policy); err != nil {
+			return fmt.Errorf("subordinates for team \"%v\": %v", team, err)
+		}
+	}
+	return nil
+}
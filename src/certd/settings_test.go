@@ -0,0 +1,62 @@
+package certd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_LoadSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := filepath.Join(dir, "certd.conf")
+	if _, err := SetupCA(config); err != nil {
+		t.Fatal(err)
+	}
+	policy := filepath.Join(dir, "policy.json")
+	ioutil.WriteFile(policy, []byte(`{
+		"policy": {"allowed_domains": ["example.com"]},
+		"profiles": {"default": {"lifetime": "24h"}}
+	}`), 0600)
+
+	st, err := LoadSettings(config, "", policy, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Policy.AllowedDomains) != 1 || len(st.Profiles) != 1 || st.CertAddrs != "localhost" {
+		t.Errorf("unexpected settings %+v", st)
+	}
+
+	ioutil.WriteFile(policy, []byte(`{"profiles": {"server": {"usages": ["server"]}}}`), 0600)
+	if _, err := LoadSettings(config, "", policy, ""); err == nil {
+		t.Errorf("expected error for missing default profile")
+	}
+
+	ioutil.WriteFile(policy, []byte(`{"policy": {"allowed_networks": ["nope"]}}`), 0600)
+	if _, err := LoadSettings(config, "", policy, ""); err == nil {
+		t.Errorf("expected error for invalid policy")
+	}
+
+	if _, err := LoadSettings(config, filepath.Join(dir, "missing.json"), "", ""); err == nil {
+		t.Errorf("expected error for missing users file")
+	}
+}
+
+func Test_Settings_Validate_CA(t *testing.T) {
+	a := newTestServer(t)
+	b := newTestServer(t)
+
+	ca := &CA{CertBytes: a.CA.CertBytes, KeyBytes: b.CA.KeyBytes}
+	st := &Settings{CA: ca, Profiles: DefaultProfiles()}
+	if err := st.Validate(); err == nil {
+		t.Errorf("expected error for mismatched key")
+	}
+	if err := (&Settings{Profiles: DefaultProfiles()}).Validate(); err == nil {
+		t.Errorf("expected error for missing CA")
+	}
+}
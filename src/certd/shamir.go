@@ -0,0 +1,110 @@
+package certd
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// MaxKeyShares is the most shares a secret can be split into, each share is
+// a distinct non-zero point in GF(256)
+const MaxKeyShares = 255
+
+// SplitSecret splits secret into n shares, any threshold of which recover it
+// with CombineShares. Each share is the value of a random polynomial of
+// degree threshold-1 over GF(256) for every byte of secret, followed by the
+// point it was evaluated at.
+func SplitSecret(secret []byte, n, threshold int) ([][]byte, error) {
+	if threshold < 2 || threshold > n || n > MaxKeyShares {
+		return nil, fmt.Errorf("invalid shares %v and threshold %v, the threshold must be at least 2 and no more than the %v shares", n, threshold, MaxKeyShares)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("empty secret")
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+	coeffs := make([]byte, threshold)
+	for j, b := range secret {
+		coeffs[0] = b
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for _, share := range shares {
+			share[j] = gfEval(coeffs, share[len(secret)])
+		}
+	}
+	return shares, nil
+}
+
+// CombineShares recovers the secret from shares made by SplitSecret. With
+// fewer shares than the threshold the result is garbage, there is no way to
+// tell so the secret must be checked by its user.
+func CombineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, fmt.Errorf("at least 2 shares are needed")
+	}
+	size := len(shares[0])
+	xs := make([]byte, len(shares))
+	for i, share := range shares {
+		if len(share) != size || size < 2 {
+			return nil, fmt.Errorf("the shares are not all the same length")
+		}
+		xs[i] = share[size-1]
+		if xs[i] == 0 {
+			return nil, fmt.Errorf("invalid share")
+		}
+		for _, x := range xs[:i] {
+			if x == xs[i] {
+				return nil, fmt.Errorf("duplicate share")
+			}
+		}
+	}
+
+	// Lagrange interpolation at x = 0, subtraction is xor in GF(256)
+	secret := make([]byte, size-1)
+	for i, share := range shares {
+		basis := byte(1)
+		for k, x := range xs {
+			if k != i {
+				basis = gfMul(basis, gfMul(x, gfInv(x^xs[i])))
+			}
+		}
+		for j := range secret {
+			secret[j] ^= gfMul(share[j], basis)
+		}
+	}
+	return secret, nil
+}
+
+// gfEval evaluates the polynomial with coeffs, lowest degree first, at x
+func gfEval(coeffs []byte, x byte) byte {
+	var y byte
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ coeffs[i]
+	}
+	return y
+}
+
+// gfMul multiplies in GF(256) with the AES polynomial, without branching on
+// its arguments so the time taken does not depend on the secret
+func gfMul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		a = a<<1 ^ -(a>>7)&0x1b
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns the multiplicative inverse of a, which is a^254
+func gfInv(a byte) byte {
+	inv := byte(1)
+	for i := 0; i < 254; i++ {
+		inv = gfMul(inv, a)
+	}
+	return inv
+}
@@ -0,0 +1,136 @@
+package certd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// KeyProvider gives access to the CA key for signing. The key may be held
+// in memory or in a device that never lets it out.
+type KeyProvider interface {
+	Signer() (crypto.Signer, error)
+}
+
+// FileKey is a KeyProvider for a PEM private key, such as the key stored in
+// a CA config
+type FileKey struct {
+	PEM []byte
+}
+
+// Signer parses the key
+func (k *FileKey) Signer() (crypto.Signer, error) {
+	key, err := ParsePrivateKeyPEM(k.PEM)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// PKCS11Key is a KeyProvider for a key in a PKCS#11 token, such as an HSM.
+// The PIN is read from CERTD_PKCS11_PIN. PKCS#11 is only available when
+// certd is built with cgo and the pkcs11 build tag.
+type PKCS11Key struct {
+	// Module is the path of the PKCS#11 library, e.g.
+	// /usr/lib/softhsm/libsofthsm2.so
+	Module string `json:"module"`
+	Slot   uint   `json:"slot"`
+	// Label is the CKA_LABEL of the private key and its public key
+	Label string `json:"label"`
+}
+
+var (
+	pkcs11Mu      sync.Mutex
+	pkcs11Signers = map[PKCS11Key]*pkcs11Session{}
+	// pkcs11Open opens a session with the token, tests replace it
+	pkcs11Open = openPKCS11
+)
+
+// Signer opens a session with the token and finds the key, the session is
+// kept open and shared by every PKCS11Key for the same key. A session the
+// token no longer accepts, e.g. after the HSM restarted, is dropped when a
+// signature fails and a new one is opened by the next call.
+func (k *PKCS11Key) Signer() (crypto.Signer, error) {
+	if k.Module == "" || k.Label == "" {
+		return nil, fmt.Errorf("pkcs11: module and label are required")
+	}
+	pkcs11Mu.Lock()
+	defer pkcs11Mu.Unlock()
+
+	if signer, ok := pkcs11Signers[*k]; ok {
+		return signer, nil
+	}
+	signer, err := pkcs11Open(k, os.Getenv(PKCS11PINEnv))
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11: %v slot %v key \"%v\": %w", k.Module, k.Slot, k.Label, err)
+	}
+	cached := &pkcs11Session{Signer: signer, key: *k}
+	pkcs11Signers[*k] = cached
+	return cached, nil
+}
+
+// sessionError is implemented by errors of a token that say the session can
+// no longer be used
+type sessionError interface {
+	sessionLost() bool
+}
+
+// pkcs11Session is the signer kept for a key, it is dropped from
+// pkcs11Signers once the token rejects its session
+type pkcs11Session struct {
+	crypto.Signer
+	key PKCS11Key
+}
+
+// Sign implements crypto.Signer
+func (s *pkcs11Session) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	sig, err := s.Signer.Sign(rand, digest, opts)
+	var se sessionError
+	if errors.As(err, &se) && se.sessionLost() {
+		s.drop()
+	}
+	return sig, err
+}
+
+// drop removes the session from pkcs11Signers and closes it
+func (s *pkcs11Session) drop() {
+	pkcs11Mu.Lock()
+	defer pkcs11Mu.Unlock()
+	if pkcs11Signers[s.key] != s {
+		return
+	}
+	delete(pkcs11Signers, s.key)
+	logger.Warn("pkcs11: the token rejected the session, a new one is opened for the next signature",
+		"module", s.key.Module, "slot", s.key.Slot, "label", s.key.Label)
+	if c, ok := s.Signer.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// publicKeysEqual reports whether a and b are the same public key
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
+
+// signatureAlgorithm returns the x509 signature algorithm with SHA-256 for
+// signatures by the key pub
+func signatureAlgorithm(pub crypto.PublicKey) x509.SignatureAlgorithm {
+	switch pub.(type) {
+	case *ecdsa.PublicKey:
+		return x509.ECDSAWithSHA256
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA
+	}
+	return x509.UnknownSignatureAlgorithm
+}
@@ -0,0 +1,12 @@
+//go:build !pkcs11 || !cgo
+
+package certd
+
+import (
+	"crypto"
+	"fmt"
+)
+
+func openPKCS11(k *PKCS11Key, pin string) (crypto.Signer, error) {
+	return nil, fmt.Errorf("certd was built without PKCS#11 support, build it with cgo and -tags pkcs11")
+}
@@ -0,0 +1,407 @@
+//go:build pkcs11 && cgo
+
+package certd
+
+/*
+#cgo linux LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdlib.h>
+
+typedef unsigned long CK_ULONG;
+typedef CK_ULONG CK_RV;
+typedef unsigned char CK_BYTE;
+
+typedef struct {
+	CK_ULONG type;
+	void *pValue;
+	CK_ULONG ulValueLen;
+} CK_ATTRIBUTE;
+
+typedef struct {
+	CK_ULONG mechanism;
+	void *pParameter;
+	CK_ULONG ulParameterLen;
+} CK_MECHANISM;
+
+typedef struct {
+	void *CreateMutex, *DestroyMutex, *LockMutex, *UnlockMutex;
+	CK_ULONG flags;
+	void *pReserved;
+} CK_C_INITIALIZE_ARGS;
+
+// the start of CK_FUNCTION_LIST, up to the last function used
+typedef struct {
+	CK_BYTE major, minor;
+	CK_RV (*C_Initialize)(void *);
+	void *C_Finalize, *C_GetInfo, *C_GetFunctionList, *C_GetSlotList,
+		*C_GetSlotInfo, *C_GetTokenInfo, *C_GetMechanismList,
+		*C_GetMechanismInfo, *C_InitToken, *C_InitPIN, *C_SetPIN;
+	CK_RV (*C_OpenSession)(CK_ULONG, CK_ULONG, void *, void *, CK_ULONG *);
+	CK_RV (*C_CloseSession)(CK_ULONG);
+	void *C_CloseAllSessions, *C_GetSessionInfo, *C_GetOperationState,
+		*C_SetOperationState;
+	CK_RV (*C_Login)(CK_ULONG, CK_ULONG, CK_BYTE *, CK_ULONG);
+	void *C_Logout, *C_CreateObject, *C_CopyObject, *C_DestroyObject,
+		*C_GetObjectSize;
+	CK_RV (*C_GetAttributeValue)(CK_ULONG, CK_ULONG, CK_ATTRIBUTE *, CK_ULONG);
+	void *C_SetAttributeValue;
+	CK_RV (*C_FindObjectsInit)(CK_ULONG, CK_ATTRIBUTE *, CK_ULONG);
+	CK_RV (*C_FindObjects)(CK_ULONG, CK_ULONG *, CK_ULONG, CK_ULONG *);
+	CK_RV (*C_FindObjectsFinal)(CK_ULONG);
+	void *C_EncryptInit, *C_Encrypt, *C_EncryptUpdate, *C_EncryptFinal,
+		*C_DecryptInit, *C_Decrypt, *C_DecryptUpdate, *C_DecryptFinal,
+		*C_DigestInit, *C_Digest, *C_DigestUpdate, *C_DigestKey,
+		*C_DigestFinal;
+	CK_RV (*C_SignInit)(CK_ULONG, CK_MECHANISM *, CK_ULONG);
+	CK_RV (*C_Sign)(CK_ULONG, CK_BYTE *, CK_ULONG, CK_BYTE *, CK_ULONG *);
+} p11_functions;
+
+// p11_load loads the module at path and initializes it for use from
+// several threads, err is set if the module can not be loaded
+static CK_RV p11_load(const char *path, p11_functions **f, const char **err) {
+	void *h = dlopen(path, RTLD_NOW | RTLD_LOCAL);
+	if (h == NULL) {
+		*err = dlerror();
+		return 0;
+	}
+	CK_RV (*get)(p11_functions **) = (CK_RV (*)(p11_functions **))dlsym(h, "C_GetFunctionList");
+	if (get == NULL) {
+		*err = dlerror();
+		return 0;
+	}
+	CK_RV rv = get(f);
+	if (rv != 0) {
+		return rv;
+	}
+	// CKF_OS_LOCKING_OK
+	CK_C_INITIALIZE_ARGS args = {NULL, NULL, NULL, NULL, 0x2, NULL};
+	return (*f)->C_Initialize(&args);
+}
+
+static CK_RV p11_open(p11_functions *f, CK_ULONG slot, CK_ULONG *session) {
+	// CKF_SERIAL_SESSION
+	return f->C_OpenSession(slot, 0x4, NULL, NULL, session);
+}
+
+static CK_RV p11_close(p11_functions *f, CK_ULONG session) {
+	return f->C_CloseSession(session);
+}
+
+static CK_RV p11_login(p11_functions *f, CK_ULONG session, CK_BYTE *pin, CK_ULONG len) {
+	// CKU_USER
+	return f->C_Login(session, 1, pin, len);
+}
+
+// p11_find finds the first object of class with label, count is 0 if there
+// is none
+static CK_RV p11_find(p11_functions *f, CK_ULONG session, CK_ULONG class, CK_BYTE *label, CK_ULONG len, CK_ULONG *obj, CK_ULONG *count) {
+	// CKA_CLASS and CKA_LABEL
+	CK_ATTRIBUTE tmpl[2] = {{0x0, &class, sizeof(class)}, {0x3, label, len}};
+	CK_RV rv = f->C_FindObjectsInit(session, tmpl, 2);
+	if (rv != 0) {
+		return rv;
+	}
+	rv = f->C_FindObjects(session, obj, 1, count);
+	f->C_FindObjectsFinal(session);
+	return rv;
+}
+
+// p11_attribute reads an attribute into buf, with buf NULL len is set to
+// the size needed
+static CK_RV p11_attribute(p11_functions *f, CK_ULONG session, CK_ULONG obj, CK_ULONG type, CK_BYTE *buf, CK_ULONG *len) {
+	CK_ATTRIBUTE a = {type, buf, *len};
+	CK_RV rv = f->C_GetAttributeValue(session, obj, &a, 1);
+	*len = a.ulValueLen;
+	return rv;
+}
+
+static CK_RV p11_sign(p11_functions *f, CK_ULONG session, CK_ULONG key, CK_ULONG mech, CK_BYTE *data, CK_ULONG len, CK_BYTE *sig, CK_ULONG *sigLen) {
+	CK_MECHANISM m = {mech, NULL, 0};
+	CK_RV rv = f->C_SignInit(session, &m, key);
+	if (rv != 0) {
+		return rv;
+	}
+	return f->C_Sign(session, data, len, sig, sigLen);
+}
+*/
+import "C"
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+	"unsafe"
+)
+
+// PKCS#11 constants from pkcs11t.h
+const (
+	ckoPublicKey  = 0x2
+	ckoPrivateKey = 0x3
+	ckkRSA        = 0x0
+	ckkEC         = 0x3
+	ckaKeyType    = 0x100
+	ckaModulus    = 0x120
+	ckaPublicExp  = 0x122
+	ckaECParams   = 0x180
+	ckaECPoint    = 0x181
+	ckmRSAPKCS    = 0x1
+	ckmECDSA      = 0x1041
+
+	ckrDeviceError                = 0x30
+	ckrDeviceRemoved              = 0x32
+	ckrSessionClosed              = 0xb0
+	ckrSessionHandleInvalid       = 0xb3
+	ckrTokenNotPresent            = 0xe0
+	ckrUserAlreadyLoggedIn        = 0x100
+	ckrUserNotLoggedIn            = 0x101
+	ckrCryptokiAlreadyInitialized = 0x191
+)
+
+// pkcs1Prefixes are the DER DigestInfo prefixes CKM_RSA_PKCS needs in front
+// of the digest, as in crypto/rsa
+var pkcs1Prefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+var curveOIDs = map[string]elliptic.Curve{
+	"1.2.840.10045.3.1.7": elliptic.P256(),
+	"1.3.132.0.34":        elliptic.P384(),
+	"1.3.132.0.35":        elliptic.P521(),
+}
+
+// pkcs11Modules are the modules loaded so far by path, a module is only
+// initialized once per process. Guarded by pkcs11Mu.
+var pkcs11Modules = map[string]*C.p11_functions{}
+
+type ckError C.CK_RV
+
+func (rv ckError) Error() string {
+	return fmt.Sprintf("CKR 0x%x", uint64(rv))
+}
+
+// sessionLost reports whether rv means the session has to be opened again
+func (rv ckError) sessionLost() bool {
+	switch rv {
+	case ckrDeviceError, ckrDeviceRemoved, ckrSessionClosed, ckrSessionHandleInvalid, ckrTokenNotPresent, ckrUserNotLoggedIn:
+		return true
+	}
+	return false
+}
+
+func ckCheck(rv C.CK_RV) error {
+	if rv != 0 {
+		return ckError(rv)
+	}
+	return nil
+}
+
+// pkcs11Signer signs with a key in a token, operations on the session are
+// serialized
+type pkcs11Signer struct {
+	mu      sync.Mutex
+	f       *C.p11_functions
+	session C.CK_ULONG
+	key     C.CK_ULONG
+	pub     crypto.PublicKey
+}
+
+// openPKCS11 is called with pkcs11Mu held
+func openPKCS11(k *PKCS11Key, pin string) (crypto.Signer, error) {
+	f, ok := pkcs11Modules[k.Module]
+	if !ok {
+		path := C.CString(k.Module)
+		defer C.free(unsafe.Pointer(path))
+		var errStr *C.char
+		rv := C.p11_load(path, &f, &errStr)
+		if errStr != nil {
+			return nil, fmt.Errorf("failed to load module: %v", C.GoString(errStr))
+		}
+		if rv != 0 && rv != ckrCryptokiAlreadyInitialized {
+			return nil, fmt.Errorf("failed to initialize module: %w", ckError(rv))
+		}
+		pkcs11Modules[k.Module] = f
+	}
+
+	s := &pkcs11Signer{f: f}
+	if err := ckCheck(C.p11_open(f, C.CK_ULONG(k.Slot), &s.session)); err != nil {
+		return nil, fmt.Errorf("failed to open a session: %w", err)
+	}
+	if err := s.init(k.Label, pin); err != nil {
+		C.p11_close(f, s.session)
+		return nil, err
+	}
+	return s, nil
+}
+
+// init logs in and finds the key with label
+func (s *pkcs11Signer) init(label, pin string) error {
+	if pin != "" {
+		b := []byte(pin)
+		rv := C.p11_login(s.f, s.session, (*C.CK_BYTE)(unsafe.Pointer(&b[0])), C.CK_ULONG(len(b)))
+		if rv != 0 && rv != ckrUserAlreadyLoggedIn {
+			return fmt.Errorf("failed to log in: %w", ckError(rv))
+		}
+	}
+
+	var err error
+	if s.key, err = s.find(ckoPrivateKey, label); err != nil {
+		return err
+	}
+	pubObj, err := s.find(ckoPublicKey, label)
+	if err != nil {
+		return err
+	}
+	s.pub, err = s.publicKey(pubObj)
+	return err
+}
+
+func (s *pkcs11Signer) find(class C.CK_ULONG, label string) (C.CK_ULONG, error) {
+	b := []byte(label)
+	var obj, count C.CK_ULONG
+	if err := ckCheck(C.p11_find(s.f, s.session, class, (*C.CK_BYTE)(unsafe.Pointer(&b[0])), C.CK_ULONG(len(b)), &obj, &count)); err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		kind := "private"
+		if class == ckoPublicKey {
+			kind = "public"
+		}
+		return 0, fmt.Errorf("no %v key found", kind)
+	}
+	return obj, nil
+}
+
+func (s *pkcs11Signer) attribute(obj, typ C.CK_ULONG) ([]byte, error) {
+	var n C.CK_ULONG
+	if err := ckCheck(C.p11_attribute(s.f, s.session, obj, typ, nil, &n)); err != nil {
+		return nil, err
+	}
+	b := make([]byte, int(n))
+	if n == 0 {
+		return b, nil
+	}
+	if err := ckCheck(C.p11_attribute(s.f, s.session, obj, typ, (*C.CK_BYTE)(unsafe.Pointer(&b[0])), &n)); err != nil {
+		return nil, err
+	}
+	return b[:int(n)], nil
+}
+
+// publicKey reads the public key from the public key object obj
+func (s *pkcs11Signer) publicKey(obj C.CK_ULONG) (crypto.PublicKey, error) {
+	b, err := s.attribute(obj, ckaKeyType)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != int(unsafe.Sizeof(C.CK_ULONG(0))) {
+		return nil, fmt.Errorf("invalid key type")
+	}
+
+	switch keyType := *(*C.CK_ULONG)(unsafe.Pointer(&b[0])); keyType {
+	case ckkRSA:
+		n, err := s.attribute(obj, ckaModulus)
+		if err != nil {
+			return nil, err
+		}
+		e, err := s.attribute(obj, ckaPublicExp)
+		if err != nil {
+			return nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA public exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case ckkEC:
+		params, err := s.attribute(obj, ckaECParams)
+		if err != nil {
+			return nil, err
+		}
+		var oid asn1.ObjectIdentifier
+		if _, err := asn1.Unmarshal(params, &oid); err != nil {
+			return nil, fmt.Errorf("invalid EC params: %v", err)
+		}
+		curve, ok := curveOIDs[oid.String()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %v", oid)
+		}
+		point, err := s.attribute(obj, ckaECPoint)
+		if err != nil {
+			return nil, err
+		}
+		// the point should be a DER OCTET STRING but some tokens return
+		// it raw
+		var raw []byte
+		if rest, err := asn1.Unmarshal(point, &raw); err != nil || len(rest) != 0 {
+			raw = point
+		}
+		return ecdsa.ParseUncompressedPublicKey(curve, raw)
+	default:
+		return nil, fmt.Errorf("unsupported key type 0x%x", uint64(keyType))
+	}
+}
+
+// Close closes the session
+func (s *pkcs11Signer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return ckCheck(C.p11_close(s.f, s.session))
+}
+
+// Public implements crypto.Signer
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign implements crypto.Signer for RSA PKCS #1 v1.5 and ECDSA
+func (s *pkcs11Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if len(digest) != opts.HashFunc().Size() {
+		return nil, fmt.Errorf("pkcs11: digest is not the size of %v", opts.HashFunc())
+	}
+	switch pub := s.pub.(type) {
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return nil, fmt.Errorf("pkcs11: RSA-PSS is not supported")
+		}
+		prefix, ok := pkcs1Prefixes[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("pkcs11: unsupported hash %v", opts.HashFunc())
+		}
+		data := append(append([]byte{}, prefix...), digest...)
+		return s.sign(ckmRSAPKCS, data, pub.Size())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		sig, err := s.sign(ckmECDSA, digest, 2*size)
+		if err != nil {
+			return nil, err
+		}
+		// the token returns r and s concatenated, x509 wants them in DER
+		half := len(sig) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(sig[:half]),
+			new(big.Int).SetBytes(sig[half:]),
+		})
+	}
+	return nil, fmt.Errorf("pkcs11: unsupported key type %T", s.pub)
+}
+
+func (s *pkcs11Signer) sign(mech C.CK_ULONG, data []byte, size int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sig := make([]byte, size)
+	n := C.CK_ULONG(size)
+	rv := C.p11_sign(s.f, s.session, s.key, mech, (*C.CK_BYTE)(unsafe.Pointer(&data[0])), C.CK_ULONG(len(data)),
+		(*C.CK_BYTE)(unsafe.Pointer(&sig[0])), &n)
+	if err := ckCheck(rv); err != nil {
+		return nil, fmt.Errorf("pkcs11: sign failed: %w", err)
+	}
+	return sig[:int(n)], nil
+}
@@ -0,0 +1,141 @@
+//go:build pkcs11 && cgo
+
+package certd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// softHSMModule returns the SoftHSM module from CERTD_TEST_PKCS11_MODULE or
+// a default install location
+func softHSMModule(t *testing.T) string {
+	if _, err := exec.LookPath("softhsm2-util"); err != nil {
+		t.Skip("softhsm2-util not found")
+	}
+	paths := []string{
+		os.Getenv("CERTD_TEST_PKCS11_MODULE"),
+		"/usr/lib/softhsm/libsofthsm2.so",
+		"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+		"/usr/local/lib/softhsm/libsofthsm2.so",
+		"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); path != "" && err == nil {
+			return path
+		}
+	}
+	t.Skip("SoftHSM module not found, set CERTD_TEST_PKCS11_MODULE")
+	return ""
+}
+
+// newSoftHSMToken creates a token in a temporary SoftHSM store, imports the
+// keys by label and returns the slot the token was given. SoftHSM only reads
+// its config once per process so there can only be one token.
+func newSoftHSMToken(t *testing.T, keys map[string]crypto.Signer) uint {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	tokens := filepath.Join(dir, "tokens")
+	os.Mkdir(tokens, 0700)
+	conf := filepath.Join(dir, "softhsm2.conf")
+	ioutil.WriteFile(conf, []byte("directories.tokendir = "+tokens+"\n"), 0600)
+	t.Setenv("SOFTHSM2_CONF", conf)
+	t.Setenv(PKCS11PINEnv, "1234")
+
+	out, err := exec.Command("softhsm2-util", "--init-token", "--free", "--label", "certd", "--pin", "1234", "--so-pin", "5678").CombinedOutput()
+	if err != nil {
+		t.Fatalf("init token: %v %s", err, out)
+	}
+	m := regexp.MustCompile(`reassigned to slot (\d+)`).FindSubmatch(out)
+	if m == nil {
+		t.Fatalf("no slot in %s", out)
+	}
+	slot, _ := strconv.ParseUint(string(m[1]), 10, 64)
+
+	id := 1
+	for label, key := range keys {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyPath := filepath.Join(dir, label+".pem")
+		ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+		out, err = exec.Command("softhsm2-util", "--import", keyPath, "--token", "certd", "--label", label,
+			"--id", strconv.Itoa(10+id), "--pin", "1234").CombinedOutput()
+		if err != nil {
+			t.Fatalf("import key: %v %s", err, out)
+		}
+		id++
+	}
+	return uint(slot)
+}
+
+func Test_PKCS11Key_softhsm(t *testing.T) {
+	module := softHSMModule(t)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, RSABits)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keys := map[string]crypto.Signer{"ca-rsa": rsaKey, "ca-ecdsa": ecKey}
+	slot := newSoftHSMToken(t, keys)
+	for label, key := range keys {
+		path := filepath.Join(t.TempDir(), "ca.json")
+		c, err := SetupPKCS11CA(path, &PKCS11Key{Module: module, Slot: slot, Label: label})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.KeyBytes) != 0 {
+			t.Errorf("%v: expected no key in the config", label)
+		}
+		caCert, _ := c.Cert()
+		if !publicKeysEqual(key.Public(), caCert.PublicKey) {
+			t.Fatalf("%v: expected the CA cert to be for the key in the token", label)
+		}
+
+		c, err = LoadCA(path)
+		if err != nil || c.PKCS11 == nil {
+			t.Fatalf("%v: expected the PKCS#11 config to be loaded %v", label, err)
+		}
+		if err := c.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		csr, _ := CreateCSR("localhost")
+		cert, err := c.CertFromCSR(csr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		crt, _ := cert.X509()
+		if err := crt.CheckSignatureFrom(caCert); err != nil {
+			t.Errorf("%v: expected the cert to be signed by the token: %v", label, err)
+		}
+
+		der, err := c.CreateCRL(nil, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		crl, _ := x509.ParseRevocationList(der)
+		if err := crl.CheckSignatureFrom(caCert); err != nil {
+			t.Errorf("%v: expected the CRL to be signed by the token: %v", label, err)
+		}
+	}
+
+	if _, err := (&PKCS11Key{Module: module, Slot: slot, Label: "missing"}).Signer(); err == nil {
+		t.Errorf("expected an error for a missing key")
+	}
+}
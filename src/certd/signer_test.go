@@ -0,0 +1,199 @@
+package certd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newECDSACA returns a CA with a P-256 key held in KeyBytes
+func newECDSACA(t *testing.T) *CA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ECDSA CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(OneYear),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return &CA{
+		CertBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyBytes:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func Test_CA_Signer_ecdsa(t *testing.T) {
+	c := newECDSACA(t)
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.KeyProvider().(*FileKey); !ok {
+		t.Errorf("expected a file key got %T", c.KeyProvider())
+	}
+	caCert, _ := c.Cert()
+
+	csr, err := CreateCSR("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := c.CertFromCSR(csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, _ := cert.X509()
+	if err := crt.CheckSignatureFrom(caCert); err != nil {
+		t.Errorf("expected the cert to be signed by the CA: %v", err)
+	}
+
+	der, err := c.CreateCRL(nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, _ := x509.ParseRevocationList(der)
+	if err := crl.CheckSignatureFrom(caCert); err != nil {
+		t.Errorf("expected the CRL to be signed by the CA: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ledger.jsonl")
+	if c.Ledger, err = OpenLedger(path); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Ledger.Close()
+	if _, err := c.CertFromCSR(csr); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if n, err := VerifyLedger(f, caCert); err != nil || n != 1 {
+		t.Errorf("expected the ledger to verify got %v %v", n, err)
+	}
+
+	s := NewServer(c, "127.0.0.1", "4443", "")
+	if r := s.Ready(); r.Status != CheckOK {
+		t.Errorf("expected ready got %+v", r.Checks)
+	}
+}
+
+func Test_CA_Signer_mismatch(t *testing.T) {
+	c := newECDSACA(t)
+	c.KeyBytes = newECDSACA(t).KeyBytes
+	if err := c.Validate(); err == nil {
+		t.Errorf("expected a key that does not match the cert to be rejected")
+	}
+
+	c = &CA{CertBytes: c.CertBytes, PKCS11: &PKCS11Key{}}
+	if _, err := c.Signer(); err == nil {
+		t.Errorf("expected an error for a PKCS#11 key without a module")
+	}
+}
+
+// fakeTokenSigner stands in for a session with a token, it fails with err
+// once it is set
+type fakeTokenSigner struct {
+	*ecdsa.PrivateKey
+	err    error
+	closed bool
+}
+
+func (s *fakeTokenSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.PrivateKey.Sign(rand, digest, opts)
+}
+
+func (s *fakeTokenSigner) Close() error {
+	s.closed = true
+	return nil
+}
+
+type fakeSessionError bool
+
+func (e fakeSessionError) Error() string     { return "token error" }
+func (e fakeSessionError) sessionLost() bool { return bool(e) }
+
+func Test_PKCS11Key_session_lost(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opened []*fakeTokenSigner
+	open := pkcs11Open
+	pkcs11Open = func(k *PKCS11Key, pin string) (crypto.Signer, error) {
+		s := &fakeTokenSigner{PrivateKey: key}
+		opened = append(opened, s)
+		return s, nil
+	}
+	k := &PKCS11Key{Module: "fake.so", Label: "session-lost"}
+	t.Cleanup(func() {
+		pkcs11Open = open
+		pkcs11Mu.Lock()
+		delete(pkcs11Signers, *k)
+		pkcs11Mu.Unlock()
+	})
+
+	digest := sha256.Sum256([]byte("certd"))
+	sign := func() error {
+		signer, err := k.Signer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		return err
+	}
+	if err := sign(); err != nil {
+		t.Fatal(err)
+	}
+
+	// other errors keep the session
+	opened[0].err = fakeSessionError(false)
+	if err := sign(); err == nil {
+		t.Errorf("expected the signature to fail")
+	}
+	if len(opened) != 1 || opened[0].closed {
+		t.Errorf("expected the session to be kept got %v opened", len(opened))
+	}
+
+	// a session the token rejects is closed and the next call opens another
+	opened[0].err = fmt.Errorf("pkcs11: sign failed: %w", fakeSessionError(true))
+	if err := sign(); err == nil {
+		t.Errorf("expected the signature to fail")
+	}
+	if err := sign(); err != nil {
+		t.Errorf("expected a new session to sign got %v", err)
+	}
+	if len(opened) != 2 || !opened[0].closed {
+		t.Errorf("expected the rejected session to be closed and another opened got %v opened", len(opened))
+	}
+}
@@ -0,0 +1,369 @@
+package certd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store keeps track of the certs issued by the CA
+type Store interface {
+	// Add records a newly issued cert, it is an error if the serial exists
+	Add(r *CertRecord) error
+	// Get returns the record for serial
+	Get(serial string) (*CertRecord, error)
+	// List returns the records matching f ordered by expiry
+	List(f CertFilter) []*CertRecord
+	// Revoke marks the cert with serial as revoked
+	Revoke(serial, reason string) (*CertRecord, error)
+	// Update runs fn in a transaction, the changes it makes are only stored
+	// if it returns nil and are stored together
+	Update(fn func(tx StoreTx) error) error
+	// Check verifies the store can be written to
+	Check() error
+	Close() error
+}
+
+// StoreTx is a transaction passed to Store.Update
+type StoreTx interface {
+	Get(serial string) (*CertRecord, error)
+	// Put adds or replaces a record
+	Put(r *CertRecord) error
+}
+
+// OpenStore opens the store described by spec, which is the type of store
+// and its path separated by a colon:
+//
+//	json:certs.json    a single JSON file, the whole file is rewritten on every change
+//	dir:/var/lib/certd a directory with a JSON file for each cert
+//	kv:certd.db        an embedded key/value store with an append-only log
+//
+// A spec with no type is a JSON file.
+func OpenStore(spec string) (Store, error) {
+	kind, path, ok := strings.Cut(spec, ":")
+	if !ok {
+		kind, path = "json", spec
+	}
+	switch kind {
+	case "json":
+		return LoadInventory(path)
+	case "dir":
+		return OpenDirStore(path)
+	case "kv":
+		return OpenKVStore(path)
+	}
+	return nil, fmt.Errorf("unknown store type \"%v\"", kind)
+}
+
+// certIndex holds the records in memory indexed by serial, host and expiry
+type certIndex struct {
+	bySerial map[string]*CertRecord
+	byHost   map[string]map[string]*CertRecord
+	// byExpiry is sorted by NotAfter and then serial
+	byExpiry []*CertRecord
+}
+
+func newCertIndex() *certIndex {
+	return &certIndex{
+		bySerial: make(map[string]*CertRecord),
+		byHost:   make(map[string]map[string]*CertRecord),
+	}
+}
+
+func expiresBefore(a, b *CertRecord) bool {
+	if a.NotAfter.Equal(b.NotAfter) {
+		return a.Serial < b.Serial
+	}
+	return a.NotAfter.Before(b.NotAfter)
+}
+
+func (x *certIndex) get(serial string) *CertRecord {
+	return x.bySerial[strings.ToLower(serial)]
+}
+
+// put adds r to the index, replacing any record with the same serial
+func (x *certIndex) put(r *CertRecord) {
+	x.remove(r.Serial)
+
+	x.bySerial[strings.ToLower(r.Serial)] = r
+	for _, h := range r.Hosts {
+		h = strings.ToLower(h)
+		if x.byHost[h] == nil {
+			x.byHost[h] = make(map[string]*CertRecord)
+		}
+		x.byHost[h][r.Serial] = r
+	}
+	i := sort.Search(len(x.byExpiry), func(i int) bool {
+		return !expiresBefore(x.byExpiry[i], r)
+	})
+	x.byExpiry = append(x.byExpiry, nil)
+	copy(x.byExpiry[i+1:], x.byExpiry[i:])
+	x.byExpiry[i] = r
+}
+
+func (x *certIndex) remove(serial string) {
+	r := x.get(serial)
+	if r == nil {
+		return
+	}
+
+	delete(x.bySerial, strings.ToLower(serial))
+	for _, h := range r.Hosts {
+		h = strings.ToLower(h)
+		delete(x.byHost[h], r.Serial)
+		if len(x.byHost[h]) == 0 {
+			delete(x.byHost, h)
+		}
+	}
+	i := sort.Search(len(x.byExpiry), func(i int) bool {
+		return !expiresBefore(x.byExpiry[i], r)
+	})
+	if i < len(x.byExpiry) && x.byExpiry[i] == r {
+		x.byExpiry = append(x.byExpiry[:i], x.byExpiry[i+1:]...)
+	}
+}
+
+// list returns copies of the records matching f, using the host or expiry
+// index to avoid looking at every record
+func (x *certIndex) list(f CertFilter, now time.Time) []*CertRecord {
+	candidates := x.byExpiry
+	if f.Host != "" {
+		candidates = make([]*CertRecord, 0, len(x.byHost[strings.ToLower(f.Host)]))
+		for _, r := range x.byHost[strings.ToLower(f.Host)] {
+			candidates = append(candidates, r)
+		}
+		sort.Slice(candidates, func(a, b int) bool {
+			return expiresBefore(candidates[a], candidates[b])
+		})
+	} else if !f.ExpiresBefore.IsZero() {
+		n := sort.Search(len(x.byExpiry), func(i int) bool {
+			return !x.byExpiry[i].NotAfter.Before(f.ExpiresBefore)
+		})
+		candidates = x.byExpiry[:n]
+	}
+
+	records := []*CertRecord{}
+	for _, r := range candidates {
+		if f.match(r, now) {
+			c := *r
+			records = append(records, &c)
+		}
+	}
+	return records
+}
+
+// all returns the records ordered by serial
+func (x *certIndex) all() []*CertRecord {
+	records := make([]*CertRecord, 0, len(x.bySerial))
+	for _, r := range x.bySerial {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(a, b int) bool {
+		return records[a].Serial < records[b].Serial
+	})
+	return records
+}
+
+// recordStore implements Store on top of a certIndex, persist is called
+// with the records changed by each transaction after they have been
+// applied to the index. If it fails the index is rolled back.
+type recordStore struct {
+	mu      sync.RWMutex
+	idx     *certIndex
+	persist func(changed []*CertRecord) error
+	// shared is set by stores that can be shared between instances. It is
+	// called with mu held before every read and transaction to take a lock
+	// across instances and bring idx up to date, the func it returns
+	// releases the lock.
+	shared func(write bool) (func(), error)
+}
+
+type storeTx struct {
+	idx     *certIndex
+	changes map[string]*CertRecord
+	order   []string
+}
+
+func (tx *storeTx) Get(serial string) (*CertRecord, error) {
+	r, ok := tx.changes[strings.ToLower(serial)]
+	if !ok {
+		r = tx.idx.get(serial)
+	}
+	if r == nil {
+		return nil, ErrCertNotFound
+	}
+	c := *r
+	return &c, nil
+}
+
+func (tx *storeTx) Put(r *CertRecord) error {
+	if !validSerial(r.Serial) {
+		return fmt.Errorf("invalid serial \"%v\"", r.Serial)
+	}
+	key := strings.ToLower(r.Serial)
+	if _, ok := tx.changes[key]; !ok {
+		tx.order = append(tx.order, key)
+	}
+	c := *r
+	tx.changes[key] = &c
+	return nil
+}
+
+func (s *recordStore) Update(fn func(tx StoreTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shared != nil {
+		release, err := s.shared(true)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	return s.update(fn)
+}
+
+// read locks the store for reading and returns the func to unlock it
+func (s *recordStore) read() (func(), error) {
+	if s.shared == nil {
+		s.mu.RLock()
+		return s.mu.RUnlock, nil
+	}
+
+	// refreshing changes idx so the write lock is needed
+	s.mu.Lock()
+	release, err := s.shared(false)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	return func() {
+		release()
+		s.mu.Unlock()
+	}, nil
+}
+
+// update runs a transaction, the caller must hold the lock
+func (s *recordStore) update(fn func(tx StoreTx) error) error {
+	tx := &storeTx{idx: s.idx, changes: make(map[string]*CertRecord)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if len(tx.order) == 0 {
+		return nil
+	}
+
+	changed := make([]*CertRecord, 0, len(tx.order))
+	prev := make([]*CertRecord, 0, len(tx.order))
+	for _, key := range tx.order {
+		r := tx.changes[key]
+		prev = append(prev, s.idx.get(key))
+		changed = append(changed, r)
+		s.idx.put(r)
+	}
+
+	if s.persist != nil {
+		if err := s.persist(changed); err != nil {
+			for i, r := range changed {
+				if prev[i] != nil {
+					s.idx.put(prev[i])
+				} else {
+					s.idx.remove(r.Serial)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// validSerial reports whether serial is non-empty and only letters and
+// digits, so it is safe to use as a file name
+func validSerial(serial string) bool {
+	if serial == "" {
+		return false
+	}
+	for _, r := range serial {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// insertRecord adds r in tx, it is an error if the serial exists
+func insertRecord(tx StoreTx, r *CertRecord) error {
+	if _, err := tx.Get(r.Serial); err == nil {
+		return fmt.Errorf("duplicate serial %v", r.Serial)
+	}
+	return tx.Put(r)
+}
+
+func (s *recordStore) Add(r *CertRecord) error {
+	return s.Update(func(tx StoreTx) error {
+		return insertRecord(tx, r)
+	})
+}
+
+func (s *recordStore) Get(serial string) (*CertRecord, error) {
+	unlock, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	r := s.idx.get(serial)
+	if r == nil {
+		return nil, ErrCertNotFound
+	}
+	c := *r
+	return &c, nil
+}
+
+func (s *recordStore) List(f CertFilter) []*CertRecord {
+	unlock, err := s.read()
+	if err != nil {
+		// the records already in memory are the best that can be done
+		logger.Error("failed to refresh the store", "error", err)
+		s.mu.RLock()
+		unlock = s.mu.RUnlock
+	}
+	defer unlock()
+
+	return s.idx.list(f, time.Now())
+}
+
+// revokeRecord marks the cert with serial as revoked in tx
+func revokeRecord(tx StoreTx, serial, reason string) (*CertRecord, error) {
+	r, err := tx.Get(serial)
+	if err != nil {
+		return nil, err
+	}
+	if r.Revoked {
+		return nil, ErrAlreadyRevoked
+	}
+	now := time.Now()
+	r.Revoked = true
+	r.RevokedAt = &now
+	r.RevocationReason = reason
+	if err := tx.Put(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (s *recordStore) Revoke(serial, reason string) (*CertRecord, error) {
+	var revoked *CertRecord
+	err := s.Update(func(tx StoreTx) error {
+		var err error
+		revoked, err = revokeRecord(tx, serial, reason)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := *revoked
+	return &c, nil
+}
@@ -0,0 +1,141 @@
+package certd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testStores opens one store of each type in a temporary directory
+func testStores(t *testing.T) (map[string]string, func()) {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]string{
+		"json": "json:" + filepath.Join(dir, "certs.json"),
+		"dir":  "dir:" + filepath.Join(dir, "certs"),
+		"kv":   "kv:" + filepath.Join(dir, "certd.db"),
+	}, func() { os.RemoveAll(dir) }
+}
+
+func Test_Store(t *testing.T) {
+	specs, cleanup := testStores(t)
+	defer cleanup()
+
+	now := time.Now()
+	for name, spec := range specs {
+		s, err := OpenStore(spec)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		s.Add(&CertRecord{Serial: "1", Hosts: []string{"a", "10.0.0.1"}, NotAfter: now.Add(2 * time.Hour)})
+		s.Add(&CertRecord{Serial: "2", Hosts: []string{"b"}, NotAfter: now.Add(time.Hour)})
+		s.Add(&CertRecord{Serial: "3", Hosts: []string{"A"}, NotAfter: now.Add(-time.Hour)})
+		if err := s.Add(&CertRecord{Serial: "1"}); err == nil {
+			t.Errorf("%v: expected error adding duplicate serial", name)
+		}
+		if err := s.Add(&CertRecord{Serial: "../x"}); err == nil {
+			t.Errorf("%v: expected error adding invalid serial", name)
+		}
+		if _, err := s.Revoke("2", "superseded"); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+		if err := s.Check(); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+		s.Close()
+
+		s, err = OpenStore(spec)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if r, err := s.Get("2"); err != nil || !r.Revoked || r.RevocationReason != "superseded" {
+			t.Errorf("%v: revocation not persisted: %+v %v", name, r, err)
+		}
+		if l := s.List(CertFilter{}); len(l) != 3 || l[0].Serial != "3" || l[2].Serial != "1" {
+			t.Errorf("%v: unexpected list %v", name, l)
+		}
+		if l := s.List(CertFilter{Host: "a"}); len(l) != 2 || l[0].Serial != "3" {
+			t.Errorf("%v: unexpected host list %v", name, l)
+		}
+		if l := s.List(CertFilter{Host: "10.0.0.1", Status: "valid"}); len(l) != 1 || l[0].Serial != "1" {
+			t.Errorf("%v: unexpected host list %v", name, l)
+		}
+		if l := s.List(CertFilter{ExpiresBefore: now.Add(90 * time.Minute)}); len(l) != 2 {
+			t.Errorf("%v: unexpected expiry list %v", name, l)
+		}
+		s.Close()
+	}
+}
+
+func Test_Store_Update_rollback(t *testing.T) {
+	specs, cleanup := testStores(t)
+	defer cleanup()
+
+	for name, spec := range specs {
+		s, err := OpenStore(spec)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		failed := errors.New("signing failed")
+		err = s.Update(func(tx StoreTx) error {
+			tx.Put(&CertRecord{Serial: "1", Hosts: []string{"a"}})
+			if _, err := tx.Get("1"); err != nil {
+				t.Errorf("%v: put not visible in the transaction: %v", name, err)
+			}
+			return failed
+		})
+		if err != failed {
+			t.Errorf("%v: expected %v got %v", name, failed, err)
+		}
+		if _, err := s.Get("1"); err != ErrCertNotFound {
+			t.Errorf("%v: expected %v got %v", name, ErrCertNotFound, err)
+		}
+		if l := s.List(CertFilter{Host: "a"}); len(l) != 0 {
+			t.Errorf("%v: unexpected list %v", name, l)
+		}
+		s.Close()
+	}
+}
+
+func Test_certIndex(t *testing.T) {
+	x := newCertIndex()
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		x.put(&CertRecord{Serial: fmt.Sprint(i), Hosts: []string{fmt.Sprintf("h%v", i%10)}, NotAfter: now.Add(time.Duration(i%7) * time.Hour)})
+	}
+	x.put(&CertRecord{Serial: "5", Hosts: []string{"moved"}, NotAfter: now.Add(time.Minute)})
+	x.remove("6")
+
+	if len(x.bySerial) != 99 || len(x.byExpiry) != 99 {
+		t.Errorf("expected 99 records, got %v %v", len(x.bySerial), len(x.byExpiry))
+	}
+	for i := 1; i < len(x.byExpiry); i++ {
+		if expiresBefore(x.byExpiry[i], x.byExpiry[i-1]) {
+			t.Fatalf("expiry index out of order at %v", i)
+		}
+	}
+	if l := x.list(CertFilter{Host: "h5"}, now); len(l) != 9 {
+		t.Errorf("expected 9 records for h5, got %v", len(l))
+	}
+	if l := x.list(CertFilter{Host: "moved"}, now); len(l) != 1 {
+		t.Errorf("expected 1 record for moved, got %v", len(l))
+	}
+	if l := x.list(CertFilter{Host: "h6"}, now); len(l) != 9 {
+		t.Errorf("expected 9 records for h6, got %v", len(l))
+	}
+	if l := x.list(CertFilter{ExpiresBefore: now.Add(30 * time.Minute)}, now); len(l) != 16 {
+		t.Errorf("expected 16 records expiring in 30 minutes, got %v", len(l))
+	}
+}
+
+func Test_OpenStore_unknown(t *testing.T) {
+	if _, err := OpenStore("nope:x"); err == nil {
+		t.Errorf("expected error for unknown store type")
+	}
+}
@@ -0,0 +1,211 @@
+package certd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const DefaultSubordinateLifetime = 90 * 24 * time.Hour
+
+// SubordinateProfile is the label subordinate CAs are counted under in the
+// issuance metrics
+const SubordinateProfile = "subordinate"
+
+// Subordinate describes the subordinate CAs a team can be issued. They are
+// limited to the team's namespace, Domains and Networks, which must be
+// allowed by the policy.
+type Subordinate struct {
+	Domains  []string `json:"domains,omitempty"`
+	Networks []string `json:"networks,omitempty"`
+	// MaxPathLen is how many CAs may follow a subordinate in a chain, 0
+	// means it can only issue leaf certs
+	MaxPathLen int `json:"max_path_len,omitempty"`
+	// MaxLifetime of a subordinate, DefaultSubordinateLifetime if zero
+	MaxLifetime Duration `json:"max_lifetime,omitempty"`
+}
+
+// SubordinateRequest is the body of a request for a subordinate CA. The
+// lifetime is the team's MaxLifetime if it is zero.
+type SubordinateRequest struct {
+	Team     string   `json:"team"`
+	CSR      string   `json:"csr"`
+	PathLen  int      `json:"path_len,omitempty"`
+	Lifetime Duration `json:"lifetime,omitempty"`
+}
+
+// Validate checks the namespace is well formed and allowed by p
+func (sub *Subordinate) Validate(p *Policy) error {
+	if len(sub.Domains) == 0 && len(sub.Networks) == 0 {
+		return fmt.Errorf("no domains or networks")
+	}
+	for _, d := range sub.Domains {
+		if strings.HasPrefix(d, "*.") || !validHostname(d) {
+			return fmt.Errorf("invalid domain \"%v\"", d)
+		}
+		if !p.hostAllowed(d) {
+			return fmt.Errorf("domain \"%v\" is not allowed by the policy", d)
+		}
+	}
+	if _, err := sub.networks(p); err != nil {
+		return err
+	}
+	if sub.MaxPathLen < 0 {
+		return fmt.Errorf("max_path_len can not be negative")
+	}
+	if sub.MaxLifetime < 0 {
+		return fmt.Errorf("max_lifetime can not be negative")
+	}
+	return nil
+}
+
+// networks parses Networks, each must be inside one of the networks
+// allowed by p
+func (sub *Subordinate) networks(p *Policy) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, n := range sub.Networks {
+		_, cidr, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, err
+		}
+		if !p.networkAllowed(cidr) {
+			return nil, fmt.Errorf("network \"%v\" is not allowed by the policy", n)
+		}
+		networks = append(networks, cidr)
+	}
+	return networks, nil
+}
+
+// networkAllowed reports whether all of n is inside an allowed network
+func (p *Policy) networkAllowed(n *net.IPNet) bool {
+	if p == nil || len(p.AllowedNetworks) == 0 {
+		return true
+	}
+	ones, bits := n.Mask.Size()
+	for _, a := range p.AllowedNetworks {
+		_, cidr, err := net.ParseCIDR(a)
+		if err != nil {
+			continue
+		}
+		aOnes, aBits := cidr.Mask.Size()
+		if aBits == bits && aOnes <= ones && cidr.Contains(n.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// issueSubordinate signs the CSR in sr as a subordinate CA for the team,
+// limited to its namespace, and records it in the store
+func (s *Server) issueSubordinate(ctx context.Context, sr *SubordinateRequest) (cert *Cert, record *CertRecord, err error) {
+	st := s.settings()
+	log := loggerFrom(ctx)
+
+	defer func() {
+		outcome := issueOutcome(err)
+		s.Metrics.Issued(SubordinateProfile, outcome)
+		switch outcome {
+		case OutcomeSuccess:
+			log.Info("subordinate CA issued", "serial", record.Serial, "team", sr.Team, "hosts", record.Hosts)
+			s.Audit.Log(ctx, AuditSubordinateIssued, "serial", record.Serial, "team", sr.Team, "hosts", record.Hosts,
+				"path_len", sr.PathLen, "not_after", record.NotAfter)
+		case OutcomeRejected:
+			log.Warn("subordinate CA request rejected", "team", sr.Team, "error", err)
+		}
+	}()
+
+	if st.CA.Sealed() {
+		return nil, nil, ErrSealed
+	}
+	sub, ok := st.Subordinates[sr.Team]
+	if !ok {
+		return nil, nil, &APIError{http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("no subordinates are configured for team \"%v\"", sr.Team)}
+	}
+	if sr.PathLen < 0 || sr.PathLen > sub.MaxPathLen {
+		return nil, nil, &PolicyError{fmt.Sprintf("path length %v requested, at most %v allowed", sr.PathLen, sub.MaxPathLen)}
+	}
+	maxLifetime := time.Duration(sub.MaxLifetime)
+	if maxLifetime <= 0 {
+		maxLifetime = DefaultSubordinateLifetime
+	}
+	lifetime := time.Duration(sr.Lifetime)
+	switch {
+	case lifetime < 0:
+		return nil, nil, &APIError{http.StatusBadRequest, ErrCodeInvalidRequest, "lifetime can not be negative"}
+	case lifetime == 0:
+		lifetime = maxLifetime
+	case lifetime > maxLifetime:
+		return nil, nil, &PolicyError{fmt.Sprintf("lifetime %v requested, at most %v allowed", lifetime, maxLifetime)}
+	}
+
+	networks, err := sub.networks(st.Policy)
+	if err != nil {
+		return nil, nil, err
+	}
+	namespace := append(append([]string{}, sub.Domains...), sub.Networks...)
+	csr, err := ParseCSR([]byte(sr.CSR), strings.Join(namespace, ","))
+	if err != nil {
+		return nil, nil, &APIError{http.StatusBadRequest, ErrCodeInvalidRequest, err.Error()}
+	}
+	// a subordinate with the key or name of one of the roots, including the
+	// next root during a rotation, would make chains and CRLs ambiguous
+	roots, err := st.CA.RootCerts()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, root := range roots {
+		if bytes.Equal(csr.CertificateRequest.RawSubjectPublicKeyInfo, root.RawSubjectPublicKeyInfo) {
+			return nil, nil, &APIError{http.StatusBadRequest, ErrCodeInvalidRequest, "the CSR has the CA's own key"}
+		}
+		if bytes.Equal(csr.CertificateRequest.RawSubject, root.RawSubject) {
+			return nil, nil, &APIError{http.StatusBadRequest, ErrCodeInvalidRequest, "the CSR has the subject of a root CA, give the subordinate another name"}
+		}
+	}
+	csr.Lifetime = lifetime
+	csr.Constraints = &CAConstraints{PathLen: sr.PathLen, LimitNames: true, Domains: sub.Domains, Networks: networks}
+	log.Info("signing subordinate CA", "team", sr.Team, "subject", csr.CertificateRequest.Subject.String())
+
+	var pending *pendingEntry
+	err = s.Inventory.Update(func(tx StoreTx) error {
+		start := time.Now()
+		var err error
+		if cert, pending, err = st.CA.prepareCert(csr); err != nil {
+			return err
+		}
+		s.Metrics.Signing(time.Since(start))
+
+		if record, err = NewCertRecord(cert, ""); err != nil {
+			return err
+		}
+		record.Team = sr.Team
+		return insertRecord(tx, record)
+	})
+	pending.finish(err)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, record, nil
+}
+
+func (s *Server) apiIssueSubordinate(w http.ResponseWriter, req *http.Request) {
+	var sr SubordinateRequest
+	if err := decodeJSON(w, req, &sr); err != nil {
+		writeAPIError(w, req, err)
+		return
+	}
+	if sr.CSR == "" {
+		writeAPIError(w, req, &APIError{http.StatusBadRequest, ErrCodeInvalidRequest, "a csr is required"})
+		return
+	}
+
+	_, record, err := s.issueSubordinate(req.Context(), &sr)
+	if err != nil {
+		writeAPIError(w, req, err)
+		return
+	}
+	writeJSON(w, req, http.StatusCreated, record)
+}
@@ -0,0 +1,238 @@
+package certd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newSubordinateTestServer(t *testing.T) *Server {
+	s := newTestServer(t)
+	s.Policy = &Policy{AllowedDomains: []string{"example.com"}, AllowedNetworks: []string{"10.0.0.0/8"}}
+	s.Subordinates = map[string]*Subordinate{
+		"mesh": {Domains: []string{"mesh.example.com"}, Networks: []string{"10.1.0.0/16"}, MaxPathLen: 1, MaxLifetime: Duration(720 * time.Hour)},
+	}
+	return s
+}
+
+func subordinateRequest(t *testing.T, s *Server, sr *SubordinateRequest, v interface{}) int {
+	b, _ := json.Marshal(sr)
+	return apiRequest(t, s, "POST", "/api/v1/subordinates", bytes.NewReader(b), v).Code
+}
+
+func Test_API_subordinate(t *testing.T) {
+	s := newSubordinateTestServer(t)
+	csr, _ := CreateCSR("mesh.example.com")
+
+	var record CertRecord
+	if code := subordinateRequest(t, s, &SubordinateRequest{Team: "mesh", CSR: string(csr.PEM())}, &record); code != http.StatusCreated {
+		t.Fatalf("expected %v got %v", http.StatusCreated, code)
+	}
+	if !record.CA || record.Team != "mesh" || len(record.Hosts) != 2 || record.Hosts[0] != "mesh.example.com" {
+		t.Errorf("unexpected record %+v", record)
+	}
+	sub, err := (&Cert{CertBytes: []byte(record.Cert)}).X509()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sub.IsCA || sub.MaxPathLen != 0 || !sub.MaxPathLenZero || !sub.PermittedDNSDomainsCritical || len(sub.PermittedIPRanges) != 1 {
+		t.Errorf("expected a subordinate CA limited to the team's namespace %+v", sub)
+	}
+	if sub.NotAfter.After(time.Now().Add(720 * time.Hour)) {
+		t.Errorf("expected the team's max lifetime got %v", sub.NotAfter)
+	}
+
+	// the subordinate can issue certs in the namespace and nowhere else
+	root, _ := s.CA.Cert()
+	subCA := &CA{CertBytes: []byte(record.Cert), KeyBytes: csr.PrivateKey}
+	for _, tt := range []struct {
+		host  string
+		valid bool
+	}{
+		{"svc.mesh.example.com", true},
+		{"10.1.2.3", true},
+		{"svc.example.com", false},
+		{"10.2.0.1", false},
+	} {
+		leafCSR, _ := CreateCSR(tt.host)
+		cert, err := subCA.CertFromCSR(leafCSR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, _ := cert.X509()
+		err = verifyChain(leaf, []*x509.Certificate{root}, []*x509.Certificate{sub})
+		if tt.valid && err != nil {
+			t.Errorf("%v: expected a valid chain: %v", tt.host, err)
+		} else if !tt.valid && err == nil {
+			t.Errorf("%v: expected the name constraints to be enforced", tt.host)
+		}
+	}
+
+	// it is revoked like any other cert
+	if n := len(s.Inventory.List(CertFilter{Host: "mesh.example.com"})); n != 1 {
+		t.Errorf("expected the subordinate in the inventory got %v", n)
+	}
+	rr := apiRequest(t, s, "POST", "/api/v1/certificates/"+record.Serial+"/revoke", nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected the subordinate to be revoked got %v %v", rr.Code, rr.Body.String())
+	}
+	der, _ := s.CA.CreateCRL(s.Inventory.List(CertFilter{Status: "revoked"}), time.Hour)
+	crl, _ := x509.ParseRevocationList(der)
+	if crl == nil || len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(sub.SerialNumber) != 0 {
+		t.Errorf("expected the subordinate in the CRL")
+	}
+}
+
+func Test_API_subordinate_rejected(t *testing.T) {
+	s := newSubordinateTestServer(t)
+	csr, _ := CreateCSR("mesh.example.com")
+	pem := string(csr.PEM())
+
+	for _, tt := range []struct {
+		name string
+		sr   *SubordinateRequest
+		code string
+	}{
+		{"unknown team", &SubordinateRequest{Team: "web", CSR: pem}, ErrCodeInvalidRequest},
+		{"no csr", &SubordinateRequest{Team: "mesh"}, ErrCodeInvalidRequest},
+		{"path length", &SubordinateRequest{Team: "mesh", CSR: pem, PathLen: 2}, ErrCodePolicyViolation},
+		{"lifetime", &SubordinateRequest{Team: "mesh", CSR: pem, Lifetime: Duration(1000 * time.Hour)}, ErrCodePolicyViolation},
+	} {
+		var apiErr apiErrorBody
+		subordinateRequest(t, s, tt.sr, &apiErr)
+		if apiErr.Error.Code != tt.code {
+			t.Errorf("%v: expected %v got %+v", tt.name, tt.code, apiErr.Error)
+		}
+	}
+
+	// only admins can issue subordinates
+	hash, _ := HashPassword("bob-pass")
+	path := filepath.Join(t.TempDir(), "users.json")
+	ioutil.WriteFile(path, []byte(fmt.Sprintf(`[{"name":"bob","password_hash":"%v","role":"issuer"}]`, hash)), 0600)
+	if s.Users, _ = LoadUsers(path); s.Users == nil {
+		t.Fatal("failed to load users")
+	}
+	b, _ := json.Marshal(&SubordinateRequest{Team: "mesh", CSR: pem})
+	rr := userRequest(t, s, "POST", "/api/v1/subordinates", "", "bob", "bob-pass", string(b))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected an issuer not to get a subordinate got %v", rr.Code)
+	}
+	if n := len(s.Inventory.List(CertFilter{})); n != 0 {
+		t.Errorf("expected nothing issued got %v", n)
+	}
+}
+
+func Test_API_subordinate_root_subject(t *testing.T) {
+	s := newSubordinateTestServer(t)
+	// the next root gets the default name, so the two roots differ
+	s.CA.CommonName = "CERTD Old Root"
+	if err := s.CA.GenerateCert(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CA.StartRotation(time.Now().Add(time.Hour), time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	roots, err := s.CA.RootCerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 2 || bytes.Equal(roots[0].RawSubject, roots[1].RawSubject) {
+		t.Fatalf("expected two roots with different subjects got %v", len(roots))
+	}
+
+	// neither the current nor the next root's subject can be taken
+	for _, root := range roots {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{RawSubject: root.RawSubject, DNSNames: []string{"mesh.example.com"}}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+
+		var apiErr apiErrorBody
+		if code := subordinateRequest(t, s, &SubordinateRequest{Team: "mesh", CSR: string(csr)}, &apiErr); code != http.StatusBadRequest {
+			t.Errorf("%v: expected %v got %v %+v", root.Subject, http.StatusBadRequest, code, apiErr.Error)
+		}
+	}
+	if n := len(s.Inventory.List(CertFilter{})); n != 0 {
+		t.Errorf("expected nothing issued got %v", n)
+	}
+}
+
+func Test_Subordinate_Validate(t *testing.T) {
+	p := &Policy{AllowedDomains: []string{"example.com"}, AllowedNetworks: []string{"10.0.0.0/8"}}
+	for _, tt := range []struct {
+		sub   *Subordinate
+		valid bool
+	}{
+		{&Subordinate{Domains: []string{"mesh.example.com"}, Networks: []string{"10.1.0.0/16"}}, true},
+		{&Subordinate{}, false},
+		{&Subordinate{Domains: []string{"mesh.example.org"}}, false},
+		{&Subordinate{Domains: []string{"*.example.com"}}, false},
+		{&Subordinate{Networks: []string{"0.0.0.0/0"}}, false},
+		{&Subordinate{Networks: []string{"10.0.0.0/8"}, MaxPathLen: -1}, false},
+	} {
+		if err := tt.sub.Validate(p); (err == nil) != tt.valid {
+			t.Errorf("%+v: expected valid %v got %v", tt.sub, tt.valid, err)
+		}
+	}
+}
+
+func Test_API_subordinate_one_name_type(t *testing.T) {
+	s := newSubordinateTestServer(t)
+	s.Subordinates["web"] = &Subordinate{Domains: []string{"web.example.com"}}
+	s.Subordinates["lab"] = &Subordinate{Networks: []string{"10.2.0.0/16"}}
+	root, _ := s.CA.Cert()
+
+	// a team is limited to the types of names it has, names of any other
+	// type fail to verify
+	for _, tt := range []struct {
+		team  string
+		hosts map[string]bool
+	}{
+		{"web", map[string]bool{"svc.web.example.com": true, "8.8.8.8": false, "::1": false, "svc.example.com": false}},
+		{"lab", map[string]bool{"10.2.0.1": true, "svc.example.com": false, "lab.example.com": false, "10.3.0.1": false}},
+	} {
+		csr, _ := CreateCSR("sub." + tt.team)
+		var record CertRecord
+		if code := subordinateRequest(t, s, &SubordinateRequest{Team: tt.team, CSR: string(csr.PEM())}, &record); code != http.StatusCreated {
+			t.Fatalf("%v: expected %v got %v", tt.team, http.StatusCreated, code)
+		}
+		if len(record.Hosts) != 1 {
+			t.Errorf("%v: expected only the namespace in the hosts got %v", tt.team, record.Hosts)
+		}
+		sub, _ := (&Cert{CertBytes: []byte(record.Cert)}).X509()
+		if len(sub.PermittedEmailAddresses) != 1 || len(sub.PermittedURIDomains) != 1 {
+			t.Errorf("%v: expected email addresses and URIs to be excluded", tt.team)
+		}
+
+		subCA := &CA{CertBytes: []byte(record.Cert), KeyBytes: csr.PrivateKey}
+		for host, valid := range tt.hosts {
+			leafCSR, _ := CreateCSR(host)
+			cert, err := subCA.CertFromCSR(leafCSR)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf, _ := cert.X509()
+			err = verifyChain(leaf, []*x509.Certificate{root}, []*x509.Certificate{sub})
+			if valid && err != nil {
+				t.Errorf("%v %v: expected a valid chain: %v", tt.team, host, err)
+			} else if !valid && err == nil {
+				t.Errorf("%v %v: expected the name constraints to be enforced", tt.team, host)
+			}
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package certd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Tenant is a named CA hosted by a Server next to its own CA. A tenant is a
+// Server of its own with its own CA, users, policy and store. Requests reach
+// it under /ca/{name}/, or when the TLS server name or Host header is one of
+// Hosts.
+type Tenant struct {
+	*Server
+	Name  string
+	Hosts []string
+	// Config is where the tenant was loaded from, it is used by reloads
+	Config *TenantConfig
+}
+
+// TenantConfig is an entry in the tenants file given to certd with -tenants
+type TenantConfig struct {
+	Name string `json:"name"`
+	// Hosts are the names routed to the tenant by SNI or the Host header,
+	// its serving cert is issued for them
+	Hosts []string `json:"hosts,omitempty"`
+	// Config is the path of the tenant's CA config
+	Config string `json:"config"`
+	Users  string `json:"users,omitempty"`
+	Policy string `json:"policy,omitempty"`
+	// Store is where the tenant's certs are recorded, in the format of
+	// -store, they are kept in memory if it is empty
+	Store  string `json:"store,omitempty"`
+	Ledger string `json:"ledger,omitempty"`
+	CRL    string `json:"crl,omitempty"`
+}
+
+// TenantInfo describes a tenant in the list of CAs
+type TenantInfo struct {
+	Name  string   `json:"name"`
+	Hosts []string `json:"hosts,omitempty"`
+	*CAInfo
+	Sealed bool `json:"sealed"`
+}
+
+var tenantNameRE = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// LoadTenants loads a JSON file containing a list of TenantConfig
+func LoadTenants(path string) ([]*TenantConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []*TenantConfig
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+
+	names := make(map[string]bool)
+	hosts := make(map[string]string)
+	for _, tc := range list {
+		if !tenantNameRE.MatchString(tc.Name) {
+			return nil, fmt.Errorf("%v: invalid tenant name \"%v\", use lowercase letters, digits, - and _", path, tc.Name)
+		}
+		if names[tc.Name] {
+			return nil, fmt.Errorf("%v: duplicate tenant \"%v\"", path, tc.Name)
+		}
+		names[tc.Name] = true
+		if tc.Config == "" {
+			return nil, fmt.Errorf("%v: tenant \"%v\" has no config", path, tc.Name)
+		}
+		for _, h := range tc.Hosts {
+			h = strings.ToLower(h)
+			if other, ok := hosts[h]; ok {
+				return nil, fmt.Errorf("%v: host \"%v\" is used by tenants \"%v\" and \"%v\"", path, h, other, tc.Name)
+			}
+			hosts[h] = tc.Name
+		}
+	}
+	return list, nil
+}
+
+// Settings loads the CA, users and policy of the tenant
+func (tc *TenantConfig) Settings() (*Settings, error) {
+	st, err := LoadSettings(tc.Config, tc.Users, tc.Policy, strings.Join(tc.Hosts, ","))
+	if err != nil {
+		return nil, fmt.Errorf("tenant \"%v\": %w", tc.Name, err)
+	}
+	return st, nil
+}
+
+// OpenTenant loads the tenant in tc, opens its store and ledger and adds it
+// to s. The tenant shares the audit log and the server wide options of s,
+// and the static credentials of s when it has no users.
+func (s *Server) OpenTenant(tc *TenantConfig) (*Tenant, error) {
+	st, err := tc.Settings()
+	if err != nil {
+		return nil, err
+	}
+
+	ts := NewServer(st.CA, s.ListenAddr, s.HTTPSPort, st.CertAddrs)
+	ts.ConfigPath = tc.Config
+	ts.CRLPath = tc.CRL
+	ts.Audit = s.Audit
+	ts.ServingCertLifetime = s.ServingCertLifetime
+	ts.ExpiryWindow = s.ExpiryWindow
+	ts.CAExpiryWarning = s.CAExpiryWarning
+	ts.CRLInterval = s.CRLInterval
+	ts.TrustedProxies = s.TrustedProxies
+	ts.Resolver = s.Resolver
+
+	if tc.Store != "" {
+		if ts.Inventory, err = OpenStore(tc.Store); err != nil {
+			return nil, fmt.Errorf("tenant \"%v\": %w", tc.Name, err)
+		}
+	}
+	if tc.Ledger != "" {
+		if st.CA.Ledger, err = OpenLedger(tc.Ledger); err != nil {
+			ts.Inventory.Close()
+			return nil, fmt.Errorf("tenant \"%v\": %w", tc.Name, err)
+		}
+	}
+	if err := ts.Reload(st); err != nil {
+		ts.closeTenant()
+		return nil, fmt.Errorf("tenant \"%v\": %w", tc.Name, err)
+	}
+
+	t, err := s.AddTenant(tc.Name, tc.Hosts, ts)
+	if err != nil {
+		ts.closeTenant()
+		return nil, err
+	}
+	t.Config = tc
+	return t, nil
+}
+
+// AddTenant hosts the CA served by ts under name, and for hosts
+func (s *Server) AddTenant(name string, hosts []string, ts *Server) (*Tenant, error) {
+	if !tenantNameRE.MatchString(name) {
+		return nil, fmt.Errorf("invalid tenant name \"%v\"", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tenants[name]; ok {
+		return nil, fmt.Errorf("duplicate tenant \"%v\"", name)
+	}
+	for _, h := range hosts {
+		if other := s.tenantForHostLocked(h); other != nil {
+			return nil, fmt.Errorf("host \"%v\" is used by tenants \"%v\" and \"%v\"", h, other.Name, name)
+		}
+	}
+	if s.tenants == nil {
+		s.tenants = make(map[string]*Tenant)
+	}
+	t := &Tenant{Server: ts, Name: name, Hosts: hosts}
+	ts.parent = s
+	s.tenants[name] = t
+	logger.Info("hosting CA", "ca", name, "hosts", hosts)
+	return t, nil
+}
+
+// Tenants returns the tenants ordered by name
+func (s *Server) Tenants() []*Tenant {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]*Tenant, 0, len(s.tenants))
+	for _, t := range s.tenants {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Tenant returns the tenant called name, nil if there is none
+func (s *Server) Tenant(name string) *Tenant {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tenants[name]
+}
+
+// tenantForHost returns the tenant serving host, which may have a port
+func (s *Server) tenantForHost(host string) *Tenant {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tenantForHostLocked(host)
+}
+
+func (s *Server) tenantForHostLocked(host string) *Tenant {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	for _, t := range s.tenants {
+		for _, h := range t.Hosts {
+			if strings.EqualFold(h, host) {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// routeTenant returns the tenant for req and the request for it to handle,
+// with the /ca/{name} prefix removed from its path. The tenant is nil when
+// the request is for the server's own CA.
+func (s *Server) routeTenant(req *http.Request) (*Tenant, *http.Request) {
+	if t := s.tenantForHost(req.Host); t != nil {
+		return t, req
+	}
+	if !strings.HasPrefix(req.URL.Path, "/ca/") {
+		return nil, req
+	}
+	name, rest, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/ca/"), "/")
+	t := s.Tenant(name)
+	if t == nil {
+		return nil, req
+	}
+	treq := req.Clone(req.Context())
+	treq.URL.Path = "/" + rest
+	treq.URL.RawPath = ""
+	return t, treq
+}
+
+// ReloadTenants loads the settings of every tenant again, a tenant whose
+// settings are invalid keeps its current ones
+func (s *Server) ReloadTenants() error {
+	var errs []string
+	for _, t := range s.Tenants() {
+		if t.Config == nil {
+			continue
+		}
+		st, err := t.Config.Settings()
+		if err == nil {
+			err = t.Reload(st)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// CloseTenants closes the stores and ledgers of the tenants
+func (s *Server) CloseTenants() {
+	for _, t := range s.Tenants() {
+		t.closeTenant()
+	}
+}
+
+// closeTenant closes the store and ledger opened by OpenTenant
+func (s *Server) closeTenant() {
+	if s.Inventory != nil {
+		s.Inventory.Close()
+	}
+	if ledger := s.settings().CA.Ledger; ledger != nil {
+		ledger.Close()
+	}
+}
+
+// apiListCAs lists the tenants
+func (s *Server) apiListCAs(w http.ResponseWriter, req *http.Request) {
+	list := []*TenantInfo{}
+	for _, t := range s.Tenants() {
+		ca := t.settings().CA
+		info, err := caInfo(ca)
+		if err != nil {
+			writeAPIError(w, req, err)
+			return
+		}
+		list = append(list, &TenantInfo{Name: t.Name, Hosts: t.Hosts, CAInfo: info, Sealed: ca.Sealed()})
+	}
+	writeJSON(w, req, http.StatusOK, list)
+}
@@ -0,0 +1,220 @@
+package certd
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTenantTestServer returns a server hosting the tenant "lab" for
+// lab.example, whose users are the admin "alice" and the issuer "bob"
+func newTenantTestServer(t *testing.T) (*Server, *Tenant) {
+	s := newTestServer(t)
+	dir := t.TempDir()
+
+	config := filepath.Join(dir, "lab.conf")
+	if _, err := SetupCA(config); err != nil {
+		t.Fatal(err)
+	}
+	aliceHash, _ := HashPassword("alice-pass")
+	bobHash, _ := HashPassword("bob-pass")
+	users, _ := json.Marshal([]*User{
+		{Name: "alice", PasswordHash: aliceHash, Role: RoleAdmin},
+		{Name: "bob", PasswordHash: bobHash, Role: RoleIssuer},
+	})
+	usersPath := filepath.Join(dir, "lab-users.json")
+	ioutil.WriteFile(usersPath, users, 0600)
+
+	tenants := filepath.Join(dir, "tenants.json")
+	ioutil.WriteFile(tenants, []byte(`[{"name":"lab","hosts":["lab.example"],"config":"`+config+`","users":"`+usersPath+`"}]`), 0600)
+	list, err := LoadTenants(tenants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant, err := s.OpenTenant(list[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.CloseTenants)
+	return s, tenant
+}
+
+// userRequest makes a request as user to s
+func userRequest(t *testing.T, s *Server, method, target, host, user, password, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if host != "" {
+		req.Host = host
+	}
+	req.SetBasicAuth(user, password)
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	return rr
+}
+
+func Test_Server_tenant_routing(t *testing.T) {
+	s, tenant := newTenantTestServer(t)
+	labCert, _ := tenant.CA.Cert()
+
+	for _, tt := range []struct {
+		name, target, host string
+	}{
+		{"path", "/ca/lab/api/v1/certificates", ""},
+		{"host", "/api/v1/certificates", "lab.example:4443"},
+	} {
+		rr := userRequest(t, s, "POST", tt.target, tt.host, "bob", "bob-pass", `{"hosts":["localhost"]}`)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("%v: expected %v got %v: %v", tt.name, http.StatusCreated, rr.Code, rr.Body.String())
+		}
+		var issued IssuedCert
+		json.Unmarshal(rr.Body.Bytes(), &issued)
+		crt, _ := (&Cert{CertBytes: []byte(issued.Cert)}).X509()
+		if crt == nil || crt.CheckSignatureFrom(labCert) != nil {
+			t.Errorf("%v: expected the cert to be issued by the tenant's CA", tt.name)
+		}
+	}
+	if n := len(tenant.Inventory.List(CertFilter{})); n != 2 {
+		t.Errorf("expected 2 certs in the tenant's store got %v", n)
+	}
+	if n := len(s.Inventory.List(CertFilter{})); n != 0 {
+		t.Errorf("expected no certs in the server's store got %v", n)
+	}
+
+	// the tenant has its own users
+	rr := userRequest(t, s, "POST", "/ca/lab/api/v1/certificates", "", DefaultUser, DefaultPassword, `{"hosts":["localhost"]}`)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected the server's credentials to be refused by the tenant got %v", rr.Code)
+	}
+	rr = userRequest(t, s, "POST", "/api/v1/certificates", "", "bob", "bob-pass", `{"hosts":["localhost"]}`)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected the tenant's credentials to be refused by the server got %v", rr.Code)
+	}
+
+	rr = userRequest(t, s, "GET", "/ca/nope/api/v1/ca", "", DefaultUser, DefaultPassword, "")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown CA to be not found got %v", rr.Code)
+	}
+	rr = userRequest(t, s, "GET", "/ca/lab/ca", "", "bob", "bob-pass", "")
+	if rr.Code != http.StatusOK || rr.Body.String() != string(tenant.CA.CertBytes) {
+		t.Errorf("expected the tenant's CA cert got %v", rr.Code)
+	}
+}
+
+func Test_Server_tenant_roles(t *testing.T) {
+	s, tenant := newTenantTestServer(t)
+
+	rr := userRequest(t, s, "POST", "/ca/lab/api/v1/certificates", "", "bob", "bob-pass", `{"hosts":["localhost"]}`)
+	var issued IssuedCert
+	json.Unmarshal(rr.Body.Bytes(), &issued)
+
+	var apiErr apiErrorBody
+	rr = userRequest(t, s, "POST", "/ca/lab/api/v1/certificates/"+issued.Serial+"/revoke", "", "bob", "bob-pass", "")
+	json.Unmarshal(rr.Body.Bytes(), &apiErr)
+	if rr.Code != http.StatusForbidden || apiErr.Error.Code != ErrCodeForbidden {
+		t.Errorf("expected an issuer not to revoke got %v %v", rr.Code, rr.Body.String())
+	}
+	rr = userRequest(t, s, "POST", "/ca/lab/api/v1/certificates/"+issued.Serial+"/revoke", "", "alice", "alice-pass", "")
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected an admin to revoke got %v %v", rr.Code, rr.Body.String())
+	}
+	if r, _ := tenant.Inventory.Get(issued.Serial); r == nil || !r.Revoked {
+		t.Errorf("expected the cert to be revoked in the tenant's store")
+	}
+
+	rr = userRequest(t, s, "POST", "/ca/lab/sys/seal", "", "bob", "bob-pass", "")
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected an issuer not to seal got %v", rr.Code)
+	}
+}
+
+func Test_Server_list_cas(t *testing.T) {
+	s, tenant := newTenantTestServer(t)
+
+	var list []*TenantInfo
+	rr := apiRequest(t, s, "GET", "/api/v1/cas", nil, &list)
+	labCert, _ := tenant.CA.Cert()
+	if rr.Code != http.StatusOK || len(list) != 1 || list[0].Name != "lab" || list[0].Fingerprint != Fingerprint(labCert) {
+		t.Fatalf("unexpected list %v %v", rr.Code, rr.Body.String())
+	}
+	if list[0].Hosts[0] != "lab.example" || list[0].Sealed {
+		t.Errorf("unexpected tenant %+v", list[0])
+	}
+}
+
+func Test_Server_tenant_sni(t *testing.T) {
+	s, tenant := newTenantTestServer(t)
+	s.serving = newServingCert(func() *CA { return s.CA }, "localhost", 0)
+	tenant.serving = newServingCert(func() *CA { return tenant.CA }, "lab.example", 0)
+
+	for _, tt := range []struct {
+		serverName string
+		ca         *CA
+	}{
+		{"lab.example", tenant.CA},
+		{"localhost", s.CA},
+		{"", s.CA},
+	} {
+		cert, err := s.getCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		caCert, _ := tt.ca.Cert()
+		if err := cert.Leaf.CheckSignatureFrom(caCert); err != nil {
+			t.Errorf("%q: expected the serving cert of the right CA: %v", tt.serverName, err)
+		}
+	}
+}
+
+func Test_LoadTenants_invalid(t *testing.T) {
+	dir := t.TempDir()
+	for _, tenants := range []string{
+		`[{"name":"Prod","config":"prod.conf"}]`,
+		`[{"name":"prod"}]`,
+		`[{"name":"prod","config":"a.conf"},{"name":"prod","config":"b.conf"}]`,
+		`[{"name":"prod","config":"a.conf","hosts":["ca.example"]},{"name":"lab","config":"b.conf","hosts":["CA.example"]}]`,
+		`{}`,
+	} {
+		path := filepath.Join(dir, "tenants.json")
+		ioutil.WriteFile(path, []byte(tenants), 0600)
+		if _, err := LoadTenants(path); err == nil {
+			t.Errorf("expected an error for %v", tenants)
+		}
+	}
+}
+
+func Test_LoadUsers_role(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	hash, _ := HashPassword("pass")
+	ioutil.WriteFile(path, []byte(`[{"name":"carol","password_hash":"`+hash+`","role":"owner"}]`), 0600)
+	if _, err := LoadUsers(path); err == nil || !strings.Contains(err.Error(), "unknown role") {
+		t.Errorf("expected an unknown role to be rejected got %v", err)
+	}
+}
+
+func Test_Server_tenant_credentials(t *testing.T) {
+	s := newTestServer(t)
+	config := filepath.Join(t.TempDir(), "lab.conf")
+	if _, err := SetupCA(config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.OpenTenant(&TenantConfig{Name: "lab", Config: config}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.CloseTenants)
+
+	if rr := userRequest(t, s, "GET", "/ca/lab/api/v1/ca", "", DefaultUser, DefaultPassword, ""); rr.Code != http.StatusOK {
+		t.Errorf("expected the static credentials to work for a tenant without users got %v", rr.Code)
+	}
+	// changed credentials apply to the tenant straight away
+	s.SetCredentials("ops", "new-pass")
+	if rr := userRequest(t, s, "GET", "/ca/lab/api/v1/ca", "", DefaultUser, DefaultPassword, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected the old credentials to be refused got %v", rr.Code)
+	}
+	if rr := userRequest(t, s, "GET", "/ca/lab/api/v1/ca", "", "ops", "new-pass", ""); rr.Code != http.StatusOK {
+		t.Errorf("expected the new credentials to work got %v", rr.Code)
+	}
+}
@@ -0,0 +1,330 @@
+package certd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This is a parser for the subset of TOML used by the server config:
+// tables, key/value pairs, strings, integers, booleans and arrays of those.
+
+// Pos is a position in a config file
+type Pos struct {
+	Line int
+	Col  int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%v:%v", p.Line, p.Col)
+}
+
+// tomlValue is a parsed value along with where it and its key were found
+type tomlValue struct {
+	pos    Pos
+	keyPos Pos
+	value  interface{}
+}
+
+// PosError is an error at a position in a config file
+type PosError struct {
+	Pos Pos
+	Msg string
+}
+
+func (e *PosError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Pos, e.Msg)
+}
+
+type tomlParser struct {
+	src    []rune
+	i      int
+	pos    Pos
+	table  string
+	values map[string]*tomlValue
+	tables map[string]Pos
+	errs   []*PosError
+}
+
+// parseTOML returns the values in src keyed by their dotted path along with
+// any syntax errors. Parsing continues on the next line after an error so
+// every error is reported.
+func parseTOML(src string) (map[string]*tomlValue, []*PosError) {
+	p := &tomlParser{
+		src:    []rune(src),
+		pos:    Pos{1, 1},
+		values: make(map[string]*tomlValue),
+		tables: make(map[string]Pos),
+	}
+	for !p.eof() {
+		if err := p.parseLine(); err != nil {
+			p.errs = append(p.errs, err)
+			p.skipLine()
+		}
+	}
+	return p.values, p.errs
+}
+
+func (p *tomlParser) eof() bool {
+	return p.i >= len(p.src)
+}
+
+func (p *tomlParser) peek() rune {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.i]
+}
+
+func (p *tomlParser) next() rune {
+	r := p.peek()
+	p.i++
+	if r == '\n' {
+		p.pos.Line++
+		p.pos.Col = 1
+	} else {
+		p.pos.Col++
+	}
+	return r
+}
+
+func (p *tomlParser) errorf(pos Pos, format string, args ...interface{}) *PosError {
+	return &PosError{pos, fmt.Sprintf(format, args...)}
+}
+
+func (p *tomlParser) skipSpace() {
+	for r := p.peek(); r == ' ' || r == '\t'; r = p.peek() {
+		p.next()
+	}
+}
+
+// skipSpaceAndComments skips whitespace, newlines and comments, used inside arrays
+func (p *tomlParser) skipSpaceAndComments() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r', '\n':
+			p.next()
+		case '#':
+			p.skipLine()
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) skipLine() {
+	for !p.eof() && p.next() != '\n' {
+	}
+}
+
+// endLine expects only whitespace or a comment before the end of the line
+func (p *tomlParser) endLine() *PosError {
+	p.skipSpace()
+	switch p.peek() {
+	case 0, '\n', '#':
+		p.skipLine()
+		return nil
+	case '\r':
+		p.next()
+		if p.peek() == '\n' {
+			p.next()
+			return nil
+		}
+	}
+	return p.errorf(p.pos, "unexpected %q, expected the end of the line", p.peek())
+}
+
+func (p *tomlParser) parseLine() *PosError {
+	p.skipSpace()
+	switch p.peek() {
+	case 0:
+		return nil
+	case '#', '\n', '\r':
+		return p.endLine()
+	case '[':
+		return p.parseTable()
+	}
+	return p.parseKeyValue()
+}
+
+func (p *tomlParser) parseTable() *PosError {
+	start := p.pos
+	p.next()
+	if p.peek() == '[' {
+		return p.errorf(start, "arrays of tables are not supported")
+	}
+
+	var parts []string
+	for {
+		p.skipSpace()
+		key, err := p.parseKey()
+		if err != nil {
+			return err
+		}
+		parts = append(parts, key)
+		p.skipSpace()
+		if r := p.next(); r == ']' {
+			break
+		} else if r != '.' {
+			return p.errorf(p.pos, "unexpected %q in table name", r)
+		}
+	}
+
+	table := strings.Join(parts, ".")
+	if prev, ok := p.tables[table]; ok {
+		return p.errorf(start, "table [%v] already defined at %v", table, prev)
+	}
+	p.tables[table] = start
+	p.table = table
+	return p.endLine()
+}
+
+func (p *tomlParser) parseKeyValue() *PosError {
+	start := p.pos
+	key, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	p.skipSpace()
+	if r := p.next(); r != '=' {
+		return p.errorf(start, "expected \"=\" after key %q", key)
+	}
+	p.skipSpace()
+
+	v, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+
+	if p.table != "" {
+		key = p.table + "." + key
+	}
+	if prev, ok := p.values[key]; ok {
+		return p.errorf(start, "key %q already defined at %v", key, prev.keyPos)
+	}
+	v.keyPos = start
+	p.values[key] = v
+	return p.endLine()
+}
+
+func (p *tomlParser) parseKey() (string, *PosError) {
+	switch p.peek() {
+	case '"', '\'':
+		v, err := p.parseString()
+		if err != nil {
+			return "", err
+		}
+		return v.value.(string), nil
+	}
+
+	start := p.pos
+	var b strings.Builder
+	for r := p.peek(); r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-'; r = p.peek() {
+		b.WriteRune(p.next())
+	}
+	if b.Len() == 0 {
+		return "", p.errorf(start, "expected a key, got %q", p.peek())
+	}
+	return b.String(), nil
+}
+
+func (p *tomlParser) parseValue() (*tomlValue, *PosError) {
+	start := p.pos
+	switch r := p.peek(); {
+	case r == '"' || r == '\'':
+		return p.parseString()
+	case r == '[':
+		return p.parseArray()
+	case r == 't' || r == 'f':
+		word := p.parseWord()
+		switch word {
+		case "true":
+			return &tomlValue{pos: start, value: true}, nil
+		case "false":
+			return &tomlValue{pos: start, value: false}, nil
+		}
+		return nil, p.errorf(start, "invalid value %q", word)
+	case r == '-' || r == '+' || r >= '0' && r <= '9':
+		word := p.parseWord()
+		n, err := strconv.ParseInt(strings.ReplaceAll(word, "_", ""), 10, 64)
+		if err != nil {
+			return nil, p.errorf(start, "invalid integer %q", word)
+		}
+		return &tomlValue{pos: start, value: n}, nil
+	case r == 0 || r == '\n' || r == '\r' || r == '#':
+		return nil, p.errorf(start, "missing value")
+	}
+	return nil, p.errorf(start, "invalid value %q", p.parseWord())
+}
+
+func (p *tomlParser) parseWord() string {
+	var b strings.Builder
+	for r := p.peek(); r != 0 && !strings.ContainsRune(" \t\r\n#,]", r); r = p.peek() {
+		b.WriteRune(p.next())
+	}
+	return b.String()
+}
+
+func (p *tomlParser) parseString() (*tomlValue, *PosError) {
+	start := p.pos
+	quote := p.next()
+	var b strings.Builder
+	for {
+		r := p.next()
+		switch {
+		case r == 0 || r == '\n':
+			return nil, p.errorf(start, "unterminated string")
+		case r == quote:
+			return &tomlValue{pos: start, value: b.String()}, nil
+		case r == '\\' && quote == '"':
+			escPos := p.pos
+			switch e := p.next(); e {
+			case 'n':
+				b.WriteRune('\n')
+			case 't':
+				b.WriteRune('\t')
+			case 'r':
+				b.WriteRune('\r')
+			case '"', '\\':
+				b.WriteRune(e)
+			default:
+				return nil, p.errorf(escPos, "invalid escape \"\\%c\"", e)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+}
+
+func (p *tomlParser) parseArray() (*tomlValue, *PosError) {
+	start := p.pos
+	p.next()
+	var values []*tomlValue
+	for {
+		p.skipSpaceAndComments()
+		if p.peek() == ']' {
+			p.next()
+			return &tomlValue{pos: start, value: values}, nil
+		}
+		if p.eof() {
+			return nil, p.errorf(start, "unterminated array")
+		}
+
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+
+		p.skipSpaceAndComments()
+		switch p.peek() {
+		case ',':
+			p.next()
+		case ']':
+		case 0:
+			return nil, p.errorf(start, "unterminated array")
+		default:
+			return nil, p.errorf(p.pos, "expected \",\" or \"]\" in array")
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package certd
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const passwordHashIterations = 100000
+
+// dummyPasswordHash is checked for unknown users so they take as long to
+// refuse as known users with a wrong password
+const dummyPasswordHash = "pbkdf2-sha256$100000$Y2VydGQtZHVtbXktc2FsdA$27runNlAY6iN+kfbLxu/n8Kt25apEwj9/4afRtiBjFg"
+
+// user roles, an admin can also revoke certs and seal the CA
+const (
+	RoleAdmin  = "admin"
+	RoleIssuer = "issuer"
+)
+
+// User is an account that can authenticate with the server
+type User struct {
+	Name string `json:"name"`
+	// PasswordHash is created with HashPassword
+	PasswordHash string `json:"password_hash"`
+	// Role is RoleAdmin or RoleIssuer, a user without a role is an admin
+	Role string `json:"role,omitempty"`
+}
+
+// IsAdmin reports whether the user has the admin role
+func (u *User) IsAdmin() bool {
+	return u.Role == "" || u.Role == RoleAdmin
+}
+
+// Users holds the accounts that can authenticate with the server
+type Users struct {
+	users map[string]*User
+}
+
+// LoadUsers loads users from a JSON file containing a list of User
+func LoadUsers(path string) (*Users, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*User
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+
+	u := &Users{users: make(map[string]*User)}
+	for _, user := range list {
+		if user.Name == "" {
+			return nil, fmt.Errorf("%v: user with no name", path)
+		}
+		if _, ok := u.users[user.Name]; ok {
+			return nil, fmt.Errorf("%v: duplicate user \"%v\"", path, user.Name)
+		}
+		switch user.Role {
+		case "", RoleAdmin, RoleIssuer:
+		default:
+			return nil, fmt.Errorf("%v: user \"%v\": unknown role \"%v\"", path, user.Name, user.Role)
+		}
+		if _, _, _, err := parsePasswordHash(user.PasswordHash); err != nil {
+			return nil, fmt.Errorf("%v: user \"%v\": %v", path, user.Name, err)
+		}
+		u.users[user.Name] = user
+	}
+	return u, nil
+}
+
+// Authenticate returns the user if name and password are valid
+func (u *Users) Authenticate(name, password string) (*User, bool) {
+	user, ok := u.users[name]
+	if !ok {
+		CheckPassword(dummyPasswordHash, password)
+		return nil, false
+	}
+	if !CheckPassword(user.PasswordHash, password) {
+		return nil, false
+	}
+	return user, true
+}
+
+// HashPassword hashes password for storage in a users file
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordHashIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%v$%v$%v", passwordHashIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword reports whether password matches a hash created by HashPassword
+func CheckPassword(hash, password string) bool {
+	iterations, salt, key, err := parsePasswordHash(hash)
+	if err != nil {
+		return false
+	}
+	k, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(key))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(k, key) == 1
+}
+
+func parsePasswordHash(hash string) (int, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return 0, nil, nil, fmt.Errorf("unsupported password hash")
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return 0, nil, nil, fmt.Errorf("invalid password hash iterations")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid password hash salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return 0, nil, nil, fmt.Errorf("invalid password hash")
+	}
+	return iterations, salt, key, nil
+}
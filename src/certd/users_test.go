@@ -0,0 +1,85 @@
+package certd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_HashPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CheckPassword(hash, "secret") {
+		t.Errorf("password did not match its hash")
+	}
+	if CheckPassword(hash, "wrong") {
+		t.Errorf("wrong password matched")
+	}
+	if CheckPassword("junk", "secret") {
+		t.Errorf("invalid hash matched")
+	}
+
+	// unknown users are checked against the dummy hash, it must be a
+	// valid one with as many iterations as a real hash
+	iterations, _, _, err := parsePasswordHash(dummyPasswordHash)
+	if err != nil || iterations != passwordHashIterations {
+		t.Errorf("expected a dummy hash with %v iterations got %v %v", passwordHashIterations, iterations, err)
+	}
+}
+
+func Test_LoadUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash, _ := HashPassword("secret")
+	path := filepath.Join(dir, "users.json")
+	ioutil.WriteFile(path, []byte(fmt.Sprintf(`[{"name":"alice","password_hash":"%v"}]`, hash)), 0600)
+
+	users, err := LoadUsers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := users.Authenticate("alice", "secret"); !ok || u.Name != "alice" {
+		t.Errorf("failed to authenticate alice")
+	}
+	if _, ok := users.Authenticate("alice", "wrong"); ok {
+		t.Errorf("authenticated with the wrong password")
+	}
+	if _, ok := users.Authenticate("bob", "secret"); ok {
+		t.Errorf("authenticated an unknown user")
+	}
+}
+
+func Test_LoadUsers_error(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash, _ := HashPassword("secret")
+	invalid := []string{
+		`{`,
+		`[{"password_hash":"` + hash + `"}]`,
+		`[{"name":"alice","password_hash":"plain"}]`,
+		`[{"name":"alice","password_hash":"` + hash + `"},{"name":"alice","password_hash":"` + hash + `"}]`,
+	}
+	for _, content := range invalid {
+		path := filepath.Join(dir, "users.json")
+		ioutil.WriteFile(path, []byte(content), 0600)
+		if _, err := LoadUsers(path); err == nil {
+			t.Errorf("%v: expected error, got nil", content)
+		}
+	}
+
+	if _, err := LoadUsers(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
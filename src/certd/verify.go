@@ -0,0 +1,136 @@
+package certd
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"time"
+)
+
+// VerifyOptions are the options for VerifyCert
+type VerifyOptions struct {
+	// Host the cert must be valid for, not checked if empty
+	Host string
+	// Usage is "server", "client" or empty for any
+	Usage string
+	// Bundle holds the roots and any intermediates, self signed certs are
+	// used as roots
+	Bundle []*x509.Certificate
+	// CRL of the leaf's issuer, if given the leaf must not be revoked
+	CRL *x509.RevocationList
+	// At is the time to verify at, now if zero
+	At time.Time
+}
+
+// VerifyCert checks that certs[0] chains to a root in opts.Bundle. Any
+// further certs are used as intermediates. The verified chains are returned.
+func VerifyCert(certs []*x509.Certificate, opts VerifyOptions) ([][]*x509.Certificate, error) {
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no cert to verify")
+	}
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
+	nroots := 0
+	for _, crt := range opts.Bundle {
+		if crt.CheckSignatureFrom(crt) == nil {
+			roots.AddCert(crt)
+			nroots++
+		} else {
+			intermediates.AddCert(crt)
+		}
+	}
+	if nroots == 0 {
+		return nil, fmt.Errorf("no root CA in the bundle")
+	}
+	for _, crt := range certs[1:] {
+		intermediates.AddCert(crt)
+	}
+
+	var usages []x509.ExtKeyUsage
+	switch opts.Usage {
+	case "", "any":
+		usages = []x509.ExtKeyUsage{x509.ExtKeyUsageAny}
+	case "server":
+		usages = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	case "client":
+		usages = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	default:
+		return nil, fmt.Errorf("unknown usage \"%v\"", opts.Usage)
+	}
+
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       opts.Host,
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   opts.At,
+		KeyUsages:     usages,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.CRL != nil {
+		if err := checkRevoked(certs[0], chains[0], opts.CRL, opts.At); err != nil {
+			return nil, err
+		}
+	}
+	return chains, nil
+}
+
+// checkRevoked checks crl was issued by the issuer of leaf in chain, is
+// current and does not list leaf
+func checkRevoked(leaf *x509.Certificate, chain []*x509.Certificate, crl *x509.RevocationList, at time.Time) error {
+	if len(chain) < 2 {
+		return fmt.Errorf("no issuer to check the CRL against")
+	}
+	if err := crl.CheckSignatureFrom(chain[1]); err != nil {
+		return fmt.Errorf("CRL was not issued by the cert's issuer: %v", err)
+	}
+	if at.IsZero() {
+		at = time.Now()
+	}
+	if !crl.NextUpdate.IsZero() && at.After(crl.NextUpdate) {
+		return fmt.Errorf("CRL expired at %v", crl.NextUpdate)
+	}
+	for _, r := range crl.RevokedCertificateEntries {
+		if r.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+			return fmt.Errorf("cert %x was revoked at %v", leaf.SerialNumber, r.RevocationTime)
+		}
+	}
+	return nil
+}
+
+// ParseCertsPEM parses every cert in b
+func ParseCertsPEM(b []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		crt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, crt)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM certificates found")
+	}
+	return certs, nil
+}
+
+// ParseCRL parses a PEM or DER encoded CRL
+func ParseCRL(b []byte) (*x509.RevocationList, error) {
+	if block, _ := pem.Decode(b); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("no PEM CRL found")
+		}
+		b = block.Bytes
+	}
+	return x509.ParseRevocationList(b)
+}
@@ -0,0 +1,72 @@
+package certd
+
+import (
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_VerifyCert(t *testing.T) {
+	s := newTestServer(t)
+	caCert, _ := s.CA.Cert()
+
+	csr, _ := NewCSR("a.example.com", KeyECDSAP256)
+	csr.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	cert, err := s.CA.CertFromCSR(csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, _ := cert.X509()
+	leaf := []*x509.Certificate{crt}
+
+	chains, err := VerifyCert(leaf, VerifyOptions{Host: "a.example.com", Usage: "server", Bundle: []*x509.Certificate{caCert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chains[0]) != 2 {
+		t.Errorf("unexpected chain %v", chains[0])
+	}
+
+	for name, opts := range map[string]VerifyOptions{
+		"host":      {Host: "b.example.com", Bundle: []*x509.Certificate{caCert}},
+		"usage":     {Usage: "client", Bundle: []*x509.Certificate{caCert}},
+		"bad usage": {Usage: "signing", Bundle: []*x509.Certificate{caCert}},
+		"no roots":  {Bundle: []*x509.Certificate{crt}},
+		"expired":   {Bundle: []*x509.Certificate{caCert}, At: crt.NotAfter.Add(time.Hour)},
+	} {
+		if _, err := VerifyCert(leaf, opts); err == nil {
+			t.Errorf("%v: expected verification to fail", name)
+		}
+	}
+
+	now := time.Now()
+	serial := crt.SerialNumber.Text(16)
+	der, _ := s.CA.CreateCRL([]*CertRecord{{Serial: serial, Revoked: true, RevokedAt: &now, NotAfter: crt.NotAfter}}, time.Hour)
+	crl, err := ParseCRL(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyCert(leaf, VerifyOptions{Bundle: []*x509.Certificate{caCert}, CRL: crl}); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("expected the cert to be revoked, got %v", err)
+	}
+	if _, err := VerifyCert(leaf, VerifyOptions{Bundle: []*x509.Certificate{caCert}, CRL: crl, At: now.Add(3 * time.Hour)}); err == nil || !strings.Contains(err.Error(), "CRL expired") {
+		t.Errorf("expected the CRL to have expired, got %v", err)
+	}
+	der, _ = s.CA.CreateCRL(nil, time.Hour)
+	crl, _ = ParseCRL(der)
+	if _, err := VerifyCert(leaf, VerifyOptions{Bundle: []*x509.Certificate{caCert}, CRL: crl}); err != nil {
+		t.Errorf("unexpected error with an empty CRL: %v", err)
+	}
+}
+
+func Test_ParseCertsPEM(t *testing.T) {
+	s := newTestServer(t)
+	certs, err := ParseCertsPEM(append(append([]byte{}, s.CA.CertBytes...), s.CA.CertBytes...))
+	if err != nil || len(certs) != 2 {
+		t.Errorf("expected 2 certs, got %v %v", len(certs), err)
+	}
+	if _, err := ParseCertsPEM([]byte("nothing")); err == nil {
+		t.Errorf("expected an error")
+	}
+}
@@ -14,11 +14,13 @@ REPORT=coverage/coverage.html
 export RUNNING_TESTS=1
 
 function GEN_REPORT() {
-    TOTAL_COVERAGE=$(grep '^coverage: .*statements$' | awk '{print $2}')
+    # wait for the tests to finish, then total the coverage of all packages
+    cat > /dev/null
+    TOTAL_COVERAGE=$(go tool cover -func=coverage/cover.out | awk '/^total:/ {print $3}')
     # generate the coverage html file
     go tool cover -html=coverage/cover.out -o $REPORT
     # add the overall coverage to the report
     sed -i "s#<span class=\"cov8\">covered</span>.*#<span class=\"cov8\">covered</span> <span style=\"color:white;\">Overall Coverage: $TOTAL_COVERAGE</span>#g" $REPORT
 }
 
-go test certd -v -cover -coverprofile=coverage/cover.out $@ | tee >(GEN_REPORT)
+go test certd certd/client -v -cover -coverprofile=coverage/cover.out $@ | tee >(GEN_REPORT)